@@ -0,0 +1,418 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// directory of Let's Encrypt, the default ACME CA
+const ACME_LETS_ENCRYPT_URL = "https://acme-v02.api.letsencrypt.org/directory"
+
+// ACME challenge types, see ACMEConfig.Challenge
+const (
+	ACME_CHALLENGE_TLS_ALPN = "tls-alpn-01"
+	ACME_CHALLENGE_DNS      = "dns-01"
+)
+
+// interval of polling pending authorizations and orders
+const _ACME_POLL_INTERVAL = 2 * time.Second
+
+// max time the "cleanup" of ACMEConfig.DNSHook runs, which is not bound by the context of the challenge
+const _ACME_DNS_HOOK_CLEANUP_TIMEOUT = time.Minute
+
+// how to obtain certificates from an ACME CA, see NewACMECertManager
+type ACMEConfig struct {
+	DirectoryURL string   // empty for ACME_LETS_ENCRYPT_URL
+	Email        string   // contact of the account, optional
+	Domains      []string // names of the certificate, the first is its common name
+	CacheDir     string   // where the account key, the certificate and its key are kept
+
+	// ACME_CHALLENGE_TLS_ALPN, answered by the listeners themselves which must be reachable at port 443 of the domains,
+	// or ACME_CHALLENGE_DNS, which supports wildcard domains and is answered by DNSHook
+	Challenge string
+	// command run as `<hook> present|cleanup <domain> <value>` to add or remove the TXT record
+	// "_acme-challenge.<domain>" of the value, "present" should return after the record is visible
+	DNSHook string
+
+	Client *http.Client // nil for http.DefaultClient
+}
+
+// answers challenges of an ACME CA
+type acmeSolver interface {
+	present(ctx context.Context, domain, keyAuth string) error
+	cleanup(domain, keyAuth string)
+}
+
+// ACME (RFC 8555) client of an account
+type acmeClient struct {
+	conf  *ACMEConfig
+	http  *http.Client
+	key   *ecdsa.PrivateKey
+	kid   string // url of the account, empty before registered
+	nonce string // unused nonce of the last response
+	dir   struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type  string `json:"type"`
+		URL   string `json:"url"`
+		Token string `json:"token"`
+	} `json:"challenges"`
+}
+
+// --- impl *acmeClient
+func newACMEClient(conf *ACMEConfig, key *ecdsa.PrivateKey) *acmeClient {
+	c := &acmeClient{conf: conf, http: conf.Client, key: key}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	return c
+}
+
+// obtain a certificate of conf.Domains with challenges answered by `solver`,
+// returns the PEM encoded certificate chain and private key
+func (c *acmeClient) obtain(ctx context.Context, solver acmeSolver) (certPEM, keyPEM []byte, err error) {
+	if err = c.getJSON(ctx, c.directoryURL(), &c.dir); err != nil {
+		return nil, nil, err
+	}
+	if err = c.register(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	var identifiers []map[string]string
+	for _, domain := range c.conf.Domains {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": domain})
+	}
+	var order acmeOrder
+	header, _, err := c.post(ctx, c.dir.NewOrder, map[string]interface{}{"identifiers": identifiers}, &order)
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := header.Get("Location")
+	for _, authzURL := range order.Authorizations {
+		if err = c.authorize(ctx, authzURL, solver); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: c.conf.Domains[0]},
+		DNSNames: c.conf.Domains,
+	}, certKey)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if _, _, err = c.post(ctx, order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return nil, nil, err
+	}
+	for order.Status == "pending" || order.Status == "ready" || order.Status == "processing" {
+		if err = sleepContext(ctx, _ACME_POLL_INTERVAL); err != nil {
+			return nil, nil, err
+		}
+		if _, _, err = c.post(ctx, orderURL, nil, &order); err != nil {
+			return nil, nil, err
+		}
+	}
+	if order.Status != "valid" {
+		return nil, nil, errors.Errorf("acme order of %s is %s", strings.Join(c.conf.Domains, ", "), order.Status)
+	}
+	_, certPEM, err = c.post(ctx, order.Certificate, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func (c *acmeClient) directoryURL() string {
+	if c.conf.DirectoryURL != "" {
+		return c.conf.DirectoryURL
+	}
+	return ACME_LETS_ENCRYPT_URL
+}
+
+// create the account of c.key, or find the existing one
+func (c *acmeClient) register(ctx context.Context) error {
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if c.conf.Email != "" {
+		account["contact"] = []string{"mailto:" + c.conf.Email}
+	}
+	header, _, err := c.post(ctx, c.dir.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	c.kid = header.Get("Location")
+	return nil
+}
+
+// answer the challenge of the authorization at `authzURL` by `solver` and wait until it is valid
+func (c *acmeClient) authorize(ctx context.Context, authzURL string, solver acmeSolver) error {
+	var authz acmeAuthorization
+	if _, _, err := c.post(ctx, authzURL, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	domain := authz.Identifier.Value
+	for _, chal := range authz.Challenges {
+		if chal.Type != c.conf.Challenge {
+			continue
+		}
+		keyAuth := chal.Token + "." + c.thumbprint()
+		if err := solver.present(ctx, domain, keyAuth); err != nil {
+			return errors.WithMessage(err, "acme challenge of "+domain)
+		}
+		err := c.respond(ctx, authzURL, chal.URL, domain)
+		solver.cleanup(domain, keyAuth)
+		return err
+	}
+	return errors.Errorf("acme challenge %s is not offered for %s", c.conf.Challenge, domain)
+}
+
+// tell the CA the challenge at `chalURL` is ready, and poll the authorization at `authzURL` until it is valid
+func (c *acmeClient) respond(ctx context.Context, authzURL, chalURL, domain string) error {
+	if _, _, err := c.post(ctx, chalURL, struct{}{}, nil); err != nil {
+		return err
+	}
+	var authz acmeAuthorization
+	for {
+		if err := sleepContext(ctx, _ACME_POLL_INTERVAL); err != nil {
+			return err
+		}
+		if _, _, err := c.post(ctx, authzURL, nil, &authz); err != nil {
+			return err
+		}
+		switch authz.Status {
+		case "pending":
+			continue
+		case "valid":
+			return nil
+		}
+		return errors.Errorf("acme authorization of %s is %s", domain, authz.Status)
+	}
+}
+
+// GET `url` and decode the JSON body into `out`
+func (c *acmeClient) getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("acme %s: %s", url, resp.Status)
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(out))
+}
+
+// POST the JWS of `payload` to `url`, nil `payload` for POST-as-GET,
+// the JSON body is decoded into `out` if it is not nil, bad nonces are retried
+func (c *acmeClient) post(ctx context.Context, url string, payload, out interface{}) (http.Header, []byte, error) {
+	for retries := 0; ; retries++ {
+		body, err := c.sign(ctx, url, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err := c.http.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		c.nonce = resp.Header.Get("Replay-Nonce")
+
+		if resp.StatusCode >= 400 {
+			var problem struct {
+				Type   string `json:"type"`
+				Detail string `json:"detail"`
+			}
+			json.Unmarshal(b, &problem)
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && retries < 3 {
+				continue
+			}
+			return nil, nil, errors.Errorf("acme %s: %s %s: %s", url, resp.Status, problem.Type, problem.Detail)
+		}
+		if out != nil {
+			if err = json.Unmarshal(b, out); err != nil {
+				return nil, nil, errors.Wrapf(err, "acme %s", url)
+			}
+		}
+		return resp.Header, b, nil
+	}
+}
+
+// JWS of `payload` for `url` in flattened JSON serialization, signed with ES256
+func (c *acmeClient) sign(ctx context.Context, url string, payload interface{}) ([]byte, error) {
+	nonce := c.nonce
+	c.nonce = ""
+	if nonce == "" {
+		req, err := http.NewRequest(http.MethodHead, c.dir.NewNonce, nil)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		resp, err := c.http.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		resp.Body.Close()
+		if nonce = resp.Header.Get("Replay-Nonce"); nonce == "" {
+			return nil, errors.New("acme: no nonce replied")
+		}
+	}
+
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = c.jwk()
+	}
+	p, err := json.Marshal(protected)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var encodedPayload string
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		encodedPayload = b64(b)
+	}
+	input := b64(p) + "." + encodedPayload
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sig := append(padBigInt(r, 32), padBigInt(s, 32)...)
+	b, err := json.Marshal(map[string]string{"protected": b64(p), "payload": encodedPayload, "signature": b64(sig)})
+	return b, errors.WithStack(err)
+}
+
+// public key of the account as a JWK, members are in lexicographic order as required by thumbprints
+func (c *acmeClient) jwk() map[string]string {
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   b64(padBigInt(c.key.X, 32)),
+		"y":   b64(padBigInt(c.key.Y, 32)),
+	}
+}
+
+// JWK thumbprint of the account key (RFC 7638)
+func (c *acmeClient) thumbprint() string {
+	jwk := c.jwk()
+	b := `{"crv":"` + jwk["crv"] + `","kty":"` + jwk["kty"] + `","x":"` + jwk["x"] + `","y":"` + jwk["y"] + `"}`
+	digest := sha256.Sum256([]byte(b))
+	return b64(digest[:])
+}
+
+// dns-01 solver running ACMEConfig.DNSHook
+type acmeDNSHook string
+
+// --- impl acmeSolver for acmeDNSHook
+
+func (hook acmeDNSHook) present(ctx context.Context, domain, keyAuth string) error {
+	out, err := exec.CommandContext(ctx, string(hook), "present", domain, acmeDNSValue(keyAuth)).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("dns hook: %s: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// within _ACME_DNS_HOOK_CLEANUP_TIMEOUT, even if the challenge is abandoned, failures are only logged
+func (hook acmeDNSHook) cleanup(domain, keyAuth string) {
+	ctx, cancel := context.WithTimeout(context.Background(), _ACME_DNS_HOOK_CLEANUP_TIMEOUT)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, string(hook), "cleanup", domain, acmeDNSValue(keyAuth)).CombinedOutput()
+	if err != nil {
+		glog.Warningf("acme dns hook cleanup of %s: %s: %s\n", domain, err, bytes.TrimSpace(out))
+	}
+}
+
+// value of the TXT record of a dns-01 challenge
+func acmeDNSValue(keyAuth string) string {
+	digest := sha256.Sum256([]byte(keyAuth))
+	return b64(digest[:])
+}
+
+// unpadded base64url
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// big endian bytes of `n` left padded with zeros to `size` bytes
+func padBigInt(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// sleep for `d` unless `ctx` is done before
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
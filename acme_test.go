@@ -0,0 +1,46 @@
+package dnsproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestACMEDNSHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("dns hooks of tests are shell scripts")
+	}
+	dir, err := ioutil.TempDir("", "acme-dns-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+	hook := filepath.Join(dir, "hook")
+	script := "#!/bin/sh\necho \"$@\" >> " + log + "\n[ \"$1\" = present ]\n"
+	if err := ioutil.WriteFile(hook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	value := acmeDNSValue("token.thumbprint")
+	// cleanup runs even after the challenge is abandoned, and its failure is only logged
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := acmeDNSHook(hook).present(ctx, "example.com", "token.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	acmeDNSHook(hook).cleanup("example.com", "token.thumbprint")
+
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "present example.com " + value + "\ncleanup example.com " + value
+	if got := strings.TrimSpace(string(b)); got != want {
+		t.Errorf("hook ran %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,443 @@
+package dnsproxy
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// serve the admin api at `laddr`, which should not be reachable from untrusted hosts,
+// requests which web pages may forge are rejected, see adminGuard
+// `reload` reloads domain lists and ip lists, nil if not supported
+// `proxyPool` is the pool passed to ServeProxyPool, nil if unknown
+func (s *Server) ServeAdmin(laddr string, reload func() error, proxyPool *ProxyPool) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	var hosts []string
+	if host, _, err := net.SplitHostPort(laddr); err == nil && host != "" {
+		hosts = append(hosts, host)
+	}
+	srv := &http.Server{Addr: laddr, Handler: s.AdminHandler(reload, proxyPool, hosts...)}
+	return errors.WithStack(srv.ListenAndServe())
+}
+
+// http handler of ServeAdmin, all responses are json except /events and /ui/:
+//
+//	GET  /cache/ip              cached routing decisions of ips
+//	GET  /cache/domain          cached answers and routing decisions of domains
+//	GET  /cache/stats           hit, miss, eviction counters and sizes of caches
+//	POST /cache/flush           drop all cached items
+//	GET  /cache/decisions       learned routing decisions to be imported by other instances, see ExportDecisions
+//	GET  /route?domain=&ip=&client=&listener=  routing decision of a domain or an ip for the optional client and listener tag
+//	GET  /domain_rules          user defined domain rules, see DomainRules
+//	POST /domain_rules/add?pattern=&action=  force domains of the pattern to "direct", "proxy" or "reject", caches are flushed
+//	POST /domain_rules/remove?pattern=       remove the rule of the pattern, caches are flushed
+//	POST /reload                reload domain lists and ip lists
+//	GET  /loglevel              glog verbosity
+//	POST /loglevel?v=1          set glog verbosity
+//	GET  /health                health of dns upstreams and proxy chains
+//	GET  /proxy/stats           proxy connections closed by idle timeout and lifetime limit, see SetProxyTimeouts
+//	GET  /proxy/buffers         usage of the pooled relay buffers of the proxy, see SetRelayBuffers
+//	GET  /proxy/conns           connections of the proxy being relayed
+//	GET  /events?type=          live events as server-sent events of the comma separated types such as "dns,route",
+//	                            all types if empty, the recent ones first, see Event
+//	GET  /events/recent         the recent events
+//	GET  /ui/                   dashboard of live events, caches and health
+//
+// /proxy/conns, /events and /ui/ require SetEventStream
+//
+// requests of hosts other than ip literals, "localhost" and `hosts` are rejected, as are requests other than GET
+// from foreign origins, see adminGuard
+func (s *Server) AdminHandler(reload func() error, proxyPool *ProxyPool, hosts ...string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache/ip", adminGet(func(r *http.Request) (interface{}, error) {
+		return s.ipcache.Items(), nil
+	}))
+	mux.HandleFunc("/cache/domain", adminGet(func(r *http.Request) (interface{}, error) {
+		return s.domaincache.Items(), nil
+	}))
+	mux.HandleFunc("/cache/stats", adminGet(func(r *http.Request) (interface{}, error) {
+		return map[string]CacheStats{"ip": s.ipcache.Stats(), "domain": s.domaincache.Stats(), "negative": s.negcache.Stats()}, nil
+	}))
+	mux.HandleFunc("/cache/flush", adminPost(func(r *http.Request) (interface{}, error) {
+		s.FlushCaches()
+		return "ok", nil
+	}))
+	mux.HandleFunc("/cache/decisions", adminGet(func(r *http.Request) (interface{}, error) {
+		return s.ExportDecisions(), nil
+	}))
+	mux.HandleFunc("/route", adminGet(s.adminRoute))
+	mux.HandleFunc("/domain_rules", adminGet(func(r *http.Request) (interface{}, error) {
+		rules, err := s.adminDomainRules()
+		if err != nil {
+			return nil, err
+		}
+		return rules.Rules(), nil
+	}))
+	mux.HandleFunc("/domain_rules/add", adminPost(func(r *http.Request) (interface{}, error) {
+		rules, err := s.adminDomainRules()
+		if err != nil {
+			return nil, err
+		}
+		trans, err := ParseTransport(r.URL.Query().Get("action"))
+		if err != nil {
+			return nil, err
+		}
+		if err := rules.Add(r.URL.Query().Get("pattern"), trans); err != nil {
+			return nil, err
+		}
+		// cached decisions of the matched domains are outdated
+		s.FlushCaches()
+		return "ok", nil
+	}))
+	mux.HandleFunc("/domain_rules/remove", adminPost(func(r *http.Request) (interface{}, error) {
+		rules, err := s.adminDomainRules()
+		if err != nil {
+			return nil, err
+		}
+		if !rules.Remove(r.URL.Query().Get("pattern")) {
+			return nil, errors.Errorf("no domain rule of pattern %q", r.URL.Query().Get("pattern"))
+		}
+		s.FlushCaches()
+		return "ok", nil
+	}))
+	mux.HandleFunc("/reload", adminPost(func(r *http.Request) (interface{}, error) {
+		if reload == nil {
+			return nil, errors.New("reloading is not supported")
+		}
+		if err := reload(); err != nil {
+			return nil, err
+		}
+		return "ok", nil
+	}))
+	mux.HandleFunc("/loglevel", adminLogLevel)
+	mux.HandleFunc("/health", adminGet(func(r *http.Request) (interface{}, error) {
+		return s.adminHealth(proxyPool), nil
+	}))
+	mux.HandleFunc("/proxy/stats", adminGet(func(r *http.Request) (interface{}, error) {
+		if s.proxyTimeouts == nil {
+			return ProxyTimeoutStats{}, nil
+		}
+		return s.proxyTimeouts.Stats(), nil
+	}))
+	mux.HandleFunc("/proxy/buffers", adminGet(func(r *http.Request) (interface{}, error) {
+		if s.relayBuffers == nil {
+			return RelayBufferStats{}, nil
+		}
+		return s.relayBuffers.Stats(), nil
+	}))
+	mux.HandleFunc("/proxy/conns", adminGet(func(r *http.Request) (interface{}, error) {
+		if s.events == nil {
+			return nil, errAdminNoEvents
+		}
+		return s.events.ProxyConns(), nil
+	}))
+	mux.HandleFunc("/events", s.adminEvents)
+	mux.HandleFunc("/events/recent", adminGet(func(r *http.Request) (interface{}, error) {
+		if s.events == nil {
+			return nil, errAdminNoEvents
+		}
+		return s.events.Recent(), nil
+	}))
+	mux.HandleFunc("/ui/", adminDashboard(s.events != nil))
+	return adminGuard(mux, hosts)
+}
+
+// reject requests which web pages may forge in browsers of the operator:
+//   - of hosts other than ip literals, "localhost" and `hosts`, as pages of DNS rebinding domains request
+//     by their names, which would read /cache/domain, i.e. the browsing history
+//   - of methods other than GET and HEAD from foreign origins, as pages of any origin send POSTs of
+//     query parameters as CORS simple requests without preflight
+//
+// requests without Origin nor Sec-Fetch-Site, such as those of `dnsproxy cache` and curl, are not browsers'
+func adminGuard(h http.Handler, hosts []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !adminHostAllowed(r.Host, hosts) {
+			http.Error(w, "forbidden host", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if origin := r.Header.Get("Origin"); origin != "" {
+				if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+					http.Error(w, "forbidden origin", http.StatusForbidden)
+					return
+				}
+			} else if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+				http.Error(w, "forbidden origin", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// whether `host` of a request, with or without the port, is an ip literal, "localhost" or any of `hosts`
+func adminHostAllowed(host string, hosts []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if net.ParseIP(host) != nil || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	for _, h := range hosts {
+		if strings.EqualFold(host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// response of /route
+type adminRouteResp struct {
+	Trans    Transport `json:"trans"`
+	Outbound string    `json:"outbound,omitempty"`
+	Cached   bool      `json:"cached"`         // decided by the cache instead of the routing policy
+	Rule     int       `json:"rule,omitempty"` // matched [[rule]] counting from 1, 0 if none
+
+	DomainRule string `json:"domain_rule,omitempty"` // pattern of the matched user defined domain rule
+
+	// lists of the default routing policy, nil if not used
+	GFWList      *bool `json:"gfw_list,omitempty"`
+	ObedientList *bool `json:"obedient_list,omitempty"`
+	ChinaIP      *bool `json:"china_ip,omitempty"`
+}
+
+// routing decision without caching it
+func (s *Server) adminRoute(r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	var client net.IP
+	if c := q.Get("client"); c != "" {
+		if client = net.ParseIP(c); client == nil {
+			return nil, errors.Errorf("invalid client %q", c)
+		}
+	}
+	listener := q.Get("listener")
+	scope := s.queryScope(client, listener)
+
+	rq := &RouteQuery{Client: client, Listener: listener, Ctx: r.Context()}
+	resp := new(adminRouteResp)
+	if domain := strings.TrimSuffix(q.Get("domain"), "."); domain != "" {
+		if item, ok := s.domaincache.Get(scope, domain, dns.TypeA); ok {
+			resp.Trans, resp.Outbound, resp.Cached = item.trans, item.outbound, true
+		}
+		rq.Req = new(dns.Msg)
+		rq.Req.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+	} else if ip := net.ParseIP(q.Get("ip")); ip != nil {
+		if trans, outbound, ok := s.ipcache.Get(scope, ip.String()); ok {
+			resp.Trans, resp.Outbound, resp.Cached = trans, outbound, true
+		}
+		rq.IP = ip
+	} else {
+		return nil, errors.New("either domain or ip is required")
+	}
+
+	policy := s.policy
+	if rp, ok := policy.(*RulePolicy); ok {
+		if i := rp.MatchRule(rq); i >= 0 {
+			resp.Rule = i + 1
+		} else {
+			policy = rp.Fallback()
+		}
+	}
+	if dp, ok := policy.(*DefaultRoutingPolicy); ok {
+		if rq.Req != nil {
+			if rule, ok := dp.DomainRules().Match(rq.Domain()); ok {
+				resp.DomainRule = rule.Pattern
+			}
+			gfw, obedient := dp.MatchDomainLists(rq.Domain())
+			resp.GFWList, resp.ObedientList = &gfw, &obedient
+		} else {
+			chn := dp.MatchChinaIP(rq.IP)
+			resp.ChinaIP = &chn
+		}
+	}
+
+	if !resp.Cached {
+		d, err := s.policy.Route(rq)
+		if err != nil {
+			return nil, err
+		}
+		resp.Trans, resp.Outbound = d.Trans, d.Outbound
+	}
+	return resp, nil
+}
+
+// user defined domain rules of the default routing policy
+func (s *Server) adminDomainRules() (*DomainRules, error) {
+	dp := s.defaultRoutingPolicy()
+	if dp == nil {
+		return nil, errors.New("domain rules require the default routing policy")
+	}
+	return dp.DomainRules(), nil
+}
+
+// response of /health
+type adminHealthResp struct {
+	Upstreams map[string][]UpstreamHealth `json:"upstreams"`
+	Proxies   map[string][]ProxyHealth    `json:"proxies"` // keyed by outbound names, "" for the default one
+}
+
+func (s *Server) adminHealth(proxyPool *ProxyPool) *adminHealthResp {
+	resp := &adminHealthResp{Proxies: make(map[string][]ProxyHealth)}
+	if r, ok := s.policy.(UpstreamHealthReporter); ok {
+		resp.Upstreams = r.UpstreamHealth()
+	}
+	if proxyPool != nil {
+		resp.Proxies[""] = proxyPool.Health()
+	}
+	for name, pool := range s.outbounds {
+		resp.Proxies[name] = pool.Health()
+	}
+	return resp
+}
+
+// how often a comment is written to idle streams of /events, so that they are not closed by intermediaries
+const _ADMIN_EVENTS_KEEPALIVE = 15 * time.Second
+
+var errAdminNoEvents = errors.New("events are not enabled, see SetEventStream")
+
+// stream events of the types of the "type" parameter as server-sent events, starting from the recent ones
+func (s *Server) adminEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.events == nil {
+		writeAdminResp(w, nil, errAdminNoEvents)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAdminResp(w, nil, errors.New("streaming is not supported"))
+		return
+	}
+	var types map[string]bool
+	if t := r.URL.Query().Get("type"); t != "" {
+		types = make(map[string]bool)
+		for _, typ := range strings.Split(t, ",") {
+			types[strings.TrimSpace(typ)] = true
+		}
+	}
+	// subscribe before the recent events are taken, so that none is missed in between
+	events, cancel := s.events.Subscribe(256)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	var last uint64
+	write := func(ev Event) error {
+		if ev.Seq <= last {
+			return nil
+		}
+		last = ev.Seq
+		if types != nil && !types[ev.Type] {
+			return nil
+		}
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, b)
+		return errors.WithStack(err)
+	}
+	for _, ev := range s.events.Recent() {
+		if write(ev) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(_ADMIN_EVENTS_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case ev := <-events:
+			err = write(ev)
+		case <-keepalive.C:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// serve the dashboard at /ui/ if `enabled`
+func adminDashboard(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !enabled {
+			writeAdminResp(w, nil, errAdminNoEvents)
+			return
+		}
+		if r.URL.Path != "/ui/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, _DASHBOARD_HTML)
+	}
+}
+
+func adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	v := flag.Lookup("v")
+	if v == nil {
+		writeAdminResp(w, nil, errors.New("glog is not initialized"))
+		return
+	}
+	if r.Method == http.MethodPost {
+		if err := v.Value.Set(r.URL.Query().Get("v")); err != nil {
+			writeAdminResp(w, nil, errors.WithStack(err))
+			return
+		}
+	}
+	writeAdminResp(w, map[string]string{"v": v.Value.String()}, nil)
+}
+
+func adminGet(f func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := f(r)
+		writeAdminResp(w, v, err)
+	}
+}
+
+func adminPost(f func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := f(r)
+		writeAdminResp(w, v, err)
+	}
+}
+
+// write `v` as json, or {"error": "..."} if `err` is not nil
+func writeAdminResp(w http.ResponseWriter, v interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		v = map[string]string{"error": err.Error()}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
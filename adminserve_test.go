@@ -0,0 +1,49 @@
+package dnsproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminGuard(t *testing.T) {
+	h := adminGuard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), []string{"router.lan"})
+	tests := []struct {
+		method string
+		host   string
+		origin string
+		site   string // Sec-Fetch-Site
+		status int
+	}{
+		{"GET", "127.0.0.1:8053", "", "", http.StatusOK},
+		{"GET", "[::1]:8053", "", "", http.StatusOK},
+		{"GET", "localhost:8053", "", "", http.StatusOK},
+		{"GET", "router.lan:8053", "", "", http.StatusOK},
+		{"POST", "127.0.0.1:8053", "", "", http.StatusOK},
+		{"POST", "127.0.0.1:8053", "http://127.0.0.1:8053", "same-origin", http.StatusOK},
+		// pages of DNS rebinding domains
+		{"GET", "rebind.attacker.example:8053", "", "", http.StatusForbidden},
+		{"GET", "rebind.attacker.example", "", "", http.StatusForbidden},
+		// simple requests of pages of foreign origins
+		{"POST", "127.0.0.1:8053", "https://attacker.example", "cross-site", http.StatusForbidden},
+		{"POST", "127.0.0.1:8053", "http://127.0.0.1:8080", "same-site", http.StatusForbidden},
+		{"POST", "127.0.0.1:8053", "null", "", http.StatusForbidden},
+		{"POST", "127.0.0.1:8053", "", "cross-site", http.StatusForbidden},
+		// reading them is blocked by browsers
+		{"GET", "127.0.0.1:8053", "https://attacker.example", "cross-site", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://"+tt.host+"/cache/flush", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.site != "" {
+			r.Header.Set("Sec-Fetch-Site", tt.site)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s of host %s from %q: status %d, want %d", tt.method, tt.host, tt.origin, w.Code, tt.status)
+		}
+	}
+}
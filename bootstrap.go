@@ -0,0 +1,124 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// resolver of hostnames of proxy nodes and DNS over HTTPS servers by nameservers given by IP,
+// so that they never depend on dnsproxy itself, which may be the system resolver and not serving yet,
+// or route the queries through the very proxy being resolved
+type BootstrapResolver struct {
+	nameservers []string // "ip:port", queried one by one until one answers
+	timeout     time.Duration
+}
+
+// --- impl *BootstrapResolver
+
+// each of `nameservers` such as "223.5.5.5:53" is waited for `timeout`, DNS_UPSTREAM_TIMEOUT if not positive
+func NewBootstrapResolver(nameservers []string, timeout time.Duration) (*BootstrapResolver, error) {
+	if len(nameservers) == 0 {
+		return nil, errors.New("no bootstrap nameserver")
+	}
+	for _, addr := range nameservers {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, errors.Errorf("bootstrap nameserver %q is not ip:port", addr)
+		}
+	}
+	if timeout <= 0 {
+		timeout = DNS_UPSTREAM_TIMEOUT
+	}
+	return &BootstrapResolver{nameservers: nameservers, timeout: timeout}, nil
+}
+
+// addresses of `host`, IPv4 ones if there is any, otherwise IPv6 ones, `host` itself if it is an IP
+func (r *BootstrapResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		ips, err := r.lookup(ctx, host, qtype)
+		if len(ips) > 0 {
+			return ips, nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, errors.Errorf("bootstrap: no address of %s", host)
+}
+
+// replace the host of `addr` such as "example.com:443" with its first address
+func (r *BootstrapResolver) ResolveAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// dial `addr` directly after resolving its host, such as DialContext of http.Transport
+func (r *BootstrapResolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	resolved, err := r.ResolveAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, resolved)
+	return conn, errors.WithStack(err)
+}
+
+// records of `qtype` answered by the first nameserver which answers, over tcp if the udp response is truncated
+func (r *BootstrapResolver) lookup(ctx context.Context, host string, qtype uint16) ([]net.IP, error) {
+	req := new(dns.Msg).SetQuestion(dns.Fqdn(host), qtype)
+	var lastErr error
+	for _, ns := range r.nameservers {
+		resp, err := r.exchange(ctx, req, ns)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return nil, errors.Errorf("bootstrap: %s %s from %s", strings.TrimSuffix(req.Question[0].Name, "."),
+				dns.RcodeToString[resp.Rcode], ns)
+		}
+		var ips []net.IP
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			}
+		}
+		return ips, nil
+	}
+	return nil, lastErr
+}
+
+func (r *BootstrapResolver) exchange(ctx context.Context, req *dns.Msg, ns string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	resp, _, err := (&dns.Client{Net: "udp"}).ExchangeContext(ctx, req, ns)
+	if err == dns.ErrTruncated || err == nil && resp.Truncated {
+		resp, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, req, ns)
+	}
+	return resp, errors.WithStack(err)
+}
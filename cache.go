@@ -1,78 +1,804 @@
 package dnsproxy
 
 import (
+	"container/list"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
 )
 
-// ip cache, cache "ip" and transport
-type ipcache struct {
-	inner *cache.Cache
+// what Add does when the key is already cached
+type CachePolicy int32
+
+const (
+	CACHE_POLICY_UPDATE     CachePolicy = iota // replace the cached item and its expiration
+	CACHE_POLICY_KEEP_FIRST                    // keep the cached item until it expires
+)
+
+// "update" or "keep_first", empty for CACHE_POLICY_UPDATE
+func ParseCachePolicy(s string) (CachePolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "update":
+		return CACHE_POLICY_UPDATE, nil
+	case "keep_first":
+		return CACHE_POLICY_KEEP_FIRST, nil
+	default:
+		return 0, errors.Errorf("unknown cache policy %q", s)
+	}
 }
 
-// --- impl ipcache
-func NewIpcache(defaultExpiration, cleanupInterval time.Duration) ipcache {
-	c := cache.New(defaultExpiration, cleanupInterval)
-	return ipcache{c}
+// counters of an IPCache or a DomainCache since created
+type CacheStats struct {
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Evictions  uint64 `json:"evictions"`             // items deleted after expired or beyond max entries, flushed items are not counted
+	Size       int    `json:"size"`                  // number of items, including expired ones not cleaned up yet
+	MaxEntries int    `json:"max_entries,omitempty"` // 0 if unbounded
 }
 
-func (c ipcache) Add(ip string, t transport) {
-	if ip == "" {
+// state shared by all copies of an IPCache or a DomainCache
+type cacheMeta struct {
+	// 64-bit atomic counters come first to be aligned on 32-bit platforms
+	hits, misses, evictions uint64
+
+	policy    int32         // CachePolicy
+	onEvicted atomic.Value  // func(key string, v interface{})
+	stale     time.Duration // expired items are kept this long to be served stale, see DomainCache.SetServeStale
+
+	// least recently used keys are deleted beyond maxEntries, 0 if unbounded
+	mu         sync.Mutex
+	maxEntries int
+	lru        *list.List // keys, the most recently used first
+	lruElems   map[string]*list.Element
+	deleting   map[string]int // keys being deleted by Delete, which are not evictions
+}
+
+// --- impl *cacheMeta
+// go-cache calling back on evictions into `meta`
+func newCacheWithMeta(cleanupInterval time.Duration) (*cache.Cache, *cacheMeta) {
+	c := cache.New(cache.NoExpiration, cleanupInterval)
+	meta := &cacheMeta{lru: list.New(), lruElems: make(map[string]*list.Element), deleting: make(map[string]int)}
+	c.OnEvicted(func(key string, v interface{}) {
+		if meta.deleted(key) {
+			meta.forget(c, key)
+			return
+		}
+		atomic.AddUint64(&meta.evictions, 1)
+		meta.forget(c, key)
+		if f, ok := meta.onEvicted.Load().(func(string, interface{})); ok && f != nil {
+			f(key, v)
+		}
+	})
+	return c, meta
+}
+
+// bound `c` to `n` items, 0 for unbounded, items beyond are deleted as evicted
+func (meta *cacheMeta) setMaxEntries(c *cache.Cache, n int) {
+	meta.mu.Lock()
+	meta.maxEntries = n
+	victims := meta.trim()
+	meta.mu.Unlock()
+	for _, key := range victims {
+		c.Delete(key)
+	}
+}
+
+// cache `v` according to the policy, or always replace the cached one if `replace`,
+// then delete the least recently used items if there are more than max entries
+func (meta *cacheMeta) put(c *cache.Cache, key string, v interface{}, ttl time.Duration, replace bool) {
+	if replace || CachePolicy(atomic.LoadInt32(&meta.policy)) == CACHE_POLICY_UPDATE {
+		c.Set(key, v, ttl)
+	} else {
+		c.Add(key, v, ttl)
+	}
+
+	meta.mu.Lock()
+	if meta.maxEntries <= 0 {
+		meta.mu.Unlock()
 		return
 	}
-	c.inner.Add(ip, t, cache.DefaultExpiration)
+	meta.touchLocked(key)
+	victims := meta.trim()
+	meta.mu.Unlock()
+	for _, key := range victims {
+		c.Delete(key)
+	}
 }
 
-func (c ipcache) Get(ip string) (transport, bool) {
-	v, ok := c.inner.Get(ip)
-	if ok {
-		return v.(transport), true
+// mark `key` as the most recently used
+func (meta *cacheMeta) touch(key string) {
+	meta.mu.Lock()
+	if meta.maxEntries > 0 {
+		meta.touchLocked(key)
+	}
+	meta.mu.Unlock()
+}
+
+func (meta *cacheMeta) touchLocked(key string) {
+	if e, ok := meta.lruElems[key]; ok {
+		meta.lru.MoveToFront(e)
 	} else {
-		return 0, false
+		meta.lruElems[key] = meta.lru.PushFront(key)
 	}
 }
 
-// domain cache, cache "domain" and dns message info
-type domaincache struct {
-	inner *cache.Cache
+// untrack the least recently used keys beyond max entries, which are to be deleted from the cache,
+// meta.mu must be held
+func (meta *cacheMeta) trim() (victims []string) {
+	if meta.maxEntries <= 0 {
+		return nil
+	}
+	for meta.lru.Len() > meta.maxEntries {
+		e := meta.lru.Back()
+		key := meta.lru.Remove(e).(string)
+		delete(meta.lruElems, key)
+		victims = append(victims, key)
+	}
+	return victims
 }
 
-type domaincacheCell struct {
-	ans   dns.RR    // cached answer
-	trans transport // transport type for answered ips in dns message
+// untrack `key` deleted from `c`, unless it has been cached again in the meantime
+func (meta *cacheMeta) forget(c *cache.Cache, key string) {
+	meta.mu.Lock()
+	defer meta.mu.Unlock()
+	if e, ok := meta.lruElems[key]; ok {
+		if _, cached := c.Get(key); !cached {
+			meta.lru.Remove(e)
+			delete(meta.lruElems, key)
+		}
+	}
+}
+
+// delete `key` from `c` without counting it as evicted nor calling the OnEvicted hook
+func (meta *cacheMeta) delete(c *cache.Cache, key string) {
+	meta.mu.Lock()
+	meta.deleting[key]++
+	meta.mu.Unlock()
+	// go-cache calls back synchronously if the key is cached
+	c.Delete(key)
+	meta.mu.Lock()
+	if meta.deleting[key]--; meta.deleting[key] <= 0 {
+		delete(meta.deleting, key)
+	}
+	meta.mu.Unlock()
+}
+
+// check if `key` is being deleted by delete, rather than evicted
+func (meta *cacheMeta) deleted(key string) bool {
+	meta.mu.Lock()
+	defer meta.mu.Unlock()
+	return meta.deleting[key] > 0
+}
+
+// untrack all keys after `c` is flushed
+func (meta *cacheMeta) flush(c *cache.Cache) {
+	meta.mu.Lock()
+	c.Flush()
+	meta.lru.Init()
+	meta.lruElems = make(map[string]*list.Element)
+	meta.mu.Unlock()
+}
+
+// count a hit or a miss
+func (meta *cacheMeta) count(hit bool) {
+	if hit {
+		atomic.AddUint64(&meta.hits, 1)
+	} else {
+		atomic.AddUint64(&meta.misses, 1)
+	}
 }
 
-// --- impl domaincache
-func NewDomaincache(defaultExpiration, cleanupInterval time.Duration) domaincache {
-	c := cache.New(defaultExpiration, cleanupInterval)
-	return domaincache{c}
+func (meta *cacheMeta) stats(c *cache.Cache) CacheStats {
+	meta.mu.Lock()
+	maxEntries := meta.maxEntries
+	meta.mu.Unlock()
+	return CacheStats{
+		Hits:       atomic.LoadUint64(&meta.hits),
+		Misses:     atomic.LoadUint64(&meta.misses),
+		Evictions:  atomic.LoadUint64(&meta.evictions),
+		Size:       c.ItemCount(),
+		MaxEntries: maxEntries,
+	}
+}
+
+// bounds of the expiration of cached items
+type ttlBounds struct {
+	min, max time.Duration
+}
+
+// --- impl ttlBounds
+// clamp `ttl` into [min, max], max is ignored if it is not positive
+func (b ttlBounds) clamp(ttl time.Duration) time.Duration {
+	if ttl < b.min {
+		ttl = b.min
+	}
+	if b.max > 0 && ttl > b.max {
+		ttl = b.max
+	}
+	return ttl
+}
+
+// `rrs` with TTLs clamped into [min, max], changed records are copied as `rrs` may be shared with caches
+func (b ttlBounds) clampRRs(rrs []dns.RR) []dns.RR {
+	if b == (ttlBounds{}) {
+		return rrs
+	}
+	var clamped []dns.RR
+	for i, rr := range rrs {
+		ttl := uint32(b.clamp(time.Duration(rr.Header().Ttl)*time.Second) / time.Second)
+		if ttl == rr.Header().Ttl {
+			continue
+		}
+		if clamped == nil {
+			clamped = append([]dns.RR(nil), rrs...)
+		}
+		clamped[i] = dns.Copy(rr)
+		clamped[i].Header().Ttl = ttl
+	}
+	if clamped == nil {
+		return rrs
+	}
+	return clamped
 }
 
-func (c domaincache) Add(domain string, answer dns.RR, t transport) {
-	if domain == "" {
+// routing decisions of ips keyed by client scopes, see ClientScoper, which are cached for the TTLs of the dns records
+// the ips come from, so that proxy requests to the ips are routed without resolving their domains again
+//
+// an IPCache is a handle created by NewIPCache, copies of it share the same items, the zero value is not usable,
+// all methods are safe for concurrent use unless noted
+type IPCache struct {
+	inner  *cache.Cache
+	bounds ttlBounds
+	meta   *cacheMeta
+}
+
+type ipcacheItem struct {
+	trans    Transport
+	outbound string // named proxy chain of TRANS_PROXY, empty for the default one
+}
+
+// --- impl IPCache
+// TTLs of added items are clamped into [minTTL, maxTTL], maxTTL is ignored if it is not positive,
+// expired items are deleted every `cleanupInterval`, and never if it is not positive, though they are never returned,
+// the cache policy is CACHE_POLICY_UPDATE unless changed by SetPolicy
+func NewIPCache(minTTL, maxTTL, cleanupInterval time.Duration) IPCache {
+	c, meta := newCacheWithMeta(cleanupInterval)
+	return IPCache{c, ttlBounds{minTTL, maxTTL}, meta}
+}
+
+// same as NewIPCache
+//
+// Deprecated: use NewIPCache instead
+func NewIpcache(minTTL, maxTTL, cleanupInterval time.Duration) IPCache {
+	return NewIPCache(minTTL, maxTTL, cleanupInterval)
+}
+
+// what Add does when the ip is already cached, safe to call while serving
+func (c IPCache) SetPolicy(p CachePolicy) {
+	atomic.StoreInt32(&c.meta.policy, int32(p))
+}
+
+// keep at most `n` items by deleting the least recently used ones, 0 for unbounded,
+// items cached before are not counted, so it should be called before any item is added
+func (c IPCache) SetMaxEntries(n int) {
+	c.meta.setMaxEntries(c.inner, n)
+}
+
+// call `f` when an item is deleted after expired, nil to remove the hook,
+// `f` runs in the cleanup goroutine so it should not block
+func (c IPCache) OnEvicted(f func(scope, ip string, t Transport, outbound string)) {
+	if f == nil {
+		c.meta.onEvicted.Store((func(string, interface{}))(nil))
 		return
 	}
-	if name := dns.Fqdn(domain); name != answer.Header().Name {
-		answer.Header().Name = name
+	c.meta.onEvicted.Store(func(key string, v interface{}) {
+		scope, ip := splitScopedCacheKey(key)
+		item := v.(ipcacheItem)
+		f(scope, ip, item.trans, item.outbound)
+	})
+}
+
+// cache `ip` for clients in `scope` for `ttl`, which is usually the TTL of the dns record `ip` comes from,
+// an already cached ip is replaced or kept according to the cache policy,
+// nothing is cached if the clamped ttl is zero
+func (c IPCache) Add(scope, ip string, t Transport, outbound string, ttl time.Duration) {
+	c.add(scope, ip, t, outbound, ttl, false)
+}
+
+// same as Add but always replaces the cached item and refreshes its expiration
+func (c IPCache) Set(scope, ip string, t Transport, outbound string, ttl time.Duration) {
+	c.add(scope, ip, t, outbound, ttl, true)
+}
+
+func (c IPCache) add(scope, ip string, t Transport, outbound string, ttl time.Duration, replace bool) {
+	if ip == "" {
+		return
+	}
+	if ttl = c.bounds.clamp(ttl); ttl <= 0 {
+		return
+	}
+	c.meta.put(c.inner, scopedCacheKey(scope, ip), ipcacheItem{t, outbound}, ttl, replace)
+}
+
+// cache `ip` as long as possible, for ips which do not come from dns records
+func (c IPCache) AddLongLived(scope, ip string, t Transport, outbound string) {
+	ttl := c.bounds.max
+	if ttl <= 0 {
+		ttl = cache.NoExpiration
 	}
-	cell := domaincacheCell{answer, t}
-	c.inner.Add(domain, &cell, cache.DefaultExpiration)
+	c.meta.put(c.inner, scopedCacheKey(scope, ip), ipcacheItem{t, outbound}, ttl, false)
 }
 
-func (c domaincache) Get(domain string) (*domaincacheCell, bool) {
-	v, ok := c.inner.Get(domain)
+// unexpired routing decision of `ip` for clients in `scope`, counted as a hit or a miss
+func (c IPCache) Get(scope, ip string) (t Transport, outbound string, ok bool) {
+	key := scopedCacheKey(scope, ip)
+	v, ok := c.inner.Get(key)
+	c.meta.count(ok)
 	if ok {
-		return v.(*domaincacheCell), true
+		c.meta.touch(key)
+		item := v.(ipcacheItem)
+		return item.trans, item.outbound, true
 	} else {
+		return 0, "", false
+	}
+}
+
+// cached routing decision of an ip, see IPCache.Items
+type IPCacheEntry struct {
+	Scope      string    `json:"scope,omitempty"`
+	IP         string    `json:"ip"`
+	Trans      Transport `json:"trans"`
+	Outbound   string    `json:"outbound,omitempty"`
+	Expiration time.Time `json:"expiration"` // zero if never expires
+}
+
+// delete `ip` cached for clients in `scope`, which is neither counted as evicted nor passed to the OnEvicted hook
+func (c IPCache) Delete(scope, ip string) {
+	c.meta.delete(c.inner, scopedCacheKey(scope, ip))
+}
+
+// number of items, including expired ones not cleaned up yet
+func (c IPCache) Len() int {
+	return c.inner.ItemCount()
+}
+
+// call `f` with each unexpired item in no particular order until it returns false,
+// `f` works on a snapshot and may modify the cache
+func (c IPCache) Iterate(f func(IPCacheEntry) bool) {
+	for key, item := range c.inner.Items() {
+		scope, ip := splitScopedCacheKey(key)
+		v := item.Object.(ipcacheItem)
+		entry := IPCacheEntry{
+			Scope:      scope,
+			IP:         ip,
+			Trans:      v.trans,
+			Outbound:   v.outbound,
+			Expiration: expirationTime(item.Expiration),
+		}
+		if !f(entry) {
+			return
+		}
+	}
+}
+
+// all unexpired items
+func (c IPCache) Items() []IPCacheEntry {
+	entries := make([]IPCacheEntry, 0, c.inner.ItemCount())
+	c.Iterate(func(entry IPCacheEntry) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	return entries
+}
+
+func (c IPCache) Stats() CacheStats {
+	return c.meta.stats(c.inner)
+}
+
+// delete all items
+func (c IPCache) Flush() {
+	c.meta.flush(c.inner)
+}
+
+// answers and routing decisions of domains keyed by client scopes and query types, see ClientScoper,
+// which are cached for the minimum TTLs of the answers, and indexed by the answered ips for PTR queries
+//
+// a DomainCache is a handle created by NewDomainCache, copies of it share the same items, the zero value is not usable,
+// all methods are safe for concurrent use unless noted
+type DomainCache struct {
+	inner   *cache.Cache
+	bounds  ttlBounds
+	meta    *cacheMeta
+	reverse *cache.Cache // scoped "ip" -> key of the A or AAAA item answering it, see LookupIP
+}
+
+// a cached answer of DomainCache, which is immutable once cached
+type DomainCacheCell struct {
+	answers  []dns.RR  // cached answer section, including CNAME chains
+	ip       net.IP    // first answered ip, nil if there is no A or AAAA record
+	trans    Transport // transport type for answered ips in dns message
+	outbound string    // named proxy chain of TRANS_PROXY, empty for the default one
+	stored   time.Time // when the answers were cached
+	expires  time.Time // when the cell expires, zero if never
+
+	current atomic.Value // *domaincacheAnswers last returned by Answers
+}
+
+// answers of a cell with TTLs decremented by `elapsed` seconds
+type domaincacheAnswers struct {
+	elapsed uint32
+	rrs     []dns.RR
+}
+
+// --- impl *DomainCacheCell
+func newDomainCacheCell(answers []dns.RR, t Transport, outbound string, stored time.Time) *DomainCacheCell {
+	cell := &DomainCacheCell{answers: answers, trans: t, outbound: outbound, stored: stored}
+	for _, ans := range answers {
+		switch v := ans.(type) {
+		case *dns.A:
+			cell.ip = v.A
+		case *dns.AAAA:
+			cell.ip = v.AAAA
+		}
+		if cell.ip != nil {
+			break
+		}
+	}
+	return cell
+}
+
+// copy of the cached answers with TTLs decremented by the time they have been cached,
+// shared by all calls within the same second so that cached queries are answered without copying, must not be modified
+func (cell *DomainCacheCell) Answers() []dns.RR {
+	elapsed := uint32(time.Since(cell.stored) / time.Second)
+	if cur, _ := cell.current.Load().(*domaincacheAnswers); cur != nil && cur.elapsed == elapsed {
+		return cur.rrs
+	}
+	answers := make([]dns.RR, len(cell.answers))
+	for i, ans := range cell.answers {
+		ans = dns.Copy(ans)
+		if hdr := ans.Header(); hdr.Ttl > elapsed {
+			hdr.Ttl -= elapsed
+		} else {
+			hdr.Ttl = 0
+		}
+		answers[i] = ans
+	}
+	cell.current.Store(&domaincacheAnswers{elapsed, answers})
+	return answers
+}
+
+// copy of the cached answers with TTLs set to _STALE_ANSWER_TTL, for answering after the cell expired
+func (cell *DomainCacheCell) StaleAnswers() []dns.RR {
+	answers := make([]dns.RR, len(cell.answers))
+	for i, ans := range cell.answers {
+		ans = dns.Copy(ans)
+		ans.Header().Ttl = _STALE_ANSWER_TTL
+		answers[i] = ans
+	}
+	return answers
+}
+
+// routing decision of the answered ips
+func (cell *DomainCacheCell) Transport() Transport {
+	return cell.trans
+}
+
+// named proxy chain of TRANS_PROXY, empty for the default one
+func (cell *DomainCacheCell) Outbound() string {
+	return cell.outbound
+}
+
+// when the cell expires, zero if never
+func (cell *DomainCacheCell) Expires() time.Time {
+	return cell.expires
+}
+
+// check if the cell has expired at `now` and can only be served stale
+func (cell *DomainCacheCell) expired(now time.Time) bool {
+	return !cell.expires.IsZero() && now.After(cell.expires)
+}
+
+// --- impl DomainCache
+// TTLs of added items are clamped into [minTTL, maxTTL], maxTTL is ignored if it is not positive,
+// expired items are deleted every `cleanupInterval`, and never if it is not positive, though they are never returned,
+// the cache policy is CACHE_POLICY_UPDATE unless changed by SetPolicy
+func NewDomainCache(minTTL, maxTTL, cleanupInterval time.Duration) DomainCache {
+	c, meta := newCacheWithMeta(cleanupInterval)
+	return DomainCache{c, ttlBounds{minTTL, maxTTL}, meta, cache.New(cache.NoExpiration, cleanupInterval)}
+}
+
+// same as NewDomainCache
+//
+// Deprecated: use NewDomainCache instead
+func NewDomaincache(minTTL, maxTTL, cleanupInterval time.Duration) DomainCache {
+	return NewDomainCache(minTTL, maxTTL, cleanupInterval)
+}
+
+// what Add does when the domain is already cached, safe to call while serving
+func (c DomainCache) SetPolicy(p CachePolicy) {
+	atomic.StoreInt32(&c.meta.policy, int32(p))
+}
+
+// keep items for `window` after they expired to be answered by GetStale when upstreams fail (RFC 8767),
+// 0 to delete items once expired, must be called before any item is added
+func (c DomainCache) SetServeStale(window time.Duration) {
+	c.meta.stale = window
+}
+
+// keep at most `n` items by deleting the least recently used ones, 0 for unbounded,
+// items cached before are not counted, so it should be called before any item is added
+func (c DomainCache) SetMaxEntries(n int) {
+	c.meta.setMaxEntries(c.inner, n)
+}
+
+// call `f` when an item is deleted after expired, nil to remove the hook,
+// `f` runs in the cleanup goroutine so it should not block
+func (c DomainCache) OnEvicted(f func(scope, domain string, qtype uint16)) {
+	if f == nil {
+		c.meta.onEvicted.Store((func(string, interface{}))(nil))
+		return
+	}
+	c.meta.onEvicted.Store(func(key string, v interface{}) {
+		scope, key := splitScopedCacheKey(key)
+		if domain, qtype, ok := splitDomaincacheKey(key); ok {
+			f(scope, domain, qtype)
+		}
+	})
+}
+
+// cache the answer section of a dns response to `qtype` query for clients in `scope`
+// for the minimum TTL of `answers`, an already cached domain is replaced or kept according to the cache policy,
+// nothing is cached if the clamped ttl is zero
+func (c DomainCache) Add(scope, domain string, qtype uint16, answers []dns.RR, t Transport, outbound string) {
+	c.add(scope, domain, qtype, answers, t, outbound, false)
+}
+
+// same as Add but always replaces the cached item and refreshes its expiration
+func (c DomainCache) Set(scope, domain string, qtype uint16, answers []dns.RR, t Transport, outbound string) {
+	c.add(scope, domain, qtype, answers, t, outbound, true)
+}
+
+func (c DomainCache) add(scope, domain string, qtype uint16, answers []dns.RR, t Transport, outbound string, replace bool) {
+	if domain == "" || len(answers) == 0 {
+		return
+	}
+	ttl := c.bounds.clamp(RRsMinTTL(answers))
+	if ttl <= 0 {
+		return
+	}
+	_answers := make([]dns.RR, len(answers))
+	for i, ans := range answers {
+		_answers[i] = dns.Copy(ans)
+	}
+	now := time.Now()
+	cell := newDomainCacheCell(_answers, t, outbound, now)
+	cell.expires = now.Add(ttl)
+	c.put(scopedCacheKey(scope, domaincacheKey(domain, qtype)), cell, replace)
+}
+
+// cache `cell` until it expires, and longer by the serve stale window
+func (c DomainCache) put(key string, cell *DomainCacheCell, replace bool) {
+	ttl := cache.NoExpiration
+	if !cell.expires.IsZero() {
+		ttl = time.Until(cell.expires) + c.meta.stale
+	}
+	c.meta.put(c.inner, key, cell, ttl, replace)
+	c.index(key, cell)
+}
+
+// index ips answered by `cell` cached at `key` for LookupIP, until the cell expires
+func (c DomainCache) index(key string, cell *DomainCacheCell) {
+	if cell.ip == nil {
+		return
+	}
+	scope, _ := splitScopedCacheKey(key)
+	ttl := cache.NoExpiration
+	if !cell.expires.IsZero() {
+		ttl = time.Until(cell.expires)
+	}
+	for _, ans := range cell.answers {
+		switch v := ans.(type) {
+		case *dns.A:
+			c.reverse.Set(scopedCacheKey(scope, v.A.String()), key, ttl)
+		case *dns.AAAA:
+			c.reverse.Set(scopedCacheKey(scope, v.AAAA.String()), key, ttl)
+		}
+	}
+}
+
+// domain recently resolved to `ip` for clients in `scope` and the remaining TTL of the answer,
+// false if no unexpired item answers `ip`
+func (c DomainCache) LookupIP(scope string, ip net.IP) (domain string, ttl uint32, ok bool) {
+	v, ok := c.reverse.Get(scopedCacheKey(scope, ip.String()))
+	if !ok {
+		return "", 0, false
+	}
+	key := v.(string)
+	// the item may have been replaced, evicted or flushed since indexed
+	item, ok := c.inner.Get(key)
+	if !ok || item.(*DomainCacheCell).expired(time.Now()) {
+		return "", 0, false
+	}
+	for _, ans := range item.(*DomainCacheCell).Answers() {
+		var answered net.IP
+		switch v := ans.(type) {
+		case *dns.A:
+			answered = v.A
+		case *dns.AAAA:
+			answered = v.AAAA
+		}
+		if answered.Equal(ip) {
+			_, key := splitScopedCacheKey(key)
+			domain, _, _ := splitDomaincacheKey(key)
+			return domain, ans.Header().Ttl, true
+		}
+	}
+	return "", 0, false
+}
+
+// unexpired cell of the domain, counted as a hit or a miss
+func (c DomainCache) Get(scope, domain string, qtype uint16) (*DomainCacheCell, bool) {
+	cell, stale, ok := c.GetStale(scope, domain, qtype)
+	if !ok || stale {
 		return nil, false
 	}
+	return cell, true
+}
+
+// cell of the domain which may have expired within the serve stale window, only unexpired ones are counted as hits
+func (c DomainCache) GetStale(scope, domain string, qtype uint16) (cell *DomainCacheCell, stale bool, ok bool) {
+	key := scopedCacheKey(scope, domaincacheKey(domain, qtype))
+	v, ok := c.inner.Get(key)
+	if ok {
+		cell = v.(*DomainCacheCell)
+		stale = cell.expired(time.Now())
+	}
+	c.meta.count(ok && !stale)
+	if !ok {
+		return nil, false, false
+	}
+	c.meta.touch(key)
+	return cell, stale, true
+}
+
+// cached answers and routing decision of a domain, see DomainCache.Items
+type DomainCacheEntry struct {
+	Scope      string    `json:"scope,omitempty"`
+	Domain     string    `json:"domain"`
+	Qtype      string    `json:"qtype"`
+	Answers    []string  `json:"answers"` // RRs in zone file format with the remaining TTLs
+	Trans      Transport `json:"trans"`
+	Outbound   string    `json:"outbound,omitempty"`
+	Expiration time.Time `json:"expiration"` // zero if never expires
+}
+
+// delete the `qtype` answer of `domain` cached for clients in `scope`,
+// which is neither counted as evicted nor passed to the OnEvicted hook
+func (c DomainCache) Delete(scope, domain string, qtype uint16) {
+	c.meta.delete(c.inner, scopedCacheKey(scope, domaincacheKey(domain, qtype)))
+}
+
+// number of items, including expired ones not cleaned up yet and those kept to be served stale
+func (c DomainCache) Len() int {
+	return c.inner.ItemCount()
+}
+
+// call `f` with each unexpired item in no particular order until it returns false, without those kept to be served stale,
+// `f` works on a snapshot and may modify the cache
+func (c DomainCache) Iterate(f func(DomainCacheEntry) bool) {
+	now := time.Now()
+	for key, item := range c.inner.Items() {
+		scope, key := splitScopedCacheKey(key)
+		domain, qtype, ok := splitDomaincacheKey(key)
+		if !ok {
+			continue
+		}
+		cell := item.Object.(*DomainCacheCell)
+		if cell.expired(now) {
+			continue
+		}
+		var answers []string
+		for _, ans := range cell.Answers() {
+			answers = append(answers, ans.String())
+		}
+		entry := DomainCacheEntry{
+			Scope:      scope,
+			Domain:     domain,
+			Qtype:      dns.TypeToString[qtype],
+			Answers:    answers,
+			Trans:      cell.trans,
+			Outbound:   cell.outbound,
+			Expiration: cell.expires,
+		}
+		if !f(entry) {
+			return
+		}
+	}
+}
+
+// all unexpired items, without those kept to be served stale
+func (c DomainCache) Items() []DomainCacheEntry {
+	entries := make([]DomainCacheEntry, 0, c.inner.ItemCount())
+	c.Iterate(func(entry DomainCacheEntry) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	return entries
+}
+
+func (c DomainCache) Stats() CacheStats {
+	return c.meta.stats(c.inner)
+}
+
+// delete all items
+func (c DomainCache) Flush() {
+	c.meta.flush(c.inner)
+	c.reverse.Flush()
+}
+
+// expiration of go-cache items in UnixNano, zero time if never expires
+func expirationTime(expiration int64) time.Time {
+	if expiration <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, expiration)
+}
+
+// reverse of expirationTime
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// key of DomainCache items, such as "example.com/28"
+func domaincacheKey(domain string, qtype uint16) string {
+	return domain + "/" + strconv.Itoa(int(qtype))
+}
+
+// reverse of domaincacheKey
+func splitDomaincacheKey(key string) (domain string, qtype uint16, ok bool) {
+	i := strings.LastIndexByte(key, '/')
+	if i < 0 {
+		return "", 0, false
+	}
+	n, err := strconv.ParseUint(key[i+1:], 10, 16)
+	if err != nil {
+		return "", 0, false
+	}
+	return key[:i], uint16(n), true
+}
+
+// key of items cached for clients in `scope`, such as "1,3@example.com/28",
+// items of the empty scope are shared by all clients, see ClientScoper
+func scopedCacheKey(scope, key string) string {
+	if scope == "" {
+		return key
+	}
+	return scope + "@" + key
+}
+
+// reverse of scopedCacheKey
+func splitScopedCacheKey(key string) (scope, _key string) {
+	if i := strings.IndexByte(key, '@'); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
 }
 
-type transport int8
+type Transport int8
 
 const (
-	_TRANS_DIRECT transport = iota
-	_TRANS_PROXY
+	TRANS_DIRECT Transport = iota
+	TRANS_PROXY
+	TRANS_REJECT // blackholed, dns queries are answered with NXDOMAIN and proxy requests are refused
 )
@@ -0,0 +1,155 @@
+package dnsproxy
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+)
+
+// on-disk representation of IPCache and DomainCache
+type cacheSnapshot struct {
+	IPs     []ipcacheSnapshotItem
+	Domains []domaincacheSnapshotItem
+}
+
+type ipcacheSnapshotItem struct {
+	Scope      string
+	IP         string
+	Trans      Transport
+	Outbound   string
+	Expiration int64 // UnixNano, 0 if never expires
+}
+
+type domaincacheSnapshotItem struct {
+	Scope      string
+	Domain     string
+	Qtype      uint16
+	Answers    []string // RRs in zone file format
+	Trans      Transport
+	Outbound   string
+	Stored     int64 // UnixNano
+	Expiration int64 // UnixNano, 0 if never expires
+}
+
+// save IPCache and DomainCache into file `fpath`
+func SaveCaches(fpath string, ipc IPCache, domainc DomainCache) error {
+	var snap cacheSnapshot
+	for key, item := range ipc.inner.Items() {
+		scope, ip := splitScopedCacheKey(key)
+		v := item.Object.(ipcacheItem)
+		snap.IPs = append(snap.IPs, ipcacheSnapshotItem{
+			Scope:      scope,
+			IP:         ip,
+			Trans:      v.trans,
+			Outbound:   v.outbound,
+			Expiration: item.Expiration,
+		})
+	}
+	for key, item := range domainc.inner.Items() {
+		scope, key := splitScopedCacheKey(key)
+		domain, qtype, ok := splitDomaincacheKey(key)
+		if !ok {
+			continue
+		}
+		cell := item.Object.(*DomainCacheCell)
+		answers := make([]string, len(cell.answers))
+		for i, ans := range cell.answers {
+			answers[i] = ans.String()
+		}
+		snap.Domains = append(snap.Domains, domaincacheSnapshotItem{
+			Scope:      scope,
+			Domain:     domain,
+			Qtype:      qtype,
+			Answers:    answers,
+			Trans:      cell.trans,
+			Outbound:   cell.outbound,
+			Stored:     cell.stored.UnixNano(),
+			Expiration: unixNano(cell.expires),
+		})
+	}
+
+	// write to a temp file then rename, so that a crash won't leave a broken snapshot
+	tmp, err := os.Create(fpath + ".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = gob.NewEncoder(tmp).Encode(&snap); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), fpath))
+}
+
+// load IPCache and DomainCache from file `fpath` which is saved by SaveCaches,
+// expired items are dropped unless they can still be served stale, it's not an error if `fpath` does not exist
+func LoadCaches(fpath string, ipc IPCache, domainc DomainCache) error {
+	file, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	var snap cacheSnapshot
+	if err = gob.NewDecoder(file).Decode(&snap); err != nil {
+		return errors.Wrapf(err, "decode cache snapshot %s", filepath.Base(fpath))
+	}
+
+	now := time.Now()
+	for _, item := range snap.IPs {
+		if d, ok := snapshotRemaining(now, item.Expiration); ok {
+			ipc.meta.put(ipc.inner, scopedCacheKey(item.Scope, item.IP), ipcacheItem{item.Trans, item.Outbound}, d, true)
+		}
+	}
+	for _, item := range snap.Domains {
+		// expired items are kept as long as they can be served stale
+		_, ok := snapshotRemaining(now.Add(-domainc.meta.stale), item.Expiration)
+		if !ok || item.Qtype == 0 { // Qtype is missing in snapshots of old versions
+			continue
+		}
+		answers := make([]dns.RR, 0, len(item.Answers))
+		for _, s := range item.Answers {
+			if ans, err := dns.NewRR(s); err == nil && ans != nil {
+				answers = append(answers, ans)
+			}
+		}
+		if len(answers) == 0 {
+			continue
+		}
+		cell := newDomainCacheCell(answers, item.Trans, item.Outbound, time.Unix(0, item.Stored))
+		cell.expires = expirationTime(item.Expiration)
+		domainc.put(scopedCacheKey(item.Scope, domaincacheKey(item.Domain, item.Qtype)), cell, true)
+	}
+	return nil
+}
+
+// periodically save caches into file `fpath`, never returns
+func PersistCaches(fpath string, interval time.Duration, ipc IPCache, domainc DomainCache) {
+	for range time.Tick(interval) {
+		if err := SaveCaches(fpath, ipc, domainc); err != nil {
+			glog.Warningf("persist caches: %s\n", err)
+		}
+	}
+}
+
+// remaining lifetime of a snapshot item, false if it has been expired
+func snapshotRemaining(now time.Time, expiration int64) (time.Duration, bool) {
+	if expiration <= 0 {
+		return cache.NoExpiration, true
+	}
+	d := time.Unix(0, expiration).Sub(now)
+	return d, d > 0
+}
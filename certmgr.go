@@ -0,0 +1,282 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// ALPN protocol of tls-alpn-01 challenges (RFC 8737)
+const _ACME_TLS_ALPN_PROTO = "acme-tls/1"
+
+// id-pe-acmeIdentifier, the extension of tls-alpn-01 challenge certificates
+var _OID_ACME_IDENTIFIER = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+const (
+	_CERT_RENEW_BEFORE   = 30 * 24 * time.Hour // ACME certificates are renewed this long before they expire
+	_CERT_CHECK_INTERVAL = 12 * time.Hour      // of ACME certificates to be renewed
+	_CERT_RETRY_INTERVAL = time.Hour           // after failing to obtain an ACME certificate
+	_CERT_OBTAIN_TIMEOUT = 10 * time.Minute
+	_CERT_WATCH_INTERVAL = time.Minute // of modifications of static certificate files
+)
+
+// certificates of tls listeners such as ServeDoH, shared by all of them,
+// either loaded from static files which are reloaded when modified, or obtained and renewed from an ACME CA,
+// Run must be running to reload or renew them
+//
+// safe for concurrent use
+type CertManager struct {
+	cert atomic.Value // *tls.Certificate, nil before obtained from the ACME CA
+
+	// static
+	certFile, keyFile string
+	modTime           time.Time
+
+	// acme, nil if static
+	acme       *ACMEConfig
+	mu         sync.Mutex
+	challenges map[string]*tls.Certificate // tls-alpn-01 certificates by domain
+}
+
+// --- impl *CertManager
+
+// certificates of `certFile` and `keyFile` in PEM
+func NewStaticCertManager(certFile, keyFile string) (*CertManager, error) {
+	m := &CertManager{certFile: certFile, keyFile: keyFile}
+	if err := m.loadStatic(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// certificates obtained from an ACME CA by Run, the cached certificate is used until then if there is one,
+// the terms of service of the CA are agreed
+func NewACMECertManager(conf ACMEConfig) (*CertManager, error) {
+	if len(conf.Domains) == 0 {
+		return nil, errors.New("acme: no domain of the certificate")
+	}
+	switch conf.Challenge {
+	case ACME_CHALLENGE_TLS_ALPN:
+	case ACME_CHALLENGE_DNS:
+		if conf.DNSHook == "" {
+			return nil, errors.New("acme: dns hook is required by dns-01 challenges")
+		}
+	default:
+		return nil, errors.Errorf("acme: unsupported challenge %q, should be %s or %s",
+			conf.Challenge, ACME_CHALLENGE_TLS_ALPN, ACME_CHALLENGE_DNS)
+	}
+	if err := os.MkdirAll(conf.CacheDir, 0700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	m := &CertManager{acme: &conf, challenges: make(map[string]*tls.Certificate)}
+	certFile, keyFile := m.acmeCachePaths()
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil && m.covers(&cert) {
+		m.cert.Store(&cert)
+	}
+	return m, nil
+}
+
+// tls config of listeners serving the certificates and answering tls-alpn-01 challenges
+func (m *CertManager) TLSConfig() *tls.Config {
+	conf := &tls.Config{GetCertificate: m.GetCertificate, NextProtos: []string{"h2", "http/1.1"}}
+	if m.acme != nil && m.acme.Challenge == ACME_CHALLENGE_TLS_ALPN {
+		conf.NextProtos = append(conf.NextProtos, _ACME_TLS_ALPN_PROTO)
+	}
+	return conf
+}
+
+// for tls.Config.GetCertificate
+func (m *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == _ACME_TLS_ALPN_PROTO {
+		m.mu.Lock()
+		cert, ok := m.challenges[strings.ToLower(hello.ServerName)]
+		m.mu.Unlock()
+		if !ok {
+			return nil, errors.Errorf("no acme challenge of %q", hello.ServerName)
+		}
+		return cert, nil
+	}
+	cert, _ := m.cert.Load().(*tls.Certificate)
+	if cert == nil {
+		return nil, errors.New("certificate is not obtained yet")
+	}
+	return cert, nil
+}
+
+// reload static certificates when modified, or obtain ACME certificates and renew them before they expire,
+// never returns
+func (m *CertManager) Run() {
+	if m.acme == nil {
+		for range time.Tick(_CERT_WATCH_INTERVAL) {
+			if info, err := os.Stat(m.certFile); err != nil || !info.ModTime().After(m.modTime) {
+				continue
+			}
+			if err := m.loadStatic(); err != nil {
+				glog.Warningf("reload certificate: %s, keep using the old one\n", err)
+				continue
+			}
+			glog.Infoln("certificate reloaded")
+		}
+	}
+	for {
+		if !m.needsRenewal() {
+			time.Sleep(_CERT_CHECK_INTERVAL)
+			continue
+		}
+		if err := m.obtain(); err != nil {
+			glog.Warningf("obtain certificate of %s: %s\n", strings.Join(m.acme.Domains, ", "), err)
+			time.Sleep(_CERT_RETRY_INTERVAL)
+			continue
+		}
+		glog.Infof("certificate of %s obtained\n", strings.Join(m.acme.Domains, ", "))
+	}
+}
+
+func (m *CertManager) loadStatic() error {
+	info, err := os.Stat(m.certFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	cert, err := tls.LoadX509KeyPair(m.certFile, m.keyFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	m.modTime = info.ModTime()
+	m.cert.Store(&cert)
+	return nil
+}
+
+// check if there is no ACME certificate or it expires soon
+func (m *CertManager) needsRenewal() bool {
+	cert, _ := m.cert.Load().(*tls.Certificate)
+	if cert == nil {
+		return true
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	return err != nil || time.Until(leaf.NotAfter) < _CERT_RENEW_BEFORE
+}
+
+// check if `cert` is valid for all domains of the ACME config
+func (m *CertManager) covers(cert *tls.Certificate) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	for _, domain := range m.acme.Domains {
+		if leaf.VerifyHostname(strings.Replace(domain, "*", "wildcard", 1)) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// obtain a certificate from the ACME CA, then use and cache it
+func (m *CertManager) obtain() error {
+	key, err := m.accountKey()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), _CERT_OBTAIN_TIMEOUT)
+	defer cancel()
+	var solver acmeSolver = m
+	if m.acme.Challenge == ACME_CHALLENGE_DNS {
+		solver = acmeDNSHook(m.acme.DNSHook)
+	}
+	certPEM, keyPEM, err := newACMEClient(m.acme, key).obtain(ctx, solver)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	m.cert.Store(&cert)
+
+	certFile, keyFile := m.acmeCachePaths()
+	if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err == nil {
+		err = ioutil.WriteFile(certFile, certPEM, 0644)
+	}
+	return errors.WithStack(err)
+}
+
+// paths of the cached certificate and its key
+func (m *CertManager) acmeCachePaths() (certFile, keyFile string) {
+	return filepath.Join(m.acme.CacheDir, "cert.pem"), filepath.Join(m.acme.CacheDir, "key.pem")
+}
+
+// the cached ACME account key, generated if there is none
+func (m *CertManager) accountKey() (*ecdsa.PrivateKey, error) {
+	fpath := filepath.Join(m.acme.CacheDir, "account.pem")
+	if b, err := ioutil.ReadFile(fpath); err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, errors.Errorf("invalid acme account key %s", fpath)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		return key, errors.Wrap(err, fpath)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = ioutil.WriteFile(fpath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	return key, errors.WithStack(err)
+}
+
+// --- impl acmeSolver for *CertManager, which answers tls-alpn-01 challenges
+
+func (m *CertManager) present(ctx context.Context, domain, keyAuth string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	digest := sha256.Sum256([]byte(keyAuth))
+	ext, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: domain},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		DNSNames:        []string{domain},
+		ExtraExtensions: []pkix.Extension{{Id: _OID_ACME_IDENTIFIER, Critical: true, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	m.mu.Lock()
+	m.challenges[strings.ToLower(domain)] = &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *CertManager) cleanup(domain, keyAuth string) {
+	m.mu.Lock()
+	delete(m.challenges, strings.ToLower(domain))
+	m.mu.Unlock()
+}
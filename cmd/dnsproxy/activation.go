@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ###################
+//  Socket Activation
+// ###################
+
+// first file descriptor passed by systemd, see sd_listen_fds(3)
+const _LISTEN_FDS_START = 3
+
+// sockets passed by systemd socket activation, in place of binding [dns].listen and [proxy].listen
+type activatedSockets struct {
+	dnsPacketConns []net.PacketConn
+	dnsListeners   []net.Listener
+	proxyListeners []net.Listener
+}
+
+// sockets passed by LISTEN_FDS, nil if dnsproxy is not socket activated,
+// sockets named "dns" or "proxy" by FileDescriptorName= of the socket unit are served as named,
+// otherwise datagram sockets are served as dns, and stream sockets are served as dns if their ports are
+// the ports of [dns].listen, as proxy if not
+func listenActivatedSockets(conf *configRepr) (*activatedSockets, error) {
+	defer func() {
+		// not to be inherited by child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	dnsPorts := make(map[string]bool)
+	for _, addr := range conf.DNS.Listen {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			dnsPorts[port] = true
+		}
+	}
+	sockets := new(activatedSockets)
+	for i := 0; i < n; i++ {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		fd := uintptr(_LISTEN_FDS_START + i)
+		if err := sockets.add(os.NewFile(fd, name), name, dnsPorts); err != nil {
+			sockets.close()
+			return nil, errors.WithMessage(err, "socket activation: fd "+strconv.Itoa(int(fd)))
+		}
+	}
+	return sockets, nil
+}
+
+// --- impl *activatedSockets
+
+// add the socket `f` named `name`, which is closed after being duplicated
+func (a *activatedSockets) add(f *os.File, name string, dnsPorts map[string]bool) error {
+	defer f.Close()
+	if l, err := net.FileListener(f); err == nil {
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		switch {
+		case name == "dns", name != "proxy" && dnsPorts[port]:
+			a.dnsListeners = append(a.dnsListeners, l)
+		default:
+			a.proxyListeners = append(a.proxyListeners, l)
+		}
+		return nil
+	}
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return errors.Errorf("%s is neither a stream nor a datagram socket", f.Name())
+	}
+	if name == "proxy" {
+		pc.Close()
+		return errors.New("datagram socket can't be served as proxy")
+	}
+	a.dnsPacketConns = append(a.dnsPacketConns, pc)
+	return nil
+}
+
+func (a *activatedSockets) close() {
+	for _, pc := range a.dnsPacketConns {
+		pc.Close()
+	}
+	for _, l := range a.dnsListeners {
+		l.Close()
+	}
+	for _, l := range a.proxyListeners {
+		l.Close()
+	}
+}
+
+// check if any dns socket is passed
+func (a *activatedSockets) hasDNS() bool {
+	return a != nil && (len(a.dnsPacketConns) > 0 || len(a.dnsListeners) > 0)
+}
+
+// check if any proxy socket is passed
+func (a *activatedSockets) hasProxy() bool {
+	return a != nil && len(a.proxyListeners) > 0
+}
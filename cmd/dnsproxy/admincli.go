@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// ###################
+//  Admin Subcommands
+// ###################
+
+const _ADMIN_CLI_USAGE = `usage:
+  dnsproxy cache flush [flags]          drop all cached items of the running dnsproxy
+  dnsproxy cache stats [flags]          print cache counters and sizes of the running dnsproxy
+  dnsproxy cache export [flags]         print learned routing decisions, for [cache].import_decisions of other instances
+  dnsproxy query [flags] <domain|ip>    print the routing decision of a domain or an ip`
+
+// handle `dnsproxy cache flush|stats|export` and `dnsproxy query <domain|ip>` by the admin api of a running dnsproxy,
+// which is found by [admin].listen of the config file unless -admin is given
+func adminCommand(args []string) error {
+	fs := flag.NewFlagSet("dnsproxy "+args[0], flag.ContinueOnError)
+	configFile := fs.String("c", "./config.toml", "path of config file, whose [admin].listen is used")
+	admin := fs.String("admin", "", "address of the admin api, in place of [admin].listen")
+	client := fs.String("client", "", "client ip, decides client rules of query")
+	listener := fs.String("listener", "", "tag of the dns listener, decides listener rules of query")
+	fs.Usage = func() {
+		io.WriteString(os.Stderr, _ADMIN_CLI_USAGE+"\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+
+	var method, path string
+	q := make(url.Values)
+	switch {
+	case args[0] == "cache" && len(args) > 1 && args[1] == "flush":
+		method, path = http.MethodPost, "/cache/flush"
+		args = args[2:]
+	case args[0] == "cache" && len(args) > 1 && args[1] == "stats":
+		method, path = http.MethodGet, "/cache/stats"
+		args = args[2:]
+	case args[0] == "cache" && len(args) > 1 && args[1] == "export":
+		method, path = http.MethodGet, "/cache/decisions"
+		args = args[2:]
+	case args[0] == "query":
+		method, path = http.MethodGet, "/route"
+		args = args[1:]
+	default:
+		fs.Usage()
+		return errors.New("unknown subcommand")
+	}
+	if err := fs.Parse(args); err != nil {
+		return errors.WithStack(err)
+	}
+	if path == "/route" {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return errors.New("query requires exactly one domain or ip")
+		}
+		if ip := net.ParseIP(fs.Arg(0)); ip != nil {
+			q.Set("ip", ip.String())
+		} else {
+			q.Set("domain", fs.Arg(0))
+		}
+		if *client != "" {
+			q.Set("client", *client)
+		}
+		if *listener != "" {
+			q.Set("listener", *listener)
+		}
+	} else if fs.NArg() > 0 {
+		fs.Usage()
+		return errors.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	addr := *admin
+	if addr == "" {
+		var err error
+		if addr, err = adminListenAddr(*configFile); err != nil {
+			return err
+		}
+	}
+	u := url.URL{Scheme: "http", Host: addr, Path: path, RawQuery: q.Encode()}
+	return callAdmin(method, u.String(), os.Stdout)
+}
+
+// address to reach [admin].listen of config file `fpath` on this host
+func adminListenAddr(fpath string) (string, error) {
+	var conf struct {
+		Admin struct {
+			Listen string `toml:"listen"`
+		} `toml:"admin"`
+	}
+	if _, err := toml.DecodeFile(fpath, &conf); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if v := os.Getenv("DNSPROXY_ADMIN_LISTEN"); v != "" {
+		conf.Admin.Listen = v
+	}
+	if conf.Admin.Listen == "" {
+		return "", errors.Errorf("%s: [admin].listen is empty, the admin api is not enabled", fpath)
+	}
+	host, port, err := net.SplitHostPort(conf.Admin.Listen)
+	if err != nil {
+		return "", errors.Errorf("%s: invalid [admin].listen %q", fpath, conf.Admin.Listen)
+	}
+	// listening on all interfaces
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// request the admin api and copy the json response to `w`
+func callAdmin(method, rawurl string, w io.Writer) error {
+	req, err := http.NewRequest(method, rawurl, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	c := &http.Client{Timeout: 10 * time.Second}
+	resp, err := c.Do(req)
+	if err != nil {
+		return errors.WithMessage(err, "is dnsproxy running with the admin api enabled?")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return errors.Errorf("admin api: %s", resp.Status)
+	}
+	_, err = w.Write(body)
+	return errors.WithStack(err)
+}
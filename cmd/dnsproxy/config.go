@@ -1,14 +1,24 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ARwMq9b6/dnsproxy"
 	"github.com/ARwMq9b6/libgost"
 	"github.com/BurntSushi/toml"
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 	"golang.org/x/net/proxy"
 )
@@ -19,158 +29,1447 @@ import (
 //  Config File
 // ############
 type configRepr struct {
-	GfwList     string `toml:"gfw_list"`
-	ChinaList   string `toml:"china_list"`
-	ChinaIPList string `toml:"china_ip_list"`
-	DNS         struct {
-		Listen   string `toml:"listen"`
-		Obedient struct {
-			Nameserver string `toml:"nameserver"`
-			Net        string `toml:"net"`
+	GfwList       fileList `toml:"gfw_list"`
+	GfwDomains    []string `toml:"gfw_domains"`
+	ChinaList     fileList `toml:"china_list"`
+	ChinaDomains  []string `toml:"china_domains"`
+	ChinaIPList   string   `toml:"china_ip_list"`
+	ChinaIPv6List string   `toml:"china_ipv6_list"`
+	GeoIP         string   `toml:"geoip"`
+	GeoIPDirect   []string `toml:"geoip_direct_countries"`
+	WatchInterval duration `toml:"watch_interval"`
+	Update        struct {
+		Interval         duration `toml:"interval"`
+		GfwListURL       string   `toml:"gfw_list_url"`
+		ChinaListURL     string   `toml:"china_list_url"`
+		ChinaIPListURL   string   `toml:"china_ip_list_url"`
+		ChinaIPv6ListURL string   `toml:"china_ipv6_list_url"`
+		UseProxy         bool     `toml:"use_proxy"`
+	} `toml:"update"`
+	Timeouts struct {
+		DNSUpstream duration `toml:"dns_upstream"`
+		ProxyDial   duration `toml:"proxy_dial"`
+		RelayIdle   duration `toml:"relay_idle"`
+		KeepAlive   duration `toml:"keepalive"`
+	} `toml:"timeouts"`
+	Bind struct {
+		Direct      bindRepr `toml:"direct"`
+		Proxy       bindRepr `toml:"proxy"`
+		ObedientDNS bindRepr `toml:"obedient_dns"`
+		AbroadDNS   bindRepr `toml:"abroad_dns"`
+	} `toml:"bind"`
+	DNS           struct {
+		Listen       addrList          `toml:"listen"`
+		QueryTimeout duration          `toml:"query_timeout"`
+		Bootstrap    []string          `toml:"bootstrap"`
+		DNS64        bool              `toml:"dns64"`
+		DNS64Prefix  string            `toml:"dns64_prefix"`
+		RejectZeroIP bool              `toml:"reject_with_zero_ip"`
+		ListenTags   map[string]string `toml:"listen_tags"`
+		MinTTL       duration          `toml:"min_ttl"`
+		MaxTTL       duration          `toml:"max_ttl"`
+		Obedient     struct {
+			Nameserver    string   `toml:"nameserver"`
+			Nameservers   []string `toml:"nameservers"`
+			Weights       []int    `toml:"weights"`
+			Secondary     []string `toml:"secondary_nameservers"`
+			Timeout       duration `toml:"timeout"`
+			Strategy      string   `toml:"strategy"`
+			ProbeInterval duration `toml:"probe_interval"`
+			Net           string   `toml:"net"`
+			DNSSEC        bool     `toml:"dnssec"`
+			UDPHardening  bool     `toml:"udp_hardening"`
+			FakeIPs       []string `toml:"fake_ips"`
 		} `toml:"obedient"`
 		Abroad struct {
-			EnableDNSOverHTTPS bool   `toml:"enable_dns_over_https"`
-			Nameserver         string `toml:"nameserver"`
-			Proxy              string `toml:"proxy"`
+			EnableDNSOverHTTPS bool     `toml:"enable_dns_over_https"`
+			DoHProvider        string   `toml:"doh_provider"`
+			DoHFormat          string   `toml:"doh_format"`
+			DoHIPs             []string `toml:"doh_ips"`
+			DoHMaxConns        int      `toml:"doh_max_conns"`
+			Nameserver         string   `toml:"nameserver"`
+			Nameservers        []string `toml:"nameservers"`
+			Weights            []int    `toml:"weights"`
+			Timeout            duration `toml:"timeout"`
+			Strategy           string   `toml:"strategy"`
+			ProbeInterval      duration `toml:"probe_interval"`
+			Net                string   `toml:"net"`
+			Proxy              string   `toml:"proxy"`
+			DNSSEC             bool     `toml:"dnssec"`
+			RetryAttempts      int      `toml:"retry_attempts"`
+			RetryBackoff       duration `toml:"retry_backoff"`
+			RetryJitter        float64  `toml:"retry_jitter"`
+			HedgeDelay         duration `toml:"hedge_delay"`
 		} `toml:"abroad"`
+		DoH struct {
+			Listen   string `toml:"listen"`
+			CertFile string `toml:"cert_file"`
+			KeyFile  string `toml:"key_file"`
+			JSONAPI  bool   `toml:"json_api"`
+		} `toml:"doh"`
+		Limit struct {
+			AllowClients []string `toml:"allow_clients"`
+			ClientQPS    int      `toml:"client_qps"`
+			ClientBurst  int      `toml:"client_burst"`
+			RRLRPS       int      `toml:"rrl_rps"`
+			RRLSlip      int      `toml:"rrl_slip"`
+		} `toml:"limit"`
+		DNSTap struct {
+			Address  string `toml:"address"`
+			Identity string `toml:"identity"`
+		} `toml:"dnstap"`
 	} `toml:"dns"`
 	Proxy struct {
-		Listen                string `toml:"listen"`
-		ProxyServer           string `toml:"proxy_server"`
-		ProxyServerExternalIP string `toml:"proxy_server_external_ip"`
+		Listen                addrList        `toml:"listen"`
+		ProxyServer           string          `toml:"proxy_server"`
+		ProxyServers          []string        `toml:"proxy_servers"`
+		Chain                 []proxyNodeRepr `toml:"chain"`
+		Strategy              string          `toml:"strategy"`
+		ProbeAddr             string          `toml:"probe_addr"`
+		ProbeInterval         duration        `toml:"probe_interval"`
+		ProxyServerExternalIP string          `toml:"proxy_server_external_ip"`
+		PreserveHostname      bool            `toml:"preserve_hostname"`
+		SniffSNI              bool            `toml:"sniff_sni"`
+		SpeculativeProxy      bool            `toml:"speculative_proxy"`
+		AllowClients          []string        `toml:"allow_clients"`
+		Users                 []string        `toml:"users"`
+		Listeners             int             `toml:"listeners"`
+		TCPFastOpen           bool            `toml:"tcp_fast_open"`
+		HappyEyeballs         bool            `toml:"happy_eyeballs"`
+		HappyEyeballsDelay    duration        `toml:"happy_eyeballs_delay"`
+		RaceProxyDelay        duration        `toml:"race_proxy_delay"`
+		DirectFallback        bool            `toml:"direct_fallback"`
+		DirectFallbackTimeout duration        `toml:"direct_fallback_timeout"`
+		DirectFallbackTTL     duration        `toml:"direct_fallback_ttl"`
+		MaxConns              int             `toml:"max_conns"`
+		ConnBandwidth         int             `toml:"conn_bandwidth"`
+		TotalBandwidth        int             `toml:"total_bandwidth"`
+		IdleTimeout           duration        `toml:"idle_timeout"`
+		MaxLifetime           duration        `toml:"max_lifetime"`
+		RelayBufferSize       int             `toml:"relay_buffer_size"`
+		Shadowsocks           struct {
+			Listen   string `toml:"listen"`
+			Method   string `toml:"method"`
+			Password string `toml:"password"`
+		} `toml:"shadowsocks"`
 	} `toml:"proxy"`
+	TLS struct {
+		CertFile string `toml:"cert_file"`
+		KeyFile  string `toml:"key_file"`
+		ACME     struct {
+			Domains   []string `toml:"domains"`
+			Email     string   `toml:"email"`
+			Directory string   `toml:"directory"`
+			Challenge string   `toml:"challenge"`
+			DNSHook   string   `toml:"dns_hook"`
+			CacheDir  string   `toml:"cache_dir"`
+		} `toml:"acme"`
+	} `toml:"tls"`
+	Admin struct {
+		Listen    string `toml:"listen"`
+		Dashboard bool   `toml:"dashboard"`
+	} `toml:"admin"`
+	Log struct {
+		Dir          string   `toml:"dir"`
+		MaxSize      int      `toml:"max_size"`
+		MaxFiles     int      `toml:"max_files"`
+		LatencyStats duration `toml:"latency_stats"`
+	} `toml:"log"`
+	Cache struct {
+		MinTTL           duration `toml:"min_ttl"`
+		MaxTTL           duration `toml:"max_ttl"`
+		PersistFile      string   `toml:"persist_file"`
+		PersistInterval  duration `toml:"persist_interval"`
+		Policy           string   `toml:"policy"`
+		PrefetchMinHits  int      `toml:"prefetch_min_hits"`
+		PrefetchInterval duration `toml:"prefetch_interval"`
+		WarmUp           []string `toml:"warm_up"`
+		IPMaxEntries     int      `toml:"ip_max_entries"`
+		DomainMaxEntries int      `toml:"domain_max_entries"`
+		ServeStale       duration `toml:"serve_stale"`
+		ImportDecisions  string   `toml:"import_decisions"`
+	} `toml:"cache"`
+	Override struct {
+		Block     []string            `toml:"block"`
+		HostsFile string              `toml:"hosts_file"`
+		Hosts     map[string][]string `toml:"hosts"`
+	} `toml:"override"`
+	DHCPLeases struct {
+		Files  []string `toml:"files"`
+		Domain string   `toml:"domain"`
+	} `toml:"dhcp_leases"`
+	DomainRules struct {
+		Direct []string `toml:"direct"`
+		Proxy  []string `toml:"proxy"`
+		Reject []string `toml:"reject"`
+	} `toml:"domain_rules"`
+	Zones []struct {
+		Origin  string   `toml:"origin"`
+		File    string   `toml:"file"`
+		Records []string `toml:"records"`
+	} `toml:"zone"`
+	Rewrites []struct {
+		From    []string `toml:"from"`
+		To      string   `toml:"to"`
+		Domains []string `toml:"domains"`
+		Direct  bool     `toml:"direct"`
+	} `toml:"rewrite"`
+	Outbounds map[string]struct {
+		ProxyServers []string `toml:"proxy_servers"`
+		Strategy     string   `toml:"strategy"`
+	} `toml:"outbounds"`
+	Resolvers map[string]struct {
+		Nameserver  string   `toml:"nameserver"`
+		Nameservers []string `toml:"nameservers"`
+		Weights     []int    `toml:"weights"`
+		Timeout     duration `toml:"timeout"`
+		Strategy    string   `toml:"strategy"`
+		Net         string   `toml:"net"`
+	} `toml:"resolvers"`
+	DomainResolvers map[string]string `toml:"domain_resolvers"`
+	Rules []struct {
+		Match    []string `toml:"match"`
+		Action   string   `toml:"action"`
+		Outbound string   `toml:"outbound"`
+		Resolver string   `toml:"resolver"`
+	} `toml:"rule"`
 }
 
-func newConfigRepr(fpath string) (*configRepr, error) {
+// time.Duration which can be decoded from a toml string such as "5m"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) (err error) {
+	if len(text) == 0 {
+		d.Duration = 0
+		return nil
+	}
+	d.Duration, err = time.ParseDuration(string(text))
+	return errors.WithStack(err)
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// a single file or a list of files such as ["./gfw_domain_list.txt", "./my_gfw_list.txt"], empty paths are dropped
+type fileList []string
+
+func (l *fileList) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*l = nil
+		if v != "" {
+			*l = fileList{v}
+		}
+	case []interface{}:
+		*l = make(fileList, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return errors.Errorf("file %v is not a string", item)
+			}
+			if s != "" {
+				*l = append(*l, s)
+			}
+		}
+	default:
+		return errors.Errorf("files %v are neither a string nor a list", v)
+	}
+	return nil
+}
+
+// the file lists downloaded by [update] are saved as, empty if there is no file
+func (l fileList) first() string {
+	if len(l) == 0 {
+		return ""
+	}
+	return l[0]
+}
+
+// a single address or a list of addresses such as ["127.0.0.1:53", "[::1]:53"]
+type addrList []string
+
+func (l *addrList) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*l = addrList{v}
+	case []interface{}:
+		*l = make(addrList, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return errors.Errorf("address %v is not a string", item)
+			}
+			*l = append(*l, s)
+		}
+	default:
+		return errors.Errorf("addresses %v are neither a string nor a list", v)
+	}
+	return nil
+}
+
+// decode config file `fpath`, apply `overrides` if not nil, then fill defaults and validate
+func newConfigRepr(fpath string, overrides *configOverrides) (*configRepr, error) {
 	var conf configRepr
-	_, err := toml.DecodeFile(fpath, &conf)
+	md, err := toml.DecodeFile(fpath, &conf)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	// most likely typos
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return nil, errors.Errorf("config.toml: unknown key %s", keys[0])
+	}
+	if overrides != nil {
+		if err := overrides.apply(&conf); err != nil {
+			return nil, err
+		}
+	}
+	conf.setDefaults()
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
 	return &conf, nil
 }
 
-// ###############
-//  Domain Matcher
-// ###############
-type domainMatch struct {
-	chineseList []string
-	gfwList     []string
+// fill optional fields which are left empty
+func (conf *configRepr) setDefaults() {
+	if conf.DNS.Obedient.Strategy == "" {
+		conf.DNS.Obedient.Strategy = "race"
+	}
+	if conf.DNS.Abroad.Strategy == "" {
+		conf.DNS.Abroad.Strategy = "race"
+	}
+	if conf.DNS.Obedient.ProbeInterval.Duration == 0 {
+		conf.DNS.Obedient.ProbeInterval.Duration = time.Minute
+	}
+	if conf.DNS.Abroad.ProbeInterval.Duration == 0 {
+		conf.DNS.Abroad.ProbeInterval.Duration = time.Minute
+	}
+	if conf.Proxy.Strategy == "" {
+		conf.Proxy.Strategy = "failover"
+	}
+	if conf.DNS.Obedient.Net == "" {
+		conf.DNS.Obedient.Net = "udp"
+	}
+	if conf.DNS.Abroad.Net == "" {
+		conf.DNS.Abroad.Net = "tcp"
+	}
+	if conf.DNS.Abroad.DoHProvider == "" {
+		conf.DNS.Abroad.DoHProvider = "google"
+	}
+	if len(conf.TLS.ACME.Domains) > 0 {
+		if conf.TLS.ACME.Challenge == "" {
+			conf.TLS.ACME.Challenge = dnsproxy.ACME_CHALLENGE_TLS_ALPN
+		}
+		if conf.TLS.ACME.CacheDir == "" {
+			conf.TLS.ACME.CacheDir = "./acme"
+		}
+	}
+	if conf.GeoIP != "" && len(conf.GeoIPDirect) == 0 {
+		conf.GeoIPDirect = []string{"CN"}
+	}
+	if conf.DNS.QueryTimeout.Duration == 0 {
+		conf.DNS.QueryTimeout.Duration = dnsproxy.DNS_QUERY_TIMEOUT
+	}
+	if conf.Timeouts.DNSUpstream.Duration == 0 {
+		conf.Timeouts.DNSUpstream.Duration = dnsproxy.DNS_UPSTREAM_TIMEOUT
+	}
+	if conf.Timeouts.ProxyDial.Duration == 0 {
+		conf.Timeouts.ProxyDial.Duration = dnsproxy.PROXY_DIAL_TIMEOUT
+	}
+	if conf.Timeouts.KeepAlive.Duration == 0 {
+		conf.Timeouts.KeepAlive.Duration = dnsproxy.PROXY_KEEPALIVE
+	}
+	if conf.DNS.Obedient.Timeout.Duration == 0 {
+		conf.DNS.Obedient.Timeout.Duration = conf.Timeouts.DNSUpstream.Duration
+	}
+	if conf.DNS.Abroad.Timeout.Duration == 0 {
+		conf.DNS.Abroad.Timeout.Duration = conf.Timeouts.DNSUpstream.Duration
+	}
+	if conf.Proxy.IdleTimeout.Duration == 0 {
+		conf.Proxy.IdleTimeout.Duration = conf.Timeouts.RelayIdle.Duration
+	}
+	if conf.DNS.Abroad.RetryBackoff.Duration == 0 {
+		conf.DNS.Abroad.RetryBackoff.Duration = 100 * time.Millisecond
+	}
+	if conf.Proxy.ProbeInterval.Duration == 0 {
+		conf.Proxy.ProbeInterval.Duration = 30 * time.Second
+	}
+	if conf.Log.MaxSize == 0 {
+		conf.Log.MaxSize = 10
+	}
+	if conf.Proxy.HappyEyeballsDelay.Duration == 0 {
+		conf.Proxy.HappyEyeballsDelay.Duration = dnsproxy.HAPPY_EYEBALLS_DELAY
+	}
+	if conf.Proxy.DirectFallbackTimeout.Duration == 0 {
+		conf.Proxy.DirectFallbackTimeout.Duration = dnsproxy.DIRECT_FALLBACK_TIMEOUT
+	}
+	if conf.Proxy.DirectFallbackTTL.Duration == 0 {
+		conf.Proxy.DirectFallbackTTL.Duration = dnsproxy.DIRECT_FALLBACK_TTL
+	}
+	if conf.Proxy.RelayBufferSize == 0 {
+		conf.Proxy.RelayBufferSize = dnsproxy.RELAY_BUFFER_SIZE / 1024
+	}
+	if conf.Cache.MaxTTL.Duration == 0 {
+		conf.Cache.MaxTTL.Duration = 1 * time.Hour
+	}
+	if conf.Cache.PersistInterval.Duration == 0 {
+		conf.Cache.PersistInterval.Duration = 5 * time.Minute
+	}
+	if conf.Cache.Policy == "" {
+		conf.Cache.Policy = "update"
+	}
+	if conf.Cache.PrefetchInterval.Duration == 0 {
+		conf.Cache.PrefetchInterval.Duration = 1 * time.Minute
+	}
 }
 
-func newDomainMatch(chineseList, gfwList []string) *domainMatch {
-	return &domainMatch{chineseList: chineseList, gfwList: gfwList}
+// check every field, all problems are reported at once
+func (conf *configRepr) validate() error {
+	var errs []string
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	// --- files
+	// domain lists are made of the files and the inline domains
+	check(checkConfigFiles("gfw_list", conf.GfwList, len(conf.GfwDomains) == 0))
+	check(checkConfigFiles("china_list", conf.ChinaList, len(conf.ChinaDomains) == 0))
+	// the geoip database replaces the china ip lists
+	check(checkConfigFile("china_ip_list", conf.ChinaIPList, conf.GeoIP == ""))
+	check(checkConfigFile("china_ipv6_list", conf.ChinaIPv6List, false))
+	check(checkConfigFile("geoip", conf.GeoIP, false))
+	for _, country := range conf.GeoIPDirect {
+		if len(strings.TrimSpace(country)) != 2 {
+			check(errors.Errorf("config.toml: invalid geoip_direct_countries %q, should be ISO 3166-1 codes such as \"CN\"", country))
+		}
+	}
+	check(checkConfigFile("[dns.doh].cert_file", conf.DNS.DoH.CertFile, false))
+	check(checkConfigFile("[dns.doh].key_file", conf.DNS.DoH.KeyFile, false))
+	check(checkConfigFile("[override].hosts_file", conf.Override.HostsFile, false))
+	check(checkConfigFile("[tls].cert_file", conf.TLS.CertFile, conf.TLS.KeyFile != ""))
+	check(checkConfigFile("[tls].key_file", conf.TLS.KeyFile, conf.TLS.CertFile != ""))
+	if fpath := conf.Cache.PersistFile; fpath != "" {
+		check(checkConfigFile("[cache].persist_file directory", filepath.Dir(fpath), true))
+	}
+
+	// --- list updates
+	for _, u := range []struct{ key, url, fpath string }{
+		{"gfw_list_url", conf.Update.GfwListURL, conf.GfwList.first()},
+		{"china_list_url", conf.Update.ChinaListURL, conf.ChinaList.first()},
+		{"china_ip_list_url", conf.Update.ChinaIPListURL, conf.ChinaIPList},
+		{"china_ipv6_list_url", conf.Update.ChinaIPv6ListURL, conf.ChinaIPv6List},
+	} {
+		if u.url == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u.url); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			check(errors.Errorf("config.toml: invalid [update].%s %q", u.key, u.url))
+		} else if u.fpath == "" {
+			check(errors.Errorf("config.toml: [update].%s is set without the list file to save", u.key))
+		}
+	}
+
+	// --- tls certificates
+	if acme := conf.TLS.ACME; len(acme.Domains) > 0 {
+		if conf.TLS.CertFile != "" {
+			check(errors.New("config.toml: [tls].cert_file and [tls.acme] can not be both set"))
+		}
+		switch acme.Challenge {
+		case dnsproxy.ACME_CHALLENGE_TLS_ALPN:
+		case dnsproxy.ACME_CHALLENGE_DNS:
+			if acme.DNSHook == "" {
+				check(errors.New("config.toml: missing [tls.acme].dns_hook, which is required by dns-01"))
+			}
+		default:
+			check(errors.Errorf("config.toml: invalid [tls.acme].challenge %q", acme.Challenge))
+		}
+		if acme.Directory != "" {
+			if parsed, err := url.Parse(acme.Directory); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+				check(errors.Errorf("config.toml: invalid [tls.acme].directory %q", acme.Directory))
+			}
+		}
+	}
+
+	// --- listen addresses
+	check(checkConfigAddrs("[dns].listen", conf.DNS.Listen))
+	check(checkListenTags(conf))
+	if _, err := dnsproxy.NewDNS64(conf.DNS.DNS64Prefix); err != nil {
+		check(errors.WithMessage(err, "config.toml: invalid [dns].dns64_prefix"))
+	}
+	check(checkConfigAddr("[dns.doh].listen", conf.DNS.DoH.Listen, false))
+	check(checkConfigAddrs("[proxy].listen", conf.Proxy.Listen))
+	check(checkConfigAddr("[admin].listen", conf.Admin.Listen, false))
+
+	// --- dns servers
+	obedient := conf.DNS.Obedient
+	if ns, err := parseNameservers("[dns.obedient]", obedient.Nameserver, obedient.Nameservers, obedient.Weights, obedient.Timeout.Duration); err != nil {
+		check(err)
+	} else {
+		for _, n := range ns {
+			check(checkConfigAddr("[dns.obedient].nameserver", n.Addr, true))
+		}
+	}
+	for _, n := range parseSecondaryNameservers(conf) {
+		check(checkConfigAddr("[dns.obedient].secondary_nameservers", n.Addr, true))
+	}
+	if _, err := dnsproxy.ParseUpstreamStrategy(obedient.Strategy); err != nil {
+		check(errors.WithMessage(err, "config.toml: invalid [dns.obedient].strategy"))
+	}
+	if obedient.Net != "udp" && obedient.Net != "tcp" {
+		check(errors.Errorf("config.toml: invalid [dns.obedient].net %q", obedient.Net))
+	}
+	if _, err := parseFakeIPs(conf); err != nil {
+		check(err)
+	}
+
+	abroad := conf.DNS.Abroad
+	if ns, err := parseNameservers("[dns.abroad]", abroad.Nameserver, abroad.Nameservers, abroad.Weights, abroad.Timeout.Duration); err != nil {
+		check(err)
+	} else if !abroad.EnableDNSOverHTTPS {
+		for _, n := range ns {
+			check(checkConfigAddr("[dns.abroad].nameserver", n.Addr, true))
+		}
+	}
+	if _, err := dnsproxy.ParseUpstreamStrategy(abroad.Strategy); err != nil {
+		check(errors.WithMessage(err, "config.toml: invalid [dns.abroad].strategy"))
+	}
+	if abroad.EnableDNSOverHTTPS {
+		if _, err := dnsproxy.ParseDoHProvider(abroad.DoHProvider, abroad.DoHFormat); err != nil {
+			check(errors.WithMessage(err, "config.toml: invalid [dns.abroad].doh_provider"))
+		}
+	}
+	if _, err := parseDoHIPs(conf); err != nil {
+		check(err)
+	}
+	if abroad.DoHMaxConns < 0 {
+		check(errors.Errorf("config.toml: invalid [dns.abroad].doh_max_conns %d", abroad.DoHMaxConns))
+	}
+	if _, err := parseBootstrapResolver(conf); err != nil {
+		check(err)
+	}
+	if p, err := parseAbroadDNSProxy(conf, nil, nil); err != nil {
+		check(err)
+	} else {
+		switch abroad.Net {
+		case "tcp":
+		case "udp":
+			if _, ok := p.(*dnsproxy.Socks5Dialer); !ok {
+				check(errors.New("config.toml: [dns.abroad].net can be udp only if [dns.abroad].proxy is socks5 " +
+					"or [[proxy.chain]] is a single socks5 node over tcp"))
+			}
+		default:
+			check(errors.Errorf("config.toml: invalid [dns.abroad].net %q", abroad.Net))
+		}
+	}
+	if abroad.RetryAttempts < 0 {
+		check(errors.Errorf("config.toml: invalid [dns.abroad].retry_attempts %d", abroad.RetryAttempts))
+	}
+	if abroad.RetryJitter < 0 || abroad.RetryJitter > 1 {
+		check(errors.Errorf("config.toml: invalid [dns.abroad].retry_jitter %v, should be in [0, 1]", abroad.RetryJitter))
+	}
+
+	// --- proxy
+	if ip := conf.Proxy.ProxyServerExternalIP; ip != "" && net.ParseIP(ip) == nil {
+		check(errors.New("config.toml: invalid [proxy].proxy_server_external_ip"))
+	}
+	if conf.Proxy.ProbeAddr != "" {
+		check(checkConfigAddr("[proxy].probe_addr", conf.Proxy.ProbeAddr, true))
+	}
+	if conf.Proxy.Listeners < 0 {
+		check(errors.New("config.toml: invalid [proxy].listeners"))
+	}
+	if conf.Proxy.MaxConns < 0 {
+		check(errors.Errorf("config.toml: invalid [proxy].max_conns %d", conf.Proxy.MaxConns))
+	}
+	if conf.Proxy.ConnBandwidth < 0 {
+		check(errors.Errorf("config.toml: invalid [proxy].conn_bandwidth %d", conf.Proxy.ConnBandwidth))
+	}
+	if conf.Proxy.TotalBandwidth < 0 {
+		check(errors.Errorf("config.toml: invalid [proxy].total_bandwidth %d", conf.Proxy.TotalBandwidth))
+	}
+	if conf.Proxy.RelayBufferSize < 1 || conf.Proxy.RelayBufferSize > 1024 {
+		check(errors.Errorf("config.toml: invalid [proxy].relay_buffer_size %d, should be 1 ~ 1024", conf.Proxy.RelayBufferSize))
+	}
+	if ss := conf.Proxy.Shadowsocks; ss.Listen != "" {
+		check(checkConfigAddr("[proxy.shadowsocks].listen", ss.Listen, false))
+		if _, err := dnsproxy.NewShadowsocksCipher(ss.Method, ss.Password); err != nil {
+			check(errors.WithMessage(err, "config.toml: invalid [proxy.shadowsocks]"))
+		}
+	}
+	_, err := parseProxyACL(conf)
+	check(err)
+	_, err = parseProxyPool(conf, nil)
+	check(err)
+	_, err = parseOutbounds(conf, nil)
+	check(err)
+	_, err = parseOutboundBinds(conf)
+	check(err)
+
+	// --- cache
+	if _, err := dnsproxy.ParseCachePolicy(conf.Cache.Policy); err != nil {
+		check(errors.WithMessage(err, "config.toml: invalid [cache].policy"))
+	}
+	if conf.Cache.PrefetchMinHits < 0 {
+		check(errors.Errorf("config.toml: invalid [cache].prefetch_min_hits %d", conf.Cache.PrefetchMinHits))
+	}
+	if conf.Cache.IPMaxEntries < 0 {
+		check(errors.Errorf("config.toml: invalid [cache].ip_max_entries %d", conf.Cache.IPMaxEntries))
+	}
+	if conf.Cache.DomainMaxEntries < 0 {
+		check(errors.Errorf("config.toml: invalid [cache].domain_max_entries %d", conf.Cache.DomainMaxEntries))
+	}
+	for _, domain := range conf.Cache.WarmUp {
+		if _, ok := dns.IsDomainName(domain); !ok {
+			check(errors.Errorf("config.toml: invalid [cache].warm_up domain %q", domain))
+		}
+	}
+
+	// --- log files
+	if conf.Log.MaxSize < 0 {
+		check(errors.Errorf("config.toml: invalid [log].max_size %d", conf.Log.MaxSize))
+	}
+	if conf.Log.MaxFiles < 0 {
+		check(errors.Errorf("config.toml: invalid [log].max_files %d", conf.Log.MaxFiles))
+	}
+
+	// --- durations
+	for _, d := range []struct {
+		key string
+		d   duration
+	}{
+		{"watch_interval", conf.WatchInterval},
+		{"[update].interval", conf.Update.Interval},
+		{"[timeouts].dns_upstream", conf.Timeouts.DNSUpstream},
+		{"[timeouts].proxy_dial", conf.Timeouts.ProxyDial},
+		{"[timeouts].relay_idle", conf.Timeouts.RelayIdle},
+		{"[timeouts].keepalive", conf.Timeouts.KeepAlive},
+		{"[dns].query_timeout", conf.DNS.QueryTimeout},
+		{"[dns].min_ttl", conf.DNS.MinTTL},
+		{"[dns].max_ttl", conf.DNS.MaxTTL},
+		{"[dns.obedient].timeout", conf.DNS.Obedient.Timeout},
+		{"[dns.obedient].probe_interval", conf.DNS.Obedient.ProbeInterval},
+		{"[dns.abroad].timeout", conf.DNS.Abroad.Timeout},
+		{"[dns.abroad].probe_interval", conf.DNS.Abroad.ProbeInterval},
+		{"[dns.abroad].retry_backoff", conf.DNS.Abroad.RetryBackoff},
+		{"[dns.abroad].hedge_delay", conf.DNS.Abroad.HedgeDelay},
+		{"[proxy].probe_interval", conf.Proxy.ProbeInterval},
+		{"[proxy].happy_eyeballs_delay", conf.Proxy.HappyEyeballsDelay},
+		{"[proxy].race_proxy_delay", conf.Proxy.RaceProxyDelay},
+		{"[proxy].direct_fallback_timeout", conf.Proxy.DirectFallbackTimeout},
+		{"[proxy].direct_fallback_ttl", conf.Proxy.DirectFallbackTTL},
+		{"[proxy].idle_timeout", conf.Proxy.IdleTimeout},
+		{"[proxy].max_lifetime", conf.Proxy.MaxLifetime},
+		{"[cache].min_ttl", conf.Cache.MinTTL},
+		{"[cache].max_ttl", conf.Cache.MaxTTL},
+		{"[cache].persist_interval", conf.Cache.PersistInterval},
+		{"[cache].prefetch_interval", conf.Cache.PrefetchInterval},
+		{"[cache].serve_stale", conf.Cache.ServeStale},
+		{"[log].latency_stats", conf.Log.LatencyStats},
+	} {
+		if d.d.Duration < 0 {
+			check(errors.Errorf("config.toml: invalid %s %s", d.key, d.d))
+		}
+	}
+	if max := conf.DNS.MaxTTL.Duration; max > 0 && conf.DNS.MinTTL.Duration > max {
+		check(errors.Errorf("config.toml: invalid [dns].min_ttl %s, greater than max_ttl %s", conf.DNS.MinTTL, conf.DNS.MaxTTL))
+	}
+
+	// --- dns limits
+	_, err = parseDNSLimiter(conf)
+	check(err)
+	_, err = parseDNSTap(conf)
+	check(err)
+
+	// --- override and rules
+	_, err = parseOverrideZone(conf)
+	check(err)
+	_, err = parseLocalZones(conf)
+	check(err)
+	_, err = parseAnswerRewriter(conf)
+	check(err)
+	check(addDomainRules(conf, dnsproxy.NewDomainRules()))
+	resolvers, err := parseResolverRegistry(conf)
+	check(err)
+	_, err = parseRoutingRules(conf, resolvers)
+	check(err)
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
 }
 
-func (match *domainMatch) MatchGFW(domain string) bool {
-	return domainMatchList(domain, match.gfwList)
+// `fpath` must exist if it is required or not empty
+func checkConfigFile(key, fpath string, required bool) error {
+	if fpath == "" {
+		if required {
+			return errors.Errorf("config.toml: missing %s", key)
+		}
+		return nil
+	}
+	if _, err := os.Stat(fpath); err != nil {
+		return errors.Errorf("config.toml: invalid %s: %s", key, err)
+	}
+	return nil
 }
 
-func (match *domainMatch) MatchObedient(domain string) bool {
-	return domainMatchList(domain, match.chineseList)
+// every file of `files` must exist, and there must be one if `required`
+func checkConfigFiles(key string, files fileList, required bool) error {
+	if len(files) == 0 {
+		return checkConfigFile(key, "", required)
+	}
+	for _, fpath := range files {
+		if err := checkConfigFile(key, fpath, true); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func domainMatchList(domain string, domainList []string) bool {
-	for _, _domain := range domainList {
-		if _domain == domain || strings.HasSuffix(domain, "."+_domain) {
-			return true
+// `addr` must be "host:port" if it is required or not empty
+func checkConfigAddr(key, addr string, required bool) error {
+	if addr == "" {
+		if required {
+			return errors.Errorf("config.toml: missing %s", key)
 		}
+		return nil
 	}
-	return false
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Errorf("config.toml: invalid %s %q", key, addr)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return errors.Errorf("config.toml: invalid %s %q", key, addr)
+	}
+	return nil
 }
 
-// #########
-//  IP util
-// #########
-func ipInIPNetList(ip net.IP, ipnets []*net.IPNet) bool {
-	if ip == nil {
-		return false
+// `addrs` must be "host:port" and not empty
+func checkConfigAddrs(key string, addrs addrList) error {
+	if len(addrs) == 0 {
+		return errors.Errorf("config.toml: missing %s", key)
 	}
-	for _, ipNet := range ipnets {
-		if ipNet.Contains(ip) {
-			return true
+	for _, addr := range addrs {
+		if err := checkConfigAddr(key, addr, true); err != nil {
+			return err
 		}
 	}
-	return false
+	return nil
 }
 
 // ############
 //  Parse TXTs
 // ############
 
-// parse china_domain_list.txt or gfw_domain_list.txt to domain list
-func legallyParseDomainList(fpath string) ([]string, error) {
-	file, err := ioutil.ReadFile(fpath)
+// domains of all `files` in order, followed by `inline` ones, AdBlock Plus rules are kept as they are
+// if `rules`, otherwise reduced to the domains they block, see legallyParseDomainList
+func legallyParseDomainLists(files fileList, inline []string, rules bool) ([]string, error) {
+	var list []string
+	for _, fpath := range files {
+		l, err := legallyParseDomainList(fpath, rules)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, l...)
+	}
+	return append(list, inline...), nil
+}
+
+// parse china_domain_list.txt, gfw_domain_list.txt or an upstream list such as dnsmasq-china-list or gfwlist
+// to domain list, whose format is detected by dnsproxy.ParseDomainList
+func legallyParseDomainList(fpath string, rules bool) ([]string, error) {
+	file, err := os.Open(fpath)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	list := strings.Split(string(file), "\n")
-	if len(list) == 0 {
-		return nil, errors.New("empty domain list")
+	defer file.Close()
+
+	list, format, err := dnsproxy.ParseDomainList(file)
+	if err != nil {
+		return nil, errors.WithMessage(err, fpath)
+	}
+	glog.V(1).Infof("%s: %d entries of %s format\n", fpath, len(list), format)
+	if format == dnsproxy.DOMAIN_LIST_ABP && !rules {
+		list = dnsproxy.ABPRuleDomains(list)
 	}
 	return list, nil
 }
 
 // parse china_ip_list.txt to IPNet list
 func legallyParseIPNetList(fpath string) ([]*net.IPNet, error) {
-	var ipNets []*net.IPNet
-
 	file, err := os.Open(fpath)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	defer file.Close()
+	return dnsproxy.ParseIPNetList(file)
+}
+
+// ##############
+//  Nameservers
+// ##############
+
+// addresses of [dns.abroad].doh_ips the DoH server is connected to, nil if it is empty
+func parseDoHIPs(conf *configRepr) ([]net.IP, error) {
+	var ips []net.IP
+	for _, s := range conf.DNS.Abroad.DoHIPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.Errorf("config.toml: invalid [dns.abroad].doh_ips %q", s)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// forged answers of the obedient nameservers by [dns.obedient].fake_ips
+func parseFakeIPs(conf *configRepr) ([]*net.IPNet, error) {
+	var ipnets []*net.IPNet
+	for _, s := range conf.DNS.Obedient.FakeIPs {
+		ipnet, err := dnsproxy.ParseIPOrNet(s)
+		if err != nil {
+			return nil, errors.Errorf("config.toml: invalid [dns.obedient].fake_ips %q", s)
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+	return ipnets, nil
+}
+
+// resolver of hostnames of proxy nodes and the DoH server by [dns].bootstrap, nil if it is empty
+func parseBootstrapResolver(conf *configRepr) (*dnsproxy.BootstrapResolver, error) {
+	if len(conf.DNS.Bootstrap) == 0 {
+		return nil, nil
+	}
+	r, err := dnsproxy.NewBootstrapResolver(conf.DNS.Bootstrap, conf.Timeouts.DNSUpstream.Duration)
+	return r, errors.WithMessage(err, "config.toml: invalid [dns].bootstrap")
+}
+
+// `nameservers` with `weights`, or `nameserver` if `nameservers` is empty, each one is waited for `timeout`
+func parseNameservers(section, nameserver string, nameservers []string, weights []int, timeout time.Duration) ([]dnsproxy.Nameserver, error) {
+	if len(nameservers) == 0 {
+		if len(weights) > 0 {
+			return nil, errors.Errorf("config.toml: %s.weights is set without %s.nameservers", section, section)
+		}
+		return []dnsproxy.Nameserver{{Addr: nameserver, Timeout: timeout}}, nil
+	}
+	if len(weights) > 0 && len(weights) != len(nameservers) {
+		return nil, errors.Errorf("config.toml: %s.weights does not match %s.nameservers", section, section)
+	}
+	list := make([]dnsproxy.Nameserver, len(nameservers))
+	for i, addr := range nameservers {
+		list[i].Addr = addr
+		list[i].Timeout = timeout
+		if len(weights) > 0 {
+			list[i].Weight = weights[i]
+		}
+	}
+	return list, nil
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		_, ipn, err := net.ParseCIDR(scanner.Text())
+// nameservers of [dns.obedient].secondary_nameservers, queried once the nameservers fail
+func parseSecondaryNameservers(conf *configRepr) []dnsproxy.Nameserver {
+	list := make([]dnsproxy.Nameserver, len(conf.DNS.Obedient.Secondary))
+	for i, addr := range conf.DNS.Obedient.Secondary {
+		list[i] = dnsproxy.Nameserver{Addr: addr, Timeout: conf.DNS.Obedient.Timeout.Duration}
+	}
+	return list
+}
+
+// parse retry_* and hedge_delay of [dns.abroad], nil to race 3 queries once as default
+func parseAbroadRetryPolicy(conf *configRepr) *dnsproxy.RetryPolicy {
+	abroad := conf.DNS.Abroad
+	if abroad.RetryAttempts == 0 {
+		return nil
+	}
+	return &dnsproxy.RetryPolicy{
+		Attempts: abroad.RetryAttempts,
+		Backoff:  abroad.RetryBackoff.Duration,
+		Jitter:   abroad.RetryJitter,
+		Hedge:    abroad.HedgeDelay.Duration,
+	}
+}
+
+// ###############
+//  Proxy ACL
+// ###############
+
+// parse allow_clients and users of [proxy], nil if everyone is allowed
+func parseProxyACL(conf *configRepr) (*dnsproxy.ProxyACL, error) {
+	var subnets []*net.IPNet
+	for _, s := range conf.Proxy.AllowClients {
+		ipnet, err := dnsproxy.ParseIPOrNet(s)
+		if err != nil {
+			return nil, errors.Errorf("config.toml: invalid [proxy].allow_clients %q", s)
+		}
+		subnets = append(subnets, ipnet)
+	}
+	var users []*url.Userinfo
+	for _, s := range conf.Proxy.Users {
+		i := strings.IndexByte(s, ':')
+		if i <= 0 {
+			return nil, errors.Errorf("config.toml: invalid [proxy].users %q, should be \"user:password\"", s)
+		}
+		users = append(users, url.UserPassword(s[:i], s[i+1:]))
+	}
+	if len(subnets) == 0 && len(users) == 0 {
+		return nil, nil
+	}
+	return dnsproxy.NewProxyACL(subnets, users), nil
+}
+
+// ###############
+//  DNS Limits
+// ###############
+
+// parse [dns.dnstap] section, nil if it is disabled
+func parseDNSTap(conf *configRepr) (*dnsproxy.DNSTap, error) {
+	if conf.DNS.DNSTap.Address == "" {
+		return nil, nil
+	}
+	t, err := dnsproxy.NewDNSTap(conf.DNS.DNSTap.Address, conf.DNS.DNSTap.Identity)
+	return t, errors.WithMessage(err, "config.toml: invalid [dns.dnstap].address")
+}
+
+// parse [dns.limit] section, nil if nothing is limited
+func parseDNSLimiter(conf *configRepr) (*dnsproxy.DNSLimiter, error) {
+	limit := conf.DNS.Limit
+	for _, v := range []struct {
+		key string
+		n   int
+	}{
+		{"client_qps", limit.ClientQPS},
+		{"client_burst", limit.ClientBurst},
+		{"rrl_rps", limit.RRLRPS},
+		{"rrl_slip", limit.RRLSlip},
+	} {
+		if v.n < 0 {
+			return nil, errors.Errorf("config.toml: invalid [dns.limit].%s %d", v.key, v.n)
+		}
+	}
+	var subnets []*net.IPNet
+	for _, s := range limit.AllowClients {
+		ipnet, err := dnsproxy.ParseIPOrNet(s)
+		if err != nil {
+			return nil, errors.Errorf("config.toml: invalid [dns.limit].allow_clients %q", s)
+		}
+		subnets = append(subnets, ipnet)
+	}
+	if len(subnets) == 0 && limit.ClientQPS == 0 && limit.RRLRPS == 0 {
+		return nil, nil
+	}
+	l := dnsproxy.NewDNSLimiter(float64(limit.ClientQPS), float64(limit.ClientBurst), float64(limit.RRLRPS), limit.RRLSlip)
+	l.SetAllowedClients(subnets)
+	return l, nil
+}
+
+// ##################
+//  TLS Certificates
+// ##################
+
+// certificates of tls listeners in [tls], nil if neither static files nor acme is configured
+func parseCertManager(conf *configRepr) (*dnsproxy.CertManager, error) {
+	if conf.TLS.CertFile != "" {
+		certs, err := dnsproxy.NewStaticCertManager(conf.TLS.CertFile, conf.TLS.KeyFile)
+		return certs, errors.WithMessage(err, "config.toml: invalid [tls].cert_file")
+	}
+	acme := conf.TLS.ACME
+	if len(acme.Domains) == 0 {
+		return nil, nil
+	}
+	certs, err := dnsproxy.NewACMECertManager(dnsproxy.ACMEConfig{
+		DirectoryURL: acme.Directory,
+		Email:        acme.Email,
+		Domains:      acme.Domains,
+		CacheDir:     acme.CacheDir,
+		Challenge:    acme.Challenge,
+		DNSHook:      acme.DNSHook,
+	})
+	return certs, errors.WithMessage(err, "config.toml: invalid [tls.acme]")
+}
+
+// ###############
+//  Override Zone
+// ###############
+// parse [override] section, nil if it is empty,
+// [override.hosts] adds ips to the same domains of hosts_file
+func parseOverrideZone(conf *configRepr) (*dnsproxy.OverrideZone, error) {
+	z := dnsproxy.NewOverrideZone()
+	for _, domain := range conf.Override.Block {
+		z.Block(domain)
+	}
+	if fpath := conf.Override.HostsFile; fpath != "" {
+		file, err := os.Open(fpath)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		ipNets = append(ipNets, ipn)
+		defer file.Close()
+		hosts, err := dnsproxy.ParseHostsFile(file)
+		if err != nil {
+			return nil, errors.WithMessage(err, "config.toml: invalid [override].hosts_file")
+		}
+		for domain, ips := range hosts {
+			z.AddHost(domain, ips...)
+		}
+	}
+	for domain, ips := range conf.Override.Hosts {
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("config.toml: invalid ip %q of [override.hosts].%q", s, domain)
+			}
+			z.AddHost(domain, ip)
+		}
+	}
+	if z.Len() == 0 {
+		return nil, nil
+	}
+	return z, nil
+}
+
+// add patterns of [domain_rules] into `rules`
+func addDomainRules(conf *configRepr, rules *dnsproxy.DomainRules) error {
+	for _, r := range []struct {
+		key      string
+		patterns []string
+		trans    dnsproxy.Transport
+	}{
+		{"direct", conf.DomainRules.Direct, dnsproxy.TRANS_DIRECT},
+		{"proxy", conf.DomainRules.Proxy, dnsproxy.TRANS_PROXY},
+		{"reject", conf.DomainRules.Reject, dnsproxy.TRANS_REJECT},
+	} {
+		for _, pattern := range r.patterns {
+			if err := rules.Add(pattern, r.trans); err != nil {
+				return errors.WithMessage(err, "config.toml: invalid [domain_rules]."+r.key)
+			}
+		}
+	}
+	return nil
+}
+
+// parse [[zone]] tables, records of a zone are read from its file first
+func parseLocalZones(conf *configRepr) ([]*dnsproxy.LocalZone, error) {
+	var zones []*dnsproxy.LocalZone
+	for i, zc := range conf.Zones {
+		section := fmt.Sprintf("config.toml: invalid [[zone]] #%d", i+1)
+		if _, ok := dns.IsDomainName(zc.Origin); !ok || zc.Origin == "" {
+			return nil, errors.Errorf("%s origin %q", section, zc.Origin)
+		}
+		var readers []io.Reader
+		if zc.File != "" {
+			data, err := ioutil.ReadFile(zc.File)
+			if err != nil {
+				return nil, errors.WithMessage(errors.WithStack(err), section+" file")
+			}
+			readers = append(readers, bytes.NewReader(data), strings.NewReader("\n"))
+		}
+		readers = append(readers, strings.NewReader(strings.Join(zc.Records, "\n")+"\n"))
+		z, err := dnsproxy.ParseLocalZone(io.MultiReader(readers...), zc.Origin, zc.File)
+		if err != nil {
+			return nil, errors.WithMessage(err, section)
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+// parse [[rewrite]] sections, nil if there is none
+func parseAnswerRewriter(conf *configRepr) (*dnsproxy.AnswerRewriter, error) {
+	if len(conf.Rewrites) == 0 {
+		return nil, nil
+	}
+	w := dnsproxy.NewAnswerRewriter()
+	for i, rc := range conf.Rewrites {
+		section := fmt.Sprintf("config.toml: invalid [[rewrite]] #%d", i+1)
+		to := net.ParseIP(rc.To)
+		if to == nil {
+			return nil, errors.Errorf("%s to %q", section, rc.To)
+		}
+		if len(rc.From) == 0 {
+			return nil, errors.Errorf("%s: empty from", section)
+		}
+		for _, s := range rc.From {
+			from, err := dnsproxy.ParseIPOrNet(s)
+			if err != nil {
+				return nil, errors.Errorf("%s from %q", section, s)
+			}
+			if err := w.Add(from, to, rc.Domains, rc.Direct); err != nil {
+				return nil, errors.WithMessage(err, section)
+			}
+		}
 	}
-	if len(ipNets) == 0 {
-		return nil, errors.New("empty IP Network list")
+	return w, nil
+}
+
+// ###############
+//  Routing Rules
+// ###############
+
+// parse [[rule]] tables in order
+func parseRoutingRules(conf *configRepr, resolvers *dnsproxy.ResolverRegistry) ([]*dnsproxy.RoutingRule, error) {
+	var rules []*dnsproxy.RoutingRule
+	for i, r := range conf.Rules {
+		trans, err := dnsproxy.ParseTransport(r.Action)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("config.toml: invalid [[rule]] #%d action", i+1))
+		}
+		rule, err := dnsproxy.NewRoutingRule(r.Match, trans, nil)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("config.toml: invalid [[rule]] #%d match", i+1))
+		}
+		if r.Outbound != "" {
+			if _, ok := conf.Outbounds[r.Outbound]; !ok || trans != dnsproxy.TRANS_PROXY {
+				return nil, errors.Errorf("config.toml: invalid [[rule]] #%d outbound", i+1)
+			}
+			rule.Outbound = r.Outbound
+		}
+		if addr := r.Resolver; addr != "" {
+			if e, ok := lookupResolver(resolvers, addr); ok {
+				rule.Resolver = e
+			} else {
+				if _, _, err := net.SplitHostPort(addr); err != nil {
+					addr = net.JoinHostPort(addr, "53")
+				}
+				rule.Resolver = dnsproxy.NewDnsTransport(addr, "udp", nil)
+			}
+		}
+		rules = append(rules, rule)
 	}
+	return rules, nil
+}
 
-	return ipNets, nil
+// addresses of [dns].listen_tags must be listened, and "listener:" patterns of [[rule]] must be of known tags
+func checkListenTags(conf *configRepr) error {
+	tags := make(map[string]bool)
+	for addr, tag := range conf.DNS.ListenTags {
+		listened := false
+		for _, laddr := range conf.DNS.Listen {
+			listened = listened || laddr == addr
+		}
+		if !listened || strings.TrimSpace(tag) == "" {
+			return errors.Errorf("config.toml: invalid [dns].listen_tags %q", addr)
+		}
+		tags[tag] = true
+	}
+	for i, r := range conf.Rules {
+		for _, pattern := range r.Match {
+			j := strings.IndexByte(pattern, ':')
+			if j < 0 || strings.TrimSpace(pattern[:j]) != "listener" {
+				continue
+			}
+			if tag := strings.TrimSpace(pattern[j+1:]); !tags[tag] {
+				return errors.Errorf("config.toml: invalid [[rule]] #%d match: unknown listener %q", i+1, tag)
+			}
+		}
+	}
+	return nil
+}
+
+// named resolvers of [resolvers] and domains assigned to them by [domain_resolvers], where resolvers may also be
+// given by address such as "10.0.0.53:53", nil if there is neither
+func parseResolverRegistry(conf *configRepr) (*dnsproxy.ResolverRegistry, error) {
+	if len(conf.Resolvers) == 0 && len(conf.DomainResolvers) == 0 {
+		return nil, nil
+	}
+	reg := dnsproxy.NewResolverRegistry()
+	for name, rc := range conf.Resolvers {
+		section := fmt.Sprintf("[resolvers.%s]", name)
+		timeout := rc.Timeout.Duration
+		if timeout <= 0 {
+			timeout = conf.Timeouts.DNSUpstream.Duration
+		}
+		ns, err := parseNameservers(section, rc.Nameserver, rc.Nameservers, rc.Weights, timeout)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range ns {
+			if err := checkConfigAddr(section+".nameserver", n.Addr, true); err != nil {
+				return nil, err
+			}
+		}
+		strategy, err := dnsproxy.ParseUpstreamStrategy(rc.Strategy)
+		if err != nil {
+			return nil, errors.WithMessage(err, "config.toml: invalid "+section+".strategy")
+		}
+		_net := rc.Net
+		if _net == "" {
+			_net = "udp"
+		}
+		if _net != "udp" && _net != "tcp" {
+			return nil, errors.Errorf("config.toml: invalid %s.net %q", section, rc.Net)
+		}
+		dt := dnsproxy.NewMultiDnsTransport(ns, _net, nil)
+		dt.SetStrategy(strategy)
+		if err := reg.Register(name, dt); err != nil {
+			return nil, errors.WithMessage(err, "config.toml: invalid "+section)
+		}
+	}
+	for domain, name := range conf.DomainResolvers {
+		if _, ok := reg.Lookup(name); !ok {
+			addr := name
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, "53")
+			}
+			if host, _, _ := net.SplitHostPort(addr); net.ParseIP(host) == nil {
+				return nil, errors.Errorf("config.toml: invalid [domain_resolvers].%q: unknown resolver %q", domain, name)
+			}
+			reg.Register(name, dnsproxy.NewDnsTransport(addr, "udp", nil))
+		}
+		if err := reg.Assign(domain, name); err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("config.toml: invalid [domain_resolvers].%q", domain))
+		}
+	}
+	return reg, nil
+}
+
+// the resolver named `name` in `resolvers`, false if there is no such one or `resolvers` is nil
+func lookupResolver(resolvers *dnsproxy.ResolverRegistry, name string) (dnsproxy.DNSExchanger, bool) {
+	if resolvers == nil {
+		return nil, false
+	}
+	return resolvers.Lookup(name)
+}
+
+// ############
+//  Proxy Pool
+// ############
+
+// proxy chains of [proxy].proxy_servers, or the single chain of parseProxyChainNodes if empty,
+// hostnames of first hops are resolved by `bootstrap` if it is not nil, see bootstrapProxyNode
+func parseProxyPool(conf *configRepr, bootstrap *dnsproxy.BootstrapResolver) (*dnsproxy.ProxyPool, error) {
+	if servers := conf.Proxy.ProxyServers; len(servers) > 0 {
+		return newProxyPool(servers, conf.Proxy.Strategy, "[proxy]", bootstrap)
+	}
+	nodes, err := parseProxyChainNodes(conf, bootstrap)
+	if err != nil {
+		return nil, err
+	}
+	s, err := dnsproxy.ParseProxyPoolStrategy(conf.Proxy.Strategy)
+	if err != nil {
+		return nil, errors.WithMessage(err, "config.toml: invalid [proxy].strategy")
+	}
+	return dnsproxy.NewProxyPool([]*gost.ProxyChain{newProxyChain(nodes...)}, s), nil
+}
+
+// named proxy chains of [outbounds.<name>] tables
+func parseOutbounds(conf *configRepr, bootstrap *dnsproxy.BootstrapResolver) (map[string]*dnsproxy.ProxyPool, error) {
+	pools := make(map[string]*dnsproxy.ProxyPool)
+	for name, o := range conf.Outbounds {
+		section := fmt.Sprintf("[outbounds.%s]", name)
+		if len(o.ProxyServers) == 0 {
+			return nil, errors.Errorf("config.toml: invalid %s.proxy_servers", section)
+		}
+		pool, err := newProxyPool(o.ProxyServers, o.Strategy, section, bootstrap)
+		if err != nil {
+			return nil, err
+		}
+		pools[name] = pool
+	}
+	return pools, nil
+}
+
+func newProxyPool(servers []string, strategy, section string, bootstrap *dnsproxy.BootstrapResolver) (*dnsproxy.ProxyPool, error) {
+	var chains []*gost.ProxyChain
+	for _, server := range servers {
+		node, err := gost.ParseProxyNode(server)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("config.toml: invalid %s.proxy_servers", section))
+		}
+		chains = append(chains, newProxyChain(bootstrapProxyNode(bootstrap, node)))
+	}
+	s, err := dnsproxy.ParseProxyPoolStrategy(strategy)
+	if err != nil {
+		return nil, errors.WithMessage(err, fmt.Sprintf("config.toml: invalid %s.strategy", section))
+	}
+	return dnsproxy.NewProxyPool(chains, s), nil
+}
+
+// #############
+//  Proxy Chain
+// #############
+
+// a hop of [[proxy.chain]]
+type proxyNodeRepr struct {
+	Protocol  string `toml:"protocol"`   // http | socks5 | ss
+	Transport string `toml:"transport"`  // tcp | tls | ws | wss | http2 | quic | kcp
+	Addr      string `toml:"addr"`       // host:port, host is also the tls server name
+	User      string `toml:"user"`       // or the kcp crypt method
+	Password  string `toml:"password"`   // or the kcp key
+	TLSVerify bool   `toml:"tls_verify"` // verify certificates of tls based transports
+	KCPConfig string `toml:"kcp_config"` // json config file of kcp
+}
+
+// nodes of [[proxy.chain]], or the single node of [dns.abroad].proxy if there is no hop,
+// the hostname of the first hop is resolved by `bootstrap` if it is not nil, see bootstrapProxyNode
+func parseProxyChainNodes(conf *configRepr, bootstrap *dnsproxy.BootstrapResolver) ([]gost.ProxyNode, error) {
+	if len(conf.Proxy.Chain) == 0 {
+		node, err := gost.ParseProxyNode(conf.DNS.Abroad.Proxy)
+		if err != nil {
+			return nil, errors.WithMessage(err, "config.toml: invalid [dns.abroad].proxy")
+		}
+		return []gost.ProxyNode{bootstrapProxyNode(bootstrap, node)}, nil
+	}
+	nodes := make([]gost.ProxyNode, len(conf.Proxy.Chain))
+	for i, repr := range conf.Proxy.Chain {
+		node, err := newProxyNode(repr)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("config.toml: invalid [[proxy.chain]] #%d", i+1))
+		}
+		if node.Transport == "kcp" && i > 0 {
+			return nil, errors.Errorf("config.toml: invalid [[proxy.chain]] #%d: kcp must be the first hop", i+1)
+		}
+		nodes[i] = node
+	}
+	nodes[0] = bootstrapProxyNode(bootstrap, nodes[0])
+	return nodes, nil
+}
+
+func newProxyNode(repr proxyNodeRepr) (gost.ProxyNode, error) {
+	switch repr.Protocol {
+	case "http", "socks5", "ss":
+	default:
+		return gost.ProxyNode{}, errors.Errorf("invalid protocol %q", repr.Protocol)
+	}
+	scheme := repr.Protocol
+	switch repr.Transport {
+	case "", "tcp":
+	case "tls", "ws", "wss", "http2", "quic", "kcp":
+		scheme += "+" + repr.Transport
+	default:
+		return gost.ProxyNode{}, errors.Errorf("invalid transport %q", repr.Transport)
+	}
+	if _, _, err := net.SplitHostPort(repr.Addr); err != nil {
+		return gost.ProxyNode{}, errors.Errorf("invalid addr %q", repr.Addr)
+	}
+	values := url.Values{}
+	if repr.TLSVerify {
+		values.Set("secure", "true")
+	}
+	if repr.KCPConfig != "" {
+		values.Set("c", repr.KCPConfig)
+	}
+	u := &url.URL{Scheme: scheme, Host: repr.Addr, RawQuery: values.Encode()}
+	if repr.User != "" || repr.Password != "" {
+		u.User = url.UserPassword(repr.User, repr.Password)
+	}
+	// options of gost.ProxyNode, such as the tls server name, can only be set by parsing
+	node, err := gost.ParseProxyNode(u.String())
+	return node, errors.WithStack(err)
+}
+
+// connect `node` by the address of its hostname resolved by `bootstrap` once, instead of by the system resolver on every dial,
+// which may be dnsproxy itself routing through this very node, the tls server name is kept,
+// nothing is done if `bootstrap` is nil or it fails, e.g. the network is not up yet,
+// only first hops are resolved, the later ones are connected through the previous hops
+func bootstrapProxyNode(bootstrap *dnsproxy.BootstrapResolver, node gost.ProxyNode) gost.ProxyNode {
+	if host, _, err := net.SplitHostPort(node.Addr); bootstrap == nil || err != nil || net.ParseIP(host) != nil {
+		return node
+	}
+	switch node.Transport {
+	case "ws", "wss", "http2":
+		// the address is also the Host header of http requests
+		glog.Warningf("bootstrap: %s over %s is resolved by the system resolver\n", node.Addr, node.Transport)
+		return node
+	}
+	addr, err := bootstrap.ResolveAddr(context.Background(), node.Addr)
+	if err != nil {
+		glog.Warningf("bootstrap: resolve proxy node %s: %s\n", node.Addr, err)
+		return node
+	}
+	glog.V(1).Infof("bootstrap: proxy node %s -> %s\n", node.Addr, addr)
+	node.Addr = addr
+	return node
+}
+
+// the only constructor of proxy chains, shared by the proxy server and abroad dns queries
+func newProxyChain(nodes ...gost.ProxyNode) *gost.ProxyChain {
+	chain := gost.NewProxyChain(nodes...)
+	chain.Init()
+	return chain
+}
+
+// local address and network interface of outbound connections, see dnsproxy.NewOutboundBind
+type bindRepr struct {
+	Address   string `toml:"address"`
+	Interface string `toml:"interface"`
+}
+
+// binds of outbound connections by [bind], nil ones are not bound
+type outboundBinds struct {
+	direct      *dnsproxy.OutboundBind // direct connections of the proxy server
+	proxy       *dnsproxy.OutboundBind // connections to proxy servers
+	obedientDNS *dnsproxy.OutboundBind
+	abroadDNS   *dnsproxy.OutboundBind // connections to abroad dns servers, or to the proxy they are queried through
+}
+
+func parseOutboundBinds(conf *configRepr) (outboundBinds, error) {
+	var binds outboundBinds
+	for _, b := range []struct {
+		key  string
+		repr bindRepr
+		bind **dnsproxy.OutboundBind
+	}{
+		{"direct", conf.Bind.Direct, &binds.direct},
+		{"proxy", conf.Bind.Proxy, &binds.proxy},
+		{"obedient_dns", conf.Bind.ObedientDNS, &binds.obedientDNS},
+		{"abroad_dns", conf.Bind.AbroadDNS, &binds.abroadDNS},
+	} {
+		bind, err := dnsproxy.NewOutboundBind(b.repr.Address, b.repr.Interface)
+		if err != nil {
+			return binds, errors.WithMessage(err, "config.toml: invalid [bind]."+b.key)
+		}
+		*b.bind = bind
+	}
+	return binds, nil
 }
 
 // #################
 //  Abroad DNS Proxy
 // #################
 
-func parseAbroadDNSProxy(proxyserver string) (proxy.Dialer, error) {
-	node, err := gost.ParseProxyNode(proxyserver)
+// dialer of abroad dns queries through the chain of parseProxyChainNodes, whose first node is connected from `bind`
+func parseAbroadDNSProxy(conf *configRepr, bootstrap *dnsproxy.BootstrapResolver, bind *dnsproxy.OutboundBind) (proxy.Dialer, error) {
+	nodes, err := parseProxyChainNodes(conf, bootstrap)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
 
-	switch node.Protocol {
-	case "socks5":
+	if node := nodes[0]; len(nodes) == 1 && node.Protocol == "socks5" && node.Transport == "" {
 		if !strings.Contains(node.Addr, ":") {
-			return nil, errors.New("lack of addr port")
+			return nil, errors.New("config.toml: invalid [dns.abroad].proxy: lack of addr port")
+		}
+		var auth *proxy.Auth
+		if len(node.Users) > 0 {
+			password, _ := node.Users[0].Password()
+			auth = &proxy.Auth{User: node.Users[0].Username(), Password: password}
 		}
-		d, err := proxy.SOCKS5("tcp", node.Addr, nil, proxy.Direct)
+		// supports both tcp and udp dns queries
+		d, err := dnsproxy.NewSocks5Dialer(node.Addr, auth)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, err
+		}
+		if err := d.SetOutboundBind(bind); err != nil {
+			return nil, err
 		}
 		return d, nil
-	default:
-		pc := gost.NewProxyChain(node)
-		return newGostProxyChain(pc), nil
 	}
+	return newGostProxyChain(newProxyChain(nodes...), bind), nil
 }
 
 // gostProxyChain implement proxy.Dialer
 type gostProxyChain struct {
 	inner *gost.ProxyChain
+	bind  *dnsproxy.OutboundBind // the first node is connected from
 }
 
-func newGostProxyChain(pc *gost.ProxyChain) gostProxyChain {
-	return gostProxyChain{inner: pc}
+func newGostProxyChain(pc *gost.ProxyChain, bind *dnsproxy.OutboundBind) gostProxyChain {
+	return gostProxyChain{inner: pc, bind: bind}
 }
 
 func (p gostProxyChain) Dial(network, addr string) (net.Conn, error) {
-	return p.inner.Dial(addr)
+	return p.bind.DialChain(p.inner, addr)
 }
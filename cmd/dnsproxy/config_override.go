@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ################
+//  Config Override
+// ################
+
+// values of config.toml overridden by environment variables and flags,
+// such as DNSPROXY_DNS_LISTEN=:53 or -dns.listen=:53, flags take precedence over environment variables,
+// lists are comma separated, tables of [outbounds], [override.hosts] and [[rule]] can't be overridden
+type configOverrides struct {
+	keys  []configOverrideKey
+	flags map[string]*configOverrideFlag
+}
+
+// a scalar or list key of config.toml such as "dns.listen"
+type configOverrideKey struct {
+	name  string
+	index []int // field index path in configRepr
+}
+
+// raw flag value, parsed when applied since flag.Parse runs before config.toml is decoded
+type configOverrideFlag struct {
+	value  string
+	isBool bool
+	set    bool
+}
+
+// --- impl flag.Value for *configOverrideFlag
+func (f *configOverrideFlag) String() string   { return f.value }
+func (f *configOverrideFlag) IsBoolFlag() bool { return f.isBool }
+
+func (f *configOverrideFlag) Set(s string) error {
+	f.value, f.set = s, true
+	return nil
+}
+
+// --- impl *configOverrides
+
+// register a flag for every overridable key of config.toml into `fs`, must be called before fs.Parse
+func newConfigOverrides(fs *flag.FlagSet) *configOverrides {
+	o := &configOverrides{flags: make(map[string]*configOverrideFlag)}
+	o.collect(reflect.TypeOf(configRepr{}), "", nil)
+	for _, key := range o.keys {
+		f := &configOverrideFlag{isBool: key.typ().Kind() == reflect.Bool}
+		o.flags[key.name] = f
+		fs.Var(f, key.name, "override "+key.name+" of config file, also "+key.envName())
+	}
+	return o
+}
+
+func (o *configOverrides) collect(t reflect.Type, prefix string, index []int) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("toml")
+		if tag == "" {
+			continue
+		}
+		name := prefix + tag
+		_index := append(append([]int(nil), index...), i)
+		switch {
+		case field.Type == reflect.TypeOf(duration{}):
+			o.keys = append(o.keys, configOverrideKey{name, _index})
+		case field.Type.Kind() == reflect.Struct:
+			o.collect(field.Type, name+".", _index)
+		case field.Type.Kind() == reflect.Slice:
+			if k := field.Type.Elem().Kind(); k == reflect.String || k == reflect.Int {
+				o.keys = append(o.keys, configOverrideKey{name, _index})
+			}
+		case field.Type.Kind() != reflect.Map:
+			o.keys = append(o.keys, configOverrideKey{name, _index})
+		}
+	}
+}
+
+// override values of `conf` by environment variables, then by flags which are set
+func (o *configOverrides) apply(conf *configRepr) error {
+	v := reflect.ValueOf(conf).Elem()
+	for _, key := range o.keys {
+		if s, ok := os.LookupEnv(key.envName()); ok {
+			if err := setConfigValue(v.FieldByIndex(key.index), s); err != nil {
+				return errors.WithMessage(err, "invalid environment variable "+key.envName())
+			}
+		}
+		if f := o.flags[key.name]; f != nil && f.set {
+			if err := setConfigValue(v.FieldByIndex(key.index), f.value); err != nil {
+				return errors.WithMessage(err, "invalid flag -"+key.name)
+			}
+		}
+	}
+	return nil
+}
+
+// --- impl configOverrideKey
+func (key configOverrideKey) typ() reflect.Type {
+	t := reflect.TypeOf(configRepr{})
+	for _, i := range key.index {
+		t = t.Field(i).Type
+	}
+	return t
+}
+
+// such as "DNSPROXY_DNS_LISTEN" for "dns.listen"
+func (key configOverrideKey) envName() string {
+	return "DNSPROXY_" + strings.ToUpper(strings.Replace(key.name, ".", "_", -1))
+}
+
+// parse `s` into `v` according to its type
+func setConfigValue(v reflect.Value, s string) error {
+	if d, ok := v.Addr().Interface().(*duration); ok {
+		return d.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var items []string
+		if s = strings.TrimSpace(s); s != "" {
+			items = strings.Split(s, ",")
+		}
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setConfigValue(slice.Index(i), strings.TrimSpace(item)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	default:
+		return errors.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -1,16 +1,16 @@
+//go:build ignore
 // +build ignore
 
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"regexp"
 	"strings"
 
+	"github.com/ARwMq9b6/dnsproxy"
 	"github.com/pkg/errors"
 )
 
@@ -41,19 +41,7 @@ var (
 
 func _main() error {
 	// copy `./config.toml` and `china_ip_list/china_ip_list.txt` to folder target
-
-	// +build go1.9
-	//
-	// ```
-	// type dst = string
-	// type src = string
-	// copys := map[dst]src{
-	//	 "target/config.toml": "./config.toml",
-	//	 "target/china_ip_list.txt": CHINA_IP_LIST_PATH,
-	// }
-	// ```
-
-	copys := map[string]string{
+	copys := map[string]string{ // dst -> src
 		"target/config.toml":       "./config.toml",
 		"target/china_ip_list.txt": CHINA_IP_LIST_PATH,
 	}
@@ -68,76 +56,32 @@ func _main() error {
 	}
 
 	// generate china-list.txt and gfw-list.txt
-	for _, generator := range [...]func() error{
-		generateGFWDomainList,
-		generateChinaDomainList,
+	for _, g := range [...]struct {
+		src, dst string
+		parse    func(r io.Reader) ([]string, error)
+	}{
+		{GFW_LIST_PATH, "target/gfw_domain_list.txt", dnsproxy.ParseGFWRules},
+		{ACCELERATED_DOMAIN_CHINA_PATH, "target/china_domain_list.txt", dnsproxy.ParseDnsmasqChinaList},
 	} {
-		if err := generator(); err != nil {
-			return err
+		if err := generateDomainList(g.src, g.dst, g.parse); err != nil {
+			return errors.WithMessage(err, "generate "+g.dst)
 		}
 	}
 	return nil
 }
 
-// generate gfw_domain_list.txt
-func generateGFWDomainList() error {
-	// read from `GFW_LIST_PATH`
-	b, err := ioutil.ReadFile(GFW_LIST_PATH)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	b, err = base64.StdEncoding.DecodeString(string(b))
+// parse list `src` into domains or rules, one per line in `dst`
+func generateDomainList(src, dst string, parse func(r io.Reader) ([]string, error)) error {
+	file, err := os.Open(src)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	content := string(b)
-
-	re := regexp.MustCompile(`.*?((:?(:?(:?[a-zA-Z])|(:?[a-zA-Z][a-zA-Z])|(:?[a-zA-Z][0-9])|(:?[0-9][a-zA-Z])|(:?[a-zA-Z0-9][a-zA-Z0-9-_]{1,61}[a-zA-Z0-9]))\.)+(:?xn--[a-z0-9-]+|[a-zA-Z]{2,6}|[a-zA-Z0-9-]{2,30}\.[a-zA-Z]{2,3})).*`)
-
-	end := strings.Index(content, "Whitelist Start")
-	matches := re.FindAllStringSubmatch(content[:end], -1)
-	mLen := len(matches)
-	if mLen == 0 {
-		return errors.New("generate gfw domains: got nothing")
-	}
-	gfwItems := make(map[string]struct{})
-	for _, groups := range matches {
-		gfwItems[groups[1]] = struct{}{}
-	}
-
-	// write to `gfw-list.txt`
-	file, err := os.Create("target/gfw_domain_list.txt")
-	if err != nil {
-		return err
-	}
 	defer file.Close()
 
-	for item, _ := range gfwItems {
-		file.Write(append([]byte(item), 0x0A))
-	}
-	return nil
-}
-
-// generate china_domain_list.txt
-func generateChinaDomainList() error {
-	// read from `ACCELERATED_DOMAIN_CHINA_PATH`
-	content, err := ioutil.ReadFile(ACCELERATED_DOMAIN_CHINA_PATH)
+	domains, err := parse(file)
 	if err != nil {
-		return errors.WithStack(err)
-	}
-	re := regexp.MustCompile(`server=/(.+)/.+`)
-	subMatch := re.FindAllSubmatch(content, -1)
-
-	domainList := make([][]byte, 0, len(subMatch))
-	for _, s := range subMatch {
-		domainList = append(domainList, s[1])
-	}
-	if len(domainList) == 0 {
-		return errors.New("generate china domains: got nothing")
+		return err
 	}
-
-	// write to `china-list.txt`
-	data := bytes.Join(domainList, []byte{0x0A})
-	return ioutil.WriteFile("target/china_domain_list.txt", data, 0644)
+	data := []byte(strings.Join(domains, "\n"))
+	return errors.WithStack(ioutil.WriteFile(dst, data, 0644))
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// ###########
+//  Log Files
+// ###########
+
+const _LOG_PRUNE_INTERVAL = 10 * time.Minute
+
+// write logs into files in [log].dir, or in `defaultDir` if [log].dir is empty,
+// logs keep going to stderr or wherever glog flags say if both are empty,
+// glog switches to a new file once the current one grows to [log].max_size MB,
+// and only the newest [log].max_files files of each level are kept,
+// must be called before anything is logged
+func setupLogFiles(conf *configRepr, defaultDir string) error {
+	dir := conf.Log.Dir
+	if dir == "" {
+		dir = defaultDir
+	}
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.WithMessage(err, "config.toml: invalid [log].dir")
+	}
+	flag.Set("log_dir", dir)
+	flag.Set("logtostderr", "false")
+	glog.MaxSize = uint64(conf.Log.MaxSize) << 20
+	if n := conf.Log.MaxFiles; n > 0 {
+		go func() {
+			for {
+				pruneLogFiles(dir, n)
+				time.Sleep(_LOG_PRUNE_INTERVAL)
+			}
+		}()
+	}
+	return nil
+}
+
+// remove all but the newest `keep` log files of each level in `dir`,
+// files are named by glog as "program.host.user.log.LEVEL.yyyymmdd-hhmmss.pid"
+func pruneLogFiles(dir string, keep int) {
+	program := filepath.Base(os.Args[0])
+	paths, err := filepath.Glob(filepath.Join(dir, program+".*.log.*"))
+	if err != nil {
+		return
+	}
+	type logFile struct {
+		path    string
+		modTime time.Time
+	}
+	byLevel := make(map[string][]logFile)
+	for _, fpath := range paths {
+		info, err := os.Lstat(fpath)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		name := filepath.Base(fpath)
+		level := name[strings.LastIndex(name, ".log.")+len(".log."):]
+		if i := strings.IndexByte(level, '.'); i >= 0 {
+			level = level[:i]
+		}
+		byLevel[level] = append(byLevel[level], logFile{fpath, info.ModTime()})
+	}
+	for _, files := range byLevel {
+		if len(files) <= keep {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+		for _, f := range files[keep:] {
+			if err := os.Remove(f.path); err != nil {
+				glog.Warningf("remove log file: %s\n", err)
+			}
+		}
+	}
+}
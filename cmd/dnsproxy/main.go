@@ -2,18 +2,49 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/ARwMq9b6/dnsproxy"
-	"github.com/ARwMq9b6/libgost"
+	"github.com/BurntSushi/toml"
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
 )
 
+// subcommands by their names, which take the arguments starting from the name
+var subcommands = map[string]func(args []string) error{
+	"service": func(args []string) error { return serviceCommand(args[1:]) },
+	"cache":   adminCommand,
+	"query":   adminCommand,
+}
+
 func main() {
-	if err := _main(); err != nil {
+	// subcommands print errors without logging
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[1:]); err != nil {
+				fmt.Fprintf(os.Stderr, "dnsproxy: %s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	var err error
+	switch {
+	case runningAsService():
+		err = runService(func(stop <-chan struct{}) error {
+			return _main(stop, true)
+		})
+	default:
+		err = _main(nil, isDaemonChild())
+	}
+	if err != nil {
 		defer os.Exit(1)
 
 		var st errors.StackTrace
@@ -27,90 +58,418 @@ func main() {
 	}
 }
 
-func _main() error {
+// run dnsproxy until it is interrupted, `stop` is closed or any server fails,
+// logs are written into files by default if it runs in the `background`
+func _main(stop <-chan struct{}, background bool) error {
 	// --- parse config
 	var configFile string
+	var checkConfig, daemon bool
 	flag.StringVar(&configFile, "c", "./config.toml", "path of config file")
+	flag.BoolVar(&checkConfig, "check-config", false, "validate config file, print the effective config and exit")
+	flag.BoolVar(&daemon, "daemon", false, "run in the background detached from the terminal, not supported on windows")
+	overrides := newConfigOverrides(flag.CommandLine)
 	flag.Parse()
 
-	conf, err := newConfigRepr(configFile)
+	conf, err := newConfigRepr(configFile, overrides)
 	if err != nil {
 		return err
 	}
-
-	// --- init globals
-	chineseDomainList, err := legallyParseDomainList(conf.ChinaList)
-	if err != nil {
+	if checkConfig {
+		return errors.WithStack(toml.NewEncoder(os.Stdout).Encode(conf))
+	}
+	if daemon && !background {
+		return startDaemon()
+	}
+	var defaultLogDir string
+	if background {
+		defaultLogDir = filepath.Join(filepath.Dir(configFile), "logs")
+	}
+	if err := setupLogFiles(conf, defaultLogDir); err != nil {
 		return err
 	}
-	gfwDomainList, err := legallyParseDomainList(conf.GfwList)
+
+	// --- init globals
+	_dm, _ipMatchCHN, err := loadLists(conf)
 	if err != nil {
 		return err
 	}
-	dm := newDomainMatch(chineseDomainList, gfwDomainList)
+	dm := dnsproxy.NewSwappableDomainMatcher(_dm)
+	ipMatchCHN := dnsproxy.NewSwappableIPMatcher(_ipMatchCHN)
 
-	chnIPList, err := legallyParseIPNetList(conf.ChinaIPList)
+	const cacheCleanupInterval = 10 * time.Minute
+	minTTL, maxTTL := conf.Cache.MinTTL.Duration, conf.Cache.MaxTTL.Duration
+	ipc := dnsproxy.NewIPCache(minTTL, maxTTL, cacheCleanupInterval)
+	domainc := dnsproxy.NewDomainCache(minTTL, maxTTL, cacheCleanupInterval)
+	cachePolicy, err := dnsproxy.ParseCachePolicy(conf.Cache.Policy)
 	if err != nil {
 		return err
 	}
-	ipMatchCHN := func(ip net.IP) bool {
-		return ipInIPNetList(ip, chnIPList)
+	ipc.SetPolicy(cachePolicy)
+	domainc.SetPolicy(cachePolicy)
+	ipc.SetMaxEntries(conf.Cache.IPMaxEntries)
+	domainc.SetMaxEntries(conf.Cache.DomainMaxEntries)
+	domainc.SetServeStale(conf.Cache.ServeStale.Duration)
+	if fpath := conf.Cache.PersistFile; fpath != "" {
+		if err := dnsproxy.LoadCaches(fpath, ipc, domainc); err != nil {
+			glog.Warningf("load caches: %s\n", err)
+		}
+		go dnsproxy.PersistCaches(fpath, conf.Cache.PersistInterval.Duration, ipc, domainc)
 	}
 
-	const (
-		cacheDefaultExpiration = 5 * time.Minute
-		cacheCleanupInterval   = 10 * time.Minute
-	)
-	ipc := dnsproxy.NewIpcache(cacheDefaultExpiration, cacheCleanupInterval)
-	domainc := dnsproxy.NewDomaincache(cacheDefaultExpiration, cacheCleanupInterval)
-
 	subnetLocalIP := net.ParseIP("114.114.114.114")
 	var subnetProxyIP net.IP
 	if ip := conf.Proxy.ProxyServerExternalIP; ip != "" {
-		subnetProxyIP = net.ParseIP(conf.Proxy.ProxyServerExternalIP)
-		if subnetProxyIP == nil {
-			return errors.New("config.toml: invalid [proxy].proxy_server_external_ip")
-		}
+		subnetProxyIP = net.ParseIP(ip)
 	} else {
 		subnetProxyIP = net.ParseIP("8.8.8.8")
 	}
 
-	proxy, err := parseAbroadDNSProxy(conf.DNS.Abroad.Proxy)
+	bootstrap, err := parseBootstrapResolver(conf)
+	if err != nil {
+		return err
+	}
+	binds, err := parseOutboundBinds(conf)
+	if err != nil {
+		return err
+	}
+	proxy, err := parseAbroadDNSProxy(conf, bootstrap, binds.abroadDNS)
 	if err != nil {
 		return err
 	}
-	abroadNet := "tcp"
+	abroadNameservers, err := parseNameservers("[dns.abroad]", conf.DNS.Abroad.Nameserver,
+		conf.DNS.Abroad.Nameservers, conf.DNS.Abroad.Weights, conf.DNS.Abroad.Timeout.Duration)
+	if err != nil {
+		return err
+	}
+	abroadStrategy, err := dnsproxy.ParseUpstreamStrategy(conf.DNS.Abroad.Strategy)
+	if err != nil {
+		return errors.WithMessage(err, "config.toml: invalid [dns.abroad].strategy")
+	}
+	dtAbroad := dnsproxy.NewMultiDnsTransport(abroadNameservers, conf.DNS.Abroad.Net, proxy)
 	if conf.DNS.Abroad.EnableDNSOverHTTPS {
-		abroadNet = "https"
+		provider, err := dnsproxy.ParseDoHProvider(conf.DNS.Abroad.DoHProvider, conf.DNS.Abroad.DoHFormat)
+		if err != nil {
+			return errors.WithMessage(err, "config.toml: invalid [dns.abroad].doh_provider")
+		}
+		dtAbroad = dnsproxy.NewDoHTransport(provider, proxy)
+		dtAbroad.SetBootstrap(bootstrap)
+		ips, err := parseDoHIPs(conf)
+		if err != nil {
+			return err
+		}
+		if len(ips) > 0 {
+			dtAbroad.SetDoHIPs(ips)
+		}
+		dtAbroad.SetDoHMaxConns(conf.DNS.Abroad.DoHMaxConns)
 	}
-	dtAbroad := dnsproxy.NewDnsTransport(conf.DNS.Abroad.Nameserver, abroadNet, proxy)
 
-	dtLocal := dnsproxy.NewDnsTransport(conf.DNS.Obedient.Nameserver, conf.DNS.Obedient.Net, nil)
+	dtAbroad.SetStrategy(abroadStrategy)
+	dtAbroad.SetOutboundBind(binds.abroadDNS)
+	if abroadStrategy != dnsproxy.STRATEGY_RACE && len(abroadNameservers) > 1 && !conf.DNS.Abroad.EnableDNSOverHTTPS {
+		go dtAbroad.Probe(conf.DNS.Abroad.ProbeInterval.Duration)
+	}
+	dtAbroad.SetDNSSEC(conf.DNS.Abroad.DNSSEC)
+	dtAbroad.SetRetryPolicy(parseAbroadRetryPolicy(conf))
+
+	localNameservers, err := parseNameservers("[dns.obedient]", conf.DNS.Obedient.Nameserver,
+		conf.DNS.Obedient.Nameservers, conf.DNS.Obedient.Weights, conf.DNS.Obedient.Timeout.Duration)
+	if err != nil {
+		return err
+	}
+	localStrategy, err := dnsproxy.ParseUpstreamStrategy(conf.DNS.Obedient.Strategy)
+	if err != nil {
+		return errors.WithMessage(err, "config.toml: invalid [dns.obedient].strategy")
+	}
+	dtLocal := dnsproxy.NewMultiDnsTransport(localNameservers, conf.DNS.Obedient.Net, nil)
+	dtLocal.SetStrategy(localStrategy)
+	secondaryNameservers := parseSecondaryNameservers(conf)
+	dtLocal.SetSecondaryNameservers(secondaryNameservers)
+	if localStrategy != dnsproxy.STRATEGY_RACE && len(localNameservers) > 1 || len(secondaryNameservers) > 0 {
+		go dtLocal.Probe(conf.DNS.Obedient.ProbeInterval.Duration)
+	}
+	dtLocal.SetDNSSEC(conf.DNS.Obedient.DNSSEC)
+	dtLocal.SetUDPHardening(conf.DNS.Obedient.UDPHardening)
+	dtLocal.SetOutboundBind(binds.obedientDNS)
 
-	dnsproxy.InitGlobals(ipc, domainc, dm, ipMatchCHN,
+	server := dnsproxy.NewServer(ipc, domainc, dm, ipMatchCHN.Match,
 		subnetLocalIP, subnetProxyIP, dtLocal, dtAbroad)
+	if interval := conf.Log.LatencyStats.Duration; interval > 0 {
+		latency := dnsproxy.NewLatencyStats()
+		dtLocal.SetLatencyStats(latency, "obedient")
+		dtAbroad.SetLatencyStats(latency, "abroad")
+		server.SetLatencyStats(latency)
+		go latency.LogPeriodically(interval)
+	}
+	if conf.Admin.Listen != "" && conf.Admin.Dashboard {
+		server.SetEventStream(dnsproxy.NewEventStream(0))
+	}
+	server.SetDNSQueryTimeout(conf.DNS.QueryTimeout.Duration)
+	if conf.DNS.DNS64 {
+		dns64, err := dnsproxy.NewDNS64(conf.DNS.DNS64Prefix)
+		if err != nil {
+			return errors.WithMessage(err, "config.toml: invalid [dns].dns64_prefix")
+		}
+		server.SetDNS64(dns64)
+	}
+	server.SetRejectWithZeroIP(conf.DNS.RejectZeroIP)
+	server.SetOutboundBinds(binds.direct, binds.proxy)
+	server.SetListenerTags(conf.DNS.ListenTags)
+	server.SetAnswerTTL(conf.DNS.MinTTL.Duration, conf.DNS.MaxTTL.Duration)
+	override, err := parseOverrideZone(conf)
+	if err != nil {
+		return err
+	}
+	if override != nil {
+		server.SetOverrideZone(override)
+	}
+	resolvers, err := parseResolverRegistry(conf)
+	if err != nil {
+		return err
+	}
+	if dp, ok := server.RoutingPolicy().(*dnsproxy.DefaultRoutingPolicy); ok {
+		if err := addDomainRules(conf, dp.DomainRules()); err != nil {
+			return err
+		}
+		dp.SetResolverRegistry(resolvers)
+		fakeIPs, err := parseFakeIPs(conf)
+		if err != nil {
+			return err
+		}
+		dp.SetFakeIPs(fakeIPs)
+	}
+	if files := conf.DHCPLeases.Files; len(files) > 0 {
+		leases := dnsproxy.NewDHCPLeases(conf.DHCPLeases.Domain, files...)
+		if err := leases.Load(); err != nil {
+			return errors.WithMessage(err, "config.toml: invalid [dhcp_leases].files")
+		}
+		server.SetDHCPLeases(leases)
+	}
+	zones, err := parseLocalZones(conf)
+	if err != nil {
+		return err
+	}
+	for _, z := range zones {
+		server.AddLocalZone(z)
+	}
+	rewriter, err := parseAnswerRewriter(conf)
+	if err != nil {
+		return err
+	}
+	if rewriter != nil {
+		server.SetAnswerRewriter(rewriter)
+	}
+	limiter, err := parseDNSLimiter(conf)
+	if err != nil {
+		return err
+	}
+	if limiter != nil {
+		server.SetDNSLimiter(limiter)
+	}
+	tap, err := parseDNSTap(conf)
+	if err != nil {
+		return err
+	}
+	if tap != nil {
+		server.SetDNSTap(tap)
+		dtLocal.SetDNSTap(tap)
+		dtAbroad.SetDNSTap(tap)
+		go tap.Run()
+	}
+	acl, err := parseProxyACL(conf)
+	if err != nil {
+		return err
+	}
+	if acl != nil {
+		server.SetProxyACL(acl)
+	}
+	if p := conf.Proxy; p.MaxConns > 0 || p.ConnBandwidth > 0 || p.TotalBandwidth > 0 {
+		server.SetProxyLimiter(dnsproxy.NewProxyLimiter(p.MaxConns, float64(p.ConnBandwidth)*1024, float64(p.TotalBandwidth)*1024))
+	}
+	dnsproxy.SetProxyDialOptions(conf.Timeouts.ProxyDial.Duration, conf.Timeouts.KeepAlive.Duration)
+	if p := conf.Proxy; p.IdleTimeout.Duration > 0 || p.MaxLifetime.Duration > 0 {
+		server.SetProxyTimeouts(dnsproxy.NewProxyTimeouts(p.IdleTimeout.Duration, p.MaxLifetime.Duration))
+	}
+	server.SetRelayBuffers(dnsproxy.NewRelayBuffers(conf.Proxy.RelayBufferSize * 1024))
+	server.SetPreserveHostname(conf.Proxy.PreserveHostname)
+	server.SetSNISniffing(conf.Proxy.SniffSNI)
+	server.SetSpeculativeProxy(conf.Proxy.SpeculativeProxy)
+	server.SetProxyListenOptions(conf.Proxy.Listeners, conf.Proxy.TCPFastOpen)
+	if conf.Proxy.HappyEyeballs {
+		server.SetHappyEyeballs(dnsproxy.NewHappyEyeballs(conf.Proxy.HappyEyeballsDelay.Duration, conf.Proxy.RaceProxyDelay.Duration))
+	}
+	if conf.Proxy.DirectFallback {
+		server.SetDirectFallback(dnsproxy.NewDirectFallback(conf.Proxy.DirectFallbackTimeout.Duration, conf.Proxy.DirectFallbackTTL.Duration))
+	}
+	rules, err := parseRoutingRules(conf, resolvers)
+	if err != nil {
+		return err
+	}
+	if tap != nil {
+		for _, r := range rules {
+			if dt, ok := r.Resolver.(interface{ SetDNSTap(*dnsproxy.DNSTap) }); ok {
+				dt.SetDNSTap(tap)
+			}
+		}
+		if resolvers != nil {
+			for _, name := range resolvers.Names() {
+				e, _ := resolvers.Lookup(name)
+				if dt, ok := e.(interface{ SetDNSTap(*dnsproxy.DNSTap) }); ok {
+					dt.SetDNSTap(tap)
+				}
+			}
+		}
+	}
+	if len(rules) > 0 {
+		server.SetRoutingPolicy(dnsproxy.NewRulePolicy(rules, server.RoutingPolicy()))
+	}
+	if fpath := conf.Cache.ImportDecisions; fpath != "" {
+		decisions, err := dnsproxy.LoadDecisions(fpath)
+		if err != nil {
+			return errors.WithMessage(err, "config.toml: invalid [cache].import_decisions")
+		}
+		if err := server.ImportDecisions(decisions); err != nil {
+			return errors.WithMessage(err, "config.toml: invalid [cache].import_decisions")
+		}
+		glog.Infof("imported %d domains and %d ips from %s\n", len(decisions.Domains), len(decisions.IPs), fpath)
+	}
+	if conf.Cache.PrefetchMinHits > 0 {
+		server.EnablePrefetch(conf.Cache.PrefetchMinHits)
+		go server.Prefetch(conf.Cache.PrefetchInterval.Duration)
+	}
+	if len(conf.Cache.WarmUp) > 0 {
+		go server.WarmUp(conf.Cache.WarmUp)
+	}
+	go watchLists(conf, conf.WatchInterval.Duration, dm, ipMatchCHN, server)
+	if interval := conf.Update.Interval.Duration; interval > 0 {
+		dialer := proxy
+		if !conf.Update.UseProxy {
+			dialer = nil
+		}
+		go updateListsPeriodically(conf, interval, dialer, dm, ipMatchCHN, server)
+	}
 
 	// --- listen and serve
 	e := make(chan error)
+	pool, err := parseProxyPool(conf, bootstrap)
+	if err != nil {
+		return err
+	}
+	outbounds, err := parseOutbounds(conf, bootstrap)
+	if err != nil {
+		return err
+	}
+	pool.SetOutboundBind(binds.proxy)
+	for name, p := range outbounds {
+		p.SetOutboundBind(binds.proxy)
+		server.SetOutbound(name, p)
+	}
+	if addr := conf.Proxy.ProbeAddr; addr != "" {
+		interval := conf.Proxy.ProbeInterval.Duration
+		if len(conf.Proxy.ProxyServers) > 0 {
+			go pool.Probe(addr, interval, 5*time.Second)
+		}
+		for _, p := range outbounds {
+			go p.Probe(addr, interval, 5*time.Second)
+		}
+	}
+	activated, err := listenActivatedSockets(conf)
+	if err != nil {
+		return err
+	}
+	sharedCerts, err := parseCertManager(conf)
+	if err != nil {
+		return err
+	}
+	if sharedCerts != nil {
+		go sharedCerts.Run()
+	}
 	go func() {
-		proxy := gost.NewProxyChain()
-		if err := proxy.AddProxyNodeString(conf.DNS.Abroad.Proxy); err != nil {
-			e <- errors.WithStack(err)
+		direct := newProxyChain()
+		var err error
+		if activated.hasProxy() {
+			err = server.ServeProxyPoolListeners(activated.proxyListeners, pool, direct)
+		} else {
+			err = server.ServeProxyPool(conf.Proxy.Listen, pool, direct)
 		}
-		proxy.Init()
-		direct := gost.NewProxyChain()
-		if err := dnsproxy.ServeProxy(conf.Proxy.Listen, proxy, direct); err != nil {
+		if err != nil {
 			e <- err
 		} else {
 			e <- errors.New("ServeProxy returned without error")
 		}
 	}()
+	if ss := conf.Proxy.Shadowsocks; ss.Listen != "" {
+		cipher, err := dnsproxy.NewShadowsocksCipher(ss.Method, ss.Password)
+		if err != nil {
+			return errors.WithMessage(err, "config.toml: invalid [proxy.shadowsocks]")
+		}
+		go func() {
+			if err := server.ServeShadowsocks(ss.Listen, cipher, pool, newProxyChain()); err != nil {
+				e <- err
+			} else {
+				e <- errors.New("ServeShadowsocks returned without error")
+			}
+		}()
+	}
 	go func() {
-		if err := dnsproxy.ServeDNS(conf.DNS.Listen); err != nil {
+		var err error
+		if activated.hasDNS() {
+			err = server.ServeDNSListeners(activated.dnsPacketConns, activated.dnsListeners)
+		} else {
+			err = server.ServeDNS(conf.DNS.Listen...)
+		}
+		if err != nil {
 			e <- err
 		} else {
 			e <- errors.New("ServeDNS returned without error")
 		}
 	}()
-	return <-e
+	if laddr := conf.Admin.Listen; laddr != "" {
+		go func() {
+			reload := func() error {
+				return reloadLists(conf, dm, ipMatchCHN, server)
+			}
+			if err := server.ServeAdmin(laddr, reload, pool); err != nil {
+				e <- err
+			} else {
+				e <- errors.New("ServeAdmin returned without error")
+			}
+		}()
+	}
+	if doh := conf.DNS.DoH; doh.Listen != "" {
+		// the listener's own certificate takes precedence over [tls]
+		certs := sharedCerts
+		if doh.CertFile != "" && doh.KeyFile != "" {
+			if certs, err = dnsproxy.NewStaticCertManager(doh.CertFile, doh.KeyFile); err != nil {
+				return errors.WithMessage(err, "config.toml: invalid [dns.doh].cert_file")
+			}
+			go certs.Run()
+		}
+		go func() {
+			if err := server.ServeDoH(doh.Listen, certs, doh.JSONAPI); err != nil {
+				e <- err
+			} else {
+				e <- errors.New("ServeDoH returned without error")
+			}
+		}()
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		select {
+		case s := <-sig:
+			glog.Infof("received signal %s, exiting\n", s)
+		case <-stop:
+			glog.Infoln("stopped, exiting")
+		}
+		e <- nil
+	}()
+	err = <-e
+
+	// save caches before exiting
+	if fpath := conf.Cache.PersistFile; fpath != "" {
+		if err := dnsproxy.SaveCaches(fpath, ipc, domainc); err != nil {
+			glog.Warningf("save caches: %s\n", err)
+		}
+	}
+	return err
 }
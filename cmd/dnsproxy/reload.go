@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ARwMq9b6/dnsproxy"
+	"github.com/golang/glog"
+)
+
+// parse domain lists and china ip lists in config, or the geoip database instead of the ip lists if configured,
+// the files of a domain list are merged along with its inline domains
+func loadLists(conf *configRepr) (dnsproxy.DomainMatcher, func(net.IP) bool, error) {
+	chineseDomainList, err := legallyParseDomainLists(conf.ChinaList, conf.ChinaDomains, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	// a domain per line is also a valid gfwlist rule
+	gfwRules, err := legallyParseDomainLists(conf.GfwList, conf.GfwDomains, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	dm := dnsproxy.NewGFWRuleListMatcher(dnsproxy.NewGFWRuleMatcher(gfwRules), chineseDomainList)
+
+	if conf.GeoIP != "" {
+		geoip, err := dnsproxy.OpenGeoIP(conf.GeoIP)
+		if err != nil {
+			return nil, nil, err
+		}
+		return dm, geoip.Matcher(conf.GeoIPDirect).Match, nil
+	}
+	chnIPList, err := legallyParseIPNetList(conf.ChinaIPList)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conf.ChinaIPv6List != "" {
+		chnIPv6List, err := legallyParseIPNetList(conf.ChinaIPv6List)
+		if err != nil {
+			return nil, nil, err
+		}
+		chnIPList = append(chnIPList, chnIPv6List...)
+	}
+	return dm, dnsproxy.NewIPNetMatcher(chnIPList).Match, nil
+}
+
+// reload lists on SIGHUP, or when any list file is modified if `interval` > 0, never returns
+func watchLists(conf *configRepr, interval time.Duration,
+	dm *dnsproxy.SwappableDomainMatcher, ipMatchCHN *dnsproxy.SwappableIPMatcher, server *dnsproxy.Server) {
+	files := append(append([]string{conf.ChinaIPList, conf.ChinaIPv6List, conf.GeoIP}, conf.GfwList...), conf.ChinaList...)
+	lastMod := listsModTime(files)
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.Tick(interval)
+	}
+
+	for {
+		select {
+		case <-sighup:
+			glog.Infoln("received SIGHUP, reloading lists")
+		case <-tick:
+			mod := listsModTime(files)
+			if !mod.After(lastMod) {
+				continue
+			}
+			glog.Infoln("list files modified, reloading lists")
+		}
+		lastMod = listsModTime(files)
+
+		if err := reloadLists(conf, dm, ipMatchCHN, server); err != nil {
+			glog.Warningf("reload lists: %s, keep using the old ones\n", err)
+		}
+	}
+}
+
+// swap in lists parsed from files in config, the old ones are kept if failed
+func reloadLists(conf *configRepr,
+	dm *dnsproxy.SwappableDomainMatcher, ipMatchCHN *dnsproxy.SwappableIPMatcher, server *dnsproxy.Server) error {
+	_dm, _ipMatchCHN, err := loadLists(conf)
+	if err != nil {
+		return err
+	}
+	dm.Swap(_dm)
+	ipMatchCHN.Swap(_ipMatchCHN)
+	// cached routing decisions may be stale
+	server.FlushCaches()
+	glog.Infoln("lists reloaded")
+	return nil
+}
+
+// latest modification time of files
+func listsModTime(files []string) time.Time {
+	var latest time.Time
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
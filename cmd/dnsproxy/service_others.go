@@ -0,0 +1,59 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ###################
+//  Daemon
+// ###################
+
+// set in the environment of the process started by -daemon
+const _DAEMON_ENV = "DNSPROXY_DAEMON"
+
+// check if dnsproxy is started by -daemon
+func isDaemonChild() bool {
+	return os.Getenv(_DAEMON_ENV) != ""
+}
+
+// start dnsproxy again with the same arguments in a new session detached from the terminal,
+// it keeps the working directory, so relative paths in the config file still work
+func startDaemon() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), _DAEMON_ENV+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Printf("dnsproxy is running in the background, pid %d\n", cmd.Process.Pid)
+	return errors.WithStack(cmd.Process.Release())
+}
+
+// ###################
+//  Windows Service
+// ###################
+
+func serviceCommand(args []string) error {
+	return errors.New("dnsproxy service is only supported on windows, run dnsproxy with -daemon or under a service manager such as systemd instead")
+}
+
+// never on other systems than windows
+func runningAsService() bool {
+	return false
+}
+
+func runService(run func(stop <-chan struct{}) error) error {
+	return run(nil)
+}
@@ -0,0 +1,182 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// ###################
+//  Windows Service
+// ###################
+
+const _SERVICE_NAME = "dnsproxy"
+
+// handle `dnsproxy service install|uninstall|start|stop`,
+// flags following install, e.g. -c, are passed to the service every time it starts
+func serviceCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: dnsproxy service install|uninstall|start|stop [flags]")
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer m.Disconnect()
+
+	if args[0] == "install" {
+		exe, err := os.Executable()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		svcArgs, err := serviceArgs(args[1:])
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(_SERVICE_NAME, exe, mgr.Config{
+			DisplayName: "dnsproxy",
+			Description: "DNS server and proxy server splitting China and abroad traffic",
+			StartType:   mgr.StartAutomatic,
+		}, svcArgs...)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		s.Close()
+		return nil
+	}
+
+	s, err := m.OpenService(_SERVICE_NAME)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer s.Close()
+	switch args[0] {
+	case "uninstall":
+		if status, err := s.Query(); err == nil && status.State != svc.Stopped {
+			s.Control(svc.Stop)
+		}
+		return errors.WithStack(s.Delete())
+	case "start":
+		return errors.WithStack(s.Start())
+	case "stop":
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for deadline := time.Now().Add(10 * time.Second); status.State != svc.Stopped; {
+			if time.Now().After(deadline) {
+				return errors.New("service is still stopping")
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	default:
+		return errors.Errorf("unknown service command %q", args[0])
+	}
+}
+
+// `args` with the path of the config file made absolute, as services start in the system directory
+func serviceArgs(args []string) ([]string, error) {
+	var svcArgs []string
+	configFile := "config.toml"
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case (arg == "-c" || arg == "--c") && i+1 < len(args):
+			configFile = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "-c="), strings.HasPrefix(arg, "--c="):
+			configFile = arg[strings.IndexByte(arg, '=')+1:]
+		default:
+			svcArgs = append(svcArgs, arg)
+		}
+	}
+	configFile, err := filepath.Abs(configFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := os.Stat(configFile); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return append([]string{"-c", configFile}, svcArgs...), nil
+}
+
+// check if dnsproxy is started by the service control manager
+func runningAsService() bool {
+	interactive, err := svc.IsAnInteractiveSession()
+	return err == nil && !interactive
+}
+
+// run `run` as the service, which returns once `stop` is closed by a stop or shutdown request,
+// relative paths in the config file are relative to the directory of the executable
+func runService(run func(stop <-chan struct{}) error) error {
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+	h := &serviceHandler{run: run}
+	if err := svc.Run(_SERVICE_NAME, h); err != nil {
+		return errors.WithStack(err)
+	}
+	return h.err
+}
+
+type serviceHandler struct {
+	run func(stop <-chan struct{}) error
+	err error // returned by run
+}
+
+// --- impl svc.Handler
+
+func (h *serviceHandler) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- h.run(stop)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case h.err = <-done:
+			if h.err != nil {
+				// service specific exit code
+				return true, 1
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				close(stop)
+				h.err = <-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// ###################
+//  Daemon
+// ###################
+
+// check if dnsproxy is started by -daemon, which is never on windows
+func isDaemonChild() bool {
+	return false
+}
+
+func startDaemon() error {
+	return errors.New("-daemon is not supported on windows, install dnsproxy as a service by `dnsproxy service install` instead")
+}
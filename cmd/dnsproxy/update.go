@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ARwMq9b6/dnsproxy"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// download lists from [update] urls every `interval`, save them as the list files in config and reload them,
+// downloads go through `dialer` if it is not nil, never returns
+func updateListsPeriodically(conf *configRepr, interval time.Duration, dialer proxy.Dialer,
+	dm *dnsproxy.SwappableDomainMatcher, ipMatchCHN *dnsproxy.SwappableIPMatcher, server *dnsproxy.Server) {
+	client := &http.Client{Timeout: time.Minute}
+	if dialer != nil {
+		client.Transport = &http.Transport{Dial: dialer.Dial}
+	}
+	for range time.Tick(interval) {
+		if err := updateLists(conf, client); err != nil {
+			glog.Warningf("update lists: %s, keep using the old ones\n", err)
+			continue
+		}
+		if err := reloadLists(conf, dm, ipMatchCHN, server); err != nil {
+			glog.Warningf("reload lists: %s, keep using the old ones\n", err)
+		}
+	}
+}
+
+// a list to download and the file to save it as
+type listUpdate struct {
+	url, fpath string
+	parse      func(r io.Reader) ([]string, error) // lines to save
+}
+
+// download and parse all lists, list files are written only if all lists are fine
+func updateLists(conf *configRepr, client *http.Client) error {
+	updates := []listUpdate{
+		{conf.Update.GfwListURL, conf.GfwList.first(), dnsproxy.ParseGFWRules},
+		{conf.Update.ChinaListURL, conf.ChinaList.first(), dnsproxy.ParseDnsmasqChinaList},
+		{conf.Update.ChinaIPListURL, conf.ChinaIPList, parseIPNetLines},
+		{conf.Update.ChinaIPv6ListURL, conf.ChinaIPv6List, parseIPNetLines},
+	}
+
+	contents := make(map[string][]byte)
+	for _, u := range updates {
+		if u.url == "" {
+			continue
+		}
+		lines, err := downloadList(client, u.url, u.parse)
+		if err != nil {
+			return errors.WithMessage(err, u.url)
+		}
+		contents[u.fpath] = []byte(strings.Join(lines, "\n") + "\n")
+	}
+
+	for fpath, content := range contents {
+		if err := writeFileAtomically(fpath, content); err != nil {
+			return err
+		}
+	}
+	glog.Infof("%d lists updated\n", len(contents))
+	return nil
+}
+
+func downloadList(client *http.Client, url string, parse func(r io.Reader) ([]string, error)) ([]string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return parse(bytes.NewReader(b))
+}
+
+// china ip lists are saved in the same format after validated
+func parseIPNetLines(r io.Reader) ([]string, error) {
+	ipNets, err := dnsproxy.ParseIPNetList(r)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, len(ipNets))
+	for i, ipn := range ipNets {
+		lines[i] = ipn.String()
+	}
+	return lines, nil
+}
+
+// write to a temp file then rename, so that a crash won't leave a broken list
+func writeFileAtomically(fpath string, data []byte) error {
+	tmp := fpath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmp, fpath); err != nil {
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package dnsproxy
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// concurrent routing of identical queries, so that a burst of queries of an uncached domain
+// costs a single walk of the decision tree and a single round of upstream queries
+type routeFlights struct {
+	mu      sync.Mutex
+	flights map[string]*routeFlight
+}
+
+type routeFlight struct {
+	done    chan struct{} // closed when d and err are set
+	d       *RouteDecision
+	err     error
+	waiters int                // calls waiting for the flight
+	cancel  context.CancelFunc // cancels the flight once no call is waiting
+}
+
+// key of routing `rq` for clients in `scope`,
+// queries differing in the DO or CD bit are answered differently and never coalesced
+func routeFlightKey(scope string, rq *RouteQuery) string {
+	q := rq.Req.Question[0]
+	var do bool
+	if opt := rq.Req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return scope + "@" + q.Name + "/" + strconv.Itoa(int(q.Qtype)) + "/" +
+		strconv.FormatBool(rq.NeedAnswer) + strconv.FormatBool(do) + strconv.FormatBool(rq.Req.CheckingDisabled)
+}
+
+// --- impl *Server
+
+// route the domain query `rq` for clients in `scope` once for all identical concurrent calls,
+// the first call starts routing in the background within the query timeout, which is canceled once
+// all calls waiting for it are done, `then` runs once with the decision before any call returns, e.g. to cache it,
+// every call gets its own copy of the response
+func (s *Server) routeCoalesced(ctx context.Context, scope string, rq *RouteQuery, then func(d *RouteDecision)) (*RouteDecision, error) {
+	key := routeFlightKey(scope, rq)
+	g := &s.flights
+
+	g.mu.Lock()
+	f, ok := g.flights[key]
+	if !ok {
+		fctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout())
+		f = &routeFlight{done: make(chan struct{}), cancel: cancel}
+		if g.flights == nil {
+			g.flights = make(map[string]*routeFlight)
+		}
+		g.flights[key] = f
+
+		frq := *rq
+		frq.Req, frq.Ctx = MsgShallowCopy(rq.Req), fctx
+		go func() {
+			defer cancel()
+			f.d, f.err = s.routeDomain(&frq)
+			if f.err == nil && then != nil {
+				then(f.d)
+			}
+			g.mu.Lock()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			g.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		g.mu.Lock()
+		if f.waiters--; f.waiters == 0 {
+			f.cancel()
+			// later calls start a new flight instead of joining the canceled one
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, errors.WithStack(ctx.Err())
+	}
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	d := *f.d
+	if d.Resp != nil {
+		d.Resp = d.Resp.Copy()
+		d.Resp.Id = rq.Req.Id
+	}
+	return &d, nil
+}
@@ -0,0 +1,144 @@
+package dnsproxy
+
+// page of /ui/ of ServeAdmin, which streams /events and polls /cache/stats, /health and /proxy/conns,
+// paths are relative so that it works behind a reverse proxy under a prefix
+const _DASHBOARD_HTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>dnsproxy</title>
+<style>
+body { font: 13px/1.4 -apple-system, "Segoe UI", "PingFang SC", "Microsoft YaHei", sans-serif; margin: 0; color: #222; background: #f4f5f7; }
+header { background: #24292e; color: #fff; padding: 8px 16px; display: flex; align-items: center; gap: 16px; }
+header h1 { font-size: 16px; margin: 0; }
+#status { font-size: 12px; color: #9be9a8; }
+#status.down { color: #f97583; }
+main { display: grid; grid-template-columns: repeat(auto-fit, minmax(520px, 1fr)); gap: 12px; padding: 12px; }
+section { background: #fff; border-radius: 4px; box-shadow: 0 1px 2px rgba(0,0,0,.1); overflow: hidden; }
+section h2 { font-size: 13px; margin: 0; padding: 6px 10px; background: #eaecef; display: flex; justify-content: space-between; }
+.scroll { max-height: 360px; overflow: auto; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 3px 8px; border-bottom: 1px solid #f0f0f0; white-space: nowrap; }
+th { position: sticky; top: 0; background: #fafbfc; font-weight: 600; }
+td.wrap { white-space: normal; word-break: break-all; }
+.direct { color: #22863a; } .proxy { color: #005cc5; } .reject, .bad { color: #cb2431; }
+.muted { color: #888; }
+</style>
+</head>
+<body>
+<header><h1>dnsproxy</h1><span id="status">connecting</span></header>
+<main>
+<section><h2>Caches</h2><div class="scroll"><table id="caches"></table></div></section>
+<section><h2>Upstreams</h2><div class="scroll"><table id="upstreams"></table></div></section>
+<section><h2>DNS queries <label><input type="checkbox" id="pause"> pause</label></h2><div class="scroll"><table id="dns">
+<tr><th>time</th><th>client</th><th>name</th><th>type</th><th>route</th><th>rcode</th><th>answers</th><th>took</th></tr></table></div></section>
+<section><h2>Routing decisions</h2><div class="scroll"><table id="route">
+<tr><th>time</th><th>client</th><th>destination</th><th>route</th></tr></table></div></section>
+<section><h2>Proxy connections <span id="nconns" class="muted"></span></h2><div class="scroll"><table id="conns"></table></div></section>
+</main>
+<script>
+"use strict";
+var MAX_ROWS = 200;
+
+function esc(s) {
+	return String(s == null ? "" : s).replace(/[&<>"]/g, function (c) {
+		return { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;" }[c];
+	});
+}
+function td(v, cls) {
+	return "<td" + (cls ? ' class="' + cls + '"' : "") + ">" + esc(v) + "</td>";
+}
+function clock(t) {
+	return new Date(t).toLocaleTimeString();
+}
+function route(trans, outbound) {
+	return td(outbound ? trans + " " + outbound : trans, trans);
+}
+function prepend(id, html) {
+	if (document.getElementById("pause").checked && id === "dns") {
+		return;
+	}
+	var table = document.getElementById(id);
+	var row = table.insertRow(1);
+	row.innerHTML = html;
+	while (table.rows.length > MAX_ROWS + 1) {
+		table.deleteRow(table.rows.length - 1);
+	}
+}
+function poll(path, interval, render) {
+	function tick() {
+		fetch(path).then(function (r) { return r.json(); }).then(render).catch(function () {});
+	}
+	tick();
+	setInterval(tick, interval);
+}
+
+poll("../cache/stats", 5000, function (stats) {
+	var html = "<tr><th>cache</th><th>size</th><th>max</th><th>hits</th><th>misses</th><th>hit rate</th><th>evictions</th></tr>";
+	Object.keys(stats).sort().forEach(function (name) {
+		var s = stats[name], n = s.hits + s.misses;
+		html += "<tr>" + td(name) + td(s.size) + td(s.max_entries || "-") + td(s.hits) + td(s.misses) +
+			td(n ? (100 * s.hits / n).toFixed(1) + "%" : "-") + td(s.evictions) + "</tr>";
+	});
+	document.getElementById("caches").innerHTML = html;
+});
+
+poll("../health", 5000, function (h) {
+	var html = "<tr><th>group</th><th>upstream</th><th>healthy</th><th>rtt</th><th>error rate</th></tr>";
+	Object.keys(h.upstreams || {}).sort().forEach(function (group) {
+		(h.upstreams[group] || []).forEach(function (u) {
+			html += "<tr>" + td(group + (u.secondary ? " (secondary)" : "")) + td(u.addr || "DoH") +
+				td(u.healthy ? "yes" : "no", u.healthy ? "" : "bad") + td(u.rtt || "-") +
+				td((100 * u.error_rate).toFixed(1) + "%") + "</tr>";
+		});
+	});
+	Object.keys(h.proxies || {}).sort().forEach(function (name) {
+		(h.proxies[name] || []).forEach(function (p) {
+			html += "<tr>" + td("proxy " + (name || "default")) + td(p.proxy) +
+				td(p.alive ? "yes" : "no", p.alive ? "" : "bad") + td(p.latency || "-") + td("") + "</tr>";
+		});
+	});
+	document.getElementById("upstreams").innerHTML = html;
+});
+
+poll("../proxy/conns", 2000, function (conns) {
+	var html = "<tr><th>since</th><th>client</th><th>destination</th><th>protocol</th><th>route</th></tr>";
+	conns.slice().reverse().slice(0, MAX_ROWS).forEach(function (c) {
+		var dest = c.host + ":" + c.port + (c.routed ? " (" + c.routed + ")" : "");
+		html += "<tr>" + td(clock(c.since)) + td(c.client) + td(dest, "wrap") + td(c.protocol || "") +
+			route(c.trans, c.outbound) + "</tr>";
+	});
+	document.getElementById("conns").innerHTML = html;
+	document.getElementById("nconns").textContent = conns.length;
+});
+
+function connect() {
+	var status = document.getElementById("status");
+	var es = new EventSource("../events?type=dns,route");
+	es.onopen = function () {
+		status.textContent = "live";
+		status.className = "";
+	};
+	es.onerror = function () {
+		status.textContent = "disconnected, retrying";
+		status.className = "down";
+	};
+	es.addEventListener("dns", function (m) {
+		var ev = JSON.parse(m.data), q = ev.dns;
+		prepend("dns", td(clock(ev.time)) + td(q.client) + td(q.name, "wrap") + td(q.qtype) +
+			(q.error ? td("failed", "bad") + td("") + td(q.error, "wrap bad") : route(q.trans, "") +
+				td(q.rcode, q.rcode === "NOERROR" ? "" : "muted") + td((q.answers || []).join(" "), "wrap")) +
+			td(q.duration));
+	});
+	es.addEventListener("route", function (m) {
+		var ev = JSON.parse(m.data), d = ev.route;
+		var dest = (d.domain || d.ip) + (d.port ? ":" + d.port : "") + (d.protocol ? " " + d.protocol : "");
+		prepend("route", td(clock(ev.time)) + td(d.client || "") + td(dest, "wrap") + route(d.trans, d.outbound));
+	});
+}
+connect();
+</script>
+</body>
+</html>
+`
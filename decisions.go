@@ -0,0 +1,117 @@
+package dnsproxy
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// routing decisions learned by probing, portable among instances so that a fleet shares what each one has learned,
+// such as {"domains": {"example.com": "proxy"}, "ips": {"93.184.216.34": "proxy"}}
+type Decisions struct {
+	Domains map[string]Transport `json:"domains"`
+	IPs     map[string]Transport `json:"ips"`
+}
+
+// load decisions from json file `fpath` exported by Server.ExportDecisions
+func LoadDecisions(fpath string) (*Decisions, error) {
+	file, err := os.Open(fpath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	d := new(Decisions)
+	if err = json.NewDecoder(file).Decode(d); err != nil {
+		return nil, errors.Wrapf(err, "decode decisions %s", filepath.Base(fpath))
+	}
+	return d, nil
+}
+
+// --- impl *Server
+
+// the default routing policy, which may be the fallback of a *RulePolicy, nil if not used
+func (s *Server) defaultRoutingPolicy() *DefaultRoutingPolicy {
+	policy := s.policy
+	if rp, ok := policy.(*RulePolicy); ok {
+		policy = rp.Fallback()
+	}
+	dp, _ := policy.(*DefaultRoutingPolicy)
+	return dp
+}
+
+// decisions shared by all clients and routed through the default proxy chains,
+// i.e. cached ones which are not client scoped nor routed through named outbounds, and learned or poisoned ones,
+// domains in the gfw list, the obedient list or user rules are left out as every instance has its own ones
+func (s *Server) ExportDecisions() *Decisions {
+	d := &Decisions{Domains: make(map[string]Transport), IPs: make(map[string]Transport)}
+	dp := s.defaultRoutingPolicy()
+	if dp != nil {
+		for domain, t := range dp.learned {
+			d.Domains[domain] = t
+		}
+		for _, domain := range dp.PoisonedDomains() {
+			d.Domains[domain] = TRANS_PROXY
+		}
+	}
+	for key, item := range s.domaincache.inner.Items() {
+		scope, key := splitScopedCacheKey(key)
+		domain, qtype, ok := splitDomaincacheKey(key)
+		if !ok || scope != "" || qtype != dns.TypeA && qtype != dns.TypeAAAA {
+			continue
+		}
+		cell := item.Object.(*DomainCacheCell)
+		if cell.ip == nil || cell.outbound != "" {
+			continue
+		}
+		if dp != nil {
+			if gfw, obedient := dp.MatchDomainLists(domain); gfw || obedient {
+				continue
+			}
+			if _, ok := dp.DomainRules().Match(domain); ok {
+				continue
+			}
+		}
+		// A records decide domains answered by both A and AAAA records
+		if _, ok := d.Domains[domain]; !ok || qtype == dns.TypeA {
+			d.Domains[domain] = cell.trans
+		}
+	}
+	for key, item := range s.ipcache.inner.Items() {
+		scope, ip := splitScopedCacheKey(key)
+		if v := item.Object.(ipcacheItem); scope == "" && v.outbound == "" && v.trans != TRANS_REJECT {
+			d.IPs[ip] = v.trans
+		}
+	}
+	return d
+}
+
+// route domains and ips by decisions exported by other instances instead of probing them,
+// cached decisions of this instance take precedence over imported ips,
+// domains can only be imported if the default routing policy is used, must be called before serving
+func (s *Server) ImportDecisions(d *Decisions) error {
+	for ip, t := range d.IPs {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return errors.Errorf("invalid ip %q in decisions", ip)
+		}
+		s.ipcache.AddLongLived("", parsed.String(), t, "")
+	}
+	if len(d.Domains) == 0 {
+		return nil
+	}
+	dp := s.defaultRoutingPolicy()
+	if dp == nil {
+		return errors.New("domain decisions require the default routing policy")
+	}
+	learned := make(map[string]Transport, len(d.Domains))
+	for domain, t := range d.Domains {
+		learned[normalizeDomain(domain)] = t
+	}
+	dp.SetLearnedDomains(learned)
+	return nil
+}
@@ -0,0 +1,281 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	_DHCP_LEASE_TTL = 60 // TTL of answers from leases, shorter if the lease expires earlier
+
+	// lease files are checked for modification at most this often, by queries rather than a timer
+	_DHCP_LEASES_CHECK_INTERVAL = 5 * time.Second
+)
+
+// search domain which some routers hand out by DHCP, names under it are never forwarded upstream
+const _DHCP_HOST_DOMAIN = `dhcp\ host`
+
+// a hostname a DHCP client asked for and the address leased to it
+type DHCPLease struct {
+	Hostname string // lower case single label
+	IP       net.IP
+	Expiry   time.Time // zero if the lease never expires
+}
+
+// lease files of dnsmasq (dhcp-leasefile, such as /tmp/dhcp.leases of OpenWrt)
+// and odhcpd (leasefile, such as /tmp/hosts/odhcpd), malformed lines and leases without hostnames are skipped:
+//
+//	1700000000 aa:bb:cc:dd:ee:ff 192.168.1.100 nas 01:aa:bb:cc:dd:ee:ff
+//	# br-lan 000100012... 1a2b3c4d nas 1700000000 1a 128 fd00::1a/128
+func ParseDHCPLeases(r io.Reader) ([]DHCPLease, error) {
+	var leases []DHCPLease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[0] == "#" {
+			leases = append(leases, parseOdhcpdLease(fields[1:])...)
+		} else if lease, ok := parseDnsmasqLease(fields); ok {
+			leases = append(leases, lease)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return leases, nil
+}
+
+// "<expiry> <mac or iaid> <ip> <hostname or *> <client id or *>", where expiry 0 is infinite,
+// the "duid" line of DHCPv6 leases is skipped as malformed
+func parseDnsmasqLease(fields []string) (DHCPLease, bool) {
+	if len(fields) < 4 || fields[3] == "*" {
+		return DHCPLease{}, false
+	}
+	expiry, err := strconv.ParseInt(fields[0], 10, 64)
+	ip := net.ParseIP(fields[2])
+	if err != nil || ip == nil {
+		return DHCPLease{}, false
+	}
+	lease := DHCPLease{Hostname: strings.ToLower(fields[3]), IP: ip}
+	if expiry > 0 {
+		lease.Expiry = time.Unix(expiry, 0)
+	}
+	return lease, true
+}
+
+// "<interface> <duid or mac> <iaid> <hostname or -> <expiry> <assignment> <prefix length> <ip/prefix length>...",
+// where expiry -1 is infinite
+func parseOdhcpdLease(fields []string) []DHCPLease {
+	if len(fields) < 8 || fields[3] == "-" || fields[3] == "" {
+		return nil
+	}
+	expiry, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return nil
+	}
+	var leases []DHCPLease
+	for _, addr := range fields[7:] {
+		if i := strings.IndexByte(addr, '/'); i >= 0 {
+			addr = addr[:i]
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		lease := DHCPLease{Hostname: strings.ToLower(fields[3]), IP: ip}
+		if expiry >= 0 {
+			lease.Expiry = time.Unix(expiry, 0)
+		}
+		leases = append(leases, lease)
+	}
+	return leases
+}
+
+// hostnames of LAN hosts answered from the lease files of the DHCP server,
+// as both "nas" and "nas.lan" if the domain is "lan", and as "nas.DHCP HOST" which some routers hand out,
+// PTR queries of leased ips are answered too, files are read again once modified
+//
+// safe for concurrent use
+type DHCPLeases struct {
+	domain string   // lower case, such as "lan", empty if hostnames are answered as single labels only
+	files  []string // lease files
+
+	mu       sync.Mutex
+	checked  time.Time              // last time the files were checked for modification
+	modTimes []time.Time            // of files when they were read
+	hosts    map[string][]DHCPLease // hostname -> leases
+	ips      map[string]DHCPLease   // ip -> lease
+}
+
+// --- impl *DHCPLeases
+func NewDHCPLeases(domain string, files ...string) *DHCPLeases {
+	return &DHCPLeases{domain: normalizeDomain(domain), files: files, modTimes: make([]time.Time, len(files))}
+}
+
+// read the lease files again if any of them is modified, files not existing yet are of no lease,
+// the old leases are kept if failed
+func (l *DHCPLeases) Load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.load()
+}
+
+func (l *DHCPLeases) load() error {
+	l.checked = time.Now()
+	modTimes := make([]time.Time, len(l.files))
+	modified := l.hosts == nil
+	for i, f := range l.files {
+		if info, err := os.Stat(f); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+		modified = modified || !modTimes[i].Equal(l.modTimes[i])
+	}
+	if !modified {
+		return nil
+	}
+
+	hosts := make(map[string][]DHCPLease)
+	ips := make(map[string]DHCPLease)
+	for _, f := range l.files {
+		file, err := os.Open(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		leases, err := ParseDHCPLeases(file)
+		file.Close()
+		if err != nil {
+			return errors.WithMessage(err, f)
+		}
+		for _, lease := range leases {
+			hosts[lease.Hostname] = append(hosts[lease.Hostname], lease)
+			ips[lease.IP.String()] = lease
+		}
+	}
+	l.hosts, l.ips, l.modTimes = hosts, ips, modTimes
+	glog.V(1).Infof("%d DHCP leases loaded\n", len(ips))
+	return nil
+}
+
+// hostname of `name` if it is a single label or under the lease domain or _DHCP_HOST_DOMAIN
+func (l *DHCPLeases) hostname(name string) (string, bool) {
+	name = normalizeDomain(name)
+	if i := strings.IndexByte(name, '.'); i < 0 {
+		return name, name != ""
+	} else if suffix := name[i+1:]; suffix == _DHCP_HOST_DOMAIN || (l.domain != "" && suffix == l.domain) {
+		return name[:i], true
+	}
+	return "", false
+}
+
+// TTL of answers of `lease`, false if it has expired
+func dhcpLeaseTTL(lease DHCPLease, now time.Time) (uint32, bool) {
+	if lease.Expiry.IsZero() {
+		return _DHCP_LEASE_TTL, true
+	}
+	left := lease.Expiry.Sub(now) / time.Second
+	if left <= 0 {
+		return 0, false
+	}
+	if left > _DHCP_LEASE_TTL {
+		left = _DHCP_LEASE_TTL
+	}
+	return uint32(left), true
+}
+
+// answer `req` if the questioned name is a leased hostname, or the reverse name of a leased ip
+func (l *DHCPLeases) Lookup(req *dns.Msg) (*dns.Msg, bool) {
+	if len(req.Question) == 0 {
+		return nil, false
+	}
+	q := req.Question[0]
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.checked) >= _DHCP_LEASES_CHECK_INTERVAL {
+		if err := l.load(); err != nil {
+			glog.Warningf("load DHCP leases: %s\n", err)
+		}
+	}
+	now := time.Now()
+
+	if q.Qtype == dns.TypePTR {
+		ip := ReverseNameToIP(q.Name)
+		if ip == nil {
+			return nil, false
+		}
+		lease, ok := l.ips[ip.String()]
+		if !ok {
+			return nil, false
+		}
+		ttl, ok := dhcpLeaseTTL(lease, now)
+		if !ok {
+			return nil, false
+		}
+		ptr := lease.Hostname
+		if l.domain != "" {
+			ptr += "." + l.domain
+		}
+		resp := MsgNewReplyFromReq(req, &dns.PTR{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: dns.Fqdn(ptr),
+		})
+		resp.Authoritative = true
+		return resp, true
+	}
+
+	host, ok := l.hostname(q.Name)
+	if !ok {
+		return nil, false
+	}
+	// answer no data for other query types of leased hostnames
+	var answer []dns.RR
+	leased := false
+	for _, lease := range l.hosts[host] {
+		ttl, ok := dhcpLeaseTTL(lease, now)
+		if !ok {
+			continue
+		}
+		leased = true
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: ttl}
+		switch ip4 := lease.IP.To4(); {
+		case q.Qtype == dns.TypeA && ip4 != nil:
+			hdr.Rrtype = dns.TypeA
+			answer = append(answer, &dns.A{Hdr: hdr, A: ip4})
+		case q.Qtype == dns.TypeAAAA && ip4 == nil:
+			hdr.Rrtype = dns.TypeAAAA
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: lease.IP})
+		}
+	}
+	if !leased {
+		return nil, false
+	}
+	resp := MsgNewReplyFromReq(req, answer...)
+	resp.Authoritative = true
+	return resp, true
+}
+
+// number of leases, expired ones included
+func (l *DHCPLeases) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.ips)
+}
+
+// --- impl *Server
+
+// answer hostnames of LAN hosts and reverse names of their ips from `l`, nil to disable, must be called before serving
+func (s *Server) SetDHCPLeases(l *DHCPLeases) {
+	s.leases = l
+}
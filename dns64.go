@@ -0,0 +1,141 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// well-known prefix of DNS64 and NAT64, see RFC 6052
+const DNS64_WELL_KNOWN_PREFIX = "64:ff9b::/96"
+
+// DNS64 synthesizing AAAA records from A records for IPv6-only clients behind NAT64, see RFC 6147
+type DNS64 struct {
+	prefix    net.IP // 16 bytes
+	prefixLen int    // in bytes, one of 4, 5, 6, 7, 8 and 12
+}
+
+// --- impl *DNS64
+
+// `prefix` is a cidr of length 32, 40, 48, 56, 64 or 96, empty for DNS64_WELL_KNOWN_PREFIX
+func NewDNS64(prefix string) (*DNS64, error) {
+	if prefix == "" {
+		prefix = DNS64_WELL_KNOWN_PREFIX
+	}
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil || ip.To4() != nil {
+		return nil, errors.Errorf("invalid dns64 prefix %q", prefix)
+	}
+	ones, _ := ipnet.Mask.Size()
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, errors.Errorf("invalid dns64 prefix %q: length must be 32, 40, 48, 56, 64 or 96", prefix)
+	}
+	if !ip.Equal(ipnet.IP) {
+		return nil, errors.Errorf("invalid dns64 prefix %q: host bits are set", prefix)
+	}
+	// bits 64 to 71 are reserved, see RFC 6052 section 2.2
+	if ones < 96 && ipnet.IP[8] != 0 {
+		return nil, errors.Errorf("invalid dns64 prefix %q: bits 64 to 71 must be zero", prefix)
+	}
+	return &DNS64{prefix: ipnet.IP.To16(), prefixLen: ones / 8}, nil
+}
+
+// embed `ip4` into the prefix, skipping the reserved octet
+func (d *DNS64) Synthesize(ip4 net.IP) net.IP {
+	ip4 = ip4.To4()
+	if ip4 == nil {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.prefix)
+	pos := d.prefixLen
+	for _, b := range ip4 {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// reverse of Synthesize, nil if `ip` is not in the prefix
+func (d *DNS64) Extract(ip net.IP) net.IP {
+	if ip.To4() != nil || len(ip) != net.IPv6len || !bytes.Equal(ip[:d.prefixLen], d.prefix[:d.prefixLen]) {
+		return nil
+	}
+	ip4 := make(net.IP, net.IPv4len)
+	pos := d.prefixLen
+	for i := range ip4 {
+		if pos == 8 {
+			pos++
+		}
+		ip4[i] = ip[pos]
+		pos++
+	}
+	return ip4
+}
+
+// check if `resp` answers no usable AAAA record, addresses mapped from ipv4 are excluded, see RFC 6147 section 5.1.4
+func dns64Needed(resp *dns.Msg) bool {
+	if resp.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	for _, ans := range resp.Answer {
+		if aaaa, ok := ans.(*dns.AAAA); ok && aaaa.AAAA.To4() == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// --- impl *Server
+
+// synthesize AAAA records of queries whose names have only A records, nil to disable,
+// proxy requests to synthesized addresses are routed as the ipv4 addresses they embed,
+// must be called before serving
+func (s *Server) SetDNS64(d *DNS64) {
+	s.dns64 = d
+}
+
+// resolve `req` as resolveQuery, then answer AAAA queries by A records of the same name if no AAAA record is answered,
+// queries with both DO and CD set are never synthesized, as the client validates DNSSEC by itself
+func (s *Server) resolveDNS64(ctx context.Context, req *dns.Msg, client net.IP) (*dns.Msg, Transport, error) {
+	resp, trans, err := s.resolveQuery(ctx, req, client)
+	if err != nil || len(req.Question) == 0 || req.Question[0].Qtype != dns.TypeAAAA || !dns64Needed(resp) {
+		return resp, trans, err
+	}
+	if opt := req.IsEdns0(); opt != nil && opt.Do() && req.CheckingDisabled {
+		return resp, trans, err
+	}
+
+	reqA := MsgShallowCopy(req)
+	reqA.Question[0].Qtype = dns.TypeA
+	respA, transA, err := s.resolveQuery(ctx, reqA, client)
+	if err != nil || respA.Rcode != dns.RcodeSuccess {
+		// the AAAA response stands
+		return resp, trans, nil
+	}
+	var answers []dns.RR
+	for _, ans := range respA.Answer {
+		switch v := ans.(type) {
+		case *dns.A:
+			hdr := v.Hdr
+			hdr.Rrtype, hdr.Rdlength = dns.TypeAAAA, 0
+			answers = append(answers, &dns.AAAA{Hdr: hdr, AAAA: s.dns64.Synthesize(v.A)})
+		case *dns.CNAME:
+			answers = append(answers, dns.Copy(v))
+		}
+	}
+	if len(answers) == 0 {
+		return resp, trans, nil
+	}
+	synthesized := MsgNewReplyFromReq(req, answers...)
+	synthesized.AuthenticatedData = false
+	return synthesized, transA, nil
+}
@@ -0,0 +1,268 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	_DNS_CONN_IDLE_TIMEOUT = 30 * time.Second // idle pooled conns are closed after this
+	_DNS_CONN_MAX_INFLIGHT = 16               // a new conn is dialed if all conns are this busy
+	_DNS_CONN_MAX_CONNS    = 4
+)
+
+// pool of dns over tcp connections to one nameserver,
+// queries are pipelined on the connections and responses are matched by message ID
+type dnsConnPool struct {
+	dial func(ctx context.Context) (net.Conn, error)
+
+	mu      sync.Mutex
+	conns   []*pipelinedDnsConn
+	dialing int // conns being dialed, which take slots of _DNS_CONN_MAX_CONNS
+}
+
+// --- impl *dnsConnPool
+func newDnsConnPool(dial func(ctx context.Context) (net.Conn, error)) *dnsConnPool {
+	return &dnsConnPool{dial: dial}
+}
+
+// exchange `req` on a pooled conn until `ctx` is done
+func (p *dnsConnPool) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	c, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.exchange(ctx, req)
+}
+
+// the least busy alive conn, dial a new one within `ctx` if all conns are busy,
+// the pool is not locked during the dial, which would hold up queries on alive conns
+func (p *dnsConnPool) get(ctx context.Context) (*pipelinedDnsConn, error) {
+	p.mu.Lock()
+
+	var best *pipelinedDnsConn
+	alive := p.conns[:0]
+	for _, c := range p.conns {
+		if c.isClosed() {
+			continue
+		}
+		alive = append(alive, c)
+		if best == nil || c.inflight() < best.inflight() {
+			best = c
+		}
+	}
+	p.conns = alive
+	if best != nil && (best.inflight() < _DNS_CONN_MAX_INFLIGHT || len(p.conns)+p.dialing >= _DNS_CONN_MAX_CONNS) {
+		p.mu.Unlock()
+		return best, nil
+	}
+	p.dialing++
+	p.mu.Unlock()
+
+	conn, err := p.dial(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	c := newPipelinedDnsConn(conn)
+	p.conns = append(p.conns, c)
+	return c, nil
+}
+
+// dns over tcp connection which sends queries without waiting for previous responses,
+// queries of different clients are given distinct message IDs on the wire, and responses are matched
+// in whatever order they arrive by the ID along with the question, so late responses of abandoned queries
+// never answer later queries reusing their IDs
+type pipelinedDnsConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex // writes of frames must not interleave
+
+	mu      sync.Mutex
+	nextID  uint16
+	pending map[uint16]pendingDnsQuery // by wire message ID
+	idle    *time.Timer
+	closed  chan struct{}
+	err     error
+}
+
+// query waiting for its response on a pipelinedDnsConn
+type pendingDnsQuery struct {
+	question []dns.Question
+	recv     chan *dns.Msg
+}
+
+// --- impl pendingDnsQuery
+
+// check if `resp` answers the query, servers may change the case of names, see RFC 4343
+func (q pendingDnsQuery) answeredBy(resp *dns.Msg) bool {
+	if len(resp.Question) != len(q.question) {
+		// e.g. FORMERR responses without the question, which are still matched by ID
+		return len(resp.Question) == 0
+	}
+	for i, rq := range resp.Question {
+		if rq.Qtype != q.question[i].Qtype || rq.Qclass != q.question[i].Qclass || !strings.EqualFold(rq.Name, q.question[i].Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// --- impl *pipelinedDnsConn
+func newPipelinedDnsConn(conn net.Conn) *pipelinedDnsConn {
+	c := &pipelinedDnsConn{
+		conn:    conn,
+		nextID:  dns.Id(),
+		pending: make(map[uint16]pendingDnsQuery),
+		closed:  make(chan struct{}),
+	}
+	c.idle = time.AfterFunc(_DNS_CONN_IDLE_TIMEOUT, c.closeIfIdle)
+	go c.readLoop()
+	return c
+}
+
+func (c *pipelinedDnsConn) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// rewrite the message ID, as concurrent queries may share the same ID
+	recv := make(chan *dns.Msg, 1)
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	if len(c.pending) > math.MaxUint16 {
+		c.mu.Unlock()
+		return nil, errors.New("all dns message IDs are in flight")
+	}
+	id := c.nextID
+	for _, ok := c.pending[id]; ok; _, ok = c.pending[id] {
+		id++
+	}
+	c.nextID = id + 1
+	c.pending[id] = pendingDnsQuery{question: req.Question, recv: recv}
+	c.idle.Stop()
+	c.mu.Unlock()
+	defer c.release(id)
+
+	_req := *req
+	_req.Id = id
+	b, err := _req.Pack()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	// the zero deadline clears the one of the previous write
+	deadline, _ := ctx.Deadline()
+	c.writeMu.Lock()
+	c.conn.SetWriteDeadline(deadline)
+	_, err = c.conn.Write(frame)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(errors.WithStack(err))
+		return nil, c.closeErr()
+	}
+
+	select {
+	case resp := <-recv:
+		resp.Id = req.Id
+		return resp, nil
+	case <-c.closed:
+		return nil, c.closeErr()
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "dns query to %s", c.conn.RemoteAddr())
+	}
+}
+
+func (c *pipelinedDnsConn) release(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+	if len(c.pending) == 0 && !c.isClosed() {
+		c.idle.Reset(_DNS_CONN_IDLE_TIMEOUT)
+	}
+}
+
+func (c *pipelinedDnsConn) readLoop() {
+	var l [2]byte
+	for {
+		if _, err := io.ReadFull(c.conn, l[:]); err != nil {
+			c.close(errors.WithStack(err))
+			return
+		}
+		b := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(c.conn, b); err != nil {
+			c.close(errors.WithStack(err))
+			return
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(b); err != nil && err != dns.ErrTruncated {
+			continue
+		}
+
+		c.mu.Lock()
+		q, ok := c.pending[resp.Id]
+		c.mu.Unlock()
+		if ok && q.answeredBy(resp) {
+			select {
+			case q.recv <- resp:
+			default: // duplicated response
+			}
+		}
+	}
+}
+
+func (c *pipelinedDnsConn) inflight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+func (c *pipelinedDnsConn) closeIfIdle() {
+	if c.inflight() == 0 {
+		c.close(errors.New("dns conn closed for being idle"))
+	}
+}
+
+func (c *pipelinedDnsConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed() {
+		return
+	}
+	c.err = err
+	close(c.closed)
+	c.idle.Stop()
+	c.conn.Close()
+}
+
+// why the conn is closed
+func (c *pipelinedDnsConn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *pipelinedDnsConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
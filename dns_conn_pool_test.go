@@ -0,0 +1,55 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// queries on alive conns are not held up by a conn being dialed
+func TestDnsConnPoolGetWhileDialing(t *testing.T) {
+	dialed, release := make(chan struct{}, 1), make(chan struct{})
+	first := true
+	p := newDnsConnPool(func(ctx context.Context) (net.Conn, error) {
+		if !first {
+			dialed <- struct{}{}
+			<-release
+		}
+		first = false
+		c, _ := net.Pipe()
+		return c, nil
+	})
+	defer close(release)
+
+	c, err := p.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close(nil)
+	// busy, so that the next get dials
+	c.mu.Lock()
+	for id := uint16(0); id < _DNS_CONN_MAX_INFLIGHT; id++ {
+		c.pending[id] = pendingDnsQuery{}
+	}
+	c.mu.Unlock()
+	go p.get(context.Background())
+	<-dialed
+
+	c.mu.Lock()
+	c.pending = make(map[uint16]pendingDnsQuery)
+	c.mu.Unlock()
+	got := make(chan *pipelinedDnsConn, 1)
+	go func() {
+		_c, _ := p.get(context.Background())
+		got <- _c
+	}()
+	select {
+	case _c := <-got:
+		if _c != c {
+			t.Errorf("got another conn than the idle one")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("get is held up by the dial")
+	}
+}
@@ -0,0 +1,179 @@
+package dnsproxy
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// idle token buckets are dropped this often
+const _DNS_LIMIT_SWEEP_INTERVAL = time.Minute
+
+// what to do with a dns response, see DNSLimiter
+type dnsLimitAction int8
+
+const (
+	_DNS_LIMIT_SEND     dnsLimitAction = iota
+	_DNS_LIMIT_TRUNCATE                // reply with an empty truncated response, so that real clients retry over tcp
+	_DNS_LIMIT_DROP
+)
+
+// abuse protection of ServeDNS, enforced before looking up anything:
+//   - clients out of the allowed subnets are refused
+//   - queries of each client ip beyond `qps` with bursts of `burst` are dropped
+//   - response rate limiting (RRL) of udp: identical responses to the same /24 (ipv4) or /56 (ipv6) subnet
+//     beyond `rrlRPS` are dropped, except every `slip`th of them is truncated
+//
+// zero rates disable the limits, all methods are safe for concurrent use
+type DNSLimiter struct {
+	allowed *IPNetMatcher // nil to allow all clients
+
+	qps, burst       float64
+	rrlRPS, rrlBurst float64
+	slip             int
+
+	mu        sync.Mutex
+	clients   map[string]*tokenBucket // client ip -> bucket
+	responses map[string]*tokenBucket // subnet, name, type and rcode of responses -> bucket
+	lastSweep time.Time
+}
+
+// --- impl *DNSLimiter
+func NewDNSLimiter(qps, burst, rrlRPS float64, slip int) *DNSLimiter {
+	// at least a whole token is needed to answer
+	if burst < qps {
+		burst = qps
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	rrlBurst := rrlRPS
+	if rrlBurst < 1 {
+		rrlBurst = 1
+	}
+	return &DNSLimiter{
+		qps:       qps,
+		burst:     burst,
+		rrlRPS:    rrlRPS,
+		rrlBurst:  rrlBurst,
+		slip:      slip,
+		clients:   make(map[string]*tokenBucket),
+		responses: make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// only answer clients in `subnets`, all clients are answered if it is empty
+func (l *DNSLimiter) SetAllowedClients(subnets []*net.IPNet) {
+	if len(subnets) == 0 {
+		l.allowed = nil
+		return
+	}
+	l.allowed = NewIPNetMatcher(subnets)
+}
+
+// check if a query from `client` is allowed, refused tells whether to reply REFUSED or drop it silently
+func (l *DNSLimiter) allowQuery(client net.IP) (ok, refused bool) {
+	if l.allowed != nil && (client == nil || !l.allowed.Match(client)) {
+		return false, true
+	}
+	if l.qps <= 0 || client == nil {
+		return true, false
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.clients[client.String()]
+	if !ok {
+		b = newTokenBucket(l.burst, now)
+		l.clients[client.String()] = b
+	}
+	return b.take(l.qps, l.burst, now), false
+}
+
+// response rate limiting of `resp` to `client` over udp
+func (l *DNSLimiter) limitResponse(client net.IP, resp *dns.Msg) dnsLimitAction {
+	if l.rrlRPS <= 0 || client == nil || len(resp.Question) == 0 {
+		return _DNS_LIMIT_SEND
+	}
+	q := resp.Question[0]
+	key := rrlSubnet(client) + "/" + q.Name + "/" + strconv.Itoa(int(q.Qtype)) + "/" + strconv.Itoa(resp.Rcode)
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.responses[key]
+	if !ok {
+		b = newTokenBucket(l.rrlBurst, now)
+		l.responses[key] = b
+	}
+	if b.take(l.rrlRPS, l.rrlBurst, now) {
+		return _DNS_LIMIT_SEND
+	}
+	b.limited++
+	if l.slip > 0 && b.limited%l.slip == 0 {
+		return _DNS_LIMIT_TRUNCATE
+	}
+	return _DNS_LIMIT_DROP
+}
+
+// drop buckets which are full again, i.e. idle for a while, must be called with l.mu held
+func (l *DNSLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < _DNS_LIMIT_SWEEP_INTERVAL {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.clients {
+		if b.refill(l.qps, l.burst, now) >= l.burst {
+			delete(l.clients, k)
+		}
+	}
+	for k, b := range l.responses {
+		if b.refill(l.rrlRPS, l.rrlBurst, now) >= l.rrlBurst {
+			delete(l.responses, k)
+		}
+	}
+}
+
+// "1.2.3.0" of 1.2.3.4, "2001:db8:0:100::" of 2001:db8:0:123::1
+func rrlSubnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(56, 128)).String()
+}
+
+type tokenBucket struct {
+	tokens  float64
+	last    time.Time
+	limited int // times limited, for slipping truncated responses
+}
+
+// --- impl *tokenBucket
+func newTokenBucket(burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: burst, last: now}
+}
+
+// tokens after refilled at `rate` per second up to `burst`
+func (b *tokenBucket) refill(rate, burst float64, now time.Time) float64 {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	return b.tokens
+}
+
+// take a token if there is any
+func (b *tokenBucket) take(rate, burst float64, now time.Time) bool {
+	if b.refill(rate, burst, now) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
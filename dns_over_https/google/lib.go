@@ -3,6 +3,8 @@ package google
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 
@@ -11,6 +13,9 @@ import (
 
 const DEFAULT_DNS_SERVER = "https://dns.google.com/resolve"
 
+// max bytes drained after a response is decoded, connections with more left are closed instead of being reused
+const maxRespSize = 64 * 1024
+
 // --- partially copied from https://github.com/wrouesnel/dns-over-https-proxy/blob/master/dns-over-https-proxy.go
 // Rough translation of the Google DNS over HTTP API
 type RespRepr struct {
@@ -47,6 +52,12 @@ type DNSRR struct {
 // name: Domian name to resolve. Example: `twitter.com`, `twitter.com.`
 // ecs(optional): edns client subnet, `0.0.0.0/0` as default if empty. Example: `0.0.0.0/0`
 func Query(rt http.RoundTripper, qtype uint16, name string, ecs ...string) (*RespRepr, error) {
+	return QueryServer(rt, DEFAULT_DNS_SERVER, qtype, name, ecs...)
+}
+
+// Same as Query, but against a Google-compatible JSON API server other than DEFAULT_DNS_SERVER
+// server: Example: `https://cloudflare-dns.com/dns-query`
+func QueryServer(rt http.RoundTripper, server string, qtype uint16, name string, ecs ...string) (*RespRepr, error) {
 	vs := make(url.Values, 3)
 	vs.Add("name", name)
 	vs.Add("type", fmt.Sprintf("%v", qtype))
@@ -58,11 +69,12 @@ func Query(rt http.RoundTripper, qtype uint16, name string, ecs ...string) (*Res
 		vs.Add("edns_client_subnet", _ecs)
 	}
 
-	_url := fmt.Sprintf("%s?%s", DEFAULT_DNS_SERVER, vs.Encode())
+	_url := fmt.Sprintf("%s?%s", server, vs.Encode())
 	req, err := http.NewRequest(http.MethodGet, _url, nil)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	req.Header.Set("Accept", "application/dns-json")
 
 	resp, err := rt.RoundTrip(req)
 	if err != nil {
@@ -74,5 +86,7 @@ func Query(rt http.RoundTripper, qtype uint16, name string, ecs ...string) (*Res
 	repr := new(RespRepr)
 	d := json.NewDecoder(resp.Body)
 	err = d.Decode(repr)
+	// read through the rest such as the trailing newline, so that the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxRespSize))
 	return repr, errors.WithStack(err)
 }
@@ -0,0 +1,102 @@
+package rfc8484
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// media type of DNS wire format messages, see https://tools.ietf.org/html/rfc8484#section-6
+const CONTENT_TYPE = "application/dns-message"
+
+// max size of a DNS message, responses larger than this are rejected
+const maxMsgSize = 65535
+
+// Performs a DNS over HTTPS exchange in wire format
+// server: URI template without variables. Example: `https://cloudflare-dns.com/dns-query`
+// method: `GET` or `POST`, `GET` as default if empty
+// msg: packed DNS query, its ID should be 0 to be cache friendly
+func Exchange(rt http.RoundTripper, server, method string, msg []byte) ([]byte, error) {
+	var req *http.Request
+	var err error
+	switch method {
+	case "", http.MethodGet:
+		sep := "?"
+		if strings.Contains(server, "?") {
+			sep = "&"
+		}
+		_url := fmt.Sprintf("%s%sdns=%s", server, sep, base64.RawURLEncoding.EncodeToString(msg))
+		req, err = http.NewRequest(http.MethodGet, _url, nil)
+	case http.MethodPost:
+		req, err = http.NewRequest(http.MethodPost, server, bytes.NewReader(msg))
+		if err == nil {
+			req.Header.Set("Content-Type", CONTENT_TYPE)
+		}
+	default:
+		return nil, errors.Errorf("unsupported http method %q", method)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Accept", CONTENT_TYPE)
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s: unexpected http status %s", server, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, CONTENT_TYPE) {
+		return nil, errors.Errorf("%s: unexpected content type %q", server, ct)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMsgSize+1))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(b) > maxMsgSize {
+		return nil, errors.Errorf("%s: response too large", server)
+	}
+	return b, nil
+}
+
+// Reads the packed DNS query of a DNS over HTTPS request in wire format, for servers
+// GET: the base64url encoded `dns` parameter
+// POST: the request body, whose content type must be CONTENT_TYPE
+func ReadRequest(req *http.Request) ([]byte, error) {
+	switch req.Method {
+	case http.MethodGet:
+		s := req.URL.Query().Get("dns")
+		if s == "" {
+			return nil, errors.New("missing dns parameter")
+		}
+		// padding is not allowed by the RFC, but accept it anyway
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return b, nil
+	case http.MethodPost:
+		if ct := req.Header.Get("Content-Type"); !strings.HasPrefix(ct, CONTENT_TYPE) {
+			return nil, errors.Errorf("unexpected content type %q", ct)
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(req.Body, maxMsgSize+1))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(b) > maxMsgSize {
+			return nil, errors.New("request too large")
+		}
+		return b, nil
+	default:
+		return nil, errors.Errorf("unsupported http method %q", req.Method)
+	}
+}
@@ -0,0 +1,77 @@
+package dnsproxytest
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// times of picking another port if the tcp one is taken after the udp one is bound
+const _DNS_SERVER_LISTEN_ATTEMPTS = 10
+
+// nameserver on loopback answering by an Exchanger over both udp and tcp of the same port,
+// for end-to-end tests of ServeDNS and ServeProxy which query nameservers by address
+type DNSServer struct {
+	e   *Exchanger
+	udp net.PacketConn
+	tcp net.Listener
+
+	srvs []*dns.Server
+}
+
+// --- impl *DNSServer
+
+// serve `e` on a random port of 127.0.0.1 until Close
+func NewDNSServer(e *Exchanger) (*DNSServer, error) {
+	s := &DNSServer{e: e}
+	var err error
+	for i := 0; i < _DNS_SERVER_LISTEN_ATTEMPTS; i++ {
+		if s.udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if s.tcp, err = net.Listen("tcp", s.udp.LocalAddr().String()); err == nil {
+			break
+		}
+		s.udp.Close()
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// started before returning, so that Close shuts them down
+	for _, srv := range []*dns.Server{{PacketConn: s.udp, Handler: s}, {Listener: s.tcp, Handler: s}} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		s.srvs = append(s.srvs, srv)
+	}
+	return s, nil
+}
+
+// such as "127.0.0.1:53535"
+func (s *DNSServer) Addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+// shut down the servers without waiting for connections in flight, such as pipelined ones of dns transports,
+// the udp one retries reading its closed conn in a busy loop unless it is shut down
+func (s *DNSServer) Close() error {
+	for _, srv := range s.srvs {
+		go srv.Shutdown()
+	}
+	return nil
+}
+
+// --- impl dns.Handler for *DNSServer
+func (s *DNSServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp, err := s.e.resolve(context.Background(), req)
+	if err == ErrNoResponse {
+		return
+	}
+	if err != nil {
+		resp = new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
+	}
+	w.WriteMsg(resp)
+}
@@ -0,0 +1,140 @@
+// fakes of the upstreams of dnsproxy for tests of code built on it without external network access:
+// Exchanger answers in memory, DNSServer serves it as a nameserver on loopback,
+// and Socks5Server stands for the proxy, e.g.
+//
+//	abroad := dnsproxytest.NewExchanger()
+//	abroad.AddRecords("www.google.com. 60 IN A 10.0.0.1")
+//	ns, _ := dnsproxytest.NewDNSServer(abroad)
+//	defer ns.Close()
+//	proxy, _ := dnsproxytest.NewSocks5Server()
+//	defer proxy.Close()
+//	// dnsproxy.NewDnsTransport(ns.Addr(), "udp", nil), gost.ParseProxyNode("socks5://" + proxy.Addr()) ...
+package dnsproxytest
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// dnsproxy.DNSExchanger answering from records in memory instead of nameservers,
+// names without any record are answered NXDOMAIN, and CNAME records are answered to every type without being followed,
+// names failed by SetError are answered SERVFAIL by DNSServer, or never answered if the error is ErrNoResponse,
+// safe for concurrent use
+type Exchanger struct {
+	mu      sync.Mutex
+	records map[string][]dns.RR // by lowercased fqdn
+	errs    map[string]error    // failures by lowercased fqdn
+	delay   time.Duration
+	queries []dns.Question
+}
+
+// --- impl *Exchanger
+
+func NewExchanger() *Exchanger {
+	return &Exchanger{records: make(map[string][]dns.RR), errs: make(map[string]error)}
+}
+
+// add records in zone file format, such as "example.com. 60 IN A 93.184.216.34"
+func (e *Exchanger) AddRecords(records ...string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if rr == nil {
+			continue
+		}
+		name := strings.ToLower(rr.Header().Name)
+		e.records[name] = append(e.records[name], rr)
+	}
+	return nil
+}
+
+// fail queries of `name` with `err`, ErrNoResponse to time them out, nil to answer them again
+func (e *Exchanger) SetError(name string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	name = strings.ToLower(dns.Fqdn(name))
+	if err == nil {
+		delete(e.errs, name)
+	} else {
+		e.errs[name] = err
+	}
+}
+
+// answer every query after `d`, as if the nameserver is that far away
+func (e *Exchanger) SetDelay(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.delay = d
+}
+
+// questions of all queries received so far in order
+func (e *Exchanger) Queries() []dns.Question {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]dns.Question(nil), e.queries...)
+}
+
+// queries never answered, as if the nameserver is down or the responses are dropped, see SetError
+var ErrNoResponse = errors.New("no response")
+
+// --- impl dnsproxy.DNSExchanger for *Exchanger
+func (e *Exchanger) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	resp, err := e.resolve(ctx, req)
+	if err == ErrNoResponse {
+		<-ctx.Done()
+		return nil, errors.WithStack(ctx.Err())
+	}
+	return resp, err
+}
+
+// answer `req` after the delay, ErrNoResponse if it is never answered
+func (e *Exchanger) resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) == 0 {
+		return nil, errors.New("no question")
+	}
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	e.mu.Lock()
+	e.queries = append(e.queries, q)
+	delay, err := e.delay, e.errs[name]
+	records, exists := e.records[name]
+	e.mu.Unlock()
+
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg).SetReply(req)
+	resp.RecursionAvailable = true
+	if !exists {
+		resp.Rcode = dns.RcodeNameError
+		return resp, nil
+	}
+	for _, rr := range records {
+		if hdr := rr.Header(); hdr.Rrtype == q.Qtype || hdr.Rrtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	return resp, nil
+}
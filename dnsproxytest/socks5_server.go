@@ -0,0 +1,116 @@
+package dnsproxytest
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/ginuerzh/gosocks5"
+	"github.com/pkg/errors"
+)
+
+// socks5 proxy on loopback without authentication supporting CONNECT only, standing for the proxy of dnsproxy,
+// destinations are recorded in order, so tests can tell which connections are proxied,
+// and connected directly unless SetDial redirects them, e.g. fake addresses abroad to local servers
+type Socks5Server struct {
+	l net.Listener
+
+	mu      sync.Mutex
+	dial    func(addr string) (net.Conn, error)
+	targets []string
+}
+
+// --- impl *Socks5Server
+
+// serve on a random port of 127.0.0.1 until Close
+func NewSocks5Server() (*Socks5Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s := &Socks5Server{l: l}
+	go s.serve()
+	return s, nil
+}
+
+// such as "127.0.0.1:1080"
+func (s *Socks5Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *Socks5Server) Close() error {
+	return errors.WithStack(s.l.Close())
+}
+
+// connect destinations by `dial` instead of directly, nil to connect them directly again
+func (s *Socks5Server) SetDial(dial func(addr string) (net.Conn, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dial = dial
+}
+
+// destinations of all CONNECT requests received so far in order, such as "www.google.com:443"
+func (s *Socks5Server) Targets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.targets...)
+}
+
+func (s *Socks5Server) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Socks5Server) handle(conn net.Conn) {
+	defer conn.Close()
+	if _, err := gosocks5.ReadMethods(conn); err != nil {
+		return
+	}
+	if err := gosocks5.WriteMethod(gosocks5.MethodNoAuth, conn); err != nil {
+		return
+	}
+	req, err := gosocks5.ReadRequest(conn)
+	if err != nil {
+		return
+	}
+	if req.Cmd != gosocks5.CmdConnect {
+		gosocks5.NewReply(gosocks5.CmdUnsupported, nil).Write(conn)
+		return
+	}
+
+	addr := req.Addr.String()
+	s.mu.Lock()
+	s.targets = append(s.targets, addr)
+	dial := s.dial
+	s.mu.Unlock()
+	if dial == nil {
+		dial = func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		}
+	}
+	target, err := dial(addr)
+	if err != nil {
+		gosocks5.NewReply(gosocks5.HostUnreachable, nil).Write(conn)
+		return
+	}
+	defer target.Close()
+	if err := gosocks5.NewReply(gosocks5.Succeeded, nil).Write(conn); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, target)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,531 @@
+package dnsproxy
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+)
+
+// DS record of the root zone KSK-2017, see https://data.iana.org/root-anchors/root-anchors.xml
+var _ROOT_TRUST_ANCHOR = &dns.DS{
+	Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+	KeyTag:     20326,
+	Algorithm:  dns.RSASHA256,
+	DigestType: dns.SHA256,
+	Digest:     "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+}
+
+// max time validated DNSKEYs are cached, regardless of their TTL
+const _DNSSEC_MAX_KEY_TTL = time.Hour
+
+// delegation of a name proved by its DS RRset or the signed denial of it, see (*dnssecValidator).delegation
+type dsState int8
+
+const (
+	_DS_SIGNED   dsState = iota // a zone cut with a validated DS RRset, the child zone is signed
+	_DS_INSECURE                // a zone cut without DS, proved by NSEC or NSEC3, names under it are unsigned
+	_DS_NOT_CUT                 // not a zone cut, or not existing, names under it are in the zone of its parent
+)
+
+// validator of DNSSEC signed responses, chains of trust are built from the root trust anchor
+// with DNSKEY and DS records queried through `dt`, unsigned RRsets are accepted as insecure only
+// if a delegation above them is proved to have no DS, so that signatures stripped by attackers are detected
+//
+// Limitations:
+//   - NSEC and NSEC3 records of negative answers are validated as RRsets, but the denial of existence is not proved,
+//     so NXDOMAIN and NODATA answers are never secure, see validate
+type dnssecValidator struct {
+	dt          *dnsTransport
+	keys        *cache.Cache // zone -> []*dns.DNSKEY, validated DNSKEY RRset of the zone
+	delegations *cache.Cache // name -> dsState, proved delegation of the name
+}
+
+// --- impl *dnssecValidator
+func newDnssecValidator(dt *dnsTransport) *dnssecValidator {
+	return &dnssecValidator{
+		dt:          dt,
+		keys:        cache.New(_DNSSEC_MAX_KEY_TTL, 10*time.Minute),
+		delegations: cache.New(_DNSSEC_MAX_KEY_TTL, 10*time.Minute),
+	}
+}
+
+// validate answer and authority sections of `resp`, failures such as SERVFAIL are not validated
+// secure: all RRsets are signed and validated, and `resp` is not a negative answer, as signed SOA and NSEC
+// records of the zone may be replayed for any name without the proof of the denial of existence
+// err: any RRset is bogus, including unsigned ones which are not provably insecure, see provablyInsecure
+func (v *dnssecValidator) validate(ctx context.Context, resp *dns.Msg) (secure bool, err error) {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return false, nil
+	}
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+	var keys []rrsetKey
+	rrsets := make(map[rrsetKey][]dns.RR)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+	authorityNS := make(map[rrsetKey]bool)
+	for i, section := range [...][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				k := rrsetKey{strings.ToLower(hdr.Name), sig.TypeCovered}
+				sigs[k] = append(sigs[k], sig)
+				continue
+			}
+			k := rrsetKey{strings.ToLower(hdr.Name), hdr.Rrtype}
+			if i == 1 && hdr.Rrtype == dns.TypeNS {
+				authorityNS[k] = true
+			}
+			if _, ok := rrsets[k]; !ok {
+				keys = append(keys, k)
+			}
+			rrsets[k] = append(rrsets[k], rr)
+		}
+	}
+	if len(keys) == 0 {
+		// negative answers of signed zones carry signed SOA and NSEC records
+		if len(resp.Question) == 0 {
+			return false, nil
+		}
+		name := resp.Question[0].Name
+		if err := v.checkInsecure(ctx, name); err != nil {
+			return false, errors.WithMessage(err, name+" empty answer")
+		}
+		return false, nil
+	}
+
+	secure = true
+	for _, k := range keys {
+		if len(sigs[k]) == 0 {
+			// NS RRsets of delegations are not signed by the parent zone, see RFC 4035 section 2.2
+			if authorityNS[k] {
+				secure = false
+				continue
+			}
+			if err := v.checkInsecure(ctx, k.name); err != nil {
+				return false, errors.WithMessage(err, k.name+" "+dns.TypeToString[k.rtype])
+			}
+			secure = false
+			continue
+		}
+		ok, err := v.verifyRRset(ctx, rrsets[k], sigs[k])
+		if err != nil {
+			return false, errors.WithMessage(err, k.name+" "+dns.TypeToString[k.rtype])
+		}
+		if !ok {
+			// signed by unsupported algorithms only, which attackers may put in place of the real signatures
+			if err := v.checkInsecure(ctx, k.name); err != nil {
+				return false, errors.WithMessage(err, k.name+" "+dns.TypeToString[k.rtype])
+			}
+			secure = false
+		}
+	}
+	if resp.Rcode == dns.RcodeNameError || len(resp.Answer) == 0 {
+		secure = false
+	}
+	return secure, nil
+}
+
+// verify `rrset` with any of `sigs`
+// false without error if all `sigs` use unsupported algorithms
+func (v *dnssecValidator) verifyRRset(ctx context.Context, rrset []dns.RR, sigs []*dns.RRSIG) (bool, error) {
+	lastErr := errors.New("dnssec: no valid signature")
+	supported := false
+	for _, sig := range sigs {
+		if _, ok := dns.AlgorithmToHash[sig.Algorithm]; !ok {
+			continue
+		}
+		supported = true
+		if !sig.ValidityPeriod(time.Time{}) {
+			lastErr = errors.New("dnssec: signature expired or not yet valid")
+			continue
+		}
+		if !dns.IsSubDomain(sig.SignerName, rrset[0].Header().Name) {
+			lastErr = errors.Errorf("dnssec: signer %s is out of zone", sig.SignerName)
+			continue
+		}
+		keys, err := v.zoneKeys(ctx, sig.SignerName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, key := range keys {
+			// only zone keys sign RRsets, see RFC 4035 section 5.3.1
+			if key.Flags&dns.ZONE != 0 && key.KeyTag() == sig.KeyTag && sig.Verify(key, rrset) == nil {
+				return true, nil
+			}
+		}
+	}
+	if !supported {
+		return false, nil
+	}
+	return false, lastErr
+}
+
+// validated DNSKEY RRset of `zone`
+func (v *dnssecValidator) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if keys, ok := v.keys.Get(zone); ok {
+		return keys.([]*dns.DNSKEY), nil
+	}
+
+	var dsSet []*dns.DS
+	if zone == "." {
+		dsSet = []*dns.DS{_ROOT_TRUST_ANCHOR}
+	} else {
+		var err error
+		if dsSet, err = v.zoneDS(ctx, zone); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := v.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var rrset []dns.RR
+	var keys []*dns.DNSKEY
+	var sigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			rrset = append(rrset, rr)
+			keys = append(keys, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.Errorf("dnssec: no DNSKEY for %s", zone)
+	}
+
+	// the DNSKEY RRset must be signed by a key which matches a trusted DS
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(time.Time{}) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || !dsMatchKey(dsSet, key) {
+				continue
+			}
+			if sig.Verify(key, rrset) == nil {
+				ttl := RRsMinTTL(rrset)
+				if ttl > _DNSSEC_MAX_KEY_TTL {
+					ttl = _DNSSEC_MAX_KEY_TTL
+				}
+				if ttl > 0 {
+					v.keys.Set(zone, keys, ttl)
+				}
+				return keys, nil
+			}
+		}
+	}
+	return nil, errors.Errorf("dnssec: DNSKEY of %s does not match a trusted DS", zone)
+}
+
+// validated DS RRset of `zone`, which is signed by the parent zone
+func (v *dnssecValidator) zoneDS(ctx context.Context, zone string) ([]*dns.DS, error) {
+	resp, err := v.query(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	var rrset []dns.RR
+	var dsSet []*dns.DS
+	var sigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.DS:
+			rrset = append(rrset, rr)
+			dsSet = append(dsSet, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDS {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	if len(dsSet) == 0 {
+		return nil, errors.Errorf("dnssec: no DS for %s", zone)
+	}
+	ok, err := v.verifyRRset(ctx, rrset, sigs)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.Errorf("dnssec: DS of %s is not signed", zone)
+	}
+	return dsSet, nil
+}
+
+// error unless `name` is provably insecure, for unsigned RRsets of it
+func (v *dnssecValidator) checkInsecure(ctx context.Context, name string) error {
+	insecure, err := v.provablyInsecure(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !insecure {
+		return errors.New("dnssec: unsigned in a signed zone")
+	}
+	return nil
+}
+
+// whether `name` is under a delegation proved to have no DS, walking down the delegations from the root,
+// it is in a signed zone if not, whose unsigned RRsets have been stripped of their signatures
+func (v *dnssecValidator) provablyInsecure(ctx context.Context, name string) (bool, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+	labels := dns.Split(name)
+	// from the top level domain down to `name`, the root is signed by the trust anchor
+	for i := len(labels) - 1; i >= 0; i-- {
+		state, err := v.delegation(ctx, name[labels[i]:])
+		if err != nil {
+			return false, err
+		}
+		if state == _DS_INSECURE {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// proved delegation of `name` whose parent is not provably insecure,
+// by its validated DS RRset, a validated CNAME, or validated NSEC or NSEC3 records denying the DS
+func (v *dnssecValidator) delegation(ctx context.Context, name string) (dsState, error) {
+	if state, ok := v.delegations.Get(name); ok {
+		return state.(dsState), nil
+	}
+	resp, err := v.queryDS(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	state, err := v.proveDelegation(ctx, name, resp)
+	if err != nil {
+		return 0, err
+	}
+	ttl := RRsMinTTL(append(append([]dns.RR(nil), resp.Answer...), resp.Ns...))
+	if ttl > _DNSSEC_MAX_KEY_TTL {
+		ttl = _DNSSEC_MAX_KEY_TTL
+	}
+	if ttl > 0 {
+		v.delegations.Set(name, state, ttl)
+	}
+	return state, nil
+}
+
+// see delegation, `resp` answers the DS query of `name`
+func (v *dnssecValidator) proveDelegation(ctx context.Context, name string, resp *dns.Msg) (dsState, error) {
+	rrsets, sigs := make(map[uint16][]dns.RR), make(map[uint16][]*dns.RRSIG)
+	for _, rr := range resp.Answer {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs[sig.TypeCovered] = append(sigs[sig.TypeCovered], sig)
+		} else {
+			rrsets[rr.Header().Rrtype] = append(rrsets[rr.Header().Rrtype], rr)
+		}
+	}
+	for _, rtype := range []uint16{dns.TypeDS, dns.TypeCNAME} {
+		if len(rrsets[rtype]) == 0 {
+			continue
+		}
+		ok, err := v.verifyRRset(ctx, rrsets[rtype], sigs[rtype])
+		if err != nil {
+			return 0, errors.WithMessage(err, name+" "+dns.TypeToString[rtype])
+		}
+		switch {
+		case !ok:
+			// the parent zone is signed by supported algorithms, as the walk goes down from the root
+			return 0, errors.Errorf("dnssec: %s %s is signed by unsupported algorithms only", name, dns.TypeToString[rtype])
+		case rtype == dns.TypeDS && !dsSupported(rrsets[rtype]):
+			// see RFC 4035 section 5.2
+			return _DS_INSECURE, nil
+		case rtype == dns.TypeDS:
+			return _DS_SIGNED, nil
+		}
+		// names owning CNAME records are never zone cuts
+		return _DS_NOT_CUT, nil
+	}
+
+	// the denial of the DS, by NSEC or NSEC3 RRsets, each of which is validated
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+	var keys []rrsetKey
+	denials := make(map[rrsetKey][]dns.RR)
+	denialSigs := make(map[rrsetKey][]*dns.RRSIG)
+	for _, rr := range resp.Ns {
+		k := rrsetKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k.rtype = sig.TypeCovered
+			denialSigs[k] = append(denialSigs[k], sig)
+			continue
+		}
+		if k.rtype != dns.TypeNSEC && k.rtype != dns.TypeNSEC3 {
+			continue
+		}
+		if _, ok := denials[k]; !ok {
+			keys = append(keys, k)
+		}
+		denials[k] = append(denials[k], rr)
+	}
+	proved := false
+	for _, k := range keys {
+		ok, err := v.verifyRRset(ctx, denials[k], denialSigs[k])
+		if err != nil {
+			return 0, errors.WithMessage(err, k.name+" "+dns.TypeToString[k.rtype])
+		}
+		if !ok {
+			return 0, errors.Errorf("dnssec: %s %s is signed by unsupported algorithms only", k.name, dns.TypeToString[k.rtype])
+		}
+		for _, rr := range denials[k] {
+			var types []uint16
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				if k.name != name {
+					// covers `name`, which does not exist
+					proved = true
+					continue
+				}
+				types = rr.TypeBitMap
+			case *dns.NSEC3:
+				if !rr.Match(name) {
+					// opted out delegations in the covered range are unsigned, see RFC 5155 section 6
+					if rr.Cover(name) && rr.Flags&_NSEC3_OPT_OUT != 0 {
+						return _DS_INSECURE, nil
+					}
+					proved = true
+					continue
+				}
+				types = rr.TypeBitMap
+			}
+			switch {
+			case hasType(types, dns.TypeDS):
+				return 0, errors.Errorf("dnssec: DS of %s is denied by a record listing it", name)
+			case hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA):
+				return _DS_INSECURE, nil
+			}
+			proved = true
+		}
+	}
+	if !proved {
+		return 0, errors.Errorf("dnssec: no DS for %s and no proof of its absence", name)
+	}
+	return _DS_NOT_CUT, nil
+}
+
+// DS query of `name`, whose negative answers are kept for the proof of the absence
+func (v *dnssecValidator) queryDS(ctx context.Context, name string) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeDS)
+	req.SetEdns0(4096, true)
+	resp, err := v.dt.spawnExchange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, errors.Errorf("dnssec: query %s DS: %s", name, dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+func (v *dnssecValidator) query(ctx context.Context, zone string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(zone, qtype)
+	req.SetEdns0(4096, true)
+	resp, err := v.dt.spawnExchange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, errors.Errorf("dnssec: query %s %s: %s",
+			zone, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// the Opt-Out flag of NSEC3 records, see RFC 5155 section 3.1.2.1
+const _NSEC3_OPT_OUT = 1
+
+func hasType(types []uint16, t uint16) bool {
+	for _, _t := range types {
+		if _t == t {
+			return true
+		}
+	}
+	return false
+}
+
+// whether any DS of `dsSet` is of a supported algorithm and digest type, zones of none of them are insecure
+func dsSupported(dsSet []dns.RR) bool {
+	for _, rr := range dsSet {
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			continue
+		}
+		if _, ok := dns.AlgorithmToHash[ds.Algorithm]; !ok {
+			continue
+		}
+		switch ds.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+			return true
+		}
+	}
+	return false
+}
+
+// whether `key` is a zone key referred by any DS in `dsSet`,
+// the SEP flag is not checked, which must not be used in validation, see RFC 4034 section 2.1.1
+func dsMatchKey(dsSet []*dns.DS, key *dns.DNSKEY) bool {
+	if key.Flags&dns.ZONE == 0 {
+		return false
+	}
+	for _, ds := range dsSet {
+		if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+			continue
+		}
+		if _ds := key.ToDS(ds.DigestType); _ds != nil && strings.EqualFold(_ds.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// set the DO bit of `req`, add an OPT RR if there isn't one
+func MsgSetDo(req *dns.Msg) {
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetDo()
+		return
+	}
+	req.SetEdns0(4096, true)
+}
+
+// remove DNSSEC records which are not queried explicitly, for clients which do not set the DO bit
+func MsgStripDNSSEC(msg *dns.Msg) {
+	var qtype uint16
+	if len(msg.Question) > 0 {
+		qtype = msg.Question[0].Qtype
+	}
+	strip := func(rrs []dns.RR) []dns.RR {
+		_rrs := rrs[:0]
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			_rrs = append(_rrs, rr)
+		}
+		return _rrs
+	}
+	msg.Answer = strip(msg.Answer)
+	msg.Ns = strip(msg.Ns)
+	msg.Extra = strip(msg.Extra)
+}
@@ -0,0 +1,182 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// nameserver on loopback of zones signed by keys generated on the fly:
+// "." and "example." are signed, "insecure.example." is an unsigned delegation whose DS is denied by a signed NSEC,
+// the DS of "unproved.example." is absent without a proof, and the keys of "nosep.example." and
+// "nozone.example." lack the SEP and the Zone Key flag respectively
+type testSignedZones struct {
+	keys    map[string]*dns.DNSKEY
+	signers map[string]crypto.Signer
+	answers map[string][]dns.RR // "name qtype" -> answer section
+	ns      map[string][]dns.RR // "name qtype" -> authority section
+}
+
+func newTestSignedZones(t *testing.T) *testSignedZones {
+	z := &testSignedZones{
+		keys:    make(map[string]*dns.DNSKEY),
+		signers: make(map[string]crypto.Signer),
+		answers: make(map[string][]dns.RR),
+		ns:      make(map[string][]dns.RR),
+	}
+	zones := []struct {
+		zone  string
+		flags uint16
+	}{
+		{".", dns.ZONE | dns.SEP},
+		{"example.", dns.ZONE | dns.SEP},
+		{"nosep.example.", dns.ZONE},
+		{"nozone.example.", dns.SEP},
+	}
+	for _, zz := range zones {
+		zone := zz.zone
+		key := &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     zz.flags,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.keys[zone], z.signers[zone] = key, priv.(crypto.Signer)
+		z.answers[zone+" DNSKEY"] = z.sign(t, zone, key)
+		if zone == "." {
+			continue
+		}
+		ds := key.ToDS(dns.SHA256)
+		ds.Hdr.Ttl = 3600
+		parent := "."
+		if i, _ := dns.NextLabel(zone, 0); i < len(zone) {
+			parent = zone[i:]
+		}
+		z.answers[zone+" DS"] = z.sign(t, parent, ds)
+		z.answers["www."+zone+" A"] = z.sign(t, zone, testRR(t, "www."+zone+" 60 IN A 192.0.2.1"))
+	}
+	z.ns["www.example. DS"] = z.sign(t, "example.", testRR(t, "www.example. 60 IN NSEC zzz.example. A RRSIG NSEC"))
+	z.ns["insecure.example. DS"] = z.sign(t, "example.", testRR(t, "insecure.example. 60 IN NSEC www.example. NS RRSIG NSEC"))
+	return z
+}
+
+// RRset of `rrs` and its RRSIG by the key of `zone`
+func (z *testSignedZones) sign(t *testing.T, zone string, rrs ...dns.RR) []dns.RR {
+	hdr := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		KeyTag:     z.keys[zone].KeyTag(),
+		SignerName: zone,
+		Algorithm:  z.keys[zone].Algorithm,
+	}
+	if err := sig.Sign(z.signers[zone], rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+// serve on a random udp port of 127.0.0.1, returns the address and the func to stop serving
+func (z *testSignedZones) serve(t *testing.T) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		k := strings.ToLower(q.Name) + " " + dns.TypeToString[q.Qtype]
+		// packing writes the lengths of RRs into their headers, which are shared by concurrent handlers
+		resp := new(dns.Msg).SetReply(req)
+		for _, rr := range z.answers[k] {
+			resp.Answer = append(resp.Answer, dns.Copy(rr))
+		}
+		for _, rr := range z.ns[k] {
+			resp.Ns = append(resp.Ns, dns.Copy(rr))
+		}
+		w.WriteMsg(resp)
+	})}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestDnssecValidate(t *testing.T) {
+	z := newTestSignedZones(t)
+	addr, stop := z.serve(t)
+	defer stop()
+	anchor := _ROOT_TRUST_ANCHOR
+	defer func() { _ROOT_TRUST_ANCHOR = anchor }()
+	_ROOT_TRUST_ANCHOR = z.keys["."].ToDS(dns.SHA256)
+
+	a := testRR(t, "www.example. 60 IN A 192.0.2.1")
+	forged := z.sign(t, "example.", testRR(t, "www.example. 60 IN A 192.0.2.2"))[1]
+	// authority section of negative answers
+	denial := append(z.sign(t, "example.", testRR(t, "example. 60 IN SOA ns.example. admin.example. 1 3600 600 86400 60")),
+		z.sign(t, "example.", testRR(t, "a.example. 60 IN NSEC zzz.example. A RRSIG NSEC"))...)
+	// signatures of a private algorithm, which is not supported
+	unsupported := func(rr dns.RR) []dns.RR {
+		sig := dns.Copy(z.answers["www.example. A"][1]).(*dns.RRSIG)
+		sig.Hdr.Name, sig.Algorithm = rr.Header().Name, dns.PRIVATEDNS
+		return []dns.RR{rr, sig}
+	}
+	tests := []struct {
+		desc   string
+		qname  string
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+		secure bool
+		bogus  bool
+	}{
+		{"signed", "www.example.", dns.RcodeSuccess, z.answers["www.example. A"], nil, true, false},
+		{"signatures stripped", "www.example.", dns.RcodeSuccess, []dns.RR{a}, nil, false, true},
+		{"forged signature", "www.example.", dns.RcodeSuccess, []dns.RR{a, forged}, nil, false, true},
+		{"records stripped", "www.example.", dns.RcodeSuccess, nil, nil, false, true},
+		{"signatures replaced by unsupported ones", "www.example.", dns.RcodeSuccess, unsupported(a), nil, false, true},
+		{"insecure delegation", "www.insecure.example.", dns.RcodeSuccess,
+			[]dns.RR{testRR(t, "www.insecure.example. 60 IN A 192.0.2.3")}, nil, false, false},
+		{"insecure delegation empty answer", "www.insecure.example.", dns.RcodeSuccess, nil, nil, false, false},
+		{"insecure delegation of unsupported signatures", "www.insecure.example.", dns.RcodeSuccess,
+			unsupported(testRR(t, "www.insecure.example. 60 IN A 192.0.2.3")), nil, false, false},
+		{"absence of DS not proved", "www.unproved.example.", dns.RcodeSuccess,
+			[]dns.RR{testRR(t, "www.unproved.example. 60 IN A 192.0.2.4")}, nil, false, true},
+		{"failure", "www.example.", dns.RcodeServerFailure, nil, nil, false, false},
+		{"key without SEP", "www.nosep.example.", dns.RcodeSuccess, z.answers["www.nosep.example. A"], nil, true, false},
+		{"key without the Zone Key flag", "www.nozone.example.", dns.RcodeSuccess, z.answers["www.nozone.example. A"], nil, false, true},
+		// the denial of existence is not proved
+		{"signed NXDOMAIN", "nonexistent.example.", dns.RcodeNameError, nil, denial, false, false},
+		{"signed NODATA", "www.example.", dns.RcodeSuccess, nil, denial, false, false},
+	}
+	v := newDnssecValidator(NewDnsTransport(addr, "udp", nil))
+	for _, tt := range tests {
+		resp := new(dns.Msg).SetQuestion(tt.qname, dns.TypeA)
+		resp.Response, resp.Rcode, resp.Answer, resp.Ns = true, tt.rcode, tt.answer, tt.ns
+		secure, err := v.validate(context.Background(), resp)
+		if bogus := err != nil; bogus != tt.bogus {
+			t.Errorf("%s: err = %v, want bogus %v", tt.desc, err, tt.bogus)
+		}
+		if secure != tt.secure {
+			t.Errorf("%s: secure = %v, want %v", tt.desc, secure, tt.secure)
+		}
+	}
+}
@@ -1,193 +1,363 @@
 package dnsproxy
 
 import (
+	"context"
+	stderrors "errors"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 )
 
-func ServeDNS(laddr string) error {
-	if ok := _DEFAULT_GLOBALS_VALIDATOR.validate(); !ok {
-		return errors.New("global vars are uninitialized")
+// how long a query of ServeDNS is resolved by default before giving up,
+// stub resolvers usually retry or fail after 5s, so a later answer is of no use
+const DNS_QUERY_TIMEOUT = 5 * time.Second
+
+// size of pooled buffers of udp responses, the largest edns buffer size in common use, larger ones are packed into new buffers
+const _UDP_RESP_BUF_SIZE = 4096
+
+// *[]byte of packed udp responses, which are written synchronously and can be reused right after
+var udpRespBufPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, _UDP_RESP_BUF_SIZE)
+	return &b
+}}
+
+// serve dns over udp and tcp on every address of `laddrs`, such as "127.0.0.1:53" and "[::1]:53" of dual-stack hosts,
+// all addresses are bound before serving and nothing is served if any of them fails
+func (s *Server) ServeDNS(laddrs ...string) error {
+	if len(laddrs) == 0 {
+		return classified(ErrInvalidConfig, errors.New("no dns listen address"))
+	}
+	var pcs []net.PacketConn
+	var ls []net.Listener
+	var tags []string
+	closeAll := func() {
+		for _, pc := range pcs {
+			pc.Close()
+		}
+		for _, l := range ls {
+			l.Close()
+		}
 	}
-	return serveDNS(laddr)
+	for _, laddr := range laddrs {
+		pc, err := net.ListenPacket("udp", laddr)
+		if err != nil {
+			closeAll()
+			return errors.WithStack(err)
+		}
+		pcs = append(pcs, pc)
+		l, err := net.Listen("tcp", laddr)
+		if err != nil {
+			closeAll()
+			return errors.WithStack(err)
+		}
+		ls = append(ls, l)
+		tags = append(tags, s.listenerTags[laddr])
+	}
+	return s.serveDNSListeners(pcs, ls, tags, tags)
 }
 
-func serveDNS(laddr string) error {
-	serveMux := dns.NewServeMux()
-	serveMux.HandleFunc(".", handleDnsRequest)
+// serve dns over udp on `pcs` and over tcp on `ls`, which are opened already,
+// e.g. passed by systemd socket activation, all of them are closed on return,
+// listeners are tagged by their addresses such as "127.0.0.1:53", see SetListenerTags
+func (s *Server) ServeDNSListeners(pcs []net.PacketConn, ls []net.Listener) error {
+	pcTags := make([]string, len(pcs))
+	for i, pc := range pcs {
+		pcTags[i] = s.listenerTags[pc.LocalAddr().String()]
+	}
+	lTags := make([]string, len(ls))
+	for i, l := range ls {
+		lTags[i] = s.listenerTags[l.Addr().String()]
+	}
+	return s.serveDNSListeners(pcs, ls, pcTags, lTags)
+}
 
-	e := make(chan error)
-	for _, _net := range [...]string{"udp", "tcp"} {
-		srv := &dns.Server{Addr: laddr, Net: _net, Handler: serveMux}
+// same as ServeDNSListeners, queries of `pcs[i]` and `ls[i]` are tagged `pcTags[i]` and `lTags[i]`
+func (s *Server) serveDNSListeners(pcs []net.PacketConn, ls []net.Listener, pcTags, lTags []string) error {
+	defer func() {
+		for _, pc := range pcs {
+			pc.Close()
+		}
+		for _, l := range ls {
+			l.Close()
+		}
+	}()
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if len(pcs) == 0 && len(ls) == 0 {
+		return classified(ErrInvalidConfig, errors.New("no dns listener"))
+	}
+	var srvs []*dns.Server
+	serveMuxes := make(map[string]*dns.ServeMux)
+	serveMux := func(tag string) *dns.ServeMux {
+		if mux, ok := serveMuxes[tag]; ok {
+			return mux
+		}
+		mux := dns.NewServeMux()
+		if tag == "" {
+			mux.HandleFunc(".", s.handleDnsRequest)
+		} else {
+			mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+				s.handleDnsRequestContext(ContextWithListener(context.Background(), tag), w, req)
+			})
+		}
+		serveMuxes[tag] = mux
+		return mux
+	}
+	// the first failed server stops serving, udp servers fail by their readers, see udpServeReader
+	e := make(chan error, 2*(len(pcs)+len(ls)))
+	done := make(chan struct{})
+	for i, pc := range pcs {
+		srvs = append(srvs, &dns.Server{PacketConn: pc, Handler: serveMux(pcTags[i]), DecorateReader: func(r dns.Reader) dns.Reader {
+			return &udpServeReader{Reader: r, failed: e, done: done}
+		}})
+	}
+	for i, l := range ls {
+		srvs = append(srvs, &dns.Server{Listener: l, Handler: serveMux(lTags[i]), IdleTimeout: func() time.Duration {
+			return _DNS_TCP_IDLE_TIMEOUT
+		}})
+	}
+	for _, srv := range srvs {
 		go func(srv *dns.Server) {
-			e <- srv.ListenAndServe()
+			e <- srv.ActivateAndServe()
 		}(srv)
 	}
-	return <-e
+	err := <-e
+	for _, srv := range srvs {
+		srv.Shutdown()
+	}
+	close(done)
+	return errors.WithStack(err)
 }
 
-func handleDnsRequest(w dns.ResponseWriter, req *dns.Msg) {
-	// 判断请求的域名是否在 domain cache 中
-	//	-> 是 -> 直接返回 cache 中内容
-	//	-> 否 ->
-	//	 -> 判断域名是否在 GFW list 中
-	//	 	-> 是 -> 将使用代理访问这个域名 -> 因此使用 EDNS0 proxy + abroad dns server 查询 IP
-	//		-> 否
-	//			-> 判断域名是否在 obedient list 中
-	//				-> 是
-	//					-> 将直连这个域名 -> 因此使用 chinese dns server 解析
-	//				-> 否
-	//			 		—> 使用随便一个中国 IP + abroad dns server 解析
-	//						-> 成功
-	//							-> 判断是否返回中国 IP
-	//								-> 是 -> 返回中国 IP 表示这个域名是 obedient -> 使用中国的 DNS 服务器再查一边: china dns sever
-	//								-> 否 -> 使用 EDNS0 Abroad + abroad dns server 解析
-	//						-> 失败 -> 使用 china dns server 解析
-	resp, err := func() (*dns.Msg, error) {
-		var domain string
-		quesFqdn := req.Question[0].Name
-
-		if strings.HasSuffix(quesFqdn, `.DHCP\ HOST.`) {
-			return MsgNewReplyFromReq(req), nil
-		} else {
-			domain = quesFqdn[:len(quesFqdn)-1]
-			if item, ok := _DEFAULT_DOMAINCACHE.Get(domain); ok {
-				return MsgNewReplyFromReq(req, item.ans), nil
-			}
-		}
+// reader of a udp dns.Server reporting the closed conn to `failed` and waiting for `done`,
+// since the server retries reading it in a busy loop until it is shut down
+type udpServeReader struct {
+	dns.Reader
+	failed   chan<- error
+	done     <-chan struct{}
+	reported bool
+}
 
-		var matchGfw bool
-		var matchObedient bool
-		matchGfw = _DEFAULT_DOMAIN_MATCHER.MatchGFW(domain)
-		if !matchGfw {
-			matchObedient = _DEFAULT_DOMAIN_MATCHER.MatchObedient(domain)
+func (r *udpServeReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	m, s, err := r.Reader.ReadUDP(conn, timeout)
+	if err != nil && stderrors.Is(err, net.ErrClosed) {
+		if !r.reported {
+			r.reported = true
+			r.failed <- err
 		}
+		<-r.done
+	}
+	return m, s, err
+}
 
-		switch {
-		case matchGfw: // domain is in gfw blacklist
-			MsgSetECSWithAddr(req, _DNS_SUBNET_PROXY_IP)
-			resp, err := _DNSSTRANSPORT_ABROAD.legallySpawnExchange(req)
-			if err != nil {
-				return nil, err
-			}
-			if ans, ip := MsgExtractAnswer(resp); ans != nil {
-				_DEFAULT_DOMAINCACHE.Add(domain, ans, _TRANS_PROXY)
-				_DEFAULT_IPCACHE.Add(ip.String(), _TRANS_PROXY)
-			}
-			return resp, nil
-		case matchObedient: // domain is in gfw whitelist
-			resp, err := _DNSSTRANSPORT_OBEDIENT.legallySpawnExchange(req)
-			if ans, ip := MsgExtractAnswer(resp); ans != nil && err == nil {
-				_DEFAULT_DOMAINCACHE.Add(domain, ans, _TRANS_DIRECT)
-				_DEFAULT_IPCACHE.Add(ip.String(), _TRANS_DIRECT)
-			} else {
-				// retry with abroad dns server
-				MsgSetECSWithAddr(req, _DNS_SUBNET_LOCAL_IP)
-				resp, err = _DNSSTRANSPORT_ABROAD.legallySpawnExchange(req)
-				if err != nil {
-					return nil, err
-				}
-				// do not add to cache
-			}
-			return resp, nil
-		default: // unknown domain
-			// async abroad query with remote ip
-			abroadQueryWithRemoteIPReq := req.Copy()
-			awaitAbroadQueryWithRemoteResp := make(chan *dns.Msg, 1)
-			go func() {
-				remoteIP := _DNS_SUBNET_PROXY_IP
-				MsgSetECSWithAddr(abroadQueryWithRemoteIPReq, remoteIP)
-				resp, _ := _DNSSTRANSPORT_ABROAD.legallySpawnExchange(abroadQueryWithRemoteIPReq)
-
-				awaitAbroadQueryWithRemoteResp <- resp
-			}()
-
-			// abroad query with local ip
-			abroadQueryWithLocalIPReq := req.Copy()
-			var abroadQueryWithLocalSucceed bool
-			var abroadQueryWithLocalAns dns.RR
-			var abroadQueryWithLocalAnsIP net.IP
-
-			localIP := _DNS_SUBNET_LOCAL_IP
-			MsgSetECSWithAddr(abroadQueryWithLocalIPReq, localIP)
-			abroadQueryWithLocalResp, err := _DNSSTRANSPORT_ABROAD.legallySpawnExchange(abroadQueryWithLocalIPReq)
-			if ans, ip := MsgExtractAnswer(abroadQueryWithLocalResp); err == nil && ans != nil {
-				abroadQueryWithLocalSucceed = abroadQueryWithLocalResp.Rcode == dns.RcodeSuccess
-				abroadQueryWithLocalAns = ans
-				abroadQueryWithLocalAnsIP = ip
-			}
-			if abroadQueryWithLocalSucceed { // succeeded to abroad query with local ip
-				var resp = abroadQueryWithLocalResp
-				var ans = abroadQueryWithLocalAns
-				var ip = abroadQueryWithLocalAnsIP
-				var trans transport
-
-				if i := abroadQueryWithLocalAnsIP.To4(); i != nil &&
-					_IP_MATCH_CHINESE_MAINLAND(i) {
-					// is Chinese mainland ipv4
-					trans = _TRANS_DIRECT
-					// try to query obedient dns server to improve `a` quality
-					_resp, err := _DNSSTRANSPORT_OBEDIENT.legallySpawnExchange(req)
-					if _ans, _ip := MsgExtractAnswer(_resp); err == nil && _ans != nil {
-						resp = _resp
-						ans = _ans
-						ip = _ip
-					}
-				} else {
-					// ipv6 or abroad ipv4
-					trans = _TRANS_PROXY
-					// try to improve resp with the result of async abroad query with remote ip
-					_resp := <-awaitAbroadQueryWithRemoteResp
-					_ans, _ip := MsgExtractAnswer(_resp)
-					if _ans != nil {
-						resp = _resp
-						ans = _ans
-						ip = _ip
-					}
-				}
-				_DEFAULT_DOMAINCACHE.Add(domain, ans, trans)
-				_DEFAULT_IPCACHE.Add(ip.String(), trans)
-				return resp, nil
-			} else { // failed to abroad query with local ip
-				// try to query with obedient dns server
-				resp, err := _DNSSTRANSPORT_OBEDIENT.legallySpawnExchange(req)
-				if err != nil { // all queries failed
-					return nil, err
-				}
-				if ans, ip := MsgExtractAnswer(resp); ans != nil {
-					var trans transport
-					if ip.To4() != nil && _IP_MATCH_CHINESE_MAINLAND(ip) {
-						// is Chinese mainland ipv4
-						trans = _TRANS_DIRECT
-					} else {
-						// ipv6 or abroad ipv4
-						trans = _TRANS_PROXY
-					}
-					_DEFAULT_DOMAINCACHE.Add(domain, ans, trans)
-					_DEFAULT_IPCACHE.Add(ip.String(), trans)
-				}
-				return resp, nil
+// tag queries arriving on the listen addresses of ServeDNS by `tags`, such as {"10.8.0.1:53": "vpn"},
+// for "listener:" patterns of routing rules, see RouteQuery.Listener, must be called before serving
+func (s *Server) SetListenerTags(tags map[string]string) {
+	s.listenerTags = tags
+}
+
+// clamp TTLs of answers of ServeDNS into [min, max], max is ignored if it is not positive,
+// e.g. a min of 60s spares clients looking up again domains of CDNs with TTLs of seconds through slow upstreams,
+// cached answers are not affected, see NewDomainCache for how long they are cached, must be called before serving
+func (s *Server) SetAnswerTTL(min, max time.Duration) {
+	s.answerTTL = ttlBounds{min, max}
+}
+
+func (s *Server) handleDnsRequest(w dns.ResponseWriter, req *dns.Msg) {
+	s.handleDnsRequestContext(context.Background(), w, req)
+}
+
+// same as handleDnsRequest, upstream queries are abandoned once `ctx` is done or the query timeout is reached
+func (s *Server) handleDnsRequestContext(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+	// 判断客户端是否被允许且未超过速率限制
+	//	-> 否 -> 拒绝或丢弃
+	// 判断请求是否合法（opcode、问题数、EDNS 版本）
+	//	-> 否 -> 返回 FORMERR、NOTIMP 或 BADVERS，见 checkDnsRequest
+	// 解析，见 (*Server).resolve
+	// 按 SetAnswerTTL 限制结果的 TTL
+	// 按客户端的 EDNS 设置结果的 OPT 记录，见 replyEdns
+	// 发布查询事件，见 SetEventStream
+	remote := w.RemoteAddr()
+	_, isUDP := remote.(*net.UDPAddr)
+	received := time.Now()
+	if s.dnstap != nil {
+		s.dnstap.captureClient(w, req, nil, received)
+	}
+	if s.dnsLimiter != nil {
+		if ok, refused := s.dnsLimiter.allowQuery(addrIP(remote)); !ok {
+			if refused {
+				w.WriteMsg(new(dns.Msg).SetRcode(req, dns.RcodeRefused))
 			}
+			glog.V(1).Infof("dns %s limited\n", remote)
+			return
 		}
-	}()
+	}
+
+	if reply, err := checkDnsRequest(req); err != nil {
+		if reply != nil {
+			replyEdns(req, reply, addrIP(remote), isUDP)
+			w.WriteMsg(reply)
+		}
+		logServeError(err, glog.Warningf)
+		return
+	}
+
+	ctx, cancel := withLazyDeadline(ctx, received.Add(s.queryTimeout()))
+	defer cancel()
+	resp, trans, err := s.resolve(ctx, req, addrIP(remote))
+	s.events.publishDNS(addrIP(remote), req, resp, trans, err, received)
 	if err != nil {
 		goto ERR
 	}
-	if err = w.WriteMsg(resp); err != nil {
+	if s.dnsLimiter != nil && isUDP {
+		switch s.dnsLimiter.limitResponse(addrIP(remote), resp) {
+		case _DNS_LIMIT_DROP:
+			return
+		case _DNS_LIMIT_TRUNCATE:
+			resp = MsgNewReplyFromReq(req)
+			resp.Truncated = true
+		}
+	}
+	resp.Answer = s.answerTTL.clampRRs(resp.Answer)
+	replyEdns(req, resp, addrIP(remote), isUDP)
+	if err = writeDnsResponse(w, req, resp, isUDP); err != nil {
 		goto ERR
 	}
+	if s.dnstap != nil {
+		s.dnstap.captureClient(w, req, resp, received)
+	}
 	return
 ERR:
-	var st errors.StackTrace
-	type stackTracer interface {
-		StackTrace() errors.StackTrace
+	logServeError(err, glog.Warningf)
+}
+
+// write `resp` to `w` in reply to `req`, udp responses are packed into pooled buffers instead of new ones,
+// and truncated if they exceed the udp payload size of `req`, see truncateReply
+func writeDnsResponse(w dns.ResponseWriter, req, resp *dns.Msg, isUDP bool) error {
+	if !isUDP {
+		return errors.WithStack(w.WriteMsg(resp))
+	}
+	buf := udpRespBufPool.Get().(*[]byte)
+	defer udpRespBufPool.Put(buf)
+	b, err := resp.PackBuffer(*buf)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if size := ednsUDPSize(req); len(b) > size {
+		for truncated := false; len(b) > size && !truncated; {
+			truncated = truncateReply(resp)
+			if b, err = resp.PackBuffer(*buf); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		glog.V(1).Infof("dns %s %s reply truncated to %d bytes, TC %v\n", w.RemoteAddr(), req.Question[0].Name, len(b), resp.Truncated)
+	}
+	_, err = w.Write(b)
+	return errors.WithStack(err)
+}
+
+// resolve `req` of `client` by the whole decision tree until `ctx` is done, returns the transport of the answered domain,
+// answers which are not routed, such as those of the override zone, are TRANS_DIRECT,
+// AAAA records are synthesized afterwards if DNS64 is enabled
+func (s *Server) resolve(ctx context.Context, req *dns.Msg, client net.IP) (*dns.Msg, Transport, error) {
+	if s.dns64 != nil {
+		return s.resolveDNS64(ctx, req, client)
+	}
+	return s.resolveQuery(ctx, req, client)
+}
+
+// resolve `req` of `client` without DNS64, see resolve
+func (s *Server) resolveQuery(ctx context.Context, req *dns.Msg, client net.IP) (*dns.Msg, Transport, error) {
+	// 判断请求的域名是否在 override 中
+	//	-> 是 -> 直接返回静态结果（屏蔽或指定的 IP）
+	// 判断请求的域名是否为 DHCP 租约中的主机名，或租约中 IP 的 PTR 查询
+	//	-> 是 -> 直接返回租约中的 IP 或主机名，见 SetDHCPLeases
+	// 判断请求的域名是否在本地区域中
+	//	-> 是 -> 直接返回本地区域的权威结果
+	// 判断请求是否为最近解析过的 IP 的 PTR 查询
+	//	-> 是 -> 直接返回 domain cache 中解析到该 IP 的域名
+	// 判断请求是否为 A/AAAA 以外的类型（MX、TXT、PTR、ANY 等）
+	//	-> 是 -> 按域名（PTR 按 IP）选择上游直接查询，不做路由决策也不缓存
+	// 判断请求的域名是否在 negative cache 中（最近返回 NXDOMAIN 或 NODATA）
+	//	-> 是 -> 直接返回缓存的 rcode 及 SOA 记录
+	// 判断请求的域名是否在 domain cache 中
+	//	-> 是 -> 直接返回 cache 中内容
+	//	-> 已过期但仍可 serve stale -> 重新解析，失败或超时则返回过期的内容
+	//	-> 否 ->
+	//	 -> 交给 routing policy 决定直连或代理并解析，见 (*DefaultRoutingPolicy).Route，同时进行的相同查询只解析一次
+	//	   -> 拒绝 -> 不解析，返回 NXDOMAIN 或 0.0.0.0，见 SetRejectWithZeroIP
+	//	   -> 按 answer rewriter 改写结果中的 IP 后缓存并返回，见 SetAnswerRewriter
+	if len(req.Question) == 0 {
+		return nil, 0, classified(ErrBadClientRequest, errors.New("dns query without question"))
+	}
+	quesFqdn := req.Question[0].Name
+	qtype := req.Question[0].Qtype
+	listener := ListenerFromContext(ctx)
+	scope := s.queryScope(client, listener)
+
+	if s.override != nil {
+		if resp, ok := s.override.Lookup(req); ok {
+			return resp, TRANS_DIRECT, nil
+		}
+	}
+	if s.leases != nil {
+		if resp, ok := s.leases.Lookup(req); ok {
+			return resp, TRANS_DIRECT, nil
+		}
+	}
+	// hosts without leases under the search domain of some routers
+	if strings.HasSuffix(strings.ToLower(quesFqdn), "."+_DHCP_HOST_DOMAIN+".") {
+		return MsgNewReplyFromReq(req), TRANS_DIRECT, nil
+	}
+	if resp, ok := s.lookupLocalZones(req); ok {
+		return resp, TRANS_DIRECT, nil
+	}
+	if resp, ok := s.lookupReverse(req, scope); ok {
+		glog.V(1).Infof("dns %s PTR %s answered from cache\n", client, quesFqdn)
+		return resp, TRANS_DIRECT, nil
+	}
+	domain := quesFqdn[:len(quesFqdn)-1]
+	if pr, ok := s.policy.(PassthroughResolver); ok && !IsAddressQtype(qtype) {
+		resp, err := pr.ResolvePassthrough(&RouteQuery{Req: req, Client: client, Listener: listener, NeedAnswer: true, Ctx: ctx})
+		if err != nil {
+			return nil, 0, err
+		}
+		glog.V(1).Infof("dns %s %s %s passed through\n", client, dns.TypeToString[qtype], quesFqdn)
+		return resp, TRANS_DIRECT, nil
+	}
+	if s.prefetch != nil {
+		s.prefetch.touch(scope, domain, qtype, client, listener)
+	}
+	if cell, ok := s.negcache.Get(scope, domain, qtype); ok {
+		return cell.Reply(req), cell.trans, nil
+	}
+	if item, stale, ok := s.domaincache.GetStale(scope, domain, qtype); ok {
+		if stale {
+			return s.resolveStale(ctx, req, client, scope, item)
+		}
+		return MsgNewReplyFromReq(req, item.Answers()...), item.trans, nil
+	}
+
+	rq := &RouteQuery{Req: req, Client: client, Listener: listener, NeedAnswer: true, Ctx: ctx}
+	d, err := s.routeCoalesced(ctx, scope, rq, func(d *RouteDecision) {
+		s.cacheDecision(scope, domain, qtype, d)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if d.Trans == TRANS_REJECT {
+		glog.V(1).Infof("dns %s %s -> %s\n", client, quesFqdn, d.Trans)
+		return s.rejectReply(req), TRANS_REJECT, nil
 	}
-	if e, ok := err.(stackTracer); ok {
-		st = e.StackTrace()
+	if d.Resp == nil {
+		return nil, 0, errors.Errorf("routing policy did not resolve %s", quesFqdn)
 	}
-	glog.Warningf("%s%+v\n", err, st)
+	glog.V(1).Infof("dns %s %s -> %s\n", client, quesFqdn, d.Trans)
+	return d.Resp, d.Trans, nil
 }
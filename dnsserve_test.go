@@ -0,0 +1,238 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ARwMq9b6/dnsproxy/dnsproxytest"
+	"github.com/miekg/dns"
+)
+
+// server of tests whose obedient and abroad dns servers are in memory, "blocked.example" is in the gfw list,
+// "cn.example" is in the obedient list, and 10.0.0.0/8 and 127.0.0.0/8 stand for Chinese mainland ips
+func newTestServer(local, abroad *dnsproxytest.Exchanger) *Server {
+	dm := NewDomainListMatcher([]string{"blocked.example"}, []string{"cn.example"})
+	china := func(ip net.IP) bool {
+		ip4 := ip.To4()
+		return ip4 != nil && (ip4[0] == 10 || ip4[0] == 127)
+	}
+	return NewServer(NewIpcache(0, time.Hour, time.Minute), NewDomaincache(0, time.Hour, time.Minute),
+		dm, china, net.ParseIP("114.114.114.114"), net.ParseIP("8.8.8.8"), local, abroad)
+}
+
+// dns.ResponseWriter of a udp client recording the responses written
+type testResponseWriter struct {
+	mu    sync.Mutex
+	resps []*dns.Msg
+}
+
+var (
+	testDNSLocalAddr  = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	testDNSRemoteAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+)
+
+func (w *testResponseWriter) LocalAddr() net.Addr  { return testDNSLocalAddr }
+func (w *testResponseWriter) RemoteAddr() net.Addr { return testDNSRemoteAddr }
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.resps = append(w.resps, m.Copy())
+	return nil
+}
+func (w *testResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+func (w *testResponseWriter) Close() error        { return nil }
+func (w *testResponseWriter) TsigStatus() error   { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack()             {}
+
+// the only response written, nil if nothing is written
+func (w *testResponseWriter) resp(t *testing.T) *dns.Msg {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch len(w.resps) {
+	case 0:
+		return nil
+	case 1:
+		return w.resps[0]
+	}
+	t.Fatalf("%d responses written", len(w.resps))
+	return nil
+}
+
+// query `name` of `qtype` through s.handleDnsRequestContext
+func testQuery(t *testing.T, ctx context.Context, s *Server, name string, qtype uint16) *dns.Msg {
+	w := &testResponseWriter{}
+	s.handleDnsRequestContext(ctx, w, new(dns.Msg).SetQuestion(dns.Fqdn(name), qtype))
+	return w.resp(t)
+}
+
+func testAnswerIPs(resp *dns.Msg) []string {
+	var ips []string
+	for _, ip := range RRsIPs(resp.Answer) {
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
+
+func testQueried(e *dnsproxytest.Exchanger, name string) bool {
+	for _, q := range e.Queries() {
+		if q.Name == dns.Fqdn(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHandleDnsRequestAnswers(t *testing.T) {
+	local, abroad := dnsproxytest.NewExchanger(), dnsproxytest.NewExchanger()
+	local.AddRecords("www.cn.example. 60 IN A 10.0.0.1", "www.cn.example. 60 IN A 10.0.0.2")
+	abroad.AddRecords("www.blocked.example. 60 IN A 8.8.4.4", "www.unknown.example. 60 IN A 9.9.9.9")
+	s := newTestServer(local, abroad)
+
+	tests := []struct {
+		name  string
+		rcode int
+		ips   []string
+	}{
+		{"www.cn.example", dns.RcodeSuccess, []string{"10.0.0.1", "10.0.0.2"}},
+		{"www.blocked.example", dns.RcodeSuccess, []string{"8.8.4.4"}},
+		{"www.unknown.example", dns.RcodeSuccess, []string{"9.9.9.9"}},
+		{"nonexistent.example", dns.RcodeNameError, nil},
+	}
+	// the second round is answered from the caches
+	for round := 0; round < 2; round++ {
+		for _, tt := range tests {
+			resp := testQuery(t, context.Background(), s, tt.name, dns.TypeA)
+			if resp == nil {
+				t.Fatalf("%s: no response", tt.name)
+			}
+			if resp.Rcode != tt.rcode {
+				t.Errorf("%s: rcode = %s, want %s", tt.name, dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if ips := testAnswerIPs(resp); !equalStrings(ips, tt.ips) {
+				t.Errorf("%s: answers = %v, want %v", tt.name, ips, tt.ips)
+			}
+		}
+	}
+	if testQueried(abroad, "www.cn.example") {
+		t.Errorf("domain of the obedient list queried abroad")
+	}
+	if testQueried(local, "www.blocked.example") {
+		t.Errorf("domain of the gfw list queried by the obedient dns server")
+	}
+	if n := len(local.Queries()) + len(abroad.Queries()); n > 8 {
+		t.Errorf("%d upstream queries, cached answers queried again", n)
+	}
+}
+
+func TestHandleDnsRequestUpstreamError(t *testing.T) {
+	local, abroad := dnsproxytest.NewExchanger(), dnsproxytest.NewExchanger()
+	local.AddRecords("www.cn.example. 60 IN A 10.0.0.1")
+	abroad.AddRecords("www.cn.example. 60 IN A 10.0.0.9", "www.blocked.example. 60 IN A 8.8.4.4")
+	s := newTestServer(local, abroad)
+
+	// failed obedient dns server is retried abroad, without caching the answer
+	local.SetError("www.cn.example", errors.New("refused"))
+	resp := testQuery(t, context.Background(), s, "www.cn.example", dns.TypeA)
+	if resp == nil || !equalStrings(testAnswerIPs(resp), []string{"10.0.0.9"}) {
+		t.Fatalf("answer of failed obedient dns server = %v, want retried abroad", resp)
+	}
+	local.SetError("www.cn.example", nil)
+	resp = testQuery(t, context.Background(), s, "www.cn.example", dns.TypeA)
+	if resp == nil || !equalStrings(testAnswerIPs(resp), []string{"10.0.0.1"}) {
+		t.Fatalf("answer of recovered obedient dns server = %v, want not cached", resp)
+	}
+
+	// nothing is replied if every dns server fails, and failures are not cached
+	abroad.SetError("www.blocked.example", errors.New("refused"))
+	if resp := testQuery(t, context.Background(), s, "www.blocked.example", dns.TypeA); resp != nil {
+		t.Fatalf("failed query replied %v", resp)
+	}
+	abroad.SetError("www.blocked.example", nil)
+	resp = testQuery(t, context.Background(), s, "www.blocked.example", dns.TypeA)
+	if resp == nil || !equalStrings(testAnswerIPs(resp), []string{"8.8.4.4"}) {
+		t.Fatalf("answer of recovered abroad dns server = %v", resp)
+	}
+}
+
+func TestHandleDnsRequestTimeout(t *testing.T) {
+	local, abroad := dnsproxytest.NewExchanger(), dnsproxytest.NewExchanger()
+	abroad.AddRecords("www.blocked.example. 60 IN A 8.8.4.4")
+	abroad.SetDelay(time.Second)
+	s := newTestServer(local, abroad)
+	s.SetDNSQueryTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if resp := testQuery(t, context.Background(), s, "www.blocked.example", dns.TypeA); resp != nil {
+		t.Fatalf("timed out query replied %v", resp)
+	}
+	if took := time.Since(start); took >= time.Second {
+		t.Fatalf("query timeout took %v, want the delay abandoned", took)
+	}
+
+	// done contexts of clients abandon queries as well
+	s.SetDNSQueryTimeout(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if resp := testQuery(t, ctx, s, "www.blocked.example", dns.TypeA); resp != nil {
+		t.Fatalf("abandoned query replied %v", resp)
+	}
+	if took := time.Since(start); took >= time.Second {
+		t.Fatalf("abandoned query took %v", took)
+	}
+
+	// answered once the dns server is near enough
+	abroad.SetDelay(0)
+	resp := testQuery(t, context.Background(), s, "www.blocked.example", dns.TypeA)
+	if resp == nil || !equalStrings(testAnswerIPs(resp), []string{"8.8.4.4"}) {
+		t.Fatalf("answer without delay = %v", resp)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dns.ResponseWriter of a udp client discarding the responses
+type discardResponseWriter struct{ testResponseWriter }
+
+func (w *discardResponseWriter) WriteMsg(m *dns.Msg) error {
+	_, err := m.Pack()
+	return err
+}
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+// queries answered from the domain cache, which most queries of clients are
+func BenchmarkHandleDnsRequest(b *testing.B) {
+	local, abroad := dnsproxytest.NewExchanger(), dnsproxytest.NewExchanger()
+	local.AddRecords("www.cn.example. 60 IN A 10.0.0.1", "www.cn.example. 60 IN A 10.0.0.2")
+	s := newTestServer(local, abroad)
+	req := new(dns.Msg).SetQuestion("www.cn.example.", dns.TypeA)
+	w := &discardResponseWriter{}
+	s.handleDnsRequest(w, req)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.handleDnsRequest(w, req)
+	}
+}
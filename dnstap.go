@@ -0,0 +1,341 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// types of dnstap messages, see https://github.com/dnstap/dnstap.pb/blob/master/dnstap.proto
+const (
+	_DNSTAP_RESOLVER_QUERY    = 3
+	_DNSTAP_RESOLVER_RESPONSE = 4
+	_DNSTAP_CLIENT_QUERY      = 5
+	_DNSTAP_CLIENT_RESPONSE   = 6
+)
+
+// socket families and protocols of dnstap messages
+const (
+	_DNSTAP_INET  = 1
+	_DNSTAP_INET6 = 2
+
+	_DNSTAP_UDP = 1
+	_DNSTAP_TCP = 2
+	_DNSTAP_DOH = 4
+)
+
+// control frames of Frame Streams, the transport of dnstap, see https://farsightsec.github.io/fstrm/
+const (
+	_FSTRM_CONTROL_ACCEPT = 0x01
+	_FSTRM_CONTROL_START  = 0x02
+	_FSTRM_CONTROL_READY  = 0x04
+
+	_FSTRM_FIELD_CONTENT_TYPE = 0x01
+)
+
+var _DNSTAP_CONTENT_TYPE = []byte("protobuf:dnstap.Dnstap")
+
+const (
+	_DNSTAP_BUFFER         = 4096            // messages waiting to be written, new ones are dropped when full
+	_DNSTAP_DIAL_TIMEOUT   = 5 * time.Second // of connecting and the handshake
+	_DNSTAP_WRITE_TIMEOUT  = 5 * time.Second
+	_DNSTAP_RETRY_INTERVAL = 5 * time.Second // after the collector is disconnected
+)
+
+// dnstap output of queries and responses of clients and nameservers,
+// written in Frame Streams to a collector such as `dnstap -u /var/run/dnstap.sock` or `dnscollector`,
+// Run must be running to write them, messages are dropped while the collector is slow or disconnected
+//
+// safe for concurrent use
+type DNSTap struct {
+	network, addr     string
+	identity, version []byte
+	frames            chan []byte // encoded Dnstap messages
+}
+
+// a message of dnstap
+type dnstapMessage struct {
+	typ                 int
+	protocol            int
+	queryAddr, respAddr net.Addr // of the client and the listener, or the nameserver for resolver messages
+	queryTime, respTime time.Time
+	queryMsg, respMsg   *dns.Msg
+}
+
+// --- impl *DNSTap
+
+// dnstap output to `addr`, "unix:///path/to/socket" or "tcp://host:port",
+// messages are identified by `identity`, the hostname if empty
+func NewDNSTap(addr, identity string) (*DNSTap, error) {
+	t := &DNSTap{version: []byte("dnsproxy"), frames: make(chan []byte, _DNSTAP_BUFFER)}
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		t.network, t.addr = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "tcp://"):
+		t.network, t.addr = "tcp", strings.TrimPrefix(addr, "tcp://")
+		if _, _, err := net.SplitHostPort(t.addr); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	default:
+		return nil, errors.Errorf("dnstap address %q is neither unix:// nor tcp://", addr)
+	}
+	if t.addr == "" {
+		return nil, errors.Errorf("invalid dnstap address %q", addr)
+	}
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	t.identity = []byte(identity)
+	return t, nil
+}
+
+// connect the collector and write messages to it, reconnect if it is disconnected, never returns
+func (t *DNSTap) Run() {
+	for {
+		if err := t.serve(); err != nil {
+			glog.Warningf("dnstap %s: %s\n", t.addr, err)
+		}
+		time.Sleep(_DNSTAP_RETRY_INTERVAL)
+	}
+}
+
+// write messages to a new connection of the collector until it fails
+func (t *DNSTap) serve() error {
+	conn, err := net.DialTimeout(t.network, t.addr, _DNSTAP_DIAL_TIMEOUT)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	// bidirectional handshake: READY -> ACCEPT -> START
+	conn.SetDeadline(time.Now().Add(_DNSTAP_DIAL_TIMEOUT))
+	if err = writeFstrmControl(conn, _FSTRM_CONTROL_READY); err != nil {
+		return err
+	}
+	if typ, err := readFstrmControl(conn); err != nil {
+		return err
+	} else if typ != _FSTRM_CONTROL_ACCEPT {
+		return errors.Errorf("unexpected frame streams control frame %d", typ)
+	}
+	if err = writeFstrmControl(conn, _FSTRM_CONTROL_START); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	glog.Infof("dnstap %s connected\n", t.addr)
+
+	// the collector closes the connection or replies FINISH only when it is going away
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	w := bufio.NewWriter(conn)
+	var size [4]byte
+	for {
+		var frame []byte
+		select {
+		case frame = <-t.frames:
+		case <-closed:
+			return errors.New("closed by the collector")
+		}
+		conn.SetWriteDeadline(time.Now().Add(_DNSTAP_WRITE_TIMEOUT))
+		binary.BigEndian.PutUint32(size[:], uint32(len(frame)))
+		w.Write(size[:])
+		if _, err = w.Write(frame); err == nil && len(t.frames) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+// queue `m` to be written, dropped if the queue is full
+func (t *DNSTap) capture(m *dnstapMessage) {
+	frame := protoBuf(nil).
+		bytes(1, t.identity).
+		bytes(2, t.version).
+		bytes(14, m.encode()).
+		varint(15, 1) // type MESSAGE
+	select {
+	case t.frames <- frame:
+	default:
+	}
+}
+
+// capture the query `req` of a client received at `queryTime`, or its response `resp` if it is not nil
+func (t *DNSTap) captureClient(w dns.ResponseWriter, req, resp *dns.Msg, queryTime time.Time) {
+	m := &dnstapMessage{
+		typ:       _DNSTAP_CLIENT_QUERY,
+		protocol:  _DNSTAP_TCP,
+		queryAddr: w.RemoteAddr(),
+		respAddr:  w.LocalAddr(),
+		queryTime: queryTime,
+		queryMsg:  req,
+	}
+	switch w.(type) {
+	case *httpDnsResponseWriter:
+		m.protocol = _DNSTAP_DOH
+	default:
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m.protocol = _DNSTAP_UDP
+		}
+	}
+	if resp != nil {
+		m.typ, m.queryMsg, m.respMsg, m.respTime = _DNSTAP_CLIENT_RESPONSE, nil, resp, time.Now()
+	}
+	t.capture(m)
+}
+
+// capture the query `req` to the nameserver `addr` over `_net` sent at `queryTime`,
+// or its response `resp` if it is not nil
+func (t *DNSTap) captureResolver(addr, _net string, req, resp *dns.Msg, queryTime time.Time) {
+	m := &dnstapMessage{
+		typ:       _DNSTAP_RESOLVER_QUERY,
+		protocol:  _DNSTAP_UDP,
+		queryTime: queryTime,
+		queryMsg:  req,
+	}
+	switch _net {
+	case "tcp":
+		m.protocol = _DNSTAP_TCP
+	case "https":
+		m.protocol = _DNSTAP_DOH
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		p, _ := strconv.Atoi(port)
+		m.respAddr = &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+	}
+	if resp != nil {
+		m.typ, m.queryMsg, m.respMsg, m.respTime = _DNSTAP_RESOLVER_RESPONSE, nil, resp, time.Now()
+	}
+	t.capture(m)
+}
+
+// --- impl *dnstapMessage
+
+// the dnstap.Message protobuf
+func (m *dnstapMessage) encode() []byte {
+	b := protoBuf(nil).varint(1, uint64(m.typ))
+	queryIP, queryPort := addrIPPort(m.queryAddr)
+	respIP, respPort := addrIPPort(m.respAddr)
+	family := 0
+	for _, ip := range []net.IP{queryIP, respIP} {
+		if ip.To4() != nil {
+			family = _DNSTAP_INET
+		} else if ip != nil {
+			family = _DNSTAP_INET6
+		}
+		if family != 0 {
+			break
+		}
+	}
+	if family != 0 {
+		b = b.varint(2, uint64(family))
+	}
+	b = b.varint(3, uint64(m.protocol))
+	if queryIP != nil {
+		b = b.bytes(4, dnstapIP(queryIP, family)).varint(6, uint64(queryPort))
+	}
+	if respIP != nil {
+		b = b.bytes(5, dnstapIP(respIP, family)).varint(7, uint64(respPort))
+	}
+	if !m.queryTime.IsZero() {
+		b = b.varint(8, uint64(m.queryTime.Unix())).fixed32(9, uint32(m.queryTime.Nanosecond()))
+	}
+	if m.queryMsg != nil {
+		if wire, err := m.queryMsg.Pack(); err == nil {
+			b = b.bytes(10, wire)
+		}
+	}
+	if !m.respTime.IsZero() {
+		b = b.varint(12, uint64(m.respTime.Unix())).fixed32(13, uint32(m.respTime.Nanosecond()))
+	}
+	if m.respMsg != nil {
+		if wire, err := m.respMsg.Pack(); err == nil {
+			b = b.bytes(14, wire)
+		}
+	}
+	return b
+}
+
+// ip and port of a *net.UDPAddr or *net.TCPAddr, nil if it is neither
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch v := addr.(type) {
+	case *net.UDPAddr:
+		return v.IP, v.Port
+	case *net.TCPAddr:
+		return v.IP, v.Port
+	}
+	return nil, 0
+}
+
+// `ip` in 4 bytes if `family` is _DNSTAP_INET, otherwise in 16 bytes
+func dnstapIP(ip net.IP, family int) []byte {
+	if ip4 := ip.To4(); ip4 != nil && family == _DNSTAP_INET {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// write a control frame of `typ` with the dnstap content type
+func writeFstrmControl(w io.Writer, typ uint32) error {
+	var b []byte
+	b = binary.BigEndian.AppendUint32(b, typ)
+	b = binary.BigEndian.AppendUint32(b, _FSTRM_FIELD_CONTENT_TYPE)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(_DNSTAP_CONTENT_TYPE)))
+	b = append(b, _DNSTAP_CONTENT_TYPE...)
+	// escape (a zero length data frame) and the length of the control frame
+	head := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(b)))
+	_, err := w.Write(append(head, b...))
+	return errors.WithStack(err)
+}
+
+// read a control frame and return its type
+func readFstrmControl(r io.Reader) (uint32, error) {
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	n := binary.BigEndian.Uint32(head[4:])
+	if binary.BigEndian.Uint32(head[:4]) != 0 || n < 4 || n > 512 {
+		return 0, errors.New("invalid frame streams control frame")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// protobuf message being encoded
+type protoBuf []byte
+
+// --- impl protoBuf
+
+func (b protoBuf) varint(field int, v uint64) protoBuf {
+	b = binary.AppendUvarint(b, uint64(field)<<3) // wire type 0
+	return binary.AppendUvarint(b, v)
+}
+
+func (b protoBuf) fixed32(field int, v uint32) protoBuf {
+	b = binary.AppendUvarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func (b protoBuf) bytes(field int, v []byte) protoBuf {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
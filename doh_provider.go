@@ -0,0 +1,128 @@
+package dnsproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ARwMq9b6/dnsproxy/dns_over_https/google"
+	"github.com/ARwMq9b6/dnsproxy/dns_over_https/rfc8484"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// DNS over HTTPS server, queried by dnsTransport whose net is "https"
+type DoHProvider interface {
+	Exchange(req *dns.Msg, rt http.RoundTripper) (*dns.Msg, error)
+}
+
+// Google JSON API at dns.google.com, also used by dns transports whose net is "https"
+var _GOOGLE_DOH_PROVIDER = NewPinnedDoHProvider(NewJSONDoHProvider(google.DEFAULT_DNS_SERVER),
+	net.IPv4(8, 8, 8, 8), net.IPv4(8, 8, 4, 4))
+
+var _DOH_PROVIDERS = struct {
+	sync.RWMutex
+	m map[string]DoHProvider
+}{m: map[string]DoHProvider{
+	// pinned to their anycast addresses, so that the well known hosts are never resolved into poisoned addresses
+	"google": _GOOGLE_DOH_PROVIDER,
+	"cloudflare": NewPinnedDoHProvider(NewWireDoHProvider("https://cloudflare-dns.com/dns-query", http.MethodGet),
+		net.IPv4(1, 1, 1, 1), net.IPv4(1, 0, 0, 1)),
+	"quad9": NewPinnedDoHProvider(NewWireDoHProvider("https://dns.quad9.net/dns-query", http.MethodGet),
+		net.IPv4(9, 9, 9, 9), net.IPv4(149, 112, 112, 112)),
+}}
+
+// register a DoH provider by name, replace the existing one if any
+func RegisterDoHProvider(name string, p DoHProvider) {
+	_DOH_PROVIDERS.Lock()
+	defer _DOH_PROVIDERS.Unlock()
+	_DOH_PROVIDERS.m[strings.ToLower(name)] = p
+}
+
+// get a registered DoH provider by name, built-in providers: google, cloudflare, quad9
+func LookupDoHProvider(name string) (DoHProvider, bool) {
+	_DOH_PROVIDERS.RLock()
+	defer _DOH_PROVIDERS.RUnlock()
+	p, ok := _DOH_PROVIDERS.m[strings.ToLower(name)]
+	return p, ok
+}
+
+// get a registered DoH provider by name, or treat `nameOrURL` as the URL of a custom provider
+// format: "wire" or "json", only used for custom provider, "wire" as default if empty
+func ParseDoHProvider(nameOrURL, format string) (DoHProvider, error) {
+	if p, ok := LookupDoHProvider(nameOrURL); ok {
+		return p, nil
+	}
+	if !strings.HasPrefix(nameOrURL, "https://") {
+		return nil, errors.Errorf("unknown DoH provider %q", nameOrURL)
+	}
+	switch strings.ToLower(format) {
+	case "", "wire":
+		return NewWireDoHProvider(nameOrURL, http.MethodGet), nil
+	case "json":
+		return NewJSONDoHProvider(nameOrURL), nil
+	default:
+		return nil, errors.Errorf("unknown DoH format %q", format)
+	}
+}
+
+// DoH provider speaks the Google JSON API, such as https://dns.google.com/resolve
+type jsonDoHProvider struct {
+	url string
+}
+
+// --- impl DoHProvider for jsonDoHProvider
+func NewJSONDoHProvider(url string) DoHProvider {
+	return jsonDoHProvider{url: url}
+}
+
+func (p jsonDoHProvider) Exchange(req *dns.Msg, rt http.RoundTripper) (*dns.Msg, error) {
+	return MsgExchangeOverJSONDOH(req, rt, p.url)
+}
+
+// DoH provider speaks the RFC 8484 wire format, such as https://cloudflare-dns.com/dns-query
+type wireDoHProvider struct {
+	url    string
+	method string // GET or POST
+}
+
+// --- impl DoHProvider for wireDoHProvider
+func NewWireDoHProvider(url, method string) DoHProvider {
+	return wireDoHProvider{url: url, method: method}
+}
+
+func (p wireDoHProvider) Exchange(req *dns.Msg, rt http.RoundTripper) (*dns.Msg, error) {
+	// DNS ID should be 0 in every DNS request, see RFC 8484 section 4.1
+	_req := *req
+	_req.Id = 0
+	b, err := _req.Pack()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	b, err = rfc8484.Exchange(rt, p.url, p.method, b)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err = resp.Unpack(b); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// DoH provider connected by fixed addresses instead of resolving its host, see (*dnsTransport).SetDoHIPs
+type pinnedDoHProvider struct {
+	DoHProvider
+	ips []net.IP
+}
+
+// --- impl DoHProvider for pinnedDoHProvider
+
+// `p` is connected by `ips` one by one by default when it is used by NewDoHTransport,
+// its certificates are still verified against the host of its url
+func NewPinnedDoHProvider(p DoHProvider, ips ...net.IP) DoHProvider {
+	return pinnedDoHProvider{DoHProvider: p, ips: ips}
+}
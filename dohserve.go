@@ -0,0 +1,226 @@
+package dnsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ARwMq9b6/dnsproxy/dns_over_https/google"
+	"github.com/ARwMq9b6/dnsproxy/dns_over_https/rfc8484"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// serve DNS over HTTPS at /dns-query in RFC 8484 wire format,
+// and at /resolve in Google JSON API format if `enableJSON`
+// plain http is served if `certs` is nil, e.g. behind a reverse proxy
+func (s *Server) ServeDoH(laddr string, certs *CertManager, enableJSON bool) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	srv := &http.Server{Addr: laddr, Handler: s.DoHHandler(enableJSON)}
+	if certs == nil {
+		return errors.WithStack(srv.ListenAndServe())
+	}
+	srv.TLSConfig = certs.TLSConfig()
+	return errors.WithStack(srv.ListenAndServeTLS("", ""))
+}
+
+// http handler of ServeDoH, queries are answered by the same pipeline as ServeDNS
+func (s *Server) DoHHandler(enableJSON bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", s.handleDoHWireRequest)
+	if enableJSON {
+		mux.HandleFunc("/resolve", s.handleDoHJSONRequest)
+	}
+	return mux
+}
+
+func (s *Server) handleDoHWireRequest(w http.ResponseWriter, r *http.Request) {
+	b, err := rfc8484.ReadRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := new(dns.Msg)
+	if err = req.Unpack(b); err != nil || len(req.Question) == 0 {
+		http.Error(w, "malformed dns message", http.StatusBadRequest)
+		return
+	}
+
+	resp := s.resolveHTTP(r, req)
+	if resp == nil {
+		http.Error(w, "failed to resolve", http.StatusBadGateway)
+		return
+	}
+	writeDoHWireResponse(w, resp)
+}
+
+// the Google JSON API, parameters are
+//   - name: the domain to query, required
+//   - type: the query type in number or name, A by default
+//   - do, cd: the DNSSEC OK and checking disabled flags, "1" or "true" to set
+//   - ct: "application/dns-message" to reply in the RFC 8484 wire format instead of JSON
+//
+// edns_client_subnet and random_padding are accepted and ignored, the routing policy sets the subnet itself,
+// failed resolutions are replied SERVFAIL in JSON as Google does, and any origin may query it from browsers
+func (s *Server) handleDoHJSONRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	q := r.URL.Query()
+	name := q.Get("name")
+	if name == "" {
+		http.Error(w, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+	if _, ok := dns.IsDomainName(name); !ok || len(dns.Fqdn(name)) > 255 {
+		http.Error(w, "invalid name parameter", http.StatusBadRequest)
+		return
+	}
+	qtype := dns.TypeA
+	if t := q.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = n
+		} else {
+			http.Error(w, "invalid type parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	if do := q.Get("do"); do == "1" || do == "true" {
+		req.SetEdns0(4096, true)
+	}
+	if cd := q.Get("cd"); cd == "1" || cd == "true" {
+		req.CheckingDisabled = true
+	}
+
+	wire := q.Get("ct") == rfc8484.CONTENT_TYPE
+	resp := s.resolveHTTP(r, req)
+	if resp == nil {
+		if wire {
+			http.Error(w, "failed to resolve", http.StatusBadGateway)
+			return
+		}
+		failed := MsgToGoogleDohResp(new(dns.Msg).SetRcode(req, dns.RcodeServerFailure))
+		failed.Comment = "failed to resolve"
+		w.Header().Set("Content-Type", "application/dns-json")
+		json.NewEncoder(w).Encode(failed)
+		return
+	}
+	if wire {
+		writeDoHWireResponse(w, resp)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-json")
+	setDoHCacheControl(w, resp)
+	json.NewEncoder(w).Encode(MsgToGoogleDohResp(resp))
+}
+
+// reply `resp` in the RFC 8484 wire format
+func writeDoHWireResponse(w http.ResponseWriter, resp *dns.Msg) {
+	b, err := resp.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", rfc8484.CONTENT_TYPE)
+	setDoHCacheControl(w, resp)
+	w.Write(b)
+}
+
+// resolve `req` with handleDnsRequest, nil if nothing is replied
+func (s *Server) resolveHTTP(r *http.Request, req *dns.Msg) *dns.Msg {
+	rw := &httpDnsResponseWriter{remote: httpRemoteAddr(r)}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		rw.local = addr
+	}
+	s.handleDnsRequestContext(r.Context(), rw, req)
+	return rw.msg
+}
+
+// cache the response as long as its min TTL, see RFC 8484 section 5.1
+func setDoHCacheControl(w http.ResponseWriter, resp *dns.Msg) {
+	if len(resp.Answer) > 0 {
+		ttl := RRsMinTTL(resp.Answer)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(ttl.Seconds())))
+	}
+}
+
+// convert `msg` to Google JSON API response, the reverse of RRNewFromGoogleDohRR
+func MsgToGoogleDohResp(msg *dns.Msg) *google.RespRepr {
+	resp := &google.RespRepr{
+		Status: int32(msg.Rcode),
+		TC:     msg.Truncated,
+		RD:     msg.RecursionDesired,
+		RA:     msg.RecursionAvailable,
+		AD:     msg.AuthenticatedData,
+		CD:     msg.CheckingDisabled,
+	}
+	for _, q := range msg.Question {
+		resp.Question = append(resp.Question, google.DNSQuestion{Name: q.Name, Type: int32(q.Qtype)})
+	}
+	toRRs := func(rrs []dns.RR) []google.DNSRR {
+		var grrs []google.DNSRR
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			grrs = append(grrs, google.DNSRR{
+				Name: hdr.Name,
+				Type: int32(hdr.Rrtype),
+				TTL:  int32(hdr.Ttl),
+				Data: strings.TrimPrefix(rr.String(), hdr.String()),
+			})
+		}
+		return grrs
+	}
+	resp.Answer = toRRs(msg.Answer)
+	resp.Authority = toRRs(msg.Ns)
+	resp.Additional = toRRs(msg.Extra)
+	return resp
+}
+
+// dns.ResponseWriter which keeps the written message, for serving dns over http
+type httpDnsResponseWriter struct {
+	local, remote net.Addr
+	msg           *dns.Msg
+}
+
+// --- impl dns.ResponseWriter for *httpDnsResponseWriter
+func (w *httpDnsResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *httpDnsResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *httpDnsResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *httpDnsResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *httpDnsResponseWriter) Close() error        { return nil }
+func (w *httpDnsResponseWriter) TsigStatus() error   { return nil }
+func (w *httpDnsResponseWriter) TsigTimersOnly(bool) {}
+func (w *httpDnsResponseWriter) Hijack()             {}
+
+// address of the http client
+func httpRemoteAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
@@ -1,5 +1,7 @@
 package dnsproxy
 
+import "strings"
+
 // check if a domain in
 // 	- gfw list
 // 	- obedient list
@@ -8,3 +10,92 @@ type DomainMatcher interface {
 	MatchGFW(domain string) bool
 	MatchObedient(domain string) bool
 }
+
+// set of domains, a domain matches if itself or any of its parent domains is in the set,
+// lookups cost O(number of labels) no matter how large the set is
+//
+// not safe for concurrent Add and Match, wrap it with SwappableDomainMatcher for updating at runtime
+type DomainSet struct {
+	m map[string]struct{}
+}
+
+// --- impl *DomainSet
+func NewDomainSet(domains ...string) *DomainSet {
+	set := &DomainSet{m: make(map[string]struct{}, len(domains))}
+	for _, domain := range domains {
+		set.Add(domain)
+	}
+	return set
+}
+
+// add a domain and all its sub domains into set, empty lines and comments starting with `#` are ignored
+func (set *DomainSet) Add(domain string) {
+	domain = normalizeDomain(domain)
+	if domain == "" || domain[0] == '#' {
+		return
+	}
+	set.m[domain] = struct{}{}
+}
+
+func (set *DomainSet) Len() int {
+	return len(set.m)
+}
+
+func (set *DomainSet) Match(domain string) bool {
+	domain = normalizeDomain(domain)
+	for domain != "" {
+		if _, ok := set.m[domain]; ok {
+			return true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return false
+}
+
+// lower case, without leading/trailing spaces and the trailing dot
+func normalizeDomain(domain string) string {
+	domain = strings.TrimSpace(domain)
+	domain = strings.TrimSuffix(domain, ".")
+	for i := 0; i < len(domain); i++ {
+		if c := domain[i]; 'A' <= c && c <= 'Z' {
+			return strings.ToLower(domain)
+		}
+	}
+	return domain
+}
+
+// DomainMatcher backed by DomainSets of gfw list and obedient list
+type DomainListMatcher struct {
+	gfw interface {
+		Match(domain string) bool
+	} // *DomainSet or *GFWRuleMatcher
+	obedient *DomainSet
+}
+
+// --- impl DomainMatcher for *DomainListMatcher
+func NewDomainListMatcher(gfwList, obedientList []string) *DomainListMatcher {
+	return &DomainListMatcher{
+		gfw:      NewDomainSet(gfwList...),
+		obedient: NewDomainSet(obedientList...),
+	}
+}
+
+// DomainListMatcher of which gfw list is gfwlist rules instead of domains
+func NewGFWRuleListMatcher(gfwRules *GFWRuleMatcher, obedientList []string) *DomainListMatcher {
+	return &DomainListMatcher{
+		gfw:      gfwRules,
+		obedient: NewDomainSet(obedientList...),
+	}
+}
+
+func (m *DomainListMatcher) MatchGFW(domain string) bool {
+	return m.gfw.Match(domain)
+}
+
+func (m *DomainListMatcher) MatchObedient(domain string) bool {
+	return m.obedient.Match(domain)
+}
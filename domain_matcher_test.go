@@ -0,0 +1,101 @@
+package dnsproxy
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// about the number of domains of gfwlist
+const benchDomainSetSize = 6000
+
+// `n` distinct random domains such as "qkzvbe.com", the same ones on every call
+func benchDomains(n int) []string {
+	r := rand.New(rand.NewSource(1))
+	tlds := []string{"com", "net", "org", "io", "jp", "tw", "com.hk", "co.uk"}
+	seen := make(map[string]bool, n)
+	domains := make([]string, 0, n)
+	for len(domains) < n {
+		label := make([]byte, 4+r.Intn(9))
+		for i := range label {
+			label[i] = byte('a' + r.Intn(26))
+		}
+		domain := string(label) + "." + tlds[r.Intn(len(tlds))]
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// the lookup of the lists before DomainSet, which compares `domain` with every listed one
+func matchDomainLinear(domain string, list []string) bool {
+	for _, d := range list {
+		if d == domain || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDomainSetMatch(t *testing.T) {
+	set := NewDomainSet("example.com", "Example.ORG.", "# comment", "", "co.uk")
+	tests := []struct {
+		domain string
+		match  bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"WWW.Example.Com.", true},
+		{"a.b.example.org", true},
+		{"anything.co.uk", true},
+		{"notexample.com", false},
+		{"example.com.cn", false},
+		{"com", false},
+		{"# comment", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := set.Match(tt.domain); got != tt.match {
+			t.Errorf("Match(%q) = %v, want %v", tt.domain, got, tt.match)
+		}
+	}
+	if set.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", set.Len())
+	}
+
+	// the same as the linear lookup
+	list := benchDomains(benchDomainSetSize)
+	set = NewDomainSet(list...)
+	for _, domain := range append(benchDomains(2*benchDomainSetSize), "www."+list[0], "a.b."+list[len(list)-1]) {
+		if got, want := set.Match(domain), matchDomainLinear(domain, list); got != want {
+			t.Errorf("Match(%q) = %v, but the linear lookup says %v", domain, got, want)
+		}
+	}
+}
+
+// lookups of subdomains of listed domains and of unlisted ones half and half
+func BenchmarkDomainSetMatch(b *testing.B) {
+	list := benchDomains(benchDomainSetSize)
+	unlisted := benchDomains(2 * benchDomainSetSize)[benchDomainSetSize:]
+	queries := make([]string, 0, 256)
+	for i := 0; len(queries) < cap(queries); i++ {
+		queries = append(queries, "www."+list[i*23%len(list)], "cdn.img."+unlisted[i*29%len(unlisted)])
+	}
+
+	b.Run("DomainSet", func(b *testing.B) {
+		set := NewDomainSet(list...)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			set.Match(queries[i%len(queries)])
+		}
+	})
+	b.Run("linear", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			matchDomainLinear(queries[i%len(queries)], list)
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package dnsproxy
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// a user defined domain pattern and the transport it forces
+type DomainRule struct {
+	Pattern string    `json:"pattern"` // such as "domain:example.com", see DomainRules.Add
+	Trans   Transport `json:"trans"`
+}
+
+// user defined domains forced to be connected directly, through the proxy or rejected by the default routing policy,
+// taking precedence over the gfw list and the obedient list, rules may be added and removed at runtime
+//
+// safe for concurrent use
+type DomainRules struct {
+	mu       sync.RWMutex
+	full     map[string]Transport // "full:" patterns
+	suffixes map[string]Transport // "domain:" patterns
+	patterns []domainPatternRule  // "wildcard:" and "regexp:" patterns, in the order they are added
+}
+
+type domainPatternRule struct {
+	DomainRule
+	re *regexp.Regexp
+}
+
+// --- impl *DomainRules
+func NewDomainRules() *DomainRules {
+	return &DomainRules{
+		full:     make(map[string]Transport),
+		suffixes: make(map[string]Transport),
+	}
+}
+
+// force domains matching `pattern` to `trans`, replacing the transport if the pattern exists, patterns are
+//   - "full:example.com": the domain only
+//   - "domain:example.com" or "example.com": the domain and its sub domains
+//   - "wildcard:*.example.*": `*` matches any characters including dots, `?` matches a single character
+//   - "regexp:^ad[0-9]*\.": a regular expression matching any part of the domain
+//
+// "full:" patterns take precedence over "domain:" ones of which the longest domain wins,
+// then wildcards and regexps are tried in the order they are added
+func (r *DomainRules) Add(pattern string, trans Transport) error {
+	rule, err := parseDomainRule(pattern)
+	if err != nil {
+		return err
+	}
+	rule.Trans = trans
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kind, value := splitDomainPattern(rule.Pattern)
+	switch kind {
+	case "full":
+		r.full[value] = trans
+	case "domain":
+		r.suffixes[value] = trans
+	default:
+		for i := range r.patterns {
+			if r.patterns[i].Pattern == rule.Pattern {
+				r.patterns[i].Trans = trans
+				return nil
+			}
+		}
+		r.patterns = append(r.patterns, rule)
+	}
+	return nil
+}
+
+// remove `pattern` added by Add, false if there is no such pattern
+func (r *DomainRules) Remove(pattern string) bool {
+	rule, err := parseDomainRule(pattern)
+	if err != nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kind, value := splitDomainPattern(rule.Pattern)
+	switch kind {
+	case "full":
+		_, ok := r.full[value]
+		delete(r.full, value)
+		return ok
+	case "domain":
+		_, ok := r.suffixes[value]
+		delete(r.suffixes, value)
+		return ok
+	}
+	for i := range r.patterns {
+		if r.patterns[i].Pattern == rule.Pattern {
+			r.patterns = append(r.patterns[:i], r.patterns[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// all rules, with normalized patterns
+func (r *DomainRules) Rules() []DomainRule {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rules := make([]DomainRule, 0, len(r.full)+len(r.suffixes)+len(r.patterns))
+	for domain, trans := range r.full {
+		rules = append(rules, DomainRule{Pattern: "full:" + domain, Trans: trans})
+	}
+	for domain, trans := range r.suffixes {
+		rules = append(rules, DomainRule{Pattern: "domain:" + domain, Trans: trans})
+	}
+	for _, rule := range r.patterns {
+		rules = append(rules, rule.DomainRule)
+	}
+	return rules
+}
+
+// the rule `domain` matches, false if none
+func (r *DomainRules) Match(domain string) (DomainRule, bool) {
+	domain = normalizeDomain(domain)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if trans, ok := r.full[domain]; ok {
+		return DomainRule{Pattern: "full:" + domain, Trans: trans}, true
+	}
+	if len(r.suffixes) > 0 {
+		for d := domain; d != ""; {
+			if trans, ok := r.suffixes[d]; ok {
+				return DomainRule{Pattern: "domain:" + d, Trans: trans}, true
+			}
+			i := strings.IndexByte(d, '.')
+			if i < 0 {
+				break
+			}
+			d = d[i+1:]
+		}
+	}
+	for _, rule := range r.patterns {
+		if rule.re.MatchString(domain) {
+			return rule.DomainRule, true
+		}
+	}
+	return DomainRule{}, false
+}
+
+// rule of `pattern` with its normalized form and compiled regexp
+func parseDomainRule(pattern string) (domainPatternRule, error) {
+	kind, value := splitDomainPattern(strings.TrimSpace(pattern))
+	var rule domainPatternRule
+	switch kind {
+	case "full", "domain":
+		value = normalizeDomain(value)
+		if value == "" {
+			return rule, errors.Errorf("invalid domain pattern %q", pattern)
+		}
+	case "wildcard":
+		value = normalizeDomain(value)
+		if value == "" {
+			return rule, errors.Errorf("invalid domain pattern %q", pattern)
+		}
+		expr := regexp.QuoteMeta(value)
+		expr = strings.Replace(expr, `\*`, `.*`, -1)
+		expr = strings.Replace(expr, `\?`, `.`, -1)
+		rule.re = regexp.MustCompile("^" + expr + "$")
+	case "regexp":
+		re, err := regexp.Compile(value)
+		if err != nil || value == "" {
+			return rule, errors.Errorf("invalid domain pattern %q", pattern)
+		}
+		rule.re = re
+	default:
+		return rule, errors.Errorf("invalid domain pattern %q", pattern)
+	}
+	rule.Pattern = kind + ":" + value
+	return rule, nil
+}
+
+// "domain:example.com" -> "domain", "example.com", patterns without a kind are "domain:" ones
+func splitDomainPattern(pattern string) (kind, value string) {
+	i := strings.IndexByte(pattern, ':')
+	if i < 0 {
+		return "domain", pattern
+	}
+	return strings.ToLower(pattern[:i]), pattern[i+1:]
+}
@@ -0,0 +1,146 @@
+package dnsproxy
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ARwMq9b6/dnsproxy/dnsproxytest"
+	"github.com/ARwMq9b6/libgost"
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// ServeDNS and ServeProxy on loopback with fake nameservers and proxy of dnsproxytest:
+// the abroad nameserver is queried through the socks5 proxy as configured by cmd/dnsproxy,
+// and proxied connections are relayed by it
+func TestEndToEnd(t *testing.T) {
+	echo := newTestEchoServer(t)
+	defer echo.Close()
+	echoPort := uint16(echo.Addr().(*net.TCPAddr).Port)
+
+	socks, err := dnsproxytest.NewSocks5Server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+
+	local, abroad := dnsproxytest.NewExchanger(), dnsproxytest.NewExchanger()
+	local.AddRecords("www.cn.example. 60 IN A 127.0.0.1")
+	abroad.AddRecords("www.blocked.example. 60 IN A 8.8.4.4", "www.unknown.example. 60 IN A 9.9.9.9")
+	localNS, err := dnsproxytest.NewDNSServer(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer localNS.Close()
+	abroadNS, err := dnsproxytest.NewDNSServer(abroad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer abroadNS.Close()
+
+	dialer, err := proxy.SOCKS5("tcp", socks.Addr(), nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := NewDomainListMatcher([]string{"blocked.example"}, []string{"cn.example"})
+	china := func(ip net.IP) bool { return ip.IsLoopback() }
+	s := NewServer(NewIpcache(0, time.Hour, time.Minute), NewDomaincache(0, time.Hour, time.Minute),
+		dm, china, net.ParseIP("114.114.114.114"), net.ParseIP("8.8.8.8"),
+		NewDnsTransport(localNS.Addr(), "udp", nil), NewDnsTransport(abroadNS.Addr(), "tcp", dialer))
+
+	// dns
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+	go s.ServeDNSListeners([]net.PacketConn{pc}, []net.Listener{l})
+	defer pc.Close()
+	defer l.Close()
+
+	tests := []struct {
+		name string
+		net  string
+		ips  []string
+	}{
+		{"www.cn.example", "udp", []string{"127.0.0.1"}},
+		{"www.blocked.example", "udp", []string{"8.8.4.4"}},
+		{"www.unknown.example", "tcp", []string{"9.9.9.9"}},
+	}
+	for _, tt := range tests {
+		addr := pc.LocalAddr().String()
+		if tt.net == "tcp" {
+			addr = l.Addr().String()
+		}
+		c := &dns.Client{Net: tt.net, Timeout: 5 * time.Second}
+		resp, _, err := c.Exchange(new(dns.Msg).SetQuestion(dns.Fqdn(tt.name), dns.TypeA), addr)
+		if err != nil {
+			t.Errorf("%s over %s: %v", tt.name, tt.net, err)
+			continue
+		}
+		if ips := testAnswerIPs(resp); !equalStrings(ips, tt.ips) {
+			t.Errorf("%s over %s: answers = %v, want %v", tt.name, tt.net, ips, tt.ips)
+		}
+	}
+	// connections to the abroad nameserver are reused, the obedient one is queried directly
+	if targets := socks.Targets(); len(targets) == 0 || targets[0] != abroadNS.Addr() {
+		t.Errorf("proxied %v, want the abroad nameserver %s", targets, abroadNS.Addr())
+	}
+	if testQueried(abroad, "www.cn.example") || !testQueried(abroad, "www.unknown.example") {
+		t.Errorf("abroad nameserver queried %v", abroad.Queries())
+	}
+
+	// proxy, proxied destinations are all served by the echo server
+	socks.SetDial(func(addr string) (net.Conn, error) {
+		if addr == abroadNS.Addr() {
+			return net.Dial("tcp", addr)
+		}
+		return net.Dial("tcp", echo.Addr().String())
+	})
+	node, err := gost.ParseProxyNode("socks5://" + socks.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := gost.NewProxyChain(node)
+	chain.Init()
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeProxyPoolListeners([]net.Listener{pl}, NewProxyPool([]*gost.ProxyChain{chain}, PROXY_POOL_FAILOVER), gost.NewProxyChain())
+	defer pl.Close()
+
+	for _, tt := range []struct {
+		host    string
+		proxied bool
+	}{
+		{"www.cn.example", false},
+		{"www.blocked.example", true},
+		{"www.unknown.example", true},
+	} {
+		before := len(socks.Targets())
+		conn, err := testSocks5Connect(pl.Addr().String(), tt.host, echoPort)
+		if err != nil {
+			t.Errorf("socks5 CONNECT %s: %v", tt.host, err)
+			continue
+		}
+		if err := testEcho(conn); err != nil {
+			t.Errorf("socks5 CONNECT %s: %v", tt.host, err)
+		}
+		conn.Close()
+		want := net.JoinHostPort(tt.host, strconv.Itoa(int(echoPort)))
+		var proxied bool
+		for _, target := range socks.Targets()[before:] {
+			proxied = proxied || target == want
+		}
+		if proxied != tt.proxied {
+			t.Errorf("socks5 CONNECT %s: proxied %v, want %v", tt.host, proxied, tt.proxied)
+		}
+	}
+}
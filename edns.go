@@ -0,0 +1,240 @@
+package dnsproxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// udp payload size advertised by OPT records of replies, small enough to avoid ip fragmentation, see dnsflagday.net/2020
+const _EDNS_UDP_SIZE = 1232
+
+const (
+	_EDNS0_PADDING = 0xc // RFC 7830, unpacked as *dns.EDNS0_LOCAL by the vendored miekg/dns
+	_EDNS0_EDE     = 0xf // extended dns errors of RFC 8914, ditto
+
+	_EDNS0_TCP_KEEPALIVE = 0xb // RFC 7828, ditto, as dns.EDNS0_TCP_KEEPALIVE packs its code and length twice
+
+	// replies are padded to multiples of it, as recommended by RFC 8467
+	_EDNS_PADDING_BLOCK = 468
+)
+
+// idle timeout of dns over tcp conns of clients, advertised by edns-tcp-keepalive options of replies
+const _DNS_TCP_IDLE_TIMEOUT = 8 * time.Second
+
+// lengths of COOKIE options, the client cookie alone or along with a server cookie, see RFC 7873 section 4
+const (
+	_EDNS_CLIENT_COOKIE_LEN     = 8
+	_EDNS_MIN_SERVER_COOKIE_LEN = 8
+	_EDNS_MAX_SERVER_COOKIE_LEN = 32
+)
+
+// secret of server cookies, which changes on restarts so that clients simply learn new cookies
+var _EDNS_COOKIE_SECRET = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// check `req` before resolving it, an error classified as ErrBadClientRequest is returned if it can not be resolved,
+// along with the reply to write, which is nil if `req` should be dropped, such as a response:
+//   - FORMERR for queries of no or more than one question, or of more than one OPT record
+//   - NOTIMP for opcodes other than QUERY
+//   - BADVERS for EDNS versions other than 0
+//   - FORMERR for COOKIE options of malformed lengths, see RFC 7873 section 5.2.2
+func checkDnsRequest(req *dns.Msg) (*dns.Msg, error) {
+	if req.Response {
+		return nil, classified(ErrBadClientRequest, errors.New("dns response received as query"))
+	}
+	var opts int
+	for _, rr := range req.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+	var rcode int
+	var err error
+	switch {
+	case req.Opcode != dns.OpcodeQuery:
+		rcode, err = dns.RcodeNotImplemented, errors.Errorf("dns opcode %s not implemented", dns.OpcodeToString[req.Opcode])
+	case len(req.Question) != 1:
+		rcode, err = dns.RcodeFormatError, errors.Errorf("dns query of %d questions", len(req.Question))
+	case opts > 1:
+		rcode, err = dns.RcodeFormatError, errors.Errorf("dns query of %d OPT records", opts)
+	case opts == 1 && req.IsEdns0().Version() != 0:
+		rcode, err = dns.RcodeBadVers, errors.Errorf("dns query of EDNS version %d", req.IsEdns0().Version())
+	case opts == 1 && !ednsCookieValid(req.IsEdns0()):
+		rcode, err = dns.RcodeFormatError, errors.New("dns query of a malformed COOKIE option")
+	default:
+		return nil, nil
+	}
+	reply := new(dns.Msg).SetRcode(req, rcode)
+	reply.RecursionAvailable = true
+	return reply, classified(ErrBadClientRequest, err)
+}
+
+// replace the OPT records of `resp` by the one of this server if `req` has one, or strip them otherwise:
+//   - the DO bit and the edns-client-subnet option of `req` are echoed, the latter with scope 0 as answers
+//     never vary with it
+//   - the COOKIE option of `req` is echoed along with a server cookie of `client`, see ednsServerCookie,
+//     cookies are never enforced, so queries of missing or stale server cookies are still answered
+//   - the edns-tcp-keepalive option of `req` is answered by _DNS_TCP_IDLE_TIMEOUT unless `isUDP`,
+//     which RFC 7828 forbids
+//   - extended errors of upstreams are kept and other options of them are dropped, as they are
+//     about the conns between this server and upstreams
+//   - `resp` is padded if `req` asks for it, within the udp payload size of `req` if `isUDP`
+//
+// extended rcodes such as BADVERS are set into the OPT record, as the vendored miekg/dns can not pack them
+func replyEdns(req, resp *dns.Msg, client net.IP, isUDP bool) {
+	var upstream *dns.OPT
+	extra := resp.Extra[:0:0]
+	for _, rr := range resp.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			if upstream == nil {
+				upstream = opt
+			}
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	resp.Extra = extra
+
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		if resp.Rcode > 0xF {
+			resp.Rcode = dns.RcodeServerFailure
+		}
+		return
+	}
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(_EDNS_UDP_SIZE)
+	opt.SetDo(reqOpt.Do())
+	if resp.Rcode > 0xF {
+		opt.Hdr.Ttl |= uint32(resp.Rcode>>4) << 24
+		resp.Rcode &= 0xF
+	}
+	if upstream != nil {
+		for _, o := range upstream.Option {
+			if o.Option() == _EDNS0_EDE {
+				opt.Option = append(opt.Option, o)
+			}
+		}
+	}
+	var padding bool
+	for _, o := range reqOpt.Option {
+		switch o := o.(type) {
+		case *dns.EDNS0_SUBNET:
+			ecs := *o
+			ecs.SourceScope = 0
+			opt.Option = append(opt.Option, &ecs)
+		case *dns.EDNS0_COOKIE:
+			if len(o.Cookie) >= 2*_EDNS_CLIENT_COOKIE_LEN {
+				clientCookie := o.Cookie[:2*_EDNS_CLIENT_COOKIE_LEN]
+				opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+					Code:   dns.EDNS0COOKIE,
+					Cookie: clientCookie + ednsServerCookie(client, clientCookie),
+				})
+			}
+		default:
+			switch o.Option() {
+			case _EDNS0_PADDING:
+				padding = true
+			case _EDNS0_TCP_KEEPALIVE:
+				if !isUDP {
+					timeout := make([]byte, 2)
+					binary.BigEndian.PutUint16(timeout, uint16(_DNS_TCP_IDLE_TIMEOUT/(100*time.Millisecond)))
+					opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: _EDNS0_TCP_KEEPALIVE, Data: timeout})
+				}
+			}
+		}
+	}
+	resp.Extra = append(resp.Extra, opt)
+	if padding {
+		max := dns.MaxMsgSize
+		if isUDP {
+			max = ednsUDPSize(req)
+		}
+		padReply(resp, opt, max)
+	}
+}
+
+// whether COOKIE options of `opt` are of the client cookie alone or along with a server cookie
+func ednsCookieValid(opt *dns.OPT) bool {
+	for _, o := range opt.Option {
+		if o, ok := o.(*dns.EDNS0_COOKIE); ok {
+			// hex encoded
+			switch n := len(o.Cookie) / 2; {
+			case n == _EDNS_CLIENT_COOKIE_LEN:
+			case n < _EDNS_CLIENT_COOKIE_LEN+_EDNS_MIN_SERVER_COOKIE_LEN, n > _EDNS_CLIENT_COOKIE_LEN+_EDNS_MAX_SERVER_COOKIE_LEN:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hex encoded server cookie of `client` which sends `clientCookie`, the first 64 bits of
+// HMAC-SHA256 of them by _EDNS_COOKIE_SECRET, see RFC 7873 appendix B.2
+func ednsServerCookie(client net.IP, clientCookie string) string {
+	mac := hmac.New(sha256.New, _EDNS_COOKIE_SECRET)
+	if ip4 := client.To4(); ip4 != nil {
+		client = ip4
+	}
+	b, _ := hex.DecodeString(clientCookie)
+	mac.Write(client)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)[:_EDNS_MIN_SERVER_COOKIE_LEN])
+}
+
+// pad `resp` of `opt` to a multiple of _EDNS_PADDING_BLOCK in length, or to `max` if it is exceeded
+func padReply(resp *dns.Msg, opt *dns.OPT, max int) {
+	b, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	n := len(b) + 4 // the code and length of the padding option
+	if n > max {
+		return
+	}
+	padded := (n + _EDNS_PADDING_BLOCK - 1) / _EDNS_PADDING_BLOCK * _EDNS_PADDING_BLOCK
+	if padded > max {
+		padded = max
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: _EDNS0_PADDING, Data: make([]byte, padded-n)})
+}
+
+// largest udp reply `req` accepts, 512 bytes unless a larger payload size is advertised by its OPT record
+func ednsUDPSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// shrink `resp` which is too large for udp, returns true once nothing can be dropped any more:
+// records of the additional section other than the OPT one go first, which needs no TC as RFC 2181 allows,
+// then the answer and authority sections are dropped with TC set, so that the client retries over tcp
+func truncateReply(resp *dns.Msg) bool {
+	var extra []dns.RR
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	if len(extra) < len(resp.Extra) {
+		resp.Extra = extra
+		return false
+	}
+	resp.Answer, resp.Ns = nil, nil
+	resp.Truncated = true
+	return true
+}
@@ -0,0 +1,102 @@
+package dnsproxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// query of `opts` in its OPT record
+func testEdnsQuery(opts ...dns.EDNS0) *dns.Msg {
+	req := new(dns.Msg).SetQuestion("www.example.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	req.IsEdns0().Option = opts
+	return req
+}
+
+// options of the reply to `req` from `client`, nil if the reply has no OPT record
+func testReplyEdnsOptions(req *dns.Msg, client net.IP, isUDP bool) []dns.EDNS0 {
+	resp := new(dns.Msg).SetReply(req)
+	replyEdns(req, resp, client, isUDP)
+	// through the wire, as clients see them
+	b, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	if err := resp.Unpack(b); err != nil || resp.IsEdns0() == nil {
+		return nil
+	}
+	return resp.IsEdns0().Option
+}
+
+func TestReplyEdnsCookie(t *testing.T) {
+	const clientCookie = "0102030405060708"
+	client, other := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	serverCookie := func(client net.IP, cookie string) string {
+		for _, o := range testReplyEdnsOptions(testEdnsQuery(&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie}), client, true) {
+			if o, ok := o.(*dns.EDNS0_COOKIE); ok {
+				if o.Cookie[:len(clientCookie)] != clientCookie {
+					t.Errorf("client cookie echoed as %s", o.Cookie[:len(clientCookie)])
+				}
+				return o.Cookie[len(clientCookie):]
+			}
+		}
+		t.Fatalf("COOKIE of %s not echoed", cookie)
+		return ""
+	}
+
+	sc := serverCookie(client, clientCookie)
+	if len(sc) != 2*_EDNS_MIN_SERVER_COOKIE_LEN {
+		t.Fatalf("server cookie %s of %d bytes", sc, len(sc)/2)
+	}
+	// the same for the client, either learning it or sending it back, and stale ones are not enforced
+	if _sc := serverCookie(client, clientCookie+sc); _sc != sc {
+		t.Errorf("server cookie %s changed into %s", sc, _sc)
+	}
+	if _sc := serverCookie(client, clientCookie+"0000000000000000"); _sc != sc {
+		t.Errorf("stale server cookie replied %s, want %s", _sc, sc)
+	}
+	if _sc := serverCookie(other, clientCookie); _sc == sc {
+		t.Errorf("server cookie %s of another client is the same", sc)
+	}
+
+	tests := []struct {
+		cookie string
+		rcode  int
+	}{
+		{clientCookie, -1},
+		{clientCookie + sc, -1},
+		{"01020304", dns.RcodeFormatError},
+		{clientCookie + "01020304", dns.RcodeFormatError},
+		{clientCookie + sc + sc + sc + sc + sc, dns.RcodeFormatError},
+	}
+	for _, tt := range tests {
+		reply, _ := checkDnsRequest(testEdnsQuery(&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: tt.cookie}))
+		rcode := -1
+		if reply != nil {
+			rcode = reply.Rcode
+		}
+		if rcode != tt.rcode {
+			t.Errorf("COOKIE %s: rcode %d, want %d", tt.cookie, rcode, tt.rcode)
+		}
+	}
+}
+
+func TestReplyEdnsTCPKeepalive(t *testing.T) {
+	req := testEdnsQuery(&dns.EDNS0_LOCAL{Code: _EDNS0_TCP_KEEPALIVE})
+	for _, isUDP := range []bool{false, true} {
+		var timeout []byte
+		for _, o := range testReplyEdnsOptions(req, net.IPv4(10, 0, 0, 1), isUDP) {
+			if o, ok := o.(*dns.EDNS0_LOCAL); ok && o.Code == _EDNS0_TCP_KEEPALIVE {
+				timeout = o.Data
+			}
+		}
+		switch {
+		case isUDP && timeout != nil:
+			t.Errorf("edns-tcp-keepalive replied over udp")
+		case !isUDP && (len(timeout) != 2 || int(timeout[0])<<8|int(timeout[1]) != 80):
+			t.Errorf("edns-tcp-keepalive replied %v over tcp, want 80 units of 100ms", timeout)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// class of errors, see ClassifyError
+type errorClass string
+
+func (c errorClass) Error() string {
+	return string(c)
+}
+
+// classes of errors returned by Server and upstreams, errors are wrapped with stacks and messages,
+// so tell their classes by ClassifyError rather than comparing them
+var (
+	ErrNotInitialized   error = errorClass("server is not fully initialized")
+	ErrInvalidConfig    error = errorClass("invalid config")
+	ErrBadClientRequest error = errorClass("bad client request")      // malformed dns queries or proxy requests
+	ErrUpstreamTimeout  error = errorClass("upstream timed out")      // dns servers or proxy servers
+	ErrUpstreamFailure  error = errorClass("upstream failed")         // dns servers or proxy servers failed other than timing out
+	ErrRejected         error = errorClass("destination is rejected") // e.g. blocked by the override zone
+)
+
+// error of a class, whose message and stack are those of the wrapped error
+type classifiedError struct {
+	class error
+	err   error
+}
+
+// --- impl *classifiedError
+
+// wrap `err` into `class`, which should be one of the Err* classes
+func classified(class, err error) error {
+	return &classifiedError{class, err}
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Cause() error {
+	return e.err
+}
+
+// both the class and the wrapped error, for errors.Is of the standard library
+func (e *classifiedError) Unwrap() []error {
+	return []error{e.class, e.err}
+}
+
+func (e *classifiedError) StackTrace() errors.StackTrace {
+	return stackTrace(e.err)
+}
+
+// class of `err`, such as ErrUpstreamTimeout, nil if it is not classified,
+// errors wrapped by github.com/pkg/errors and the standard library are both looked into
+func ClassifyError(err error) error {
+	for err != nil {
+		switch e := err.(type) {
+		case errorClass:
+			return e
+		case *classifiedError:
+			return e.class
+		}
+		if c, ok := err.(interface{ Cause() error }); ok {
+			err = c.Cause()
+		} else if u, ok := err.(interface{ Unwrap() error }); ok {
+			err = u.Unwrap()
+		} else {
+			return nil
+		}
+	}
+	return nil
+}
+
+// classify `err` of an upstream as ErrUpstreamTimeout or ErrUpstreamFailure,
+// unless it is classified already or caused by the caller's cancellation
+func upstreamError(err error) error {
+	if err == nil || ClassifyError(err) != nil {
+		return err
+	}
+	cause := errors.Cause(err)
+	if cause == context.Canceled {
+		return err
+	}
+	if ne, ok := cause.(net.Error); cause == context.DeadlineExceeded || ok && ne.Timeout() {
+		return classified(ErrUpstreamTimeout, err)
+	}
+	return classified(ErrUpstreamFailure, err)
+}
+
+// the outermost stack of `err`, nil if there is none
+func stackTrace(err error) errors.StackTrace {
+	type stackTracer interface {
+		StackTrace() errors.StackTrace
+	}
+	if e, ok := err.(stackTracer); ok {
+		return e.StackTrace()
+	}
+	return nil
+}
+
+// log `err` of serving a client by its class: bad requests are verbose, failures of upstreams are warnings,
+// and others are logged with their stacks by `logf`, such as glog.Errorf
+func logServeError(err error, logf func(format string, args ...interface{})) {
+	switch ClassifyError(err) {
+	case ErrBadClientRequest:
+		glog.V(1).Infof("%s: %s\n", ErrBadClientRequest, err)
+	case ErrUpstreamTimeout, ErrUpstreamFailure, ErrRejected:
+		glog.Warningf("%s\n", err)
+	default:
+		logf("%s%+v\n", err, stackTrace(err))
+	}
+}
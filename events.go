@@ -0,0 +1,235 @@
+package dnsproxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// types of Event
+const (
+	EVENT_DNS         = "dns"         // a query of ServeDNS or ServeDoH is answered or failed
+	EVENT_ROUTE       = "route"       // a domain or an ip is routed by the routing policy, cached decisions are not
+	EVENT_PROXY_OPEN  = "proxy_open"  // a connection of ServeProxy is routed and being relayed
+	EVENT_PROXY_CLOSE = "proxy_close" // the relay of a connection of ServeProxy is done
+)
+
+// something happened in Server, see SetEventStream, one of DNS, Route and Proxy is set according to Type
+type Event struct {
+	Seq   uint64      `json:"seq"` // increases by 1 from 1, gaps mean events dropped for a slow subscriber
+	Time  time.Time   `json:"time"`
+	Type  string      `json:"type"`
+	DNS   *DNSEvent   `json:"dns,omitempty"`
+	Route *RouteEvent `json:"route,omitempty"`
+	Proxy *ProxyConn  `json:"proxy,omitempty"`
+}
+
+// query of EVENT_DNS
+type DNSEvent struct {
+	Client   string   `json:"client"`
+	Name     string   `json:"name"`
+	Qtype    string   `json:"qtype"`
+	Rcode    string   `json:"rcode,omitempty"`   // empty if failed
+	Trans    string   `json:"trans,omitempty"`   // how the domain is routed, empty if failed
+	Answers  []string `json:"answers,omitempty"` // ips of the answer
+	Duration string   `json:"duration"`          // such as "35ms"
+	Error    string   `json:"error,omitempty"`
+}
+
+// decision of EVENT_ROUTE
+type RouteEvent struct {
+	Client   string    `json:"client,omitempty"`
+	Domain   string    `json:"domain,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Port     uint16    `json:"port,omitempty"`     // set for connections routed by RulePolicy.RouteConnection
+	Protocol string    `json:"protocol,omitempty"` // ditto
+	Trans    Transport `json:"trans"`
+	Outbound string    `json:"outbound,omitempty"`
+}
+
+// connection of ServeProxy of EVENT_PROXY_OPEN and EVENT_PROXY_CLOSE, see (*EventStream).ProxyConns
+type ProxyConn struct {
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	Host     string    `json:"host"`               // destination as requested
+	Port     string    `json:"port"`               // ditto
+	Routed   string    `json:"routed,omitempty"`   // domain routed instead of Host, such as that of the Host header
+	Protocol string    `json:"protocol,omitempty"` // sniffed application protocol
+	Trans    Transport `json:"trans"`              // never TRANS_REJECT
+	Outbound string    `json:"outbound,omitempty"` // named proxy chain
+	Since    time.Time `json:"since"`              // when it is routed
+	Duration string    `json:"duration,omitempty"` // how long it is relayed, set once it is closed
+}
+
+// live events of a Server for the dashboard of ServeAdmin, the latest ones are kept for new subscribers,
+// events published into a nil one are dropped
+type EventStream struct {
+	mu     sync.Mutex
+	seq    uint64
+	recent []Event // ring buffer of the latest events, recent[seq % len(recent)] is the next one
+	subs   map[chan Event]struct{}
+
+	connID uint64
+	conns  map[uint64]*ProxyConn // connections of ServeProxy being relayed
+}
+
+// --- impl *EventStream
+
+// latest events kept by NewEventStream by default
+const EVENT_BACKLOG = 500
+
+// keep the latest `backlog` events for new subscribers, EVENT_BACKLOG if not positive
+func NewEventStream(backlog int) *EventStream {
+	if backlog <= 0 {
+		backlog = EVENT_BACKLOG
+	}
+	return &EventStream{
+		recent: make([]Event, backlog),
+		subs:   make(map[chan Event]struct{}),
+		conns:  make(map[uint64]*ProxyConn),
+	}
+}
+
+// events from now on, buffered by `size`, events are dropped for the subscriber rather than waiting for it
+// once the buffer is full; `cancel` must be called once done
+func (es *EventStream) Subscribe(size int) (events <-chan Event, cancel func()) {
+	ch := make(chan Event, size)
+	es.mu.Lock()
+	es.subs[ch] = struct{}{}
+	es.mu.Unlock()
+	return ch, func() {
+		es.mu.Lock()
+		delete(es.subs, ch)
+		es.mu.Unlock()
+	}
+}
+
+// the latest events in order
+func (es *EventStream) Recent() []Event {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	n := uint64(len(es.recent))
+	if es.seq < n {
+		n = es.seq
+	}
+	events := make([]Event, 0, n)
+	for seq := es.seq - n; seq < es.seq; seq++ {
+		events = append(events, es.recent[seq%uint64(len(es.recent))])
+	}
+	return events
+}
+
+// connections of ServeProxy being relayed, in the order they are opened
+func (es *EventStream) ProxyConns() []ProxyConn {
+	es.mu.Lock()
+	conns := make([]ProxyConn, 0, len(es.conns))
+	for _, c := range es.conns {
+		conns = append(conns, *c)
+	}
+	es.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+func (es *EventStream) publish(ev Event) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.publishLocked(ev)
+}
+
+func (es *EventStream) publishLocked(ev Event) {
+	es.seq++
+	ev.Seq = es.seq
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	es.recent[(ev.Seq-1)%uint64(len(es.recent))] = ev
+	for ch := range es.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// publish EVENT_DNS of `req` from `client` received at `start`, answered by `resp` routed by `trans` or failed by `err`
+func (es *EventStream) publishDNS(client net.IP, req, resp *dns.Msg, trans Transport, err error, start time.Time) {
+	if es == nil {
+		return
+	}
+	q := req.Question[0]
+	e := &DNSEvent{
+		Name:     q.Name,
+		Qtype:    dns.TypeToString[q.Qtype],
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+	}
+	if client != nil {
+		e.Client = client.String()
+	}
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		e.Rcode, e.Trans = dns.RcodeToString[resp.Rcode], trans.String()
+		for _, ip := range RRsIPs(resp.Answer) {
+			e.Answers = append(e.Answers, ip.String())
+		}
+	}
+	es.publish(Event{Time: start, Type: EVENT_DNS, DNS: e})
+}
+
+// publish EVENT_ROUTE of `d` made for `q`
+func (es *EventStream) publishRoute(q *RouteQuery, d *RouteDecision) {
+	if es == nil {
+		return
+	}
+	e := &RouteEvent{Domain: q.Domain(), Port: q.Port, Protocol: q.Protocol, Trans: d.Trans, Outbound: d.Outbound}
+	if q.Client != nil {
+		e.Client = q.Client.String()
+	}
+	if q.IP != nil {
+		e.IP = q.IP.String()
+	}
+	es.publish(Event{Type: EVENT_ROUTE, Route: e})
+}
+
+// publish EVENT_PROXY_OPEN of `c` and keep it in ProxyConns until closeProxyConn is called with the returned id
+func (es *EventStream) openProxyConn(c ProxyConn) uint64 {
+	if es == nil {
+		return 0
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.connID++
+	c.ID, c.Since = es.connID, time.Now()
+	es.conns[c.ID] = &c
+	open := c
+	es.publishLocked(Event{Time: c.Since, Type: EVENT_PROXY_OPEN, Proxy: &open})
+	return c.ID
+}
+
+// publish EVENT_PROXY_CLOSE of the connection `id` returned by openProxyConn
+func (es *EventStream) closeProxyConn(id uint64) {
+	if es == nil {
+		return
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	c, ok := es.conns[id]
+	if !ok {
+		return
+	}
+	delete(es.conns, id)
+	c.Duration = time.Since(c.Since).Round(time.Millisecond).String()
+	es.publishLocked(Event{Type: EVENT_PROXY_CLOSE, Proxy: c})
+}
+
+// --- impl *Server
+
+// publish dns queries, routing decisions and proxy connections into `es` for the dashboard of ServeAdmin,
+// nil to disable, must be called before serving
+func (s *Server) SetEventStream(es *EventStream) {
+	s.events = es
+}
@@ -0,0 +1,141 @@
+package dnsproxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/ARwMq9b6/libgost"
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// how long to wait for a direct connection before falling back to the proxy chain by default
+const DIRECT_FALLBACK_TIMEOUT = 5 * time.Second
+
+// how long ips which failed to be connected directly are proxied by default
+const DIRECT_FALLBACK_TTL = 30 * time.Minute
+
+// fallback of direct destinations of ServeProxy which turn out to be unreachable:
+// if a direct connection is refused, reset or not established within `timeout`,
+// the destination is connected through the proxy chain instead,
+// and its ips are cached as TRANS_PROXY for `ttl` so that following requests go straight to the proxy,
+// a cached domain is switched to TRANS_PROXY until its dns answer expires
+//
+// destinations in local zones or with non-public ips are never proxied since proxy chains could not reach them either
+type DirectFallback struct {
+	timeout time.Duration
+	ttl     time.Duration
+}
+
+// --- impl *DirectFallback
+func NewDirectFallback(timeout, ttl time.Duration) *DirectFallback {
+	if timeout <= 0 {
+		timeout = DIRECT_FALLBACK_TIMEOUT
+	}
+	if ttl <= 0 {
+		ttl = DIRECT_FALLBACK_TTL
+	}
+	return &DirectFallback{timeout: timeout, ttl: ttl}
+}
+
+// check if connecting `ips` of a destination through proxy chains makes sense
+func (f *DirectFallback) worth(ips []net.IP) bool {
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialer of `host` resolved into `ips` for `client`, which dials by `dial`,
+// or the first ip through `direct` if `dial` is nil, and falls back to `proxy`
+func (f *DirectFallback) newFallbackDialer(s *Server, client net.IP, host string, ips []net.IP,
+	dial func(port string) (net.Conn, error), direct, proxy *gost.ProxyChain) *fallbackDialer {
+	if dial == nil {
+		dial = func(port string) (net.Conn, error) {
+			c, err := s.directBind.DialChain(direct, net.JoinHostPort(ips[0].String(), port))
+			return c, errors.WithStack(err)
+		}
+	}
+	return &fallbackDialer{f: f, s: s, client: client, host: host, ips: ips, direct: dial, proxy: proxy}
+}
+
+type fallbackDialer struct {
+	f      *DirectFallback
+	s      *Server // whose caches remember failed destinations, and whose outbound binds are dialed from
+	client net.IP
+	host   string   // requested host, dialed through the proxy chain
+	ips    []net.IP // resolved ips of `host`
+	direct func(port string) (net.Conn, error)
+	proxy  *gost.ProxyChain
+}
+
+// --- impl *fallbackDialer
+func (d *fallbackDialer) Dial(port string) (net.Conn, error) {
+	c, err := d.dialDirect(port)
+	if err == nil {
+		return c, nil
+	}
+	glog.Warningf("direct %s failed, falling back to proxy: %s\n", net.JoinHostPort(d.host, port), err)
+	d.s.rememberDirectFailure(d.client, d.host, d.ips, d.f.ttl)
+
+	c, err = d.s.proxyBind.DialChain(d.proxy, net.JoinHostPort(d.host, port))
+	if err != nil {
+		return nil, errors.Wrap(err, "fallback to proxy")
+	}
+	return c, nil
+}
+
+// dial directly within the timeout, a connection established too late is closed
+func (d *fallbackDialer) dialDirect(port string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := d.direct(port)
+		done <- result{c, err}
+	}()
+	timer := time.NewTimer(d.f.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-done; r.err == nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, errors.Errorf("not connected within %s", d.f.timeout)
+	}
+}
+
+// --- impl *Server
+
+// route `ips` and the domain `host` for `client` through the default proxy chains from now on
+func (s *Server) rememberDirectFailure(client net.IP, host string, ips []net.IP, ttl time.Duration) {
+	scope := s.clientScope(client)
+	for _, ip := range ips {
+		s.ipcache.Set(scope, ip.String(), TRANS_PROXY, "", ttl)
+	}
+	if net.ParseIP(host) != nil {
+		return
+	}
+	for _, qtype := range [...]uint16{dns.TypeA, dns.TypeAAAA} {
+		if item, ok := s.domaincache.Get(scope, host, qtype); ok && item.trans == TRANS_DIRECT {
+			s.domaincache.Set(scope, host, qtype, item.Answers(), TRANS_PROXY, "")
+		}
+	}
+}
+
+// global unicast ips out of private networks
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
@@ -0,0 +1,366 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// start of the metadata section of a MaxMind DB file, which is searched from the end of the file
+var _MMDB_METADATA_MARKER = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// bytes of zeros between the search tree and the data section
+const _MMDB_DATA_SEPARATOR = 16
+
+// data types of MaxMind DB, see https://maxmind.github.io/MaxMind-DB/
+const (
+	_MMDB_EXTENDED = iota
+	_MMDB_POINTER
+	_MMDB_STRING
+	_MMDB_DOUBLE
+	_MMDB_BYTES
+	_MMDB_UINT16
+	_MMDB_UINT32
+	_MMDB_MAP
+	_MMDB_INT32
+	_MMDB_UINT64
+	_MMDB_UINT128
+	_MMDB_ARRAY
+	_MMDB_CONTAINER
+	_MMDB_END_MARKER
+	_MMDB_BOOLEAN
+	_MMDB_FLOAT
+)
+
+// country database in the MaxMind DB format, such as GeoLite2-Country.mmdb and GeoLite2-City.mmdb,
+// which tells the ISO 3166-1 country code of an ip, safe for concurrent use
+type GeoIP struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint // bits of a record, 24, 28 or 32
+	ipVersion  uint // 4 or 6
+	dataStart  uint // offset of the data section in buf
+	ipv4Start  uint // node of ::/96 where ipv4 addresses start in ipv6 trees
+
+	mu        sync.Mutex
+	countries map[uint]string // offset in the data section -> country code, records are shared by many networks
+}
+
+// --- impl *GeoIP
+
+// read the MaxMind DB file at `fpath` into memory
+func OpenGeoIP(fpath string) (*GeoIP, error) {
+	buf, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	g, err := NewGeoIP(buf)
+	return g, errors.WithMessage(err, fpath)
+}
+
+// GeoIP of the MaxMind DB file content `buf`
+func NewGeoIP(buf []byte) (*GeoIP, error) {
+	i := bytes.LastIndex(buf, _MMDB_METADATA_MARKER)
+	if i < 0 {
+		return nil, errors.New("invalid maxmind db: metadata not found")
+	}
+	metaStart := uint(i + len(_MMDB_METADATA_MARKER))
+	meta, _, err := (&mmdbDecoder{buf: buf[metaStart:]}).decode(0, 0)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid maxmind db metadata")
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid maxmind db metadata")
+	}
+	g := &GeoIP{
+		buf:        buf,
+		nodeCount:  mmdbUint(m["node_count"]),
+		recordSize: mmdbUint(m["record_size"]),
+		ipVersion:  mmdbUint(m["ip_version"]),
+		countries:  make(map[uint]string),
+	}
+	if g.recordSize != 24 && g.recordSize != 28 && g.recordSize != 32 {
+		return nil, errors.Errorf("unsupported maxmind db record size %d", g.recordSize)
+	}
+	if g.ipVersion != 4 && g.ipVersion != 6 {
+		return nil, errors.Errorf("unsupported maxmind db ip version %d", g.ipVersion)
+	}
+	if g.nodeCount > metaStart {
+		return nil, errors.New("invalid maxmind db: search tree is out of range")
+	}
+	treeSize := g.nodeCount * g.recordSize / 4
+	g.dataStart = treeSize + _MMDB_DATA_SEPARATOR
+	if g.dataStart > metaStart {
+		return nil, errors.New("invalid maxmind db: search tree is out of range")
+	}
+
+	if g.ipVersion == 6 {
+		for i := 0; i < 96 && g.ipv4Start < g.nodeCount; i++ {
+			g.ipv4Start = g.record(g.ipv4Start, 0)
+		}
+	}
+	return g, nil
+}
+
+// ISO 3166-1 code of the country where `ip` is, such as "CN", or the country where it is registered,
+// empty if unknown
+func (g *GeoIP) Country(ip net.IP) string {
+	offset, ok := g.lookup(ip)
+	if !ok {
+		return ""
+	}
+	g.mu.Lock()
+	country, ok := g.countries[offset]
+	g.mu.Unlock()
+	if ok {
+		return country
+	}
+
+	v, _, err := (&mmdbDecoder{buf: g.buf[g.dataStart:]}).decode(offset, 0)
+	if record, ok := v.(map[string]interface{}); ok && err == nil {
+		for _, key := range []string{"country", "registered_country"} {
+			if c, ok := record[key].(map[string]interface{}); ok {
+				if code, ok := c["iso_code"].(string); ok && code != "" {
+					country = strings.ToUpper(code)
+					break
+				}
+			}
+		}
+	}
+	g.mu.Lock()
+	g.countries[offset] = country
+	g.mu.Unlock()
+	return country
+}
+
+// offset of the record of `ip` in the data section, false if there is none
+func (g *GeoIP) lookup(ip net.IP) (uint, bool) {
+	bits := ip.To4()
+	node := g.ipv4Start
+	if bits == nil {
+		if bits = ip.To16(); bits == nil || g.ipVersion == 4 {
+			return 0, false
+		}
+		node = 0
+	}
+	for i := 0; i < len(bits)*8 && node < g.nodeCount; i++ {
+		node = g.record(node, uint(bits[i/8]>>(7-uint(i%8))&1))
+	}
+	if node < g.nodeCount+_MMDB_DATA_SEPARATOR {
+		// not found, the tree is deeper than the address, or a corrupt record into the separator
+		return 0, false
+	}
+	offset := node - g.nodeCount - _MMDB_DATA_SEPARATOR
+	if g.dataStart+offset >= uint(len(g.buf)) {
+		return 0, false
+	}
+	return offset, true
+}
+
+// the left (0) or the right (1) record of `node`
+func (g *GeoIP) record(node, bit uint) uint {
+	b := g.buf[node*g.recordSize/4:]
+	switch g.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// IPMatcher of ips in `countries`, which are ISO 3166-1 codes such as "CN"
+func (g *GeoIP) Matcher(countries []string) *GeoIPMatcher {
+	m := &GeoIPMatcher{geoip: g, countries: make(map[string]struct{}, len(countries))}
+	for _, c := range countries {
+		m.countries[strings.ToUpper(strings.TrimSpace(c))] = struct{}{}
+	}
+	return m
+}
+
+// IPMatcher of ips in some countries, see GeoIP.Matcher
+type GeoIPMatcher struct {
+	geoip     *GeoIP
+	countries map[string]struct{}
+}
+
+// --- impl IPMatcher for *GeoIPMatcher
+
+func (m *GeoIPMatcher) Match(ip net.IP) bool {
+	_, ok := m.countries[m.geoip.Country(ip)]
+	return ok
+}
+
+// decoder of the data section or the metadata section `buf`
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// --- impl *mmdbDecoder
+
+// the value at `offset` and the offset after it, `depth` guards against loops of pointers
+func (d *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("maxmind db data is nested too deeply")
+	}
+	if offset >= uint(len(d.buf)) {
+		return nil, 0, errors.New("maxmind db data is out of range")
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == _MMDB_POINTER {
+		pointer, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(pointer, depth+1)
+		return v, next, err
+	}
+	if typ == _MMDB_EXTENDED {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, errors.New("maxmind db data is out of range")
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if (typ == _MMDB_MAP || typ == _MMDB_ARRAY) && size > uint(len(d.buf))-offset {
+		// each entry takes a byte at least, not to allocate for corrupt sizes
+		return nil, 0, errors.New("maxmind db data is out of range")
+	}
+	switch typ {
+	case _MMDB_MAP:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("maxmind db map key is not a string")
+			}
+			if m[key], offset, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case _MMDB_ARRAY:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			if v, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, offset, nil
+	case _MMDB_BOOLEAN:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errors.New("maxmind db data is out of range")
+	}
+	b := d.buf[offset : offset+size]
+	offset += size
+	switch typ {
+	case _MMDB_STRING:
+		return string(b), offset, nil
+	case _MMDB_BYTES:
+		return b, offset, nil
+	case _MMDB_DOUBLE:
+		if size != 8 {
+			return nil, 0, errors.New("invalid maxmind db double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case _MMDB_FLOAT:
+		if size != 4 {
+			return nil, 0, errors.New("invalid maxmind db float")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case _MMDB_UINT16, _MMDB_UINT32, _MMDB_UINT64, _MMDB_INT32:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		if typ == _MMDB_INT32 {
+			return int32(n), offset, nil
+		}
+		return n, offset, nil
+	case _MMDB_UINT128:
+		// too large for routing, kept as raw bytes
+		return b, offset, nil
+	}
+	return nil, 0, errors.Errorf("unsupported maxmind db data type %d", typ)
+}
+
+// payload size of the field of `ctrl`, whose following bytes start at `offset`
+func (d *mmdbDecoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1F)
+	if size < 29 {
+		return size, offset, nil
+	}
+	n := size - 28 // 1, 2 or 3 bytes follow
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errors.New("maxmind db data is out of range")
+	}
+	var v uint
+	for _, c := range d.buf[offset : offset+n] {
+		v = v<<8 | uint(c)
+	}
+	switch size {
+	case 29:
+		v += 29
+	case 30:
+		v += 285
+	case 31:
+		v += 65821
+	}
+	return v, offset + n, nil
+}
+
+// target of the pointer of `ctrl`, whose following bytes start at `offset`
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3&0x3) + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errors.New("maxmind db data is out of range")
+	}
+	var v uint
+	if n < 4 {
+		v = uint(ctrl & 0x7)
+	}
+	for _, c := range d.buf[offset : offset+n] {
+		v = v<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		v += 2048
+	case 3:
+		v += 526336
+	}
+	return v, offset + n, nil
+}
+
+// unsigned integer of the metadata, 0 if it is not
+func mmdbUint(v interface{}) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
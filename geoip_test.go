@@ -0,0 +1,280 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// network of a test MaxMind DB and the country code of its record
+type testMMDBNetwork struct {
+	cidr    string
+	country string
+}
+
+// control bytes of a field of `typ` with a payload of `size` bytes or entries
+func testMMDBCtrl(typ, size int) []byte {
+	ctrlTyp := typ
+	if typ > 7 {
+		ctrlTyp = _MMDB_EXTENDED
+	}
+	var b []byte
+	switch {
+	case size < 29:
+		b = []byte{byte(ctrlTyp<<5 | size)}
+	case size < 285:
+		b = []byte{byte(ctrlTyp<<5 | 29), byte(size - 29)}
+	default:
+		b = []byte{byte(ctrlTyp<<5 | 30), byte((size - 285) >> 8), byte(size - 285)}
+	}
+	if typ > 7 {
+		b = append([]byte{b[0], byte(typ - 7)}, b[1:]...)
+	}
+	return b
+}
+
+func testMMDBString(s string) []byte {
+	return append(testMMDBCtrl(_MMDB_STRING, len(s)), s...)
+}
+
+func testMMDBUint64(n uint64) []byte {
+	b := testMMDBCtrl(_MMDB_UINT64, 8)
+	return append(b, byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32), byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// pointer to `v` in the data section, in the shortest of the forms
+func testMMDBPointer(v int) []byte {
+	switch {
+	case v < 2048:
+		return []byte{byte(_MMDB_POINTER<<5 | v>>8), byte(v)}
+	case v < 526336:
+		v -= 2048
+		return []byte{byte(_MMDB_POINTER<<5 | 1<<3 | v>>16), byte(v >> 8), byte(v)}
+	case v < 134744064:
+		v -= 526336
+		return []byte{byte(_MMDB_POINTER<<5 | 2<<3 | v>>24), byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	return []byte{_MMDB_POINTER<<5 | 3<<3, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+// metadata section, with its marker, of a MaxMind DB
+func testMMDBMetadata(nodeCount, recordSize, ipVersion uint64) []byte {
+	b := append([]byte(nil), _MMDB_METADATA_MARKER...)
+	b = append(b, testMMDBCtrl(_MMDB_MAP, 4)...)
+	b = append(append(b, testMMDBString("database_type")...), testMMDBString("GeoLite2-Country")...)
+	b = append(append(b, testMMDBString("node_count")...), testMMDBUint64(nodeCount)...)
+	b = append(append(b, testMMDBString("record_size")...), testMMDBUint64(recordSize)...)
+	b = append(append(b, testMMDBString("ip_version")...), testMMDBUint64(ipVersion)...)
+	return b
+}
+
+// MaxMind DB of `networks`, whose records start after `pad` bytes of the data section, for record values
+// of more than 24 bits and pointers of longer forms, keys of the records after the first are pointers
+// to those of the first, as written by MaxMind
+func testMMDB(t *testing.T, ipVersion, recordSize, pad int, networks []testMMDBNetwork) []byte {
+	data := make([]byte, pad)
+	records := make(map[string]int) // country -> offset in the data section
+	var countryKey, isoCodeKey int
+	for _, n := range networks {
+		if _, ok := records[n.country]; ok {
+			continue
+		}
+		records[n.country] = len(data)
+		data = append(data, testMMDBCtrl(_MMDB_MAP, 1)...)
+		if len(records) == 1 {
+			countryKey = len(data)
+			data = append(append(data, testMMDBString("country")...), testMMDBCtrl(_MMDB_MAP, 1)...)
+			isoCodeKey = len(data)
+			data = append(data, testMMDBString("iso_code")...)
+		} else {
+			data = append(append(data, testMMDBPointer(countryKey)...), testMMDBCtrl(_MMDB_MAP, 1)...)
+			data = append(data, testMMDBPointer(isoCodeKey)...)
+		}
+		data = append(data, testMMDBString(n.country)...)
+	}
+
+	// records are nodes if not negative, -1 if empty, or -2 - the offset of the data
+	nodes := [][2]int{{-1, -1}}
+	for _, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := ipnet.IP
+		ones, _ := ipnet.Mask.Size()
+		if ip4 := ip.To4(); ipVersion == 6 && ip4 != nil {
+			ip, ones = append(make(net.IP, 12), ip4...), ones+96
+		}
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - uint(i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -2 - records[n.country]
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	nodeCount := len(nodes)
+	var buf []byte
+	for _, node := range nodes {
+		var r [2]uint32
+		for i, v := range node {
+			switch {
+			case v >= 0:
+				r[i] = uint32(v)
+			case v == -1:
+				r[i] = uint32(nodeCount)
+			default:
+				r[i] = uint32(nodeCount + _MMDB_DATA_SEPARATOR - 2 - v)
+			}
+		}
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(r[0]>>16), byte(r[0]>>8), byte(r[0]), byte(r[1]>>16), byte(r[1]>>8), byte(r[1]))
+		case 28:
+			buf = append(buf, byte(r[0]>>16), byte(r[0]>>8), byte(r[0]), byte(r[0]>>24<<4|r[1]>>24&0xF),
+				byte(r[1]>>16), byte(r[1]>>8), byte(r[1]))
+		default:
+			buf = append(buf, make([]byte, 8)...)
+			binary.BigEndian.PutUint32(buf[len(buf)-8:], r[0])
+			binary.BigEndian.PutUint32(buf[len(buf)-4:], r[1])
+		}
+	}
+	buf = append(buf, make([]byte, _MMDB_DATA_SEPARATOR)...)
+	buf = append(buf, data...)
+	return append(buf, testMMDBMetadata(uint64(nodeCount), uint64(recordSize), uint64(ipVersion))...)
+}
+
+var testMMDBNetworks = []testMMDBNetwork{
+	{"1.2.3.0/24", "CN"},
+	{"8.8.8.0/24", "US"},
+	{"10.0.0.0/8", "US"},
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	tests := []struct {
+		ipVersion  int
+		recordSize int
+		pad        int
+	}{
+		{4, 24, 0},
+		{6, 24, 0},
+		// records of more than 24 bits, with the high nibbles of 28-bit records and pointers of 3 bytes
+		{4, 28, 1 << 24},
+		{6, 28, 1 << 24},
+		// pointers of 2 bytes
+		{4, 32, 1 << 12},
+		{6, 32, 1 << 12},
+	}
+	for _, tt := range tests {
+		networks := testMMDBNetworks
+		if tt.ipVersion == 6 {
+			// ipv4 lookups from the root of the tree would find 1.2.3.4 here
+			networks = append(networks, testMMDBNetwork{"102:300::/24", "DE"}, testMMDBNetwork{"2001:db8::/32", "JP"})
+		}
+		g, err := NewGeoIP(testMMDB(t, tt.ipVersion, tt.recordSize, tt.pad, networks))
+		if err != nil {
+			t.Fatalf("ipv%d %d-bit: %v", tt.ipVersion, tt.recordSize, err)
+		}
+		lookups := map[string]string{
+			"1.2.3.4":        "CN",
+			"::ffff:1.2.3.4": "CN",
+			"8.8.8.8":        "US",
+			"10.1.2.3":       "US",
+			"9.9.9.9":        "",
+			"2001:db8::1":    "",
+			"102:300::1":     "",
+			"2001:db9::1":    "",
+		}
+		if tt.ipVersion == 6 {
+			lookups["2001:db8::1"] = "JP"
+			lookups["102:300::1"] = "DE"
+		}
+		for ip, want := range lookups {
+			// twice for the cached countries
+			for i := 0; i < 2; i++ {
+				if got := g.Country(net.ParseIP(ip)); got != want {
+					t.Errorf("ipv%d %d-bit: country of %s is %q, want %q", tt.ipVersion, tt.recordSize, ip, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestGeoIPCorrupt(t *testing.T) {
+	ips := []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("8.8.8.8"), net.ParseIP("9.9.9.9"), net.ParseIP("2001:db8::1")}
+	networks := append(testMMDBNetworks, testMMDBNetwork{"2001:db8::/32", "JP"})
+	db := testMMDB(t, 6, 28, 0, networks)
+
+	for n := 0; n < len(db); n++ {
+		if _, err := NewGeoIP(db[:n]); err == nil {
+			t.Errorf("truncated to %d of %d bytes: no error", n, len(db))
+		}
+	}
+
+	// corrupt search trees and data only fail lookups
+	metaStart := bytes.LastIndex(db, _MMDB_METADATA_MARKER)
+	for i := 0; i < metaStart; i++ {
+		for _, c := range []byte{0x00, 0xFF, db[i] ^ 0x80, db[i] ^ 0x01} {
+			b := append([]byte(nil), db...)
+			b[i] = c
+			g, err := NewGeoIP(b)
+			if err != nil {
+				t.Fatalf("byte %d corrupted: %v", i, err)
+			}
+			for _, ip := range ips {
+				g.Country(ip)
+			}
+		}
+	}
+
+	tests := []struct {
+		desc string
+		buf  []byte
+	}{
+		{"no metadata", []byte("GeoLite2-Country")},
+		{"unsupported record size", append(make([]byte, 64), testMMDBMetadata(1, 20, 4)...)},
+		{"unsupported ip version", append(make([]byte, 64), testMMDBMetadata(1, 24, 5)...)},
+		{"search tree out of range", append(make([]byte, 64), testMMDBMetadata(16, 24, 4)...)},
+		{"search tree of overflowing size", append(make([]byte, 64), testMMDBMetadata(1<<62, 32, 4)...)},
+		{"metadata not a map", append(append([]byte(nil), _MMDB_METADATA_MARKER...), testMMDBString("node_count")...)},
+	}
+	for _, tt := range tests {
+		if _, err := NewGeoIP(tt.buf); err == nil {
+			t.Errorf("%s: no error", tt.desc)
+		}
+	}
+}
+
+func TestMMDBDecoderCorrupt(t *testing.T) {
+	tests := []struct {
+		desc string
+		buf  []byte
+	}{
+		{"empty", nil},
+		{"pointer to itself", []byte{_MMDB_POINTER << 5, 0}},
+		{"pointer out of range", testMMDBPointer(1 << 20)},
+		{"truncated pointer", testMMDBPointer(1 << 20)[:2]},
+		{"truncated string", testMMDBString("country")[:4]},
+		{"truncated size", testMMDBCtrl(_MMDB_STRING, 300)[:2]},
+		{"truncated extended type", testMMDBCtrl(_MMDB_UINT64, 8)[:1]},
+		{"map of a huge size", []byte{_MMDB_MAP<<5 | 31, 0xFF, 0xFF, 0xFF}},
+		{"array of a huge size", []byte{_MMDB_EXTENDED<<5 | 31, _MMDB_ARRAY - 7, 0xFF, 0xFF, 0xFF}},
+		{"map key not a string", append(testMMDBCtrl(_MMDB_MAP, 1), testMMDBUint64(1)...)},
+		{"truncated map", append(testMMDBCtrl(_MMDB_MAP, 2), testMMDBString("country")...)},
+		{"double of 4 bytes", append(testMMDBCtrl(_MMDB_DOUBLE, 4), 0, 0, 0, 0)},
+		{"unsupported type", testMMDBCtrl(_MMDB_CONTAINER, 0)},
+	}
+	for _, tt := range tests {
+		if v, _, err := (&mmdbDecoder{buf: tt.buf}).decode(0, 0); err == nil {
+			t.Errorf("%s: decoded %v, want an error", tt.desc, v)
+		}
+	}
+}
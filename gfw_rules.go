@@ -0,0 +1,183 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// gfwlist rules in Adblock Plus filter syntax, matched against domains since urls are unknown to dns queries,
+// a domain matches if any rule matches it and no exception rule ("@@" prefixed) does:
+//
+//	"example.com", ".example.com", "||example.com"  example.com and its sub domains
+//	"|http://example.com/"                          example.com only
+//	"*.example.*", "/^https?:\/\/example\.com/"     tested against "http://<domain>/" and "https://<domain>/"
+//
+// paths of rules are ignored, except that exception rules with paths never match,
+// comments ("!" or "#"), the header ("[AutoProxy x.x]") and keywords without any dot are ignored
+type GFWRuleMatcher struct {
+	block     gfwRuleSet
+	exception gfwRuleSet
+}
+
+type gfwRuleSet struct {
+	domains  *DomainSet          // domains and their sub domains
+	hosts    map[string]struct{} // exact domains
+	patterns []*regexp.Regexp    // wildcard and regular expression rules, matched against urls
+}
+
+// --- impl *GFWRuleMatcher
+func NewGFWRuleMatcher(rules []string) *GFWRuleMatcher {
+	m := &GFWRuleMatcher{
+		block:     gfwRuleSet{domains: NewDomainSet(), hosts: make(map[string]struct{})},
+		exception: gfwRuleSet{domains: NewDomainSet(), hosts: make(map[string]struct{})},
+	}
+	for _, rule := range rules {
+		m.add(rule)
+	}
+	return m
+}
+
+func (m *GFWRuleMatcher) add(rule string) {
+	rule = strings.TrimSpace(rule)
+	if rule == "" || rule[0] == '!' || rule[0] == '[' || rule[0] == '#' {
+		return
+	}
+	set := &m.block
+	isException := strings.HasPrefix(rule, "@@")
+	if isException {
+		set = &m.exception
+		rule = rule[2:]
+	}
+	// ABP options such as "$third-party" are meaningless for domains
+	if i := strings.LastIndexByte(rule, '$'); i > 0 && rule[0] != '/' {
+		rule = rule[:i]
+	}
+
+	switch {
+	case len(rule) > 2 && rule[0] == '/' && rule[len(rule)-1] == '/':
+		if re, err := regexp.Compile(rule[1 : len(rule)-1]); err == nil {
+			set.patterns = append(set.patterns, re)
+		}
+		return
+	case strings.Contains(rule, "*"):
+		if re, err := regexp.Compile(abpPatternToRegexp(rule)); err == nil {
+			set.patterns = append(set.patterns, re)
+		}
+		return
+	}
+
+	exact := false
+	switch {
+	case strings.HasPrefix(rule, "||"):
+		rule = rule[2:]
+	case strings.HasPrefix(rule, "|"):
+		rule = rule[1:]
+		exact = true
+	default:
+		rule = strings.TrimPrefix(rule, ".")
+	}
+	if i := strings.Index(rule, "://"); i >= 0 {
+		rule = rule[i+3:]
+	}
+	host, path := rule, ""
+	if i := strings.IndexAny(rule, "/^?#:|"); i >= 0 {
+		host, path = rule[:i], strings.Trim(rule[i:], "/^|")
+	}
+	if !strings.Contains(host, ".") || (isException && path != "") {
+		return
+	}
+	if exact {
+		set.hosts[normalizeDomain(host)] = struct{}{}
+	} else {
+		set.domains.Add(host)
+	}
+}
+
+func (m *GFWRuleMatcher) Match(domain string) bool {
+	domain = normalizeDomain(domain)
+	return m.block.match(domain) && !m.exception.match(domain)
+}
+
+// number of rules in effect, exceptions included
+func (m *GFWRuleMatcher) Len() int {
+	return m.block.len() + m.exception.len()
+}
+
+// --- impl *gfwRuleSet
+func (set *gfwRuleSet) match(domain string) bool {
+	if _, ok := set.hosts[domain]; ok {
+		return true
+	}
+	if set.domains.Match(domain) {
+		return true
+	}
+	if len(set.patterns) == 0 {
+		return false
+	}
+	urls := [...]string{"http://" + domain + "/", "https://" + domain + "/"}
+	for _, re := range set.patterns {
+		for _, url := range urls {
+			if re.MatchString(url) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (set *gfwRuleSet) len() int {
+	return set.domains.Len() + len(set.hosts) + len(set.patterns)
+}
+
+// regular expression of an ABP filter with wildcards
+func abpPatternToRegexp(rule string) string {
+	var b strings.Builder
+	switch {
+	case strings.HasPrefix(rule, "||"):
+		b.WriteString(`^[a-z][a-z0-9+.-]*://([^/?#]*\.)?`)
+		rule = rule[2:]
+	case strings.HasPrefix(rule, "|"):
+		b.WriteString(`^`)
+		rule = rule[1:]
+	}
+	end := ""
+	if strings.HasSuffix(rule, "|") {
+		rule, end = rule[:len(rule)-1], `$`
+	}
+	for _, c := range rule {
+		switch c {
+		case '*':
+			b.WriteString(`.*`)
+		case '^':
+			b.WriteString(`(?:[^\w.%-]|$)`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString(end)
+	return b.String()
+}
+
+// rules of the base64 encoded gfwlist https://github.com/gfwlist/gfwlist, including whitelist rules,
+// see GFWRuleMatcher
+func ParseGFWRules(r io.Reader) ([]string, error) {
+	var rules []string
+	scanner := bufio.NewScanner(base64.NewDecoder(base64.StdEncoding, r))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && line[0] != '!' {
+			rules = append(rules, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("empty gfwlist")
+	}
+	return rules, nil
+}
@@ -2,63 +2,37 @@ package dnsproxy
 
 import (
 	"net"
-	"sync"
-)
-
-var (
-	_DEFAULT_IPCACHE     ipcache
-	_DEFAULT_DOMAINCACHE domaincache
-
-	_DEFAULT_DOMAIN_MATCHER    DomainMatcher
-	_IP_MATCH_CHINESE_MAINLAND func(net.IP) bool
 
-	_DNS_SUBNET_LOCAL_IP net.IP
-	_DNS_SUBNET_PROXY_IP net.IP
-
-	_DNSSTRANSPORT_OBEDIENT *dnsTransport
-	_DNSSTRANSPORT_ABROAD   *dnsTransport
+	"github.com/ARwMq9b6/libgost"
+	"github.com/pkg/errors"
 )
 
-var _DEFAULT_GLOBALS_VALIDATOR = newGlobalsValidator()
-
-// to determine if globals has been initialized
-type globalsValidator struct {
-	sync.Once
-	ok bool // cached result of verification
-}
+// server used by package level ServeDNS and ServeProxy
+var _DEFAULT_SERVER *Server
 
-// --- impl *globalsValidator
-func newGlobalsValidator() *globalsValidator {
-	return &globalsValidator{}
+// init global vars
+//
+// Deprecated: use NewServer instead
+func InitGlobals(ipc IPCache, domainc DomainCache,
+	dm DomainMatcher, ipMatchCHN func(net.IP) bool,
+	subnetLocalIP, subnetProxyIP net.IP,
+	dtObedient, dtAbroad DNSExchanger) {
+	_DEFAULT_SERVER = NewServer(ipc, domainc, dm, ipMatchCHN,
+		subnetLocalIP, subnetProxyIP, dtObedient, dtAbroad)
 }
 
-func (v *globalsValidator) validate() bool {
-	v.Do(func() {
-		if _DEFAULT_IPCACHE.inner != nil &&
-			_DEFAULT_DOMAINCACHE.inner != nil &&
-			_DEFAULT_DOMAIN_MATCHER != nil &&
-			_IP_MATCH_CHINESE_MAINLAND != nil &&
-			_DNS_SUBNET_LOCAL_IP != nil &&
-			_DNS_SUBNET_LOCAL_IP != nil &&
-			_DNSSTRANSPORT_OBEDIENT != nil &&
-			_DNSSTRANSPORT_ABROAD != nil {
-			v.ok = true
-		}
-	})
-	return v.ok
+// Deprecated: use (*Server).ServeDNS instead
+func ServeDNS(laddr string) error {
+	if _DEFAULT_SERVER == nil {
+		return errors.New("global vars are uninitialized")
+	}
+	return _DEFAULT_SERVER.ServeDNS(laddr)
 }
 
-// init global vars
-func InitGlobals(ipc ipcache, domainc domaincache,
-	dm DomainMatcher, ipMatchCHN func(net.IP) bool,
-	subnetLocalIP, subnetProxyIP net.IP,
-	dtObedient, dtAbroad *dnsTransport) {
-	_DEFAULT_IPCACHE = ipc
-	_DEFAULT_DOMAINCACHE = domainc
-	_DEFAULT_DOMAIN_MATCHER = dm
-	_IP_MATCH_CHINESE_MAINLAND = ipMatchCHN
-	_DNS_SUBNET_LOCAL_IP = subnetLocalIP
-	_DNS_SUBNET_PROXY_IP = subnetProxyIP
-	_DNSSTRANSPORT_OBEDIENT = dtObedient
-	_DNSSTRANSPORT_ABROAD = dtAbroad
+// Deprecated: use (*Server).ServeProxy instead
+func ServeProxy(laddr string, proxy, direct *gost.ProxyChain) error {
+	if _DEFAULT_SERVER == nil {
+		return errors.New("global vars are uninitialized")
+	}
+	return _DEFAULT_SERVER.ServeProxy([]string{laddr}, proxy, direct)
 }
@@ -0,0 +1,171 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/ARwMq9b6/libgost"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// delay between connection attempts to successive candidate ips recommended by RFC 8305
+const HAPPY_EYEBALLS_DELAY = 250 * time.Millisecond
+
+// Happy Eyeballs (RFC 8305) for direct connections of ServeProxy:
+// all resolved ips of a destination are dialed one after another, `delay` apart or as soon as the former fails,
+// instead of waiting for a broken ip to time out, the first established connection wins and the others are canceled,
+// the proxy chain joins the race after `proxyDelay` if it is positive
+type HappyEyeballs struct {
+	delay      time.Duration
+	proxyDelay time.Duration
+}
+
+// --- impl *HappyEyeballs
+func NewHappyEyeballs(delay, proxyDelay time.Duration) *HappyEyeballs {
+	if delay <= 0 {
+		delay = HAPPY_EYEBALLS_DELAY
+	}
+	return &HappyEyeballs{delay: delay, proxyDelay: proxyDelay}
+}
+
+// dialer of the candidate `ips` of `host` through `direct`, racing against `proxy` if it is enabled,
+// both are dialed from the outbound binds of `s`
+func (he *HappyEyeballs) newRacingDialer(s *Server, host string, ips []net.IP, direct, proxy *gost.ProxyChain) *racingDialer {
+	if he.proxyDelay <= 0 {
+		proxy = nil
+	}
+	return &racingDialer{he: he, s: s, host: host, ips: interleaveIPFamilies(ips), direct: direct, proxy: proxy}
+}
+
+// worth racing, i.e. there are other choices than the only ip, false if there is no ip
+func (he *HappyEyeballs) worth(ips []net.IP) bool {
+	return len(ips) > 1 || (len(ips) == 1 && he.proxyDelay > 0)
+}
+
+type racingDialer struct {
+	he     *HappyEyeballs
+	s      *Server  // whose outbound binds are dialed from
+	host   string   // requested host, dialed through the proxy chain
+	ips    []net.IP // candidates dialed in order
+	direct *gost.ProxyChain
+	proxy  *gost.ProxyChain // nil to not race against the proxy chain
+}
+
+type racingResult struct {
+	conn  net.Conn
+	err   error
+	addr  string
+	proxy bool
+}
+
+// --- impl *racingDialer
+func (d *racingDialer) Dial(port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan racingResult, len(d.ips)+1)
+	pending, next := 0, 0
+	var nextAttempt, proxyAttempt <-chan time.Time
+	startNext := func() {
+		addr := net.JoinHostPort(d.ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			c, err := d.dialDirect(ctx, addr)
+			results <- racingResult{c, err, addr, false}
+		}()
+		nextAttempt = nil
+		if next < len(d.ips) {
+			nextAttempt = time.After(d.he.delay)
+		}
+	}
+	if d.proxy != nil {
+		proxyAttempt = time.After(d.he.proxyDelay)
+	}
+
+	startNext()
+	var firstErr error
+	for {
+		select {
+		case <-nextAttempt:
+			startNext()
+		case <-proxyAttempt:
+			proxyAttempt = nil
+			addr := net.JoinHostPort(d.host, port)
+			pending++
+			go func() {
+				// dialing through proxy chains can not be canceled, losers are closed once connected
+				c, err := d.s.proxyBind.DialChain(d.proxy, addr)
+				results <- racingResult{c, errors.WithStack(err), addr, true}
+			}()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go closeRacingLosers(results, pending)
+				if r.proxy {
+					glog.V(1).Infof("happy eyeballs %s:%s: proxy won\n", d.host, port)
+				} else {
+					glog.V(1).Infof("happy eyeballs %s:%s: %s won\n", d.host, port, r.addr)
+				}
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(d.ips) {
+				startNext()
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+func (d *racingDialer) dialDirect(ctx context.Context, addr string) (net.Conn, error) {
+	if len(d.direct.Nodes()) > 0 {
+		c, err := d.s.directBind.DialChain(d.direct, addr)
+		return c, errors.WithStack(err)
+	}
+	dialer := d.s.directBind.dialer("tcp", 0)
+	dialer.Timeout, dialer.KeepAlive = gost.DialTimeout, gost.KeepAliveTime
+	c, err := dialer.DialContext(ctx, "tcp", addr)
+	return c, errors.WithStack(err)
+}
+
+// close connections of attempts which finish after the race is won
+func closeRacingLosers(results <-chan racingResult, pending int) {
+	for ; pending > 0; pending-- {
+		if r := <-results; r.err == nil {
+			r.conn.Close()
+		}
+	}
+}
+
+// reorder `ips` so that ipv6 and ipv4 addresses alternate, starting with the family of the first one,
+// the order within each family is kept
+func interleaveIPFamilies(ips []net.IP) []net.IP {
+	if len(ips) == 0 {
+		return ips
+	}
+	var first, second []net.IP
+	isIPv4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == isIPv4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	_ips := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			_ips = append(_ips, first[i])
+		}
+		if i < len(second) {
+			_ips = append(_ips, second[i])
+		}
+	}
+	return _ips
+}
@@ -0,0 +1,162 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/ARwMq9b6/libgost"
+)
+
+// callbacks of embedders, such as custom telemetry or feedback loops into routing policies, without forking
+// the handlers, see (*Server).SetHooks and (*dnsTransport).SetHooks
+//
+// callbacks are registered by the On* methods before serving, several ones of a kind are called in the order
+// they are registered; they are called synchronously on the paths of queries and connections,
+// so they should be quick and must not modify their arguments
+type Hooks struct {
+	dnsDecision   []func(q *RouteQuery, d *RouteDecision)
+	proxyDecision []func(d *ProxyDecision)
+	upstreamError []func(e *UpstreamError)
+	cacheEvict    []func(e *CacheEviction)
+}
+
+// routing decision of a connection of ServeProxy, see OnProxyDecision
+type ProxyDecision struct {
+	Client   net.IP
+	Host     string // destination as requested, a domain or an ip
+	Port     string
+	Routed   string // domain routed instead of Host, such as that of the Host header, empty if Host is routed
+	Protocol string // sniffed application protocol such as "tls", empty if unknown
+	Trans    Transport
+	Outbound string // named proxy chain of TRANS_PROXY, empty for the default one
+}
+
+// failure of a dns server or a proxy chain, see OnUpstreamError
+type UpstreamError struct {
+	Kind string // "dns" or "proxy"
+	Name string // usage of dns servers such as "abroad", see (*dnsTransport).SetHooks, or the named proxy chain
+	Addr string // such as "8.8.8.8:53", empty for DNS over HTTPS, or the nodes of the proxy chain
+	Err  error  // classified as ErrUpstreamTimeout or ErrUpstreamFailure, see ClassifyError
+}
+
+// item deleted from a cache of Server after expired or beyond the max entries, see OnCacheEvict
+type CacheEviction struct {
+	Cache    string // "ip" or "domain"
+	Scope    string // clients sharing the item, see ClientScoper
+	Key      string // ip of the ip cache or domain of the domain cache
+	Qtype    uint16 // of the domain cache
+	Trans    Transport
+	Outbound string // of the ip cache
+}
+
+// --- impl *Hooks
+
+func NewHooks() *Hooks {
+	return &Hooks{}
+}
+
+// call `f` with each domain routed by the routing policy, of dns queries and of destinations of ServeProxy
+// whose q.NeedAnswer is false, after the answer is rewritten by SetAnswerRewriter; cached decisions are not routed again
+func (h *Hooks) OnDNSDecision(f func(q *RouteQuery, d *RouteDecision)) {
+	h.dnsDecision = append(h.dnsDecision, f)
+}
+
+// call `f` with the routing decision of each connection of ServeProxy, including rejected ones, before connecting
+func (h *Hooks) OnProxyDecision(f func(d *ProxyDecision)) {
+	h.proxyDecision = append(h.proxyDecision, f)
+}
+
+// call `f` with each failed query of dns servers of transports of SetHooks, and each failed connection
+// through a proxy chain of ServeProxy; queries and connections abandoned by clients are not failures
+func (h *Hooks) OnUpstreamError(f func(e *UpstreamError)) {
+	h.upstreamError = append(h.upstreamError, f)
+}
+
+// call `f` with each item deleted from the ip cache or the domain cache after expired or beyond the max entries,
+// flushed items are not evicted, `f` runs in the cleanup goroutine of the cache
+func (h *Hooks) OnCacheEvict(f func(e *CacheEviction)) {
+	h.cacheEvict = append(h.cacheEvict, f)
+}
+
+// the following are safe to call on nil
+
+func (h *Hooks) dnsDecided(q *RouteQuery, d *RouteDecision) {
+	if h == nil {
+		return
+	}
+	for _, f := range h.dnsDecision {
+		f(q, d)
+	}
+}
+
+func (h *Hooks) proxyDecided(d *ProxyDecision) {
+	if h == nil {
+		return
+	}
+	for _, f := range h.proxyDecision {
+		f(d)
+	}
+}
+
+func (h *Hooks) wantsUpstreamErrors() bool {
+	return h != nil && len(h.upstreamError) > 0
+}
+
+func (h *Hooks) upstreamFailed(e *UpstreamError) {
+	if h == nil {
+		return
+	}
+	for _, f := range h.upstreamError {
+		f(e)
+	}
+}
+
+func (h *Hooks) cacheEvicted(e *CacheEviction) {
+	for _, f := range h.cacheEvict {
+		f(e)
+	}
+}
+
+// --- impl *Server
+
+// call back into `h` on routing decisions, failures of proxy chains and evictions of caches, nil to disable,
+// failures of dns servers are reported by transports of (*dnsTransport).SetHooks,
+// must be called before serving
+func (s *Server) SetHooks(h *Hooks) {
+	s.hooks = h
+	if h == nil {
+		s.ipcache.OnEvicted(nil)
+		s.domaincache.OnEvicted(nil)
+		return
+	}
+	s.ipcache.OnEvicted(func(scope, ip string, t Transport, outbound string) {
+		h.cacheEvicted(&CacheEviction{Cache: "ip", Scope: scope, Key: ip, Trans: t, Outbound: outbound})
+	})
+	s.domaincache.OnEvicted(func(scope, domain string, qtype uint16) {
+		h.cacheEvicted(&CacheEviction{Cache: "domain", Scope: scope, Key: domain, Qtype: qtype})
+	})
+}
+
+// `dial` reporting its failures to s.hooks as those of `chain` named `outbound`, see timedDialer
+func (s *Server) hookedDialer(outbound string, chain *gost.ProxyChain, bind *OutboundBind, host string, dial func(port string) (net.Conn, error)) func(port string) (net.Conn, error) {
+	if dial == nil {
+		dial = func(port string) (net.Conn, error) {
+			return bind.DialChain(chain, net.JoinHostPort(host, port))
+		}
+	}
+	return func(port string) (net.Conn, error) {
+		c, err := dial(port)
+		if err != nil {
+			s.hooks.upstreamFailed(&UpstreamError{Kind: "proxy", Name: outbound, Addr: fmt.Sprint(chain.Nodes()), Err: upstreamError(err)})
+		}
+		return c, err
+	}
+}
+
+// --- impl *dnsTransport
+
+// report failed queries of nameservers to `h` as UpstreamError of `name` such as "abroad", nil to disable,
+// must be called before querying
+func (dt *dnsTransport) SetHooks(h *Hooks, name string) {
+	dt.hooks, dt.hooksName = h, name
+}
@@ -0,0 +1,116 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+)
+
+// check if an ip is in a set, such as Chinese mainland ip ranges
+type IPMatcher interface {
+	Match(ip net.IP) bool
+}
+
+// IPMatcher backed by sorted and merged ip ranges, lookups are binary searches
+type IPNetMatcher struct {
+	v4 []ipv4Range
+	v6 []ipv6Range
+}
+
+type ipv4Range struct {
+	first, last uint32
+}
+
+type ipv6Range struct {
+	first, last uint128
+}
+
+type uint128 struct {
+	hi, lo uint64
+}
+
+// --- impl IPMatcher for *IPNetMatcher
+func NewIPNetMatcher(ipnets []*net.IPNet) *IPNetMatcher {
+	m := new(IPNetMatcher)
+	for _, ipnet := range ipnets {
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			mask := ipnet.Mask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			first := binary.BigEndian.Uint32(ip4) & binary.BigEndian.Uint32(mask)
+			m.v4 = append(m.v4, ipv4Range{first, first | ^binary.BigEndian.Uint32(mask)})
+		} else if ip16 := ipnet.IP.To16(); ip16 != nil && len(ipnet.Mask) == net.IPv6len {
+			ip, mask := toUint128(ip16), toUint128(net.IP(ipnet.Mask))
+			first := uint128{ip.hi & mask.hi, ip.lo & mask.lo}
+			m.v6 = append(m.v6, ipv6Range{first, uint128{first.hi | ^mask.hi, first.lo | ^mask.lo}})
+		}
+	}
+
+	// sort and merge overlapping or adjacent ranges
+	sort.Slice(m.v4, func(i, j int) bool { return m.v4[i].first < m.v4[j].first })
+	merged4 := m.v4[:0]
+	for _, r := range m.v4 {
+		if n := len(merged4); n > 0 && (merged4[n-1].last == ^uint32(0) || r.first <= merged4[n-1].last+1) {
+			if r.last > merged4[n-1].last {
+				merged4[n-1].last = r.last
+			}
+			continue
+		}
+		merged4 = append(merged4, r)
+	}
+	m.v4 = merged4
+
+	sort.Slice(m.v6, func(i, j int) bool { return m.v6[i].first.less(m.v6[j].first) })
+	merged6 := m.v6[:0]
+	for _, r := range m.v6 {
+		if n := len(merged6); n > 0 && !merged6[n-1].last.less(r.first.prev()) {
+			if merged6[n-1].last.less(r.last) {
+				merged6[n-1].last = r.last
+			}
+			continue
+		}
+		merged6 = append(merged6, r)
+	}
+	m.v6 = merged6
+	return m
+}
+
+func (m *IPNetMatcher) Match(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		v := binary.BigEndian.Uint32(ip4)
+		// index of the first range starts after v
+		i := sort.Search(len(m.v4), func(i int) bool { return m.v4[i].first > v })
+		return i > 0 && v <= m.v4[i-1].last
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		v := toUint128(ip16)
+		i := sort.Search(len(m.v6), func(i int) bool { return v.less(m.v6[i].first) })
+		return i > 0 && !m.v6[i-1].last.less(v)
+	}
+	return false
+}
+
+// number of merged ip ranges
+func (m *IPNetMatcher) Len() int {
+	return len(m.v4) + len(m.v6)
+}
+
+func toUint128(ip net.IP) uint128 {
+	return uint128{binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])}
+}
+
+func (a uint128) less(b uint128) bool {
+	return a.hi < b.hi || (a.hi == b.hi && a.lo < b.lo)
+}
+
+// a - 1, 0 stays 0
+func (a uint128) prev() uint128 {
+	if a.lo == 0 {
+		if a.hi == 0 {
+			return a
+		}
+		return uint128{a.hi - 1, ^uint64(0)}
+	}
+	return uint128{a.hi, a.lo - 1}
+}
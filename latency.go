@@ -0,0 +1,155 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// upper bounds of latency histogram buckets, the last bucket is unbounded
+var _LATENCY_BUCKETS = [...]time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// histogram of succeeded operations and the count of failed ones
+type latencyHistogram struct {
+	counts   [len(_LATENCY_BUCKETS) + 1]uint64
+	total    uint64
+	sum      time.Duration
+	failures uint64
+	timeouts uint64 // failures classified as ErrUpstreamTimeout
+}
+
+// --- impl *latencyHistogram
+
+func (h *latencyHistogram) observe(d time.Duration, err error) {
+	if err != nil {
+		h.failures++
+		if ClassifyError(upstreamError(err)) == ErrUpstreamTimeout {
+			h.timeouts++
+		}
+		return
+	}
+	i := sort.Search(len(_LATENCY_BUCKETS), func(i int) bool { return d <= _LATENCY_BUCKETS[i] })
+	h.counts[i]++
+	h.total++
+	h.sum += d
+}
+
+// upper bound of the bucket holding the `q` quantile, -1 if unbounded
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	rank := uint64(q*float64(h.total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var n uint64
+	for i, c := range h.counts {
+		if n += c; n >= rank {
+			if i < len(_LATENCY_BUCKETS) {
+				return _LATENCY_BUCKETS[i]
+			}
+			break
+		}
+	}
+	return -1
+}
+
+// such as "n=120 fail=3 timeout=2 avg=85ms p50<=100ms p90<=250ms p99<=1s [<=10ms:5 <=25ms:10 ...]"
+func (h *latencyHistogram) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "n=%d fail=%d timeout=%d", h.total, h.failures, h.timeouts)
+	if h.total == 0 {
+		return buf.String()
+	}
+	fmt.Fprintf(&buf, " avg=%s", (h.sum / time.Duration(h.total)).Round(time.Millisecond))
+	for _, q := range []struct {
+		name string
+		q    float64
+	}{{"p50", 0.5}, {"p90", 0.9}, {"p99", 0.99}} {
+		if d := h.quantile(q.q); d >= 0 {
+			fmt.Fprintf(&buf, " %s<=%s", q.name, d)
+		} else {
+			fmt.Fprintf(&buf, " %s>%s", q.name, _LATENCY_BUCKETS[len(_LATENCY_BUCKETS)-1])
+		}
+	}
+	buf.WriteString(" [")
+	sep := ""
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		if i < len(_LATENCY_BUCKETS) {
+			fmt.Fprintf(&buf, "%s<=%s:%d", sep, _LATENCY_BUCKETS[i], c)
+		} else {
+			fmt.Fprintf(&buf, "%s>%s:%d", sep, _LATENCY_BUCKETS[i-1], c)
+		}
+		sep = " "
+	}
+	buf.WriteString("]")
+	return buf.String()
+}
+
+// latency histograms of dns queries and proxied connections, summarized into logs periodically,
+// keyed by what is measured, such as "dns abroad", "dns abroad 8.8.8.8:53" and "connect proxy"
+type LatencyStats struct {
+	mu    sync.Mutex
+	hists map[string]*latencyHistogram
+}
+
+// --- impl *LatencyStats
+
+func NewLatencyStats() *LatencyStats {
+	return &LatencyStats{hists: make(map[string]*latencyHistogram)}
+}
+
+// record an operation of `key` started at `start`, safe to call on nil
+func (ls *LatencyStats) observe(key string, start time.Time, err error) {
+	if ls == nil {
+		return
+	}
+	d := time.Since(start)
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	h, ok := ls.hists[key]
+	if !ok {
+		h = new(latencyHistogram)
+		ls.hists[key] = h
+	}
+	h.observe(d, err)
+}
+
+// log a line for each key observed since the last call, then start over
+func (ls *LatencyStats) Log() {
+	ls.mu.Lock()
+	hists := ls.hists
+	ls.hists = make(map[string]*latencyHistogram)
+	ls.mu.Unlock()
+
+	keys := make([]string, 0, len(hists))
+	for key := range hists {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		glog.Infof("latency %s: %s\n", key, hists[key])
+	}
+}
+
+// call Log every `interval`, never returns
+func (ls *LatencyStats) LogPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		ls.Log()
+	}
+}
@@ -0,0 +1,86 @@
+package dnsproxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// context.Context with a deadline whose timer is not started until Done is called,
+// for queries answered without waiting, such as those from the cache, which would otherwise pay for a timer each
+type lazyDeadlineCtx struct {
+	parent   context.Context
+	deadline time.Time
+
+	mu       sync.Mutex
+	inner    context.Context // of context.WithDeadline, nil until Done is called
+	cancel   context.CancelFunc
+	canceled bool
+}
+
+// like context.WithDeadline but the timer is started lazily, see lazyDeadlineCtx
+func withLazyDeadline(parent context.Context, deadline time.Time) (context.Context, context.CancelFunc) {
+	c := &lazyDeadlineCtx{parent: parent, deadline: deadline}
+	if d, ok := parent.Deadline(); ok && d.Before(c.deadline) {
+		c.deadline = d
+	}
+	return c, c.cancelLazy
+}
+
+// --- impl context.Context for *lazyDeadlineCtx
+
+func (c *lazyDeadlineCtx) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *lazyDeadlineCtx) Done() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inner == nil {
+		c.inner, c.cancel = context.WithDeadline(c.parent, c.deadline)
+		if c.canceled {
+			c.cancel()
+		}
+	}
+	return c.inner.Done()
+}
+
+func (c *lazyDeadlineCtx) Err() error {
+	c.mu.Lock()
+	inner, canceled := c.inner, c.canceled
+	c.mu.Unlock()
+	switch {
+	case inner != nil:
+		return inner.Err()
+	case canceled:
+		return context.Canceled
+	}
+	if err := c.parent.Err(); err != nil {
+		return err
+	}
+	if !time.Now().Before(c.deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// values of the started context, so that contexts derived from it find its cancellation
+// and propagate it without spawning goroutines
+func (c *lazyDeadlineCtx) Value(key interface{}) interface{} {
+	c.mu.Lock()
+	inner := c.inner
+	c.mu.Unlock()
+	if inner != nil {
+		return inner.Value(key)
+	}
+	return c.parent.Value(key)
+}
+
+func (c *lazyDeadlineCtx) cancelLazy() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.canceled = true
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
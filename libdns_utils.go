@@ -4,10 +4,12 @@ import (
 	"context"
 	"net"
 	"net/http"
-	"sync/atomic"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ARwMq9b6/dnsproxy/dns_over_https/google"
+	"github.com/golang/glog"
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 	"golang.org/x/net/proxy"
@@ -31,8 +33,51 @@ func MsgNewReplyFromReq(req *dns.Msg, answer ...dns.RR) *dns.Msg {
 	return resp
 }
 
-// Perform query into Google DNS over HTTPS server
+// reply to `req` that the domain does not exist
+func MsgNewNXDomainReply(req *dns.Msg) *dns.Msg {
+	resp := MsgNewReplyFromReq(req)
+	resp.Rcode = dns.RcodeNameError
+	return resp
+}
+
+// copy of `m` which can be modified by MsgSetECSWithAddr, MsgSetDo and setting the question,
+// cheaper than m.Copy() as records other than the OPT one are shared with `m`
+func MsgShallowCopy(m *dns.Msg) *dns.Msg {
+	c := &dns.Msg{MsgHdr: m.MsgHdr, Compress: m.Compress, Answer: m.Answer, Ns: m.Ns}
+	c.Question = append([]dns.Question(nil), m.Question...)
+	if len(m.Extra) > 0 {
+		c.Extra = make([]dns.RR, len(m.Extra))
+		for i, rr := range m.Extra {
+			if opt, ok := rr.(*dns.OPT); ok {
+				rr = msgCopyOPT(opt)
+			}
+			c.Extra[i] = rr
+		}
+	}
+	return c
+}
+
+// copy of `opt` along with its edns-client-subnet option, which is modified in place by MsgSetECSWithAddr
+func msgCopyOPT(opt *dns.OPT) *dns.OPT {
+	c := &dns.OPT{Hdr: opt.Hdr, Option: make([]dns.EDNS0, len(opt.Option))}
+	for i, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			_ecs := *ecs
+			o = &_ecs
+		}
+		c.Option[i] = o
+	}
+	return c
+}
+
+// Perform query into Google DNS over HTTPS server, dns.google.com is connected by `rt`,
+// see (*dnsTransport).SetDoHIPs
 func MsgExchangeOverGoogleDOH(req *dns.Msg, rt http.RoundTripper) (resp *dns.Msg, err error) {
+	return MsgExchangeOverJSONDOH(req, rt, google.DEFAULT_DNS_SERVER)
+}
+
+// Perform query into DNS over HTTPS server which speaks the Google JSON API
+func MsgExchangeOverJSONDOH(req *dns.Msg, rt http.RoundTripper, server string) (resp *dns.Msg, err error) {
 	qtype := req.Question[0].Qtype
 	name := req.Question[0].Name
 
@@ -45,7 +90,7 @@ func MsgExchangeOverGoogleDOH(req *dns.Msg, rt http.RoundTripper) (resp *dns.Msg
 			}
 		}
 	}
-	dohresp, err := google.Query(rt, qtype, name, ecs.String())
+	dohresp, err := google.QueryServer(rt, server, qtype, name, ecs.String())
 	if err != nil {
 		return nil, err
 	}
@@ -162,8 +207,89 @@ func MsgExtractAnswer(msg *dns.Msg) (dns.RR, net.IP) {
 	return nil, nil
 }
 
+// check if `msg` says the domain does not exist (NXDOMAIN), or has no address of the type (NODATA),
+// which is final and not changed by asking other nameservers, see RFC 2308
+func MsgIsNegative(msg *dns.Msg) bool {
+	if msg == nil {
+		return false
+	}
+	if msg.Rcode == dns.RcodeNameError {
+		return true
+	}
+	ans, _ := MsgExtractAnswer(msg)
+	return msg.Rcode == dns.RcodeSuccess && ans == nil
+}
+
+// check if `msg` says the nameserver failed (SERVFAIL) or refused (REFUSED) to resolve,
+// which says nothing about the domain, so other nameservers are worth asking
+func MsgIsServerFailure(msg *dns.Msg) bool {
+	return msg != nil && (msg.Rcode == dns.RcodeServerFailure || msg.Rcode == dns.RcodeRefused)
+}
+
+// ip of a PTR query name such as "4.3.2.1.in-addr.arpa." or "1.0.[...].8.b.d.0.1.0.0.2.ip6.arpa.",
+// the reverse of dns.ReverseAddr, nil if `name` is not a complete reverse name
+func ReverseNameToIP(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles {
+			n, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return nil
+			}
+			// the first nibble is the lowest 4 bits of the last byte
+			k := len(nibbles) - 1 - i
+			ip[k/2] |= byte(n) << (4 * uint(1-k%2))
+		}
+		return ip
+	}
+	return nil
+}
+
 // --- impl dns.RR
 
+// minimum TTL of `rrs`, 0 if `rrs` is empty
+func RRsMinTTL(rrs []dns.RR) time.Duration {
+	if len(rrs) == 0 {
+		return 0
+	}
+	min := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		if ttl := rr.Header().Ttl; ttl < min {
+			min = ttl
+		}
+	}
+	return time.Duration(min) * time.Second
+}
+
+// ips of A and AAAA records in `rrs` in order, nil if there is none
+func RRsIPs(rrs []dns.RR) []net.IP {
+	var ips []net.IP
+	for _, rr := range rrs {
+		switch v := rr.(type) {
+		case *dns.A:
+			ips = append(ips, v.A)
+		case *dns.AAAA:
+			ips = append(ips, v.AAAA)
+		}
+	}
+	return ips
+}
+
 // Initialize a new RRGeneric from a google dns over https RR
 func RRNewFromGoogleDohRR(grr google.DNSRR) dns.RR {
 	var rr dns.RR
@@ -197,86 +323,328 @@ func RRNewFromGoogleDohRR(grr google.DNSRR) dns.RR {
 	return rr
 }
 
+// resolver of queries routed by RoutingPolicy, implemented by the dns transports of NewDnsTransport and its siblings,
+// and by in-memory fakes such as dnsproxytest.Exchanger for tests
+type DNSExchanger interface {
+	// resolve `req` until `ctx` is done
+	Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+}
+
+// DNSExchanger which reports the health of its nameservers
+type upstreamHealthExchanger interface {
+	Health() []UpstreamHealth
+}
+
+// health of the nameservers of `e`, nil if unknown
+func exchangerHealth(e DNSExchanger) []UpstreamHealth {
+	if h, ok := e.(upstreamHealthExchanger); ok {
+		return h.Health()
+	}
+	return nil
+}
+
 // client for dns query
 type dnsTransport struct {
-	nameserver string // DNS server
-	net        string // ["tcp" | "udp" | "https"]
+	upstreams []*upstream      // DNS servers, a single one without address if net is "https"
+	selector  UpstreamSelector // how upstreams are ordered, nil to race them, see SetStrategy
+	retry     *RetryPolicy     // retries of failed queries, see SetRetryPolicy
+	net       string           // ["tcp" | "udp" | "https"]
 
 	proxy proxy.Dialer // proxy for dns query, set to nil if don't need proxy
+	doh   DoHProvider  // DNS over HTTPS server, only used when net is "https"
+
+	secondary   []*upstream // DNS servers fallen back to once upstreams fail, see SetSecondaryNameservers
+	onSecondary int32       // 1 while every one of upstreams is dead and secondary are queried instead, atomic
+
+	dnssec *dnssecValidator // validate responses if not nil, see SetDNSSEC
+
+	latency     *LatencyStats // records query latencies if not nil, see SetLatencyStats
+	latencyName string        // such as "abroad"
+
+	dnstap *DNSTap // captures queries to nameservers if not nil, see SetDNSTap
+
+	hooks     *Hooks // failed queries are reported to it if not nil, see SetHooks
+	hooksName string // such as "abroad"
+
+	hardenUDP bool // see SetUDPHardening
+
+	bind *OutboundBind // local address of connections to nameservers, see SetOutboundBind
+
+	httpRT    *http.Transport    // keep-alive conns to DNS over HTTPS server
+	dohIPs    []net.IP           // addresses the DNS over HTTPS server is connected to if not empty, see SetDoHIPs
+	bootstrap *BootstrapResolver // resolves the DNS over HTTPS server if not nil, see SetBootstrap
 }
 
 // --- impl *dnsTransport
 
+// `nameserver` is ignored and Google JSON API is used if `net` is "https", see NewDoHTransport
 func NewDnsTransport(nameserver, net string, _proxy proxy.Dialer) *dnsTransport {
-	return &dnsTransport{nameserver: nameserver, net: net, proxy: _proxy}
+	return NewMultiDnsTransport([]Nameserver{{Addr: nameserver}}, net, _proxy)
 }
 
-func (dt *dnsTransport) legallySpawnQuery(domain string, qtype uint16, ecsAddr ...net.IP) (*dns.Msg, error) {
-	req := &dns.Msg{}
-	req.SetQuestion(dns.Fqdn(domain), qtype)
+// new dns transport queries over multiple `nameservers`, see SetStrategy
+func NewMultiDnsTransport(nameservers []Nameserver, net string, _proxy proxy.Dialer) *dnsTransport {
+	if net == "https" {
+		return NewDoHTransport(_GOOGLE_DOH_PROVIDER, _proxy)
+	}
+	dt := &dnsTransport{net: net, proxy: _proxy}
+	for _, ns := range nameservers {
+		dt.addUpstream(ns)
+	}
+	return dt
+}
 
-	if ecsAddr != nil {
-		MsgSetECSWithAddr(req, ecsAddr[0])
+// new dns transport queries over DNS over HTTPS server `provider`,
+// which is connected by its addresses if it is pinned, see NewPinnedDoHProvider
+func NewDoHTransport(provider DoHProvider, _proxy proxy.Dialer) *dnsTransport {
+	dt := &dnsTransport{net: "https", proxy: _proxy, doh: provider}
+	if p, ok := provider.(pinnedDoHProvider); ok {
+		dt.dohIPs = p.ips
 	}
-	return dt.legallySpawnExchange(req)
+	dt.addUpstream(Nameserver{})
+	dt.initHTTP()
+	return dt
 }
 
-func (dt *dnsTransport) legallySpawnExchange(req *dns.Msg) (*dns.Msg, error) {
-	const spawnNum int8 = 3
-	resp := make(chan *dns.Msg, spawnNum)
-	lastErr := make(chan error)
-	var failedTimes int32
+func (dt *dnsTransport) addUpstream(ns Nameserver) {
+	dt.upstreams = append(dt.upstreams, dt.newUpstream(ns))
+}
 
-	for range [spawnNum]struct{}{} {
-		go func() {
-			if r, err := dt.Exchange(req); err == nil {
-				resp <- r
-			} else {
-				if atomic.LoadInt32(&failedTimes) == int32(spawnNum-1) {
-					resp <- nil
-					lastErr <- err
-				} else {
-					atomic.AddInt32(&failedTimes, 1)
-				}
+// connections to `ns` are reused across queries, tcp queries are pipelined
+func (dt *dnsTransport) newUpstream(ns Nameserver) *upstream {
+	u := &upstream{addr: ns.Addr, weight: ns.Weight, timeout: ns.Timeout}
+	if u.weight <= 0 {
+		u.weight = 1
+	}
+	if u.timeout <= 0 {
+		u.timeout = DNS_UPSTREAM_TIMEOUT
+	}
+	u.tcpPool = newDnsConnPool(func(ctx context.Context) (net.Conn, error) {
+		return dt.dial(ctx, "tcp", u.addr)
+	})
+	return u
+}
+
+func (dt *dnsTransport) initHTTP() {
+	if dt.net != "https" {
+		return
+	}
+	// queries are multiplexed on a single HTTP/2 conn kept alive across queries,
+	// which is not attempted by default once DialContext is customized
+	dt.httpRT = &http.Transport{
+		DialContext:         dt.dialDoH,
+		ForceAttemptHTTP2:   true,
+		IdleConnTimeout:     _DNS_CONN_IDLE_TIMEOUT,
+		MaxIdleConnsPerHost: _DNS_CONN_MAX_CONNS,
+	}
+}
+
+// open at most `n` conns to the DNS over HTTPS server, queries wait for a free one beyond that if it speaks HTTP/1.1,
+// 0 for no limit, must be called before serving
+func (dt *dnsTransport) SetDoHMaxConns(n int) {
+	if dt.httpRT == nil {
+		return
+	}
+	dt.httpRT.MaxConnsPerHost = n
+	if n > dt.httpRT.MaxIdleConnsPerHost {
+		dt.httpRT.MaxIdleConnsPerHost = n
+	}
+}
+
+// connect the DNS over HTTPS server at `addr` until `ctx` is done, the tls server name and the Host header
+// are still the hostname of its url, so it can be connected by any address:
+// dt.dohIPs one by one until one succeeds, or the address resolved by dt.bootstrap if it is connected directly,
+// or `addr` itself, which is resolved by the proxy or the system resolver
+func (dt *dnsTransport) dialDoH(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(dt.dohIPs) > 0 {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var lastErr error
+		for _, ip := range dt.dohIPs {
+			conn, err := dt.dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
 			}
-		}()
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, lastErr
+	}
+	if dt.bootstrap != nil && dt.proxy == nil {
+		resolved, err := dt.bootstrap.ResolveAddr(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return dt.dial(ctx, network, resolved)
 	}
+	return dt.dial(ctx, network, addr)
+}
+
+// connect nameservers from the local address or network interface of `b`, nil to not bind,
+// connections through the proxy are not affected, whose dialer is bound by itself, e.g. by (*Socks5Dialer).SetOutboundBind,
+// must be called before serving
+func (dt *dnsTransport) SetOutboundBind(b *OutboundBind) {
+	dt.bind = b
+}
 
-	if r := <-resp; r != nil {
-		return r, nil
+// validate DNSSEC signed responses if `enable`:
+// the DO bit is set on every query, AD is set in secure responses,
+// and bogus responses are replaced with SERVFAIL
+func (dt *dnsTransport) SetDNSSEC(enable bool) {
+	if enable {
+		dt.dnssec = newDnssecValidator(dt)
 	} else {
-		return nil, <-lastErr
+		dt.dnssec = nil
 	}
 }
 
-func (dt *dnsTransport) Exchange(req *dns.Msg) (r *dns.Msg, err error) {
-	if dt.net == "https" {
-		var dialc func(ctx context.Context, network, addr string) (net.Conn, error)
-		if dt.proxy != nil {
-			dialc = func(ctx context.Context, network, addr string) (net.Conn, error) {
-				return dt.proxy.Dial(network, addr)
+// record latencies of queries and of each nameserver into `ls` under `name`, such as "abroad", nil to disable,
+// must be called before serving
+func (dt *dnsTransport) SetLatencyStats(ls *LatencyStats, name string) {
+	dt.latency, dt.latencyName = ls, name
+}
+
+// capture queries to nameservers and their responses into `t`, nil to disable, must be called before serving
+func (dt *dnsTransport) SetDNSTap(t *DNSTap) {
+	dt.dnstap = t
+}
+
+// resolve the host of the DNS over HTTPS server by `r` instead of the system resolver, which may be dnsproxy itself,
+// only if the server is connected directly, hosts are resolved by the proxy otherwise,
+// nil to use the system resolver, must be called before serving
+func (dt *dnsTransport) SetBootstrap(r *BootstrapResolver) {
+	dt.bootstrap = r
+}
+
+// connect the DNS over HTTPS server by `ips` one by one instead of resolving its host, which is often poisoned,
+// both directly and through the proxy, certificates are still verified against the host, such as dns.google.com,
+// takes precedence over SetBootstrap, nil to resolve the host again, must be called before serving
+func (dt *dnsTransport) SetDoHIPs(ips []net.IP) {
+	dt.dohIPs = ips
+}
+
+// --- impl DNSExchanger for *dnsTransport, see legallySpawnExchange
+func (dt *dnsTransport) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return dt.legallySpawnExchange(ctx, req)
+}
+
+// exchange `req` according to dt.selector until `ctx` is done, and validate the response if DNSSEC is enabled
+func (dt *dnsTransport) legallySpawnExchange(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	if dt.latency != nil {
+		start := time.Now()
+		defer func() {
+			if err == nil || ctx.Err() == nil {
+				dt.latency.observe("dns "+dt.latencyName, start, err)
 			}
+		}()
+	}
+	if dt.dnssec == nil {
+		return dt.spawnExchange(ctx, req)
+	}
+
+	var do bool
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	_req := MsgShallowCopy(req)
+	MsgSetDo(_req)
+	resp, err = dt.spawnExchange(ctx, _req)
+	if err != nil {
+		return nil, err
+	}
+	secure, err := dt.dnssec.validate(ctx, resp)
+	if err != nil {
+		glog.Warningf("%s: %s\n", req.Question[0].Name, err)
+		return new(dns.Msg).SetRcode(req, dns.RcodeServerFailure), nil
+	}
+	resp.AuthenticatedData = secure
+	if !do {
+		MsgStripDNSSEC(resp)
+	}
+	return resp, nil
+}
+
+// exchange `req` with the first healthy nameserver until `ctx` is done or the nameserver times out
+func (dt *dnsTransport) Exchange(ctx context.Context, req *dns.Msg) (r *dns.Msg, err error) {
+	return dt.exchangeUpstream(ctx, dt.healthyUpstreams()[0], req)
+}
+
+// exchange `req` with `u` within its timeout, and record its health
+func (dt *dnsTransport) exchangeUpstream(ctx context.Context, u *upstream, req *dns.Msg) (r *dns.Msg, err error) {
+	// packing writes the lengths of RRs into their headers, and racing or hedged queries pack `req` concurrently
+	req = req.Copy()
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+	start := time.Now()
+	if dt.dnstap != nil {
+		dt.dnstap.captureResolver(u.addr, dt.net, req, nil, start)
+	}
+	defer func() {
+		err = upstreamError(err)
+		if dt.dnstap != nil && err == nil {
+			dt.dnstap.captureResolver(u.addr, dt.net, req, r, start)
 		}
-		rt := &http.Transport{
-			DisableKeepAlives: true,
-			DialContext:       dialc,
+		// queries abandoned by the caller say nothing about the nameserver
+		if err == nil || parent.Err() == nil {
+			u.report(err, time.Since(start))
+			if dt.latency != nil && u.addr != "" {
+				dt.latency.observe("dns "+dt.latencyName+" "+u.addr, start, err)
+			}
+			if err != nil {
+				dt.hooks.upstreamFailed(&UpstreamError{Kind: "dns", Name: dt.hooksName, Addr: u.addr, Err: err})
+			}
 		}
-		return MsgExchangeOverGoogleDOH(req, rt)
+	}()
+
+	if dt.net == "https" {
+		return dt.doh.Exchange(req, contextRoundTripper{ctx, dt.httpRT})
 	}
 
-	// --- partially copied from (*dns.Client).exchange
-	const dnsTimeout time.Duration = 2 * time.Second
+	r, err = dt.exchange(ctx, u, req, dt.net)
+	if dt.net == "udp" && (err == dns.ErrTruncated || err == nil && r.Truncated) {
+		// response is too large for udp, retry over tcp for this query only
+		return dt.exchange(ctx, u, req, "tcp")
+	}
+	return r, errors.WithStack(err)
+}
 
-	var conn net.Conn
+// dial `addr` until `ctx` is done, through dt.proxy if it is set
+func (dt *dnsTransport) dial(ctx context.Context, _net, addr string) (net.Conn, error) {
 	if p := dt.proxy; p != nil {
-		conn, err = p.Dial(dt.net, dt.nameserver)
+		return dialContext(ctx, p, _net, addr)
+	}
+	return dt.bind.DialContext(ctx, _net, addr)
+}
+
+// exchange `req` with `u` over `_net` ["tcp" | "udp"] until `ctx` is done
+func (dt *dnsTransport) exchange(ctx context.Context, u *upstream, req *dns.Msg, _net string) (r *dns.Msg, err error) {
+	if _net == "tcp" {
+		return u.tcpPool.Exchange(ctx, req)
+	}
+
+	sent := req
+	if dt.hardenUDP {
+		sent = hardenUDPQuery(req)
+	}
+
+	// --- partially copied from (*dns.Client).exchange
+	var conn net.Conn
+	if dt.hardenUDP && dt.proxy == nil {
+		conn, err = dialUDPRandomPort(ctx, dt.bind, u.addr)
 	} else {
-		conn, err = net.DialTimeout(dt.net, dt.nameserver, dnsTimeout)
+		conn, err = dt.dial(ctx, _net, u.addr)
 	}
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
 	defer conn.Close()
+	// unblock the write or read once `ctx` is done
+	defer context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })()
 
 	co := new(dns.Conn)
 	co.Conn = conn
@@ -287,15 +655,77 @@ func (dt *dnsTransport) Exchange(req *dns.Msg) (r *dns.Msg, err error) {
 		co.UDPSize = opt.UDPSize()
 	}
 
-	co.SetWriteDeadline(time.Now().Add(dnsTimeout))
-	if err = co.WriteMsg(req); err != nil {
-		return nil, errors.WithStack(err)
+	if deadline, ok := ctx.Deadline(); ok {
+		co.SetDeadline(deadline)
+	}
+	if err = co.WriteMsg(sent); err != nil {
+		return nil, errors.WithStack(contextErr(ctx, err))
 	}
 
-	co.SetReadDeadline(time.Now().Add(dnsTimeout))
-	r, err = co.ReadMsg()
+	for {
+		r, err = co.ReadMsg()
+		if !dt.hardenUDP {
+			break
+		}
+		if _, isNetErr := err.(net.Error); isNetErr {
+			break
+		}
+		// malformed or mismatched responses may be spoofed, wait for the genuine one until the deadline
+		if r != nil && (err == nil || err == dns.ErrTruncated) && hardenedUDPResponseMatches(sent, r) {
+			restoreHardenedUDPResponse(req, sent, r)
+			break
+		}
+	}
+	if err == dns.ErrTruncated {
+		// partially unpacked, let the caller decide whether to retry
+		return r, err
+	}
 	if err == nil && r.Id != req.Id {
 		err = dns.ErrId
 	}
-	return r, errors.WithStack(err)
+	return r, errors.WithStack(contextErr(ctx, err))
+}
+
+// ctx.Err() if `err` is caused by `ctx` being done, otherwise `err`
+func contextErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// dial `addr` by `d` which knows nothing about contexts, the dialing is abandoned once `ctx` is done
+// and the conn established too late is closed
+func dialContext(ctx context.Context, d proxy.Dialer, network, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := d.Dial(network, addr)
+		done <- result{c, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, errors.WithStack(r.err)
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.err == nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, errors.WithStack(ctx.Err())
+	}
+}
+
+// http.RoundTripper sending requests with `ctx`, for DoH providers which are unaware of contexts
+type contextRoundTripper struct {
+	ctx context.Context
+	rt  http.RoundTripper
+}
+
+// --- impl http.RoundTripper for contextRoundTripper
+func (t contextRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.rt.RoundTrip(req.WithContext(t.ctx))
 }
@@ -0,0 +1,278 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// domain part of a gfwlist rule, such as "example.com" of "||example.com^"
+var gfwListDomainRe = regexp.MustCompile(`.*?((:?(:?(:?[a-zA-Z])|(:?[a-zA-Z][a-zA-Z])|(:?[a-zA-Z][0-9])|(:?[0-9][a-zA-Z])|(:?[a-zA-Z0-9][a-zA-Z0-9-_]{1,61}[a-zA-Z0-9]))\.)+(:?xn--[a-z0-9-]+|[a-zA-Z]{2,6}|[a-zA-Z0-9-]{2,30}\.[a-zA-Z]{2,3})).*`)
+
+// domains of the base64 encoded gfwlist https://github.com/gfwlist/gfwlist,
+// rules after "Whitelist Start" are ignored
+func ParseGFWList(r io.Reader) ([]string, error) {
+	b, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, r))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	content := string(b)
+	if end := strings.Index(content, "Whitelist Start"); end >= 0 {
+		content = content[:end]
+	}
+
+	var domains []string
+	seen := make(map[string]struct{})
+	for _, groups := range gfwListDomainRe.FindAllStringSubmatch(content, -1) {
+		if _, ok := seen[groups[1]]; !ok {
+			seen[groups[1]] = struct{}{}
+			domains = append(domains, groups[1])
+		}
+	}
+	if len(domains) == 0 {
+		return nil, errors.New("empty gfwlist")
+	}
+	return domains, nil
+}
+
+// "server=/example.cn/114.114.114.114" lines of https://github.com/felixonmars/dnsmasq-china-list
+var dnsmasqServerRe = regexp.MustCompile(`server=/(.+)/.+`)
+
+// domains of dnsmasq-china-list such as accelerated-domains.china.conf
+func ParseDnsmasqChinaList(r io.Reader) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if m := dnsmasqServerRe.FindStringSubmatch(scanner.Text()); m != nil {
+			domains = append(domains, m[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(domains) == 0 {
+		return nil, errors.New("empty dnsmasq china list")
+	}
+	return domains, nil
+}
+
+// formats of domain lists, see ParseDomainList
+type DomainListFormat int8
+
+const (
+	DOMAIN_LIST_PLAIN   DomainListFormat = iota // a domain per line, or a gfwlist rule for the gfw list
+	DOMAIN_LIST_DNSMASQ                         // dnsmasq conf such as dnsmasq-china-list, "server=/example.cn/114.114.114.114"
+	DOMAIN_LIST_HOSTS                           // hosts files such as those of ad blocking, "0.0.0.0 example.com"
+	DOMAIN_LIST_ABP                             // AdBlock Plus filters such as gfwlist, "||example.com^", maybe base64 encoded
+)
+
+func (f DomainListFormat) String() string {
+	switch f {
+	case DOMAIN_LIST_DNSMASQ:
+		return "dnsmasq"
+	case DOMAIN_LIST_HOSTS:
+		return "hosts"
+	case DOMAIN_LIST_ABP:
+		return "abp"
+	}
+	return "plain"
+}
+
+// "server=/example.cn/114.114.114.114", "ipset=/example.com/gfwlist" and the like, whose domains are separated by "/"
+var dnsmasqDomainsRe = regexp.MustCompile(`^(?:server|local|address|ipset|nftset)=/(.+)/`)
+
+// names of hosts files which are not domains of the list, such as "127.0.0.1 localhost"
+var hostsLocalNames = map[string]struct{}{
+	"localhost": {}, "localhost.localdomain": {}, "local": {}, "broadcasthost": {}, "0.0.0.0": {},
+	"ip6-localhost": {}, "ip6-loopback": {}, "ip6-localnet": {}, "ip6-mcastprefix": {},
+	"ip6-allnodes": {}, "ip6-allrouters": {}, "ip6-allhosts": {},
+}
+
+// lines of a domain list in any of the formats, which is detected from its content,
+// base64 encoded lists such as gfwlist.txt are decoded first:
+//   - domains of dnsmasq conf and hosts files
+//   - plain lines and AdBlock Plus rules as they are, which GFWRuleMatcher accepts, see ABPRuleDomains for DomainSet
+//
+// comments, empty lines and element hiding rules of AdBlock Plus are dropped, an empty list is not an error
+func ParseDomainList(r io.Reader) ([]string, DomainListFormat, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	if decoded, ok := decodeBase64List(content); ok {
+		content = decoded
+	}
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(line, "\ufeff"))
+		if line != "" && line[0] != '#' && line[0] != '!' {
+			lines = append(lines, line)
+		}
+	}
+
+	format := detectDomainListFormat(lines)
+	var list []string
+	for _, line := range lines {
+		switch format {
+		case DOMAIN_LIST_DNSMASQ:
+			if m := dnsmasqDomainsRe.FindStringSubmatch(line); m != nil {
+				for _, domain := range strings.Split(m[1], "/") {
+					// "#" matches all domains
+					if domain != "" && domain != "#" {
+						list = append(list, domain)
+					}
+				}
+			}
+		case DOMAIN_LIST_HOSTS:
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+				continue
+			}
+			for _, name := range fields[1:] {
+				if _, ok := hostsLocalNames[strings.ToLower(name)]; !ok {
+					list = append(list, name)
+				}
+			}
+		case DOMAIN_LIST_ABP:
+			if line[0] == '[' || strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") {
+				continue
+			}
+			list = append(list, line)
+		default:
+			if fields := strings.Fields(line); len(fields) > 0 {
+				list = append(list, fields[0])
+			}
+		}
+	}
+	return list, format, nil
+}
+
+// content of a base64 encoded list, which has no dot unlike domains
+func decodeBase64List(content []byte) ([]byte, bool) {
+	compact := bytes.Join(bytes.Fields(content), nil)
+	if len(compact) == 0 || bytes.IndexByte(compact, '.') >= 0 {
+		return nil, false
+	}
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(compact)))
+	n, err := base64.StdEncoding.Decode(decoded, compact)
+	if err != nil || !utf8.Valid(decoded[:n]) {
+		return nil, false
+	}
+	return decoded[:n], true
+}
+
+// format of most of `lines`, AdBlock Plus if any line has its syntax
+func detectDomainListFormat(lines []string) DomainListFormat {
+	var dnsmasq, hosts int
+	for _, line := range lines {
+		switch {
+		case dnsmasqDomainsRe.MatchString(line):
+			dnsmasq++
+		case strings.HasPrefix(line, "[Adblock") || strings.HasPrefix(line, "[AutoProxy") ||
+			strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") || strings.HasSuffix(line, "^"):
+			return DOMAIN_LIST_ABP
+		default:
+			if fields := strings.Fields(line); len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+				hosts++
+			}
+		}
+	}
+	switch {
+	case dnsmasq > 0 && dnsmasq*2 >= len(lines):
+		return DOMAIN_LIST_DNSMASQ
+	case hosts > 0 && hosts*2 >= len(lines):
+		return DOMAIN_LIST_HOSTS
+	}
+	return DOMAIN_LIST_PLAIN
+}
+
+// domains blocked by AdBlock Plus `rules`, such as "example.com" of "||example.com^", for DomainSet,
+// exceptions, regular expressions and wildcard rules are dropped
+func ABPRuleDomains(rules []string) []string {
+	var domains []string
+	for _, rule := range rules {
+		if rule == "" || strings.HasPrefix(rule, "@@") || rule[0] == '/' || rule[0] == '[' || strings.Contains(rule, "*") {
+			continue
+		}
+		rule = strings.TrimLeft(rule, "|.")
+		if i := strings.Index(rule, "://"); i >= 0 {
+			rule = rule[i+3:]
+		}
+		if i := strings.IndexAny(rule, "/^?#:|$"); i >= 0 {
+			rule = rule[:i]
+		}
+		if strings.Contains(rule, ".") {
+			domains = append(domains, rule)
+		}
+	}
+	return domains
+}
+
+// CIDR lines such as china_ip_list.txt of https://github.com/17mon/china_ip_list,
+// empty lines and lines starting with "#" are skipped
+func ParseIPNetList(r io.Reader) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, ipn, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		ipNets = append(ipNets, ipn)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(ipNets) == 0 {
+		return nil, errors.New("empty IP Network list")
+	}
+	return ipNets, nil
+}
+
+// static mappings of an /etc/hosts-style file, lines are "<ip> <name> [<alias>...]",
+// comments start with "#", zones of ipv6 addresses such as "fe80::1%lo0" are dropped
+func ParseHostsFile(r io.Reader) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		s := fields[0]
+		if i := strings.IndexByte(s, '%'); i >= 0 {
+			s = s[:i]
+		}
+		ip := net.ParseIP(s)
+		if ip == nil || len(fields) < 2 {
+			return nil, errors.Errorf("invalid hosts line %d: %q", n, scanner.Text())
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(name)
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return hosts, nil
+}
@@ -0,0 +1,209 @@
+package dnsproxy
+
+import (
+	"io"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// TTL of the SOA record of local zones without one, which is also the TTL of negative answers
+const _LOCAL_ZONE_SOA_TTL = 60
+
+// max CNAME hops followed inside a local zone
+const _LOCAL_ZONE_MAX_CNAME = 8
+
+// authoritative zone answered by ServeDNS itself, e.g. "lan" for hosts in the home network,
+// names in it are resolved by neither upstreams nor the routing policy,
+// PTR queries of ips in its A and AAAA records are answered too
+type LocalZone struct {
+	origin  string              // lower case fqdn, such as "lan."
+	records map[string][]dns.RR // lower case fqdn of owner names -> RRs
+	reverse map[string]dns.RR   // reverse names of ips in A and AAAA records -> PTR records
+}
+
+// --- impl *LocalZone
+func NewLocalZone(origin string) *LocalZone {
+	origin = strings.ToLower(dns.Fqdn(origin))
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: _LOCAL_ZONE_SOA_TTL},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster." + origin,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  _LOCAL_ZONE_SOA_TTL,
+	}
+	return &LocalZone{
+		origin:  origin,
+		records: map[string][]dns.RR{origin: {soa}},
+		reverse: make(map[string]dns.RR),
+	}
+}
+
+// parse a zone file, relative names are relative to `origin`, `file` is only used in error messages
+func ParseLocalZone(r io.Reader, origin, file string) (*LocalZone, error) {
+	z := NewLocalZone(origin)
+	var err error
+	// drain the channel to stop the parser even if failed
+	for t := range dns.ParseZone(r, z.origin, file) {
+		if err != nil {
+			continue
+		}
+		if t.Error != nil {
+			err = errors.WithStack(t.Error)
+		} else {
+			err = z.AddRR(t.RR)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// such as "lan."
+func (z *LocalZone) Origin() string {
+	return z.origin
+}
+
+// add a record whose owner name is inside the zone, an SOA record at the origin replaces the default one
+func (z *LocalZone) AddRR(rr dns.RR) error {
+	hdr := rr.Header()
+	name := strings.ToLower(hdr.Name)
+	if !dns.IsSubDomain(z.origin, name) {
+		return errors.Errorf("%s is out of local zone %s", hdr.Name, z.origin)
+	}
+	if _, ok := rr.(*dns.SOA); ok {
+		if name != z.origin {
+			return errors.Errorf("SOA record %s is not at the origin of local zone %s", hdr.Name, z.origin)
+		}
+		z.records[name] = append([]dns.RR{rr}, z.records[name][1:]...)
+		return nil
+	}
+	z.records[name] = append(z.records[name], rr)
+
+	var ip string
+	switch v := rr.(type) {
+	case *dns.A:
+		ip = v.A.String()
+	case *dns.AAAA:
+		ip = v.AAAA.String()
+	}
+	if reverse, err := dns.ReverseAddr(ip); ip != "" && err == nil && !strings.HasPrefix(name, "*.") {
+		if _, ok := z.reverse[reverse]; !ok {
+			z.reverse[reverse] = &dns.PTR{
+				Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: hdr.Ttl},
+				Ptr: hdr.Name,
+			}
+		}
+	}
+	return nil
+}
+
+// number of records, the SOA record excluded
+func (z *LocalZone) Len() int {
+	n := 0
+	for _, rrs := range z.records {
+		n += len(rrs)
+	}
+	return n - 1
+}
+
+// check if the zone is authoritative for `name`, reverse names of its ips included,
+// returns the length of the matched origin to choose the most specific zone
+func (z *LocalZone) match(name string, qtype uint16) (int, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	if dns.IsSubDomain(z.origin, name) {
+		return len(z.origin), true
+	}
+	if qtype == dns.TypePTR {
+		if _, ok := z.reverse[name]; ok {
+			return len(name), true
+		}
+	}
+	return 0, false
+}
+
+// answer `req` authoritatively if the questioned name is in the zone
+func (z *LocalZone) Lookup(req *dns.Msg) (*dns.Msg, bool) {
+	if len(req.Question) == 0 {
+		return nil, false
+	}
+	q := req.Question[0]
+	if _, ok := z.match(q.Name, q.Qtype); !ok {
+		return nil, false
+	}
+	name := strings.ToLower(dns.Fqdn(q.Name))
+	resp := MsgNewReplyFromReq(req)
+	resp.Authoritative = true
+
+	if ptr, ok := z.reverse[name]; ok && q.Qtype == dns.TypePTR {
+		resp.Answer = []dns.RR{dns.Copy(ptr)}
+		return resp, true
+	}
+	if !dns.IsSubDomain(z.origin, name) {
+		return nil, false
+	}
+
+	for i := 0; i < _LOCAL_ZONE_MAX_CNAME; i++ {
+		rrs, ok := z.lookupName(name)
+		if !ok {
+			if len(resp.Answer) == 0 {
+				resp.Rcode = dns.RcodeNameError
+			}
+			break
+		}
+		answer, cname := selectRRs(rrs, q.Qtype)
+		resp.Answer = append(resp.Answer, answer...)
+		if cname == "" || !dns.IsSubDomain(z.origin, cname) {
+			break
+		}
+		name = cname
+	}
+	if len(resp.Answer) == 0 {
+		resp.Ns = []dns.RR{dns.Copy(z.records[z.origin][0])}
+	}
+	return resp, true
+}
+
+// RRs of `name`, or those of the wildcard "*.parent" with owner names rewritten to `name`
+func (z *LocalZone) lookupName(name string) ([]dns.RR, bool) {
+	if rrs, ok := z.records[name]; ok {
+		return rrs, true
+	}
+	if name == z.origin {
+		return nil, false
+	}
+	rrs, ok := z.records["*."+parentDomain(name)]
+	if !ok {
+		return nil, false
+	}
+	_rrs := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		_rrs[i] = dns.Copy(rr)
+		_rrs[i].Header().Name = name
+	}
+	return _rrs, true
+}
+
+// copies of RRs of `qtype`, all RRs for ANY,
+// or the CNAME record and its target if there is no RR of `qtype`
+func selectRRs(rrs []dns.RR, qtype uint16) (answer []dns.RR, cname string) {
+	for _, rr := range rrs {
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			answer = append(answer, dns.Copy(rr))
+		}
+	}
+	if len(answer) > 0 || qtype == dns.TypeCNAME {
+		return answer, ""
+	}
+	for _, rr := range rrs {
+		if v, ok := rr.(*dns.CNAME); ok {
+			return []dns.RR{dns.Copy(v)}, strings.ToLower(v.Target)
+		}
+	}
+	return nil, ""
+}
@@ -0,0 +1,107 @@
+package dnsproxy
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	_NEGCACHE_MAX_TTL          = time.Hour // negative answers are cached at most this long even if their SOA says longer
+	_NEGCACHE_MAX_ENTRIES      = 10000     // bounded against floods of random nonexistent subdomains
+	_NEGCACHE_CLEANUP_INTERVAL = time.Minute
+)
+
+// cache of NXDOMAIN and NODATA responses for the TTL of the SOA record in their authority sections (RFC 2308),
+// so that queries of nonexistent domains or types are not routed again and again,
+// failures such as timeouts, SERVFAIL and REFUSED are never cached
+type negcache struct {
+	inner *cache.Cache
+	meta  *cacheMeta
+}
+
+type negcacheCell struct {
+	rcode  int
+	soa    *dns.SOA  // authority of the negative answer
+	trans  Transport // the domain was decided to
+	stored time.Time
+}
+
+// --- impl *negcacheCell
+
+// reply to `req` with the cached rcode and SOA record whose TTL is decremented by the time it has been cached
+func (cell *negcacheCell) Reply(req *dns.Msg) *dns.Msg {
+	resp := MsgNewReplyFromReq(req)
+	resp.Rcode = cell.rcode
+	soa := dns.Copy(cell.soa)
+	if elapsed := uint32(time.Since(cell.stored) / time.Second); soa.Header().Ttl > elapsed {
+		soa.Header().Ttl -= elapsed
+	} else {
+		soa.Header().Ttl = 0
+	}
+	resp.Ns = []dns.RR{soa}
+	return resp
+}
+
+// --- impl negcache
+func newNegcache() negcache {
+	c, meta := newCacheWithMeta(_NEGCACHE_CLEANUP_INTERVAL)
+	meta.setMaxEntries(c, _NEGCACHE_MAX_ENTRIES)
+	return negcache{c, meta}
+}
+
+// cache `resp` to `qtype` query of `domain` for clients in `scope` if it is negative and has a SOA record,
+// for the minimum of the SOA's TTL and MINIMUM field as RFC 2308 says, capped by _NEGCACHE_MAX_TTL
+func (c negcache) Add(scope, domain string, qtype uint16, resp *dns.Msg, t Transport) {
+	if domain == "" || !MsgIsNegative(resp) || len(resp.Answer) > 0 {
+		return
+	}
+	var soa *dns.SOA
+	for _, rr := range resp.Ns {
+		if v, ok := rr.(*dns.SOA); ok {
+			soa = v
+			break
+		}
+	}
+	if soa == nil {
+		return
+	}
+	ttl := soa.Hdr.Ttl
+	if soa.Minttl < ttl {
+		ttl = soa.Minttl
+	}
+	d := time.Duration(ttl) * time.Second
+	if d > _NEGCACHE_MAX_TTL {
+		d = _NEGCACHE_MAX_TTL
+	}
+	if d <= 0 {
+		return
+	}
+	// the TTL of the negative answer, rather than the SOA's own one
+	soa = dns.Copy(soa).(*dns.SOA)
+	soa.Hdr.Ttl = uint32(d / time.Second)
+	cell := &negcacheCell{rcode: resp.Rcode, soa: soa, trans: t, stored: time.Now()}
+	c.meta.put(c.inner, scopedCacheKey(scope, domaincacheKey(domain, qtype)), cell, d, true)
+}
+
+// unexpired negative answer of the domain
+func (c negcache) Get(scope, domain string, qtype uint16) (*negcacheCell, bool) {
+	key := scopedCacheKey(scope, domaincacheKey(domain, qtype))
+	v, ok := c.inner.Get(key)
+	c.meta.count(ok)
+	if !ok {
+		return nil, false
+	}
+	c.meta.touch(key)
+	return v.(*negcacheCell), true
+}
+
+func (c negcache) Stats() CacheStats {
+	return c.meta.stats(c.inner)
+}
+
+// delete all items
+func (c negcache) Flush() {
+	c.meta.flush(c.inner)
+}
@@ -0,0 +1,158 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/ARwMq9b6/libgost"
+	"github.com/pkg/errors"
+)
+
+// local address and network interface which outbound connections leave from, e.g. on routers with policy routing,
+// direct connections leave by the WAN while connections to proxy servers leave by a VPN interface,
+// see (*Server).SetOutboundBinds and (*dnsTransport).SetOutboundBind
+//
+// a nil *OutboundBind dials as usual
+type OutboundBind struct {
+	ip    net.IP // local address, nil for any
+	iface string // network interface bound by SO_BINDTODEVICE, empty for any
+}
+
+// --- impl *OutboundBind
+
+// bind to the local address `ip` and the network interface `iface`, either can be empty, nil if both are,
+// binding to interfaces is only supported on linux and may require CAP_NET_RAW,
+// the interface needs not exist yet, e.g. a VPN interface which comes up later
+func NewOutboundBind(ip, iface string) (*OutboundBind, error) {
+	if ip == "" && iface == "" {
+		return nil, nil
+	}
+	b := &OutboundBind{iface: iface}
+	if ip != "" {
+		if b.ip = net.ParseIP(ip); b.ip == nil {
+			return nil, errors.Errorf("invalid bind address %q", ip)
+		}
+	}
+	if iface != "" && !_BIND_TO_DEVICE_SUPPORTED {
+		return nil, errors.New("binding to network interfaces is only supported on linux")
+	}
+	return b, nil
+}
+
+// such as "192.168.1.2", "dev wg0" or "10.8.0.2 dev wg0"
+func (b *OutboundBind) String() string {
+	if b == nil {
+		return "<nil>"
+	}
+	switch {
+	case b.iface == "":
+		return b.ip.String()
+	case b.ip == nil:
+		return "dev " + b.iface
+	}
+	return b.ip.String() + " dev " + b.iface
+}
+
+// dialer over `network` from `port` of the bound address, 0 for any port
+func (b *OutboundBind) dialer(network string, port int) *net.Dialer {
+	var ip net.IP
+	d := &net.Dialer{}
+	if b != nil {
+		ip = b.ip
+		if b.iface != "" {
+			d.Control = bindToDevice(b.iface)
+		}
+	}
+	if ip != nil || port != 0 {
+		switch network {
+		case "udp", "udp4", "udp6":
+			d.LocalAddr = &net.UDPAddr{IP: ip, Port: port}
+		default:
+			d.LocalAddr = &net.TCPAddr{IP: ip, Port: port}
+		}
+	}
+	return d
+}
+
+// dial `addr` over `network` until `ctx` is done
+func (b *OutboundBind) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := b.dialer(network, 0).DialContext(ctx, network, addr)
+	return conn, errors.WithStack(err)
+}
+
+// --- impl proxy.Dialer, e.g. the forward dialer of proxy.SOCKS5, within gost.DialTimeout
+func (b *OutboundBind) Dial(network, addr string) (net.Conn, error) {
+	d := b.dialer(network, 0)
+	d.Timeout = gost.DialTimeout
+	conn, err := d.Dial(network, addr)
+	return conn, errors.WithStack(err)
+}
+
+// dial `addr` through `chain` as chain.Dial does, but the first hop is connected from `b`,
+// chains of http2 or kcp transports are dialed by gost without binding, as it manages their connections itself
+func (b *OutboundBind) DialChain(chain *gost.ProxyChain, addr string) (net.Conn, error) {
+	if b == nil || chain.Http2Enabled() || chain.KCPEnabled() {
+		return chain.Dial(addr)
+	}
+	nodes := chain.Nodes()
+	if len(nodes) == 0 {
+		return b.Dial("tcp", addr)
+	}
+
+	// --- partially copied from (*gost.ProxyChain).travelNodes
+	conn, err := b.Dial("tcp", nodes[0].Addr)
+	if err != nil {
+		return nil, err
+	}
+	setProxyKeepAlive(conn)
+	var pc *gost.ProxyConn
+	for i, node := range nodes {
+		if i > 0 {
+			if err = pc.Connect(node.Addr); err != nil {
+				break
+			}
+		}
+		pc = gost.NewProxyConn(conn, node)
+		conn = pc
+		if err = pc.Handshake(); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = pc.Connect(addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	return pc, nil
+}
+
+// udp socket from the bound address, for datagrams to any destination
+func (b *OutboundBind) listenUDP() (*net.UDPConn, error) {
+	var lc net.ListenConfig
+	laddr := ":0"
+	if b != nil {
+		if b.ip != nil {
+			laddr = net.JoinHostPort(b.ip.String(), "0")
+		}
+		if b.iface != "" {
+			lc.Control = bindToDevice(b.iface)
+		}
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", laddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// --- impl *Server
+
+// connect destinations of ServeProxy directly from `direct`, and proxy servers from `proxy`, nil to not bind,
+// udp datagrams of socks5 associations as well, must be called before serving
+//
+// chains of http2 or kcp transports are not bound, see (*OutboundBind).DialChain
+func (s *Server) SetOutboundBinds(direct, proxy *OutboundBind) {
+	s.directBind, s.proxyBind = direct, proxy
+}
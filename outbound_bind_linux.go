@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package dnsproxy
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const _BIND_TO_DEVICE_SUPPORTED = true
+
+// control function of net.Dialer and net.ListenConfig, which binds sockets to the network interface `iface`
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.Wrapf(serr, "set SO_BINDTODEVICE %s", iface)
+	}
+}
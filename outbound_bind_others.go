@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package dnsproxy
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// SO_BINDTODEVICE is only supported on linux, NewOutboundBind refuses interfaces elsewhere
+const _BIND_TO_DEVICE_SUPPORTED = false
+
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.Errorf("binding to network interface %s is only supported on linux", iface)
+	}
+}
@@ -0,0 +1,85 @@
+package dnsproxy
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// TTL of answers from override zone
+const _OVERRIDE_TTL = 60
+
+// static answers which take precedence over caches and upstream dns servers,
+// e.g. to block ad domains or pin internal host names
+type OverrideZone struct {
+	hosts   map[string][]net.IP // pinned domain -> ips, subdomains are not matched
+	blocked *DomainSet          // blocked domains and their subdomains, answered with NXDOMAIN
+}
+
+// --- impl *OverrideZone
+func NewOverrideZone() *OverrideZone {
+	return &OverrideZone{hosts: make(map[string][]net.IP), blocked: NewDomainSet()}
+}
+
+// pin `domain` to `ips`, both ipv4 and ipv6 are accepted
+func (z *OverrideZone) AddHost(domain string, ips ...net.IP) {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return
+	}
+	z.hosts[domain] = append(z.hosts[domain], ips...)
+}
+
+// answer NXDOMAIN for `domain` and its subdomains
+func (z *OverrideZone) Block(domain string) {
+	z.blocked.Add(domain)
+}
+
+func (z *OverrideZone) Len() int {
+	return len(z.hosts) + z.blocked.Len()
+}
+
+// ips pinned for `domain`, and whether it is blocked
+func (z *OverrideZone) lookupHost(domain string) (ips []net.IP, blocked bool) {
+	domain = normalizeDomain(domain)
+	if z.blocked.Match(domain) {
+		return nil, true
+	}
+	return z.hosts[domain], false
+}
+
+// reply to `req` if the questioned domain is blocked or pinned
+func (z *OverrideZone) Lookup(req *dns.Msg) (*dns.Msg, bool) {
+	if len(req.Question) == 0 {
+		return nil, false
+	}
+	q := req.Question[0]
+	domain := normalizeDomain(q.Name)
+
+	if z.blocked.Match(domain) {
+		resp := new(dns.Msg).SetRcode(req, dns.RcodeNameError)
+		resp.RecursionAvailable = true
+		return resp, true
+	}
+
+	ips, ok := z.hosts[domain]
+	if !ok {
+		return nil, false
+	}
+	// answer no data for other query types of pinned domains
+	var answer []dns.RR
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: _OVERRIDE_TTL}
+	for _, ip := range ips {
+		switch ip4 := ip.To4(); {
+		case q.Qtype == dns.TypeA && ip4 != nil:
+			hdr.Rrtype = dns.TypeA
+			answer = append(answer, &dns.A{Hdr: hdr, A: ip4})
+		case q.Qtype == dns.TypeAAAA && ip4 == nil:
+			hdr.Rrtype = dns.TypeAAAA
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	resp := MsgNewReplyFromReq(req, answer...)
+	resp.Authoritative = true
+	return resp, true
+}
@@ -0,0 +1,92 @@
+package dnsproxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+// domains whose answers of the chinese dns server turned out to be forged, see SetFakeIPs
+//
+// safe for concurrent use
+type poisonedDomains struct {
+	mu      sync.RWMutex
+	domains map[string]struct{}
+}
+
+// --- impl *poisonedDomains
+
+func (d *poisonedDomains) add(domain string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.domains == nil {
+		d.domains = make(map[string]struct{})
+	}
+	d.domains[normalizeDomain(domain)] = struct{}{}
+}
+
+func (d *poisonedDomains) has(domain string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.domains[normalizeDomain(domain)]
+	return ok
+}
+
+// sorted
+func (d *poisonedDomains) list() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	domains := make([]string, 0, len(d.domains))
+	for domain := range d.domains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// --- impl *DefaultRoutingPolicy
+
+// answers of the chinese dns server with any ip in `ipnets` are forged by the gfw and discarded,
+// the domains are proxied and resolved by the abroad dns server since then, unless they are in the obedient list
+// or forced by user rules, must be called before serving
+func (p *DefaultRoutingPolicy) SetFakeIPs(ipnets []*net.IPNet) {
+	p.fakeIPs = NewIPNetMatcher(ipnets)
+}
+
+// domains detected to be poisoned so far, see SetFakeIPs
+func (p *DefaultRoutingPolicy) PoisonedDomains() []string {
+	return p.poisoned.list()
+}
+
+// check if any address answered in `resp` is a fake ip, see SetFakeIPs
+func (p *DefaultRoutingPolicy) forged(resp *dns.Msg) bool {
+	if p.fakeIPs == nil || p.fakeIPs.Len() == 0 || resp == nil {
+		return false
+	}
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if ip != nil && p.fakeIPs.Match(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// mark `domain` proxied if the decision of `st` discarded a poisoned answer for it
+func (p *DefaultRoutingPolicy) learnPoisoned(domain string, st *routeState, d *RouteDecision) {
+	direct := st.results[_ROUTE_STEP_DIRECT]
+	if d == nil || d.Trans != TRANS_PROXY || direct == nil || !direct.poisoned || p.poisoned.has(domain) {
+		return
+	}
+	p.poisoned.add(domain)
+	glog.Infof("%s is poisoned, proxied since now\n", domain)
+}
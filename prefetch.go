@@ -0,0 +1,160 @@
+package dnsproxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// number of domains resolved at the same time by Prefetch and WarmUp
+const PREFETCH_CONCURRENCY = 8
+
+// access counters of dns queries since the last prefetch round
+type prefetcher struct {
+	minHits int
+
+	mu      sync.Mutex
+	queries map[string]*prefetchQuery // keyed by scoped domaincache keys
+}
+
+// a dns query to resolve again, and how many times it has been asked
+type prefetchQuery struct {
+	domain   string
+	qtype    uint16
+	client   net.IP // the last client asking, which decides the routing and the cache scope
+	listener string // tag of the dns listener the last client asked on
+	hits     int
+}
+
+// --- impl *prefetcher
+func newPrefetcher(minHits int) *prefetcher {
+	return &prefetcher{minHits: minHits, queries: make(map[string]*prefetchQuery)}
+}
+
+func (p *prefetcher) touch(scope, domain string, qtype uint16, client net.IP, listener string) {
+	key := scopedCacheKey(scope, domaincacheKey(domain, qtype))
+	p.mu.Lock()
+	q, ok := p.queries[key]
+	if !ok {
+		q = &prefetchQuery{domain: domain, qtype: qtype}
+		p.queries[key] = q
+	}
+	q.client, q.listener = client, listener
+	q.hits++
+	p.mu.Unlock()
+}
+
+// queries asked at least minHits times, counters are reset
+func (p *prefetcher) popular() map[string]*prefetchQuery {
+	p.mu.Lock()
+	queries := p.queries
+	p.queries = make(map[string]*prefetchQuery)
+	p.mu.Unlock()
+
+	for key, q := range queries {
+		if q.hits < p.minHits {
+			delete(queries, key)
+		}
+	}
+	return queries
+}
+
+// --- impl *Server
+
+// count dns queries for Prefetch, domains asked at least `minHits` times between two prefetch rounds are popular,
+// must be called before serving
+func (s *Server) EnablePrefetch(minHits int) {
+	if minHits < 1 {
+		minHits = 1
+	}
+	s.prefetch = newPrefetcher(minHits)
+}
+
+// every `interval`, resolve popular domains again if their cached answers expire before the round after next,
+// so that they never have to be resolved while clients are waiting, never returns,
+// nothing is done unless EnablePrefetch is called
+func (s *Server) Prefetch(interval time.Duration) {
+	if s.prefetch == nil {
+		return
+	}
+	for range time.Tick(interval) {
+		queries := s.prefetch.popular()
+		if len(queries) == 0 {
+			continue
+		}
+		deadline := time.Now().Add(2 * interval)
+		var batch []*prefetchQuery
+		for key, q := range queries {
+			// not counted as cache hits or misses
+			v, ok := s.domaincache.inner.Get(key)
+			if !ok {
+				continue
+			}
+			if expires := v.(*DomainCacheCell).expires; !expires.IsZero() && expires.Before(deadline) {
+				batch = append(batch, q)
+			}
+		}
+		if n := s.resolveBatch(batch); n > 0 {
+			glog.V(1).Infof("prefetched %d domains\n", n)
+		}
+	}
+}
+
+// resolve A records of `domains` into caches before serving, e.g. right after started,
+// failures are logged and ignored
+func (s *Server) WarmUp(domains []string) {
+	batch := make([]*prefetchQuery, len(domains))
+	for i, domain := range domains {
+		batch[i] = &prefetchQuery{domain: normalizeDomain(domain), qtype: dns.TypeA}
+	}
+	n := s.resolveBatch(batch)
+	glog.Infof("warmed up %d of %d domains\n", n, len(domains))
+}
+
+// resolve and cache `batch` concurrently, returns the number of succeeded queries
+func (s *Server) resolveBatch(batch []*prefetchQuery) int {
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		n   int
+		sem = make(chan struct{}, PREFETCH_CONCURRENCY)
+	)
+	for _, q := range batch {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(q *prefetchQuery) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := s.resolveAndCache(q); err != nil {
+				glog.Warningf("prefetch %s: %s\n", q.domain, err)
+				return
+			}
+			mu.Lock()
+			n++
+			mu.Unlock()
+		}(q)
+	}
+	wg.Wait()
+	return n
+}
+
+// resolve `q` as if its client asked again, replacing the cached answers
+func (s *Server) resolveAndCache(q *prefetchQuery) error {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(q.domain), q.qtype)
+	d, err := s.routeDomain(&RouteQuery{Req: req, Client: q.client, Listener: q.listener, NeedAnswer: true})
+	if err != nil {
+		return err
+	}
+	if d.Resp == nil {
+		return errors.New("routing policy did not resolve it")
+	}
+	s.storeDecision(s.queryScope(q.client, q.listener), q.domain, q.qtype, d, true)
+	return nil
+}
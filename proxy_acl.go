@@ -0,0 +1,85 @@
+package dnsproxy
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ARwMq9b6/libgost"
+	"github.com/ginuerzh/gosocks5"
+)
+
+// access control of ServeProxy, clients must be in the allowed subnets if there are any,
+// and must authenticate as one of the users if there are any,
+// by socks5 username/password or http basic authentication (Proxy-Authorization), socks4 clients are rejected then
+type ProxyACL struct {
+	allowed *IPNetMatcher   // nil to allow all client ips
+	users   []*url.Userinfo // empty to skip authentication
+}
+
+// --- impl *ProxyACL
+func NewProxyACL(allowedClients []*net.IPNet, users []*url.Userinfo) *ProxyACL {
+	acl := &ProxyACL{users: users}
+	if len(allowedClients) > 0 {
+		acl.allowed = NewIPNetMatcher(allowedClients)
+	}
+	return acl
+}
+
+func (acl *ProxyACL) allowClient(client net.IP) bool {
+	return acl.allowed == nil || (client != nil && acl.allowed.Match(client))
+}
+
+// check credentials the same way as gost does, an empty username or password of a user matches any
+func (acl *ProxyACL) authenticate(username, password string) bool {
+	for _, user := range acl.users {
+		p, _ := user.Password()
+		if (username == user.Username() && password == p) ||
+			(username == user.Username() && p == "") ||
+			(user.Username() == "" && password == p) {
+			return true
+		}
+	}
+	return false
+}
+
+// socks5 method selector which demands username/password authentication if there are users
+func (acl *ProxyACL) socks5Selector(direct *gost.ProxyChain) gosocks5.Selector {
+	return gost.NewProxyServer(gost.ProxyNode{Users: acl.users}, direct, nil).Selector
+}
+
+// check Proxy-Authorization of `req` and remove it, returns the reason if rejected
+func (acl *ProxyACL) authenticateHTTP(req *http.Request) (reason string, ok bool) {
+	if len(acl.users) == 0 {
+		return "", true
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	req.Header.Del("Proxy-Authorization")
+	if auth == "" {
+		return "http proxy authentication required", false
+	}
+	username, password, ok := parseBasicAuth(auth)
+	if !ok || !acl.authenticate(username, password) {
+		return "http proxy authentication failed", false
+	}
+	return "", true
+}
+
+// "Basic dXNlcjpwYXNz" -> "user", "pass"
+func parseBasicAuth(auth string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	i := strings.IndexByte(string(b), ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return string(b[:i]), string(b[i+1:]), true
+}
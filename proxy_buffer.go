@@ -0,0 +1,76 @@
+package dnsproxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// default size of relay buffers, the same as io.Copy
+const RELAY_BUFFER_SIZE = 32 * 1024
+
+// buffers of ServeProxy and ServeShadowsocks shared by all connections, which read requests and copy data through them,
+// recycled by a sync.Pool instead of being allocated for each connection,
+// tcp relays spliced by the kernel need no buffer at all, see relayCopy
+//
+// a nil *RelayBuffers allocates buffers of RELAY_BUFFER_SIZE without pooling, all methods are safe for concurrent use
+type RelayBuffers struct {
+	// 64-bit atomic counters come first to be aligned on 32-bit platforms
+	gets   uint64
+	allocs uint64
+	puts   uint64
+
+	size int
+	pool sync.Pool // of *[]byte
+}
+
+// --- impl *RelayBuffers
+
+// buffers of `size` bytes, RELAY_BUFFER_SIZE if it is not positive
+func NewRelayBuffers(size int) *RelayBuffers {
+	if size <= 0 {
+		size = RELAY_BUFFER_SIZE
+	}
+	b := &RelayBuffers{size: size}
+	b.pool.New = func() interface{} {
+		atomic.AddUint64(&b.allocs, 1)
+		buf := make([]byte, size)
+		return &buf
+	}
+	return b
+}
+
+// usage of the pool
+type RelayBufferStats struct {
+	Size   int    `json:"size"`
+	Gets   uint64 `json:"gets"`
+	Allocs uint64 `json:"allocs"` // buffers allocated because none was free in the pool
+	InUse  uint64 `json:"in_use"` // buffers taken and not returned yet
+}
+
+func (b *RelayBuffers) Stats() RelayBufferStats {
+	gets, puts := atomic.LoadUint64(&b.gets), atomic.LoadUint64(&b.puts)
+	return RelayBufferStats{
+		Size:   b.size,
+		Gets:   gets,
+		Allocs: atomic.LoadUint64(&b.allocs),
+		InUse:  gets - puts,
+	}
+}
+
+// take a buffer, which must be returned by put once it is no longer used
+func (b *RelayBuffers) get() *[]byte {
+	if b == nil {
+		buf := make([]byte, RELAY_BUFFER_SIZE)
+		return &buf
+	}
+	atomic.AddUint64(&b.gets, 1)
+	return b.pool.Get().(*[]byte)
+}
+
+func (b *RelayBuffers) put(buf *[]byte) {
+	if b == nil {
+		return
+	}
+	atomic.AddUint64(&b.puts, 1)
+	b.pool.Put(buf)
+}
@@ -0,0 +1,131 @@
+package dnsproxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connections over the cap of ServeProxy must send their requests in this long to be replied a failure
+const _PROXY_REJECT_TIMEOUT = 5 * time.Second
+
+// overload protection of ServeProxy and ServeShadowsocks:
+//   - connections beyond `maxConns` are replied a failure, e.g. 503 for http and general failure for socks5
+//   - each direction of each connection is limited to `connRate` bytes per second
+//   - each direction of all connections together is limited to `totalRate` bytes per second
+//
+// zero values disable the limits, all methods are safe for concurrent use
+type ProxyLimiter struct {
+	maxConns int64
+	conns    int64 // connections being served, accessed atomically
+
+	connRate float64
+	// aggregate limits of all connections, nil if disabled
+	totalUp   *byteLimiter // from clients
+	totalDown *byteLimiter // to clients
+}
+
+// --- impl *ProxyLimiter
+func NewProxyLimiter(maxConns int, connRate, totalRate float64) *ProxyLimiter {
+	l := &ProxyLimiter{maxConns: int64(maxConns), connRate: connRate}
+	if totalRate > 0 {
+		l.totalUp, l.totalDown = newByteLimiter(totalRate), newByteLimiter(totalRate)
+	}
+	return l
+}
+
+// take a connection slot for `conn` and limit its bandwidth, the slot is released when the returned conn is closed,
+// false if there are too many connections, then `conn` is returned with a deadline for replying the failure
+func (l *ProxyLimiter) admit(conn net.Conn) (net.Conn, bool) {
+	if l == nil {
+		return conn, true
+	}
+	if n := atomic.AddInt64(&l.conns, 1); l.maxConns > 0 && n > l.maxConns {
+		atomic.AddInt64(&l.conns, -1)
+		conn.SetDeadline(time.Now().Add(_PROXY_REJECT_TIMEOUT))
+		return conn, false
+	}
+	c := &limitedConn{Conn: conn, l: l}
+	if l.connRate > 0 {
+		c.up, c.down = newByteLimiter(l.connRate), newByteLimiter(l.connRate)
+	}
+	return c, true
+}
+
+// client connection counted by a *ProxyLimiter
+type limitedConn struct {
+	net.Conn
+	l        *ProxyLimiter
+	up, down *byteLimiter // nil if connections are not limited individually
+	release  sync.Once
+}
+
+// --- impl *limitedConn
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.up.wait(n)
+		c.l.totalUp.wait(n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	c.down.wait(len(b))
+	c.l.totalDown.wait(len(b))
+	return c.Conn.Write(b)
+}
+
+func (c *limitedConn) Close() error {
+	c.release.Do(func() {
+		atomic.AddInt64(&c.l.conns, -1)
+	})
+	return c.Conn.Close()
+}
+
+// --- impl relayWrapper for *limitedConn
+
+func (c *limitedConn) relayInner(read bool) net.Conn {
+	return c.Conn
+}
+
+func (c *limitedConn) relayed(n int, read bool) {
+	if read {
+		c.up.wait(n)
+		c.l.totalUp.wait(n)
+	} else {
+		c.down.wait(n)
+		c.l.totalDown.wait(n)
+	}
+}
+
+// blocking token bucket of bytes, which allows a burst of one second
+type byteLimiter struct {
+	rate float64
+
+	mu sync.Mutex
+	b  *tokenBucket
+}
+
+// --- impl *byteLimiter
+func newByteLimiter(rate float64) *byteLimiter {
+	return &byteLimiter{rate: rate, b: newTokenBucket(rate, time.Now())}
+}
+
+// take `n` bytes, and sleep until the debt is paid off if there are not enough,
+// a nil limiter never waits
+func (l *byteLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.b.refill(l.rate, l.rate, time.Now())
+	l.b.tokens -= float64(n)
+	tokens := l.b.tokens
+	l.mu.Unlock()
+	if tokens < 0 {
+		time.Sleep(time.Duration(-tokens / l.rate * float64(time.Second)))
+	}
+}
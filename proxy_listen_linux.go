@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package dnsproxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// max pending TCP Fast Open connections which have not completed the three-way handshake
+const _TCP_FASTOPEN_QLEN = 256
+
+// listen on `laddr` with SO_REUSEPORT, so that several listeners on the same address
+// share incoming connections balanced by the kernel, and with TCP Fast Open optionally
+func listenTCP(laddr string, reusePort, fastOpen bool) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if reusePort {
+				if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); serr != nil {
+					serr = errors.Wrap(serr, "set SO_REUSEPORT")
+					return
+				}
+			}
+			if fastOpen {
+				if serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, _TCP_FASTOPEN_QLEN); serr != nil {
+					serr = errors.Wrap(serr, "set TCP_FASTOPEN")
+				}
+			}
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return serr
+	}}
+	l, err := lc.Listen(context.Background(), "tcp", laddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return l, nil
+}
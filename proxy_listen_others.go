@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package dnsproxy
+
+import (
+	"net"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// plain net.Listen, SO_REUSEPORT load balancing and TCP Fast Open are only supported on linux
+func listenTCP(laddr string, reusePort, fastOpen bool) (net.Listener, error) {
+	if reusePort {
+		return nil, errors.New("multiple proxy listeners are only supported on linux")
+	}
+	if fastOpen {
+		glog.Warningln("TCP Fast Open is only supported on linux, ignored")
+	}
+	l, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return l, nil
+}
@@ -0,0 +1,188 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ARwMq9b6/libgost"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// how a ProxyPool chooses among its alive proxy chains
+type ProxyPoolStrategy int8
+
+const (
+	PROXY_POOL_FAILOVER    ProxyPoolStrategy = iota // the alive chain with the lowest latency
+	PROXY_POOL_ROUND_ROBIN                          // alive chains in turn
+)
+
+// parse "failover" or "round_robin", PROXY_POOL_FAILOVER if empty
+func ParseProxyPoolStrategy(s string) (ProxyPoolStrategy, error) {
+	switch strings.ToLower(s) {
+	case "", "failover":
+		return PROXY_POOL_FAILOVER, nil
+	case "round_robin":
+		return PROXY_POOL_ROUND_ROBIN, nil
+	default:
+		return 0, errors.Errorf("unknown proxy pool strategy %q", s)
+	}
+}
+
+// proxy chains with health probes, connections to be proxied go through one of the alive chains
+type ProxyPool struct {
+	chains   []*pooledProxyChain
+	strategy ProxyPoolStrategy
+	next     uint32        // round robin counter
+	bind     *OutboundBind // chains are probed from, see SetOutboundBind
+}
+
+// health of a proxy chain, see (*ProxyPool).Health
+type ProxyHealth struct {
+	Proxy   string `json:"proxy"`
+	Alive   bool   `json:"alive"`
+	Latency string `json:"latency"` // such as "35ms", empty if never probed
+}
+
+// a chain of ProxyPool with its health
+type pooledProxyChain struct {
+	chain       *gost.ProxyChain
+	server      *gost.ProxyServer
+	udpUpstream *socks5UDPUpstream
+
+	mu      sync.Mutex
+	alive   bool
+	latency time.Duration // time to connect the probe address through the chain
+}
+
+// --- impl *ProxyPool
+
+// all chains are considered alive until probed
+func NewProxyPool(chains []*gost.ProxyChain, strategy ProxyPoolStrategy) *ProxyPool {
+	p := &ProxyPool{strategy: strategy}
+	for _, chain := range chains {
+		p.chains = append(p.chains, &pooledProxyChain{
+			chain:       chain,
+			server:      gost.NewProxyServer(gost.ProxyNode{}, chain, nil),
+			udpUpstream: udpUpstreamOf(chain),
+			alive:       true,
+		})
+	}
+	return p
+}
+
+func (p *ProxyPool) validate() error {
+	if p == nil || len(p.chains) == 0 {
+		return errors.New("proxy pool has no proxy chain")
+	}
+	return nil
+}
+
+// probe chains from the local address or network interface of `b`, which should be the proxy bind of the server,
+// see (*Server).SetOutboundBinds, must be called before probing
+func (p *ProxyPool) SetOutboundBind(b *OutboundBind) {
+	p.bind = b
+}
+
+// probe every chain by connecting `addr` through it every `interval`, never returns
+func (p *ProxyPool) Probe(addr string, interval, timeout time.Duration) {
+	for {
+		var wg sync.WaitGroup
+		for _, c := range p.chains {
+			wg.Add(1)
+			go func(c *pooledProxyChain) {
+				defer wg.Done()
+				c.probe(p.bind, addr, timeout)
+			}(c)
+		}
+		wg.Wait()
+		time.Sleep(interval)
+	}
+}
+
+// health of all chains in order
+func (p *ProxyPool) Health() []ProxyHealth {
+	health := make([]ProxyHealth, 0, len(p.chains))
+	for _, c := range p.chains {
+		h := ProxyHealth{Proxy: fmt.Sprint(c.chain.Nodes()), Alive: c.isAlive()}
+		if latency := c.getLatency(); latency > 0 {
+			h.Latency = latency.String()
+		}
+		health = append(health, h)
+	}
+	return health
+}
+
+// the chain for a new proxied connection, the first chain if none is alive
+func (p *ProxyPool) pick() *pooledProxyChain {
+	var alive []*pooledProxyChain
+	for _, c := range p.chains {
+		if c.isAlive() {
+			alive = append(alive, c)
+		}
+	}
+	if len(alive) == 0 {
+		return p.chains[0]
+	}
+	if p.strategy == PROXY_POOL_ROUND_ROBIN {
+		n := atomic.AddUint32(&p.next, 1)
+		return alive[int(n)%len(alive)]
+	}
+	best := alive[0]
+	for _, c := range alive[1:] {
+		if c.getLatency() < best.getLatency() {
+			best = c
+		}
+	}
+	return best
+}
+
+// --- impl *pooledProxyChain
+func (c *pooledProxyChain) probe(bind *OutboundBind, addr string, timeout time.Duration) {
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := bind.DialChain(c.chain, addr)
+		if err == nil {
+			conn.Close()
+		}
+		errc <- err
+	}()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-time.After(timeout):
+		err = errors.Errorf("timed out after %s", timeout)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if c.alive {
+			glog.Warningf("proxy %s is down: %s\n", c.chain.Nodes(), err)
+		}
+		c.alive = false
+		return
+	}
+	if !c.alive {
+		glog.Infof("proxy %s is up\n", c.chain.Nodes())
+	}
+	c.alive = true
+	c.latency = time.Since(start)
+}
+
+func (c *pooledProxyChain) isAlive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.alive
+}
+
+func (c *pooledProxyChain) getLatency() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latency
+}
@@ -0,0 +1,93 @@
+package dnsproxy
+
+import (
+	"io"
+	"net"
+	"runtime"
+)
+
+// conns wrapping another one, such as those of ProxyTimeouts and ProxyLimiter,
+// whose traffic can be relayed on the wrapped conn directly as long as it is accounted by relayed
+type relayWrapper interface {
+	// the wrapped conn to be read from if `read`, otherwise to be written to,
+	// nil while it can not be bypassed yet, e.g. some data read from it is held by the wrapper
+	relayInner(read bool) net.Conn
+	// account `n` bytes relayed on the wrapped conn, read from it if `read`, otherwise written to it
+	relayed(n int, read bool)
+}
+
+// bytes relayed between two accountings of the relayWrappers, when tcp conns are relayed bypassing them
+const _RELAY_CHUNK_SIZE = 64 * 1024
+
+// copy `src` to `dst` through a buffer of `bufs` until either is done,
+// on linux tcp conns under relayWrappers are relayed by (*net.TCPConn).ReadFrom, which splices them in the kernel
+// without copying into userspace, elsewhere it would copy through a new buffer on every call
+func relayCopy(dst, src net.Conn, bufs *RelayBuffers) {
+	var buf *[]byte
+	defer func() {
+		if buf != nil {
+			bufs.put(buf)
+		}
+	}()
+	for runtime.GOOS == "linux" {
+		tdst, dws, dpending := unwrapRelayConn(dst, false)
+		tsrc, sws, spending := unwrapRelayConn(src, true)
+		if !dpending && !spending {
+			if tdst == nil || tsrc == nil {
+				break
+			}
+			// in chunks, so that the wrappers account the traffic as it goes, e.g. rate limits of ProxyLimiter
+			for {
+				n, err := tdst.ReadFrom(&io.LimitedReader{R: tsrc, N: _RELAY_CHUNK_SIZE})
+				if n > 0 {
+					for _, w := range sws {
+						w.relayed(int(n), true)
+					}
+					for _, w := range dws {
+						w.relayed(int(n), false)
+					}
+				}
+				if err != nil || n == 0 {
+					return
+				}
+			}
+		}
+		// drain the data held by the wrappers through them, e.g. the sniffed head of the client conn
+		if buf == nil {
+			buf = bufs.get()
+		}
+		n, err := src.Read(*buf)
+		if n > 0 {
+			if _, werr := dst.Write((*buf)[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	if buf == nil {
+		buf = bufs.get()
+	}
+	io.CopyBuffer(dst, src, *buf)
+}
+
+// the *net.TCPConn under the relayWrappers of `c` to be read from if `read`, otherwise to be written to,
+// and the wrappers from the outermost, nil if there is none, `pending` if any wrapper can not be bypassed yet
+func unwrapRelayConn(c net.Conn, read bool) (tc *net.TCPConn, ws []relayWrapper, pending bool) {
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v, ws, false
+		case relayWrapper:
+			inner := v.relayInner(read)
+			if inner == nil {
+				return nil, nil, true
+			}
+			ws = append(ws, v)
+			c = inner
+		default:
+			return nil, nil, false
+		}
+	}
+}
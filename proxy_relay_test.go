@@ -0,0 +1,97 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+)
+
+// relayWrapper of tests counting the bytes it accounts
+type countingConn struct {
+	net.Conn
+	mu          sync.Mutex
+	read, wrote int
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.relayed(n, true)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.relayed(n, false)
+	return n, err
+}
+
+func (c *countingConn) relayInner(read bool) net.Conn { return c.Conn }
+
+func (c *countingConn) relayed(n int, read bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if read {
+		c.read += n
+	} else {
+		c.wrote += n
+	}
+}
+
+// both ends of a tcp conn on loopback
+func testTCPPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := <-accepted
+	if a == nil {
+		t.Fatal("accept failed")
+	}
+	return c.(*net.TCPConn), a.(*net.TCPConn)
+}
+
+func TestRelayCopy(t *testing.T) {
+	data := make([]byte, 5*_RELAY_CHUNK_SIZE+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	client, srcEnd := testTCPPair(t)
+	defer client.Close()
+	dstEnd, target := testTCPPair(t)
+	defer target.Close()
+	src, dst := &countingConn{Conn: srcEnd}, &countingConn{Conn: dstEnd}
+
+	go func() {
+		client.Write(data)
+		client.CloseWrite()
+	}()
+	done := make(chan struct{})
+	go func() {
+		relayCopy(dst, src, NewRelayBuffers(0))
+		dstEnd.CloseWrite()
+		close(done)
+	}()
+	got, err := ioutil.ReadAll(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if !bytes.Equal(got, data) {
+		t.Fatalf("relayed %d bytes, which differ from the %d sent", len(got), len(data))
+	}
+	if src.read != len(data) || dst.wrote != len(data) {
+		t.Errorf("accounted %d bytes read and %d written, want %d", src.read, dst.wrote, len(data))
+	}
+}
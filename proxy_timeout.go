@@ -0,0 +1,154 @@
+package dnsproxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// reaping of dead connections of ServeProxy and ServeShadowsocks, whose relays would otherwise block forever:
+//   - connections without traffic in either direction for `idle` are closed
+//   - connections are closed `lifetime` after accepted regardless of traffic
+//
+// zero durations disable the limits, all methods are safe for concurrent use
+type ProxyTimeouts struct {
+	// 64-bit atomic counters come first to be aligned on 32-bit platforms
+	idleReaped     uint64
+	lifetimeReaped uint64
+
+	idle, lifetime time.Duration
+}
+
+// --- impl *ProxyTimeouts
+func NewProxyTimeouts(idle, lifetime time.Duration) *ProxyTimeouts {
+	return &ProxyTimeouts{idle: idle, lifetime: lifetime}
+}
+
+// connections closed by the timeouts
+type ProxyTimeoutStats struct {
+	IdleReaped     uint64 `json:"idle_reaped"`
+	LifetimeReaped uint64 `json:"lifetime_reaped"`
+}
+
+func (t *ProxyTimeouts) Stats() ProxyTimeoutStats {
+	return ProxyTimeoutStats{
+		IdleReaped:     atomic.LoadUint64(&t.idleReaped),
+		LifetimeReaped: atomic.LoadUint64(&t.lifetimeReaped),
+	}
+}
+
+// close the client connection `conn` when it is idle or too old, until the returned conn is closed,
+// all traffic of the connection must go through the returned conn, or be recorded by touchConn
+func (t *ProxyTimeouts) watch(conn net.Conn) net.Conn {
+	if t == nil || (t.idle <= 0 && t.lifetime <= 0) {
+		return conn
+	}
+	c := &watchedConn{Conn: conn, t: t, lastActive: time.Now().UnixNano()}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.idle > 0 {
+		c.idleTimer = time.AfterFunc(t.idle, c.checkIdle)
+	}
+	if t.lifetime > 0 {
+		c.lifetimeTimer = time.AfterFunc(t.lifetime, func() {
+			c.reap(&t.lifetimeReaped, "lived for "+t.lifetime.String())
+		})
+	}
+	return c
+}
+
+// client connection watched by a *ProxyTimeouts
+type watchedConn struct {
+	lastActive int64 // unix nano of the last traffic, accessed atomically
+	net.Conn
+	t *ProxyTimeouts
+
+	mu            sync.Mutex
+	idleTimer     *time.Timer
+	lifetimeTimer *time.Timer
+	closed        bool
+}
+
+// --- impl *watchedConn
+
+func (c *watchedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *watchedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *watchedConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// reap the connection if it has been idle for c.t.idle, otherwise check again when it would be
+func (c *watchedConn) checkIdle() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+	if idle < c.t.idle {
+		c.mu.Lock()
+		if !c.closed {
+			c.idleTimer.Reset(c.t.idle - idle)
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.reap(&c.t.idleReaped, "idle for "+idle.Round(time.Second).String())
+}
+
+// close the connection and count it in `counter` unless it is closed already
+func (c *watchedConn) reap(counter *uint64, reason string) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+	atomic.AddUint64(counter, 1)
+	glog.V(1).Infof("proxy %s closed: %s\n", c.RemoteAddr(), reason)
+	c.Close()
+}
+
+func (c *watchedConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		if c.lifetimeTimer != nil {
+			c.lifetimeTimer.Stop()
+		}
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// --- impl relayWrapper for *watchedConn
+
+func (c *watchedConn) relayInner(read bool) net.Conn {
+	return c.Conn
+}
+
+func (c *watchedConn) relayed(n int, read bool) {
+	c.touch()
+}
+
+// record traffic of the watched `conn` which does not go through it, e.g. udp datagrams of a socks5 association
+func touchConn(conn net.Conn) {
+	if c, ok := conn.(*watchedConn); ok {
+		c.touch()
+	}
+}
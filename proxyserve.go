@@ -3,9 +3,16 @@ package dnsproxy
 import (
 	"bufio"
 	"bytes"
+	"context"
+	stderrors "errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ARwMq9b6/libgost"
@@ -15,203 +22,508 @@ import (
 	"github.com/pkg/errors"
 )
 
-func ServeProxy(laddr string, proxy, direct *gost.ProxyChain) error {
-	if ok := _DEFAULT_GLOBALS_VALIDATOR.validate(); !ok {
-		return errors.New("global vars are uninitialized")
+// pauses of the accept loops of ServeProxy after temporary errors such as running out of file descriptors,
+// doubled from the min one on each consecutive error
+const (
+	_PROXY_ACCEPT_MIN_DELAY = 5 * time.Millisecond
+	_PROXY_ACCEPT_MAX_DELAY = time.Second
+)
+
+// defaults of SetProxyDialOptions, the same as libgost
+const (
+	PROXY_DIAL_TIMEOUT = 30 * time.Second
+	PROXY_KEEPALIVE    = 180 * time.Second
+)
+
+// timeout of dialing destinations and proxy nodes, and the TCP keepalive period of client conns of ServeProxy
+// and ServeShadowsocks and of conns to destinations and proxy nodes, zero to keep the current one,
+// they are globals of libgost shared by all servers, must be called before serving
+func SetProxyDialOptions(timeout, keepAlive time.Duration) {
+	if timeout > 0 {
+		gost.DialTimeout = timeout
+	}
+	if keepAlive > 0 {
+		gost.KeepAliveTime = keepAlive
+	}
+}
+
+// enable TCP keepalive of `c` by the period of SetProxyDialOptions, so that peers gone without closing are detected,
+// nothing is done if `c` is not a tcp conn, e.g. dialed through proxy nodes which set it by themselves
+func setProxyKeepAlive(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(gost.KeepAliveTime)
+	}
+}
+
+// serve the http, socks5 and socks4(a) proxy on every address of `laddrs`, such as "127.0.0.1:1080" and "[::1]:1080",
+// all addresses are bound before serving and nothing is served if any of them fails
+func (s *Server) ServeProxy(laddrs []string, proxy, direct *gost.ProxyChain) error {
+	return s.ServeProxyPool(laddrs, NewProxyPool([]*gost.ProxyChain{proxy}, PROXY_POOL_FAILOVER), direct)
+}
+
+// like ServeProxy, but each proxied connection goes through a chain picked from `pool`,
+// run pool.Probe concurrently to skip dead chains
+func (s *Server) ServeProxyPool(laddrs []string, pool *ProxyPool, direct *gost.ProxyChain) error {
+	if len(laddrs) == 0 {
+		return classified(ErrInvalidConfig, errors.New("no proxy listen address"))
 	}
-	return serveProxy(laddr, proxy, direct)
+	n := s.proxyListeners
+	if n < 1 {
+		n = 1
+	}
+	listeners := make([]net.Listener, 0, n*len(laddrs))
+	for _, laddr := range laddrs {
+		for i := 0; i < n; i++ {
+			l, err := listenTCP(laddr, n > 1, s.proxyFastOpen)
+			if err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return err
+			}
+			listeners = append(listeners, l)
+		}
+	}
+	return s.ServeProxyPoolListeners(listeners, pool, direct)
 }
 
-func serveProxy(laddr string, proxy, direct *gost.ProxyChain) error {
-	serverProxy := gost.NewProxyServer(gost.ProxyNode{}, proxy, nil)
+// like ServeProxyPool, but serve on `listeners` which are opened already, e.g. passed by systemd socket activation,
+// SetProxyListenOptions takes no effect, all listeners are closed on return,
+// which is nil once any of them is closed by others
+func (s *Server) ServeProxyPoolListeners(listeners []net.Listener, pool *ProxyPool, direct *gost.ProxyChain) error {
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if err := pool.validate(); err != nil {
+		return err
+	}
+	for name, pool := range s.outbounds {
+		if err := pool.validate(); err != nil {
+			return errors.WithMessage(err, "outbound "+name)
+		}
+	}
+	if len(listeners) == 0 {
+		return classified(ErrInvalidConfig, errors.New("no proxy listener"))
+	}
 	serverDirect := gost.NewProxyServer(gost.ProxyNode{}, direct, nil)
-	servers := map[transport]*gost.ProxyServer{
-		_TRANS_PROXY:  serverProxy,
-		_TRANS_DIRECT: serverDirect,
+	var selector gosocks5.Selector = serverDirect.Selector
+	if s.proxyACL != nil && len(s.proxyACL.users) > 0 {
+		selector = s.proxyACL.socks5Selector(direct)
 	}
 
-	l, err := net.Listen("tcp", laddr)
-	if err != nil {
-		return errors.WithStack(err)
+	// one accept loop for each listener, the first failed or closed one stops serving
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errc <- s.acceptProxyConns(l, pool, serverDirect, selector)
+		}(l)
 	}
+	return <-errc
+}
+
+func (s *Server) acceptProxyConns(l net.Listener, pool *ProxyPool, serverDirect *gost.ProxyServer, selector gosocks5.Selector) error {
+	return acceptConns(l, "proxy", func(conn net.Conn) {
+		if err := s.handleProxyConn(conn, pool, serverDirect, selector); err != nil {
+			logServeError(err, glog.Errorf)
+		}
+	})
+}
+
+// accept connections from `l` and handle each of them by `handle` in its own goroutine, returns nil once `l` is closed,
+// temporary errors pause the loop with exponential backoff,
+// a panic of `handle` is logged with its stack and closes its connection only, the process goes on serving
+func acceptConns(l net.Listener, name string, handle func(net.Conn)) error {
+	var delay time.Duration
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			glog.Error(err)
+			if stderrors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			// e.g. too many open files, wait for some connections to be closed
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay *= 2; delay < _PROXY_ACCEPT_MIN_DELAY {
+					delay = _PROXY_ACCEPT_MIN_DELAY
+				} else if delay > _PROXY_ACCEPT_MAX_DELAY {
+					delay = _PROXY_ACCEPT_MAX_DELAY
+				}
+				glog.Errorf("%s accept: %s, retrying in %s\n", name, err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return errors.WithStack(err)
 		}
+		delay = 0
+		setProxyKeepAlive(conn)
 		go func(conn net.Conn) {
-			if err := handleProxyConn(conn, serverProxy, serverDirect, servers); err != nil {
-				var st errors.StackTrace
-				type stackTracer interface {
-					StackTrace() errors.StackTrace
-				}
-				if e, ok := err.(stackTracer); ok {
-					st = e.StackTrace()
+			defer func() {
+				if r := recover(); r != nil {
+					conn.Close()
+					glog.Errorf("%s %s panic: %v\n%s", name, conn.RemoteAddr(), r, debug.Stack())
 				}
-				glog.Errorf("%s%+v\n", err, st)
-			}
+			}()
+			handle(conn)
 		}(conn)
 	}
 }
 
-func handleProxyConn(conn net.Conn, serverProxy, serverDirect *gost.ProxyServer, servers map[transport]*gost.ProxyServer) error {
+// `selector` negotiates socks5 authentication methods
+func (s *Server) handleProxyConn(conn net.Conn, pool *ProxyPool, serverDirect *gost.ProxyServer,
+	selector gosocks5.Selector) error {
+	client := addrIP(conn.RemoteAddr())
+	if s.proxyACL != nil && !s.proxyACL.allowClient(client) {
+		conn.Close()
+		glog.Warningf("proxy %s rejected: client is not allowed\n", conn.RemoteAddr())
+		return nil
+	}
+	// connections over the cap are closed after replying a failure in the protocol of their requests
+	conn, admitted := s.proxyLimiter.admit(conn)
+	conn = s.proxyTimeouts.watch(conn)
 	defer conn.Close()
-
-	b := make([]byte, gost.MediumBufferSize)
-
-	n, err := io.ReadAtLeast(conn, b, 2)
-	if err != nil && err != io.EOF {
-		return errors.WithStack(err)
+	watched := conn
+
+	buf := s.relayBuffers.get()
+	n, err := io.ReadAtLeast(conn, *buf, 2)
+	// copied out so that the buffer is returned right away instead of being held until the head is read through
+	b := append([]byte(nil), (*buf)[:n]...)
+	s.relayBuffers.put(buf)
+	if err == io.EOF {
+		// closed without sending anything
+		return nil
+	}
+	if err != nil {
+		return classified(ErrBadClientRequest, errors.WithStack(err))
 	}
 
 	var reqer requester
 	conn = newConnLeftAppendReader(conn, bytes.NewReader(b[:n]))
 	if b[0] == gosocks5.Ver5 {
-		conn = gosocks5.ServerConn(conn, serverProxy.Selector)
+		sel := &socks5ConnSelector{Selector: selector, conn: conn}
+		conn = gosocks5.ServerConn(conn, sel)
 		req, err := gosocks5.ReadRequest(conn)
+		if err == gosocks5.ErrAuthFailure || err == gosocks5.ErrBadMethod {
+			glog.Warningf("proxy %s rejected: socks5 authentication failed\n", conn.RemoteAddr())
+			return nil
+		}
 		if err != nil {
-			return errors.WithStack(err)
+			return classified(ErrBadClientRequest, errors.WithStack(err))
+		}
+		// the negotiated conn passed through by gosocks5 from now on, bypassed so that relays can be spliced
+		conn = sel.conn
+		if req.Cmd == gosocks5.CmdUdp && admitted {
+			// datagrams are proxied through the default proxy chains only
+			return s.handleSocks5UDPAssociate(conn, pool.pick().udpUpstream, func() { touchConn(watched) })
+		}
+		reqer = newSocks5Request(req, conn, s.preserveHost)
+	} else if b[0] == _SOCKS4_VERSION {
+		req, err := readSocks4Request(conn)
+		if err != nil {
+			return classified(ErrBadClientRequest, err)
+		}
+		if s.proxyACL != nil && len(s.proxyACL.users) > 0 {
+			glog.Warningf("proxy %s rejected: socks4 can not authenticate\n", conn.RemoteAddr())
+			writeSocks4Reply(conn, _SOCKS4_REJECTED, nil)
+			return nil
 		}
-		reqer = newSocks5Request(req, conn)
+		if !req.isConnect() {
+			glog.Warningf("proxy %s rejected: unsupported socks4 command %d\n", conn.RemoteAddr(), req.cmd)
+			writeSocks4Reply(conn, _SOCKS4_REJECTED, nil)
+			return nil
+		}
+		reqer = req
 	} else {
-		req, err := http.ReadRequest(bufio.NewReader(conn))
+		// net/http drops the Host header of requests in absolute form, keep the raw head to find it
+		head := &prefixRecorder{max: gost.MediumBufferSize}
+		req, err := http.ReadRequest(bufio.NewReader(io.TeeReader(conn, head)))
 		if err != nil {
-			return errors.WithStack(err)
+			return classified(ErrBadClientRequest, errors.WithStack(err))
+		}
+		if s.proxyACL != nil {
+			if reason, ok := s.proxyACL.authenticateHTTP(req); !ok {
+				glog.Warningf("proxy %s rejected: %s\n", conn.RemoteAddr(), reason)
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+					"Proxy-Authenticate: Basic realm=\"dnsproxy\"\r\n\r\n"))
+				return nil
+			}
 		}
-		reqer = newHTTPRequest(req, conn)
+		reqer = newHTTPRequest(req, conn, rawHostHeader(head.b))
 	}
+	if !admitted {
+		glog.Warningf("proxy %s rejected: too many connections\n", conn.RemoteAddr())
+		replyRefused(reqer, http.StatusServiceUnavailable, gosocks5.Failure)
+		return nil
+	}
+	return s.handleProxyRequest(client, reqer, pool, serverDirect)
+}
 
+// route the destination of `reqer` from `client`, then connect it directly or through a proxy chain
+func (s *Server) handleProxyRequest(client net.IP, reqer requester, pool *ProxyPool, serverDirect *gost.ProxyServer) error {
 	// switch req.Addr.Type:
 	// case AddrIPv4, typ == AddrIPv6:
 	//	-> 去 DNS 缓存里找是直连还是代理
 	//		—> 找到
 	//			-> 根据得到的策略执行直连或代理
 	//		-> 未找到
-	// 			-> 中国 IP 直连，外国 IP 代理
+	// 			-> 交给 routing policy 决定
 	// case AddrDomain:
 	//	-> 尝试在缓存中找域名信息
 	//		-> 找到 -> 根据策略进行直连或代理
 	//		-> 未找到
-	//			 -> 判断域名是否在 gfw list 中
-	//			 	-> 是
-	//					-> 直接代理（不 DNS 解析）
-	//				-> 否
-	//					-> 检查域名是否在 china ip list 中
-	//						-> 是 -> 使用 china dns sever 解析 -> 直连
-	//						-> 否
-	//							-> 使用 edns0 china + abroad dns server 解析
-	//								-> 成功
-	//									-> 判断是否返回中国 IP
-	//										-> 是
-	//		 									-> 使用 china dns sever 解析 -> 直连
-	//										-> 否 -> 直接代理（不 DNS 解析）
-	//								-> 失败
-	//									—> 使用 china dns server 解析
-	//										-> 判断是否返回中国 IP
-	//											-> 是 -> 直连
-	//											-> 否 -> 直接代理（不 DNS 解析）
-	ps, err := func() (*gost.ProxyServer, error) {
-		switch reqer.getAddrType() {
-		case AddrIPv4, AddrIPv6:
-			host := reqer.getHostName()
-			trans, ok := _DEFAULT_IPCACHE.Get(host)
-			if !ok {
-				ip := net.ParseIP(host)
-
-				if ip.To4() != nil && _IP_MATCH_CHINESE_MAINLAND(ip) {
-					trans = _TRANS_DIRECT
-				} else {
-					trans = _TRANS_PROXY
-				}
-				_DEFAULT_IPCACHE.Add(host, trans)
-			}
-			return servers[trans], nil
-		case AddrDomain:
-			domain := reqer.getHostName()
-			// try to get domain info from cache
-			if item, ok := _DEFAULT_DOMAINCACHE.Get(domain); ok {
-				if item.trans == _TRANS_DIRECT {
-					switch v := item.ans.(type) {
-					case *dns.A:
-						reqer.setRedirect(v.A)
-					case *dns.AAAA:
-						reqer.setRedirect(v.AAAA)
-					default:
-						return nil, errors.New("unreachable!")
-					}
-				}
-				return servers[item.trans], nil
-			}
-			matchGfw := _DEFAULT_DOMAIN_MATCHER.MatchGFW(domain)
-			matchObedient := _DEFAULT_DOMAIN_MATCHER.MatchObedient(domain)
-			switch {
-			case matchGfw:
-				return serverProxy, nil
-			case matchObedient:
-				resp, err := _DNSSTRANSPORT_OBEDIENT.legallySpawnQuery(domain, dns.TypeA)
-				if ans, ip := MsgExtractAnswer(resp); err == nil && ans != nil {
-					reqer.setRedirect(ip)
-
-					_DEFAULT_IPCACHE.Add(ip.String(), _TRANS_DIRECT)
-					_DEFAULT_DOMAINCACHE.Add(domain, ans, _TRANS_DIRECT)
-				}
-				return serverDirect, nil
-			default:
-				// abroad query with local ip
-				resp, err := _DNSSTRANSPORT_ABROAD.legallySpawnQuery(domain, dns.TypeA, _DNS_SUBNET_LOCAL_IP)
-				if ans, ip := MsgExtractAnswer(resp); err == nil && ans != nil {
-					// succeeded to abroad query with local ip
-					var trans transport
-					if ip.To4() != nil && _IP_MATCH_CHINESE_MAINLAND(ip) {
-						// is Chinese mainland ipv4
-						trans = _TRANS_DIRECT
-						// try to query obedient dns server to improve `a` quality
-						resp, err = _DNSSTRANSPORT_OBEDIENT.legallySpawnQuery(domain, dns.TypeA)
-						if _ans, _ip := MsgExtractAnswer(resp); err == nil && _ans != nil {
-							ans = _ans
-							ip = _ip
-						}
-						reqer.setRedirect(ip)
-					} else { // ipv6 or abroad ipv4
-						trans = _TRANS_PROXY
-						// do not change the host name or addr type
-					}
-					_DEFAULT_DOMAINCACHE.Add(domain, ans, trans)
-					_DEFAULT_IPCACHE.Add(ip.String(), trans)
-					return servers[trans], nil
-				} else { // failed to abroad query with local ip
-					// try to query with obedient dns server
-					resp, err = _DNSSTRANSPORT_OBEDIENT.legallySpawnQuery(domain, dns.TypeA)
-					if ans, ip := MsgExtractAnswer(resp); err == nil && ans != nil {
-						var trans transport
-						if ip.To4() != nil && _IP_MATCH_CHINESE_MAINLAND(ip) {
-							trans = _TRANS_DIRECT
-
-							reqer.setRedirect(ip)
-						} else { // ipv6 or abroad ipv4
-							trans = _TRANS_PROXY
-						}
-						_DEFAULT_IPCACHE.Add(ip.String(), trans)
-						_DEFAULT_DOMAINCACHE.Add(domain, ans, trans)
-
-						return servers[trans], nil
-					} else {
-						// all queries failed
-						return serverProxy, nil
-					}
-				}
-			}
+	//			-> 交给 routing policy 决定，代理的域名不必解析，直连的域名重定向到解析出的 IP
+	//				-> 失败 -> 代理
+	// application protocol for "protocol:" patterns of rules
+	protocol := reqer.getProtocol()
+	rp, _ := s.policy.(*RulePolicy)
+	// the real destination of a CONNECT to an ip may be told by the TLS ClientHello
+	var err error
+	if s.sniffSNI && reqer.isConnect() && reqer.getAddrType() != AddrDomain {
+		if protocol, err = s.sniffServerName(reqer); err != nil {
+			return err
 		}
-		return nil, nil
-	}()
+	} else if rp != nil && rp.needsProtocol() && reqer.isConnect() {
+		if protocol, err = s.sniffConnProtocol(reqer); err != nil {
+			return err
+		}
+	}
+	host := reqer.getHostName()
+	routeType, routeHost := reqer.getAddrType(), host
+	// plain http requests to an ip are routed by the domain of their Host header, but still connect the ip
+	domain := reqer.getHostHeaderDomain()
+	if routeType != AddrDomain && domain != "" {
+		routeType, routeHost = AddrDomain, domain
+	}
+	// unknown domains are dialed through the proxy chains while being routed, see SetSpeculativeProxy
+	var spec *speculativeDial
+	if s.speculativeProxy && reqer.isConnect() && routeType == AddrDomain && s.worthSpeculating(client, host) {
+		spec = startSpeculativeDial(pool.pick().server, s.proxyBind, host, reqer.getPort())
+	}
+	port, _ := strconv.ParseUint(reqer.getPort(), 10, 16)
+	trans, outbound, redirect, err := s.routeConnection(client, routeType, routeHost, uint16(port), "tcp", protocol)
 	if err != nil {
+		if spec != nil {
+			spec.discard()
+		}
 		return err
 	}
+	if s.hooks != nil {
+		d := &ProxyDecision{Client: client, Host: host, Port: reqer.getPort(), Protocol: protocol, Trans: trans, Outbound: outbound}
+		if routeHost != host {
+			d.Routed = routeHost
+		}
+		s.hooks.proxyDecided(d)
+	}
+	if trans == TRANS_REJECT {
+		if spec != nil {
+			spec.discard()
+		}
+		glog.V(1).Infof("proxy %s %s -> %s\n", client, routeHost, trans)
+		replyRefused(reqer, http.StatusForbidden, gosocks5.NotAllowed)
+		return nil
+	}
+	if routeHost != host {
+		redirect = nil
+		glog.V(1).Infof("proxy %s %s (Host: %s) -> %s %s\n", client, host, routeHost, trans, outbound)
+	} else {
+		glog.V(1).Infof("proxy %s %s -> %s %s\n", client, host, trans, outbound)
+	}
+	if len(redirect) > 0 {
+		reqer.setRedirect(redirect[0])
+	}
+	dialHost := host
+	if len(redirect) > 0 {
+		dialHost = redirect[0].String()
+	}
+	var ps *gost.ProxyServer
+	var dial func(port string) (net.Conn, error)
+	bind := s.proxyBind
+	if trans == TRANS_DIRECT {
+		ps, bind = serverDirect, s.directBind
+		candidates := redirect
+		if len(candidates) == 0 {
+			if ip := net.ParseIP(host); ip != nil {
+				candidates = []net.IP{ip}
+			}
+		}
+		if s.happyEyeballs != nil && s.happyEyeballs.worth(candidates) {
+			dial = s.happyEyeballs.newRacingDialer(s, host, candidates, serverDirect.Chain, pool.pick().server.Chain).Dial
+		}
+		if s.fallback != nil && s.fallback.worth(candidates) && !s.inLocalZones(host) && !s.pinnedByOverride(host) {
+			dial = s.fallback.newFallbackDialer(s, client, host, candidates, dial, serverDirect.Chain, pool.pick().server.Chain).Dial
+		}
+	} else if _, named := s.outbounds[outbound]; spec != nil && !named {
+		ps, dial, spec = spec.server, spec.Dial, nil
+	} else {
+		if p, ok := s.outbounds[outbound]; ok {
+			pool = p
+		}
+		ps = pool.pick().server
+	}
+	if spec != nil {
+		spec.discard()
+	}
 	reqer.setProxyServer(ps)
-	reqer.exec()
+	// plain http requests are relayed by gost, unless the connections should be bound, see SetOutboundBinds
+	if dial == nil && (reqer.isConnect() || bind != nil && reqer.getProtocol() == "http") {
+		// relayed by ourselves instead of gost, through pooled buffers or spliced, see relayConns
+		chain := ps.Chain
+		dial = func(port string) (net.Conn, error) {
+			c, err := bind.DialChain(chain, net.JoinHostPort(dialHost, port))
+			if err == nil {
+				setProxyKeepAlive(c)
+			}
+			return c, err
+		}
+	}
+	if s.latency != nil {
+		key := strings.TrimSpace("connect " + trans.String() + " " + outbound)
+		dial = s.timedDialer(key, ps.Chain, bind, dialHost, dial)
+	}
+	if trans == TRANS_PROXY && s.hooks.wantsUpstreamErrors() {
+		dial = s.hookedDialer(outbound, ps.Chain, bind, dialHost, dial)
+	}
+	if dial != nil {
+		reqer.setDialer(dial)
+	}
+	if s.events != nil {
+		c := ProxyConn{Client: client.String(), Host: host, Port: reqer.getPort(), Protocol: protocol, Trans: trans, Outbound: outbound}
+		if routeHost != host {
+			c.Routed = routeHost
+		}
+		id := s.events.openProxyConn(c)
+		defer s.events.closeProxyConn(id)
+	}
+	reqer.exec(s.relayBuffers)
 	return nil
 }
 
+// decide how to connect `port` of `host` over `network` for `client` as routeDestination,
+// but connection scoped rules take precedence over cached decisions of `host`, see RulePolicy.RouteConnection,
+// except for domains of the override zone and local zones
+func (s *Server) routeConnection(client net.IP, addrType uint8, host string, port uint16, network, protocol string) (trans Transport, outbound string, redirect []net.IP, err error) {
+	rp, ok := s.policy.(*RulePolicy)
+	if !ok || !rp.hasConnectionRules() {
+		return s.routeDestination(client, addrType, host)
+	}
+	rq := &RouteQuery{Client: client, Port: port, Network: network, Protocol: protocol}
+	switch addrType {
+	case AddrIPv4, AddrIPv6:
+		if rq.IP = net.ParseIP(host); rq.IP == nil {
+			return 0, "", nil, classified(ErrBadClientRequest, errors.Errorf("invalid ip address %q", host))
+		}
+		if s.dns64 != nil {
+			if ip4 := s.dns64.Extract(rq.IP); ip4 != nil {
+				rq.IP = ip4
+			}
+		}
+	case AddrDomain:
+		if s.inLocalZones(host) {
+			return s.routeDestination(client, addrType, host)
+		}
+		if s.override != nil {
+			if ips, blocked := s.override.lookupHost(host); blocked || len(ips) > 0 {
+				return s.routeDestination(client, addrType, host)
+			}
+		}
+		rq.Req = new(dns.Msg)
+		rq.Req.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	default:
+		return s.routeDestination(client, addrType, host)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout())
+	defer cancel()
+	rq.Ctx = ctx
+	d, ok, err := rp.RouteConnection(rq)
+	if !ok {
+		return s.routeDestination(client, addrType, host)
+	}
+	if err != nil {
+		return 0, "", nil, err
+	}
+	s.events.publishRoute(rq, d)
+	if d.Trans == TRANS_DIRECT && d.Resp != nil {
+		redirect = RRsIPs(d.Resp.Answer)
+	}
+	return d.Trans, d.Outbound, redirect, nil
+}
+
+// decide how to connect `host` for `client`, `outbound` is the named proxy chain of TRANS_PROXY,
+// `redirect` are the ips to connect instead of the domain `host` if not empty, the first one is preferred
+func (s *Server) routeDestination(client net.IP, addrType uint8, host string) (trans Transport, outbound string, redirect []net.IP, err error) {
+	scope := s.clientScope(client)
+	switch addrType {
+	case AddrIPv4, AddrIPv6:
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return 0, "", nil, classified(ErrBadClientRequest, errors.Errorf("invalid ip address %q", host))
+		}
+		// synthesized addresses of DNS64 are routed as the ipv4 addresses they embed
+		if s.dns64 != nil {
+			if ip4 := s.dns64.Extract(ip); ip4 != nil {
+				ip = ip4
+			}
+		}
+		// the same form as cached ips from dns answers, e.g. "2001:db8::1" rather than "2001:0db8:0:0::1"
+		host = ip.String()
+		trans, outbound, ok := s.ipcache.Get(scope, host)
+		if !ok {
+			rq := &RouteQuery{IP: ip, Client: client}
+			d, err := s.policy.Route(rq)
+			if err != nil {
+				return 0, "", nil, err
+			}
+			s.events.publishRoute(rq, d)
+			trans, outbound = d.Trans, d.Outbound
+			if d.Cacheable {
+				s.ipcache.AddLongLived(scope, host, trans, outbound)
+			}
+		}
+		return trans, outbound, nil, nil
+	case AddrDomain:
+		domain := host
+		// pinned domains of the override zone are always connected directly to their ips
+		if s.override != nil {
+			if ips, blocked := s.override.lookupHost(domain); blocked {
+				return 0, "", nil, classified(ErrRejected, errors.Errorf("%s is blocked by the override zone", domain))
+			} else if len(ips) > 0 {
+				return TRANS_DIRECT, "", ips, nil
+			}
+		}
+		// names of local zones are always connected directly
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+		if resp, ok := s.lookupLocalZones(req); ok {
+			return TRANS_DIRECT, "", RRsIPs(resp.Answer), nil
+		}
+		// try to get domain info from cache
+		if item, ok := s.domaincache.Get(scope, domain, dns.TypeA); ok {
+			if item.trans == TRANS_DIRECT {
+				return item.trans, "", RRsIPs(item.answers), nil
+			}
+			return item.trans, item.outbound, nil, nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout())
+		d, err := s.routeCoalesced(ctx, scope, &RouteQuery{Req: req, Client: client, Ctx: ctx}, func(d *RouteDecision) {
+			s.cacheDecision(scope, domain, dns.TypeA, d)
+		})
+		cancel()
+		if err != nil {
+			// all queries failed
+			return TRANS_PROXY, "", nil, nil
+		}
+		if d.Trans == TRANS_DIRECT && d.Resp != nil {
+			return d.Trans, "", RRsIPs(d.Resp.Answer), nil
+		}
+		return d.Trans, d.Outbound, nil, nil
+	}
+	return 0, "", nil, classified(ErrBadClientRequest, errors.Errorf("unsupported address type %d of %s", addrType, host))
+}
+
 const (
 	AddrIPv4   uint8 = gosocks5.AddrIPv4
 	AddrDomain       = gosocks5.AddrDomain
@@ -221,34 +533,62 @@ const (
 type requester interface {
 	getHostName() string
 	getAddrType() uint8
+	getPort() string
 
 	setRedirect(ip net.IP)
+	setDialer(dial func(port string) (net.Conn, error))
 	setProxyServer(*gost.ProxyServer)
 
-	exec()
+	// for sniffing, see Server.SetSNISniffing
+	isConnect() bool
+	replyEarly() (net.Conn, error) // reply success before connecting, returns the client connection
+	setConn(conn net.Conn)
+	setHostName(host string) // connect `host` instead of the requested one
+
+	getHostHeaderDomain() string // domain of the Host header of plain http requests, empty if there is none
+	getProtocol() string         // application protocol told by the request itself, see SNIFFED_PROTOCOLS
+
+	exec(bufs *RelayBuffers) // connect and relay through buffers of `bufs`
+}
+
+// AddrIPv4 or AddrIPv6
+func addrTypeOf(ip net.IP) uint8 {
+	if ip.To4() != nil {
+		return AddrIPv4
+	}
+	return AddrIPv6
 }
 
 type socks5Request struct {
 	req   *gosocks5.Request
 	conn  net.Conn
 	proxy *gost.ProxyServer
+
+	preserveHost bool                                // keep the requested host name and dial `redirect` by ourselves
+	redirect     net.IP                              // set if preserveHost
+	dial         func(port string) (net.Conn, error) // dials by ourselves instead of `redirect` if not nil
+	replied      bool                                // success has been replied before connecting
 }
 
-func newSocks5Request(req *gosocks5.Request, conn net.Conn) *socks5Request {
-	return &socks5Request{req: req, conn: conn, proxy: nil}
+func newSocks5Request(req *gosocks5.Request, conn net.Conn, preserveHost bool) *socks5Request {
+	return &socks5Request{req: req, conn: conn, proxy: nil, preserveHost: preserveHost}
 }
 
 func (r *socks5Request) setRedirect(ip net.IP) {
-	var addrType uint8
-	if ip.To4() != nil {
-		addrType = AddrIPv4
-	} else {
-		addrType = AddrIPv6
+	if r.preserveHost && r.req.Cmd == gosocks5.CmdConnect {
+		r.redirect = ip
+		return
 	}
-	r.req.Addr.Type = addrType
+	r.req.Addr.Type = addrTypeOf(ip)
 	r.req.Addr.Host = ip.String()
 }
 
+func (r *socks5Request) setDialer(dial func(port string) (net.Conn, error)) {
+	if r.req.Cmd == gosocks5.CmdConnect {
+		r.dial = dial
+	}
+}
+
 func (r *socks5Request) getHostName() string {
 	return r.req.Addr.Host
 }
@@ -257,26 +597,90 @@ func (r *socks5Request) getAddrType() uint8 {
 	return r.req.Addr.Type
 }
 
+func (r *socks5Request) getPort() string {
+	return strconv.Itoa(int(r.req.Addr.Port))
+}
+
 func (r *socks5Request) setProxyServer(ps *gost.ProxyServer) {
 	r.proxy = ps
 }
 
-func (r *socks5Request) exec() {
-	gost.NewSocks5Server(r.conn, r.proxy).HandleRequest(r.req)
+func (r *socks5Request) isConnect() bool {
+	return r.req.Cmd == gosocks5.CmdConnect
+}
+
+func (r *socks5Request) replyEarly() (net.Conn, error) {
+	r.replied = true
+	addr := &gosocks5.Addr{Type: AddrIPv4, Host: "0.0.0.0"}
+	if err := gosocks5.NewReply(gosocks5.Succeeded, addr).Write(r.conn); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return r.conn, nil
+}
+
+func (r *socks5Request) setConn(conn net.Conn) {
+	r.conn = conn
+}
+
+func (r *socks5Request) setHostName(host string) {
+	r.req.Addr.Type = AddrDomain
+	r.req.Addr.Host = host
+}
+
+func (r *socks5Request) getHostHeaderDomain() string {
+	return ""
+}
+
+func (r *socks5Request) getProtocol() string {
+	return ""
+}
+
+func (r *socks5Request) exec(bufs *RelayBuffers) {
+	if r.redirect == nil && r.dial == nil && !r.replied {
+		gost.NewSocks5Server(r.conn, r.proxy).HandleRequest(r.req)
+		return
+	}
+
+	addr, c, err := dialRedirect(r.proxy.Chain, r.redirect, r.dial, r.req.Addr.Host, r.getPort())
+	if err != nil {
+		glog.Warningf("socks5 %s -> %s (%s): %s\n", r.conn.RemoteAddr(), r.req.Addr, addr, err)
+		if !r.replied {
+			gosocks5.NewReply(gosocks5.HostUnreachable, nil).Write(r.conn)
+		}
+		return
+	}
+	defer c.Close()
+
+	if !r.replied {
+		if err := gosocks5.NewReply(gosocks5.Succeeded, gost.ToSocksAddr(c.LocalAddr())).Write(r.conn); err != nil {
+			return
+		}
+	}
+	relayConns(r.conn, c, bufs)
 }
 
 type httpRequest struct {
-	req   *http.Request
-	conn  net.Conn
-	proxy *gost.ProxyServer
+	req      *http.Request
+	conn     net.Conn
+	proxy    *gost.ProxyServer
+	redirect net.IP                              // ip to dial instead of the requested host, nil if not redirected
+	dial     func(port string) (net.Conn, error) // dials by ourselves instead of `redirect` if not nil
+	replied  bool                                // the CONNECT has been replied before connecting
+
+	hostHeader string // raw Host header, which differs from req.Host for requests in absolute form
 }
 
-func newHTTPRequest(req *http.Request, conn net.Conn) *httpRequest {
-	return &httpRequest{req: req, conn: conn, proxy: nil}
+func newHTTPRequest(req *http.Request, conn net.Conn, hostHeader string) *httpRequest {
+	return &httpRequest{req: req, conn: conn, proxy: nil, hostHeader: hostHeader}
 }
 
-func (r *httpRequest) setRedirect(_ net.IP) {
-	// TODO: make it come true
+// dial `ip` instead of the requested host, the Host header is kept intact
+func (r *httpRequest) setRedirect(ip net.IP) {
+	r.redirect = ip
+}
+
+func (r *httpRequest) setDialer(dial func(port string) (net.Conn, error)) {
+	r.dial = dial
 }
 
 func (r *httpRequest) getHostName() string {
@@ -285,20 +689,205 @@ func (r *httpRequest) getHostName() string {
 
 func (r *httpRequest) getAddrType() uint8 {
 	if ip := net.ParseIP(r.req.URL.Hostname()); ip != nil {
-		if ip.To4() != nil {
-			return AddrIPv4
-		}
-		return AddrIPv6
+		return addrTypeOf(ip)
 	}
 	return AddrDomain
 }
 
+// port of the requested host, defaults to that of the scheme
+func (r *httpRequest) getPort() string {
+	if port := r.req.URL.Port(); port != "" {
+		return port
+	}
+	if r.req.URL.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
 func (r *httpRequest) setProxyServer(ps *gost.ProxyServer) {
 	r.proxy = ps
 }
 
-func (r *httpRequest) exec() {
-	gost.NewHttpServer(r.conn, r.proxy).HandleRequest(r.req)
+func (r *httpRequest) isConnect() bool {
+	return r.req.Method == http.MethodConnect
+}
+
+func (r *httpRequest) replyEarly() (net.Conn, error) {
+	r.replied = true
+	if _, err := r.conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return r.conn, nil
+}
+
+func (r *httpRequest) setConn(conn net.Conn) {
+	r.conn = conn
+}
+
+func (r *httpRequest) setHostName(host string) {
+	r.req.URL.Host = net.JoinHostPort(host, r.req.URL.Port())
+	r.req.Host = r.req.URL.Host
+}
+
+func (r *httpRequest) getHostHeaderDomain() string {
+	if r.isConnect() || r.hostHeader == "" {
+		return ""
+	}
+	domain := (&url.URL{Host: r.hostHeader}).Hostname()
+	if net.ParseIP(domain) != nil || !strings.Contains(domain, ".") {
+		return ""
+	}
+	return normalizeDomain(domain)
+}
+
+// "http" for plain http requests, CONNECTs tell nothing
+func (r *httpRequest) getProtocol() string {
+	if r.isConnect() {
+		return ""
+	}
+	return "http"
+}
+
+func (r *httpRequest) exec(bufs *RelayBuffers) {
+	if r.redirect == nil && r.dial == nil && !r.replied {
+		gost.NewHttpServer(r.conn, r.proxy).HandleRequest(r.req)
+		return
+	}
+
+	addr, c, err := dialRedirect(r.proxy.Chain, r.redirect, r.dial, r.req.URL.Hostname(), r.getPort())
+	if err != nil {
+		glog.Warningf("http %s -> %s (%s): %s\n", r.conn.RemoteAddr(), r.req.Host, addr, err)
+		if !r.replied {
+			r.conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"))
+		}
+		return
+	}
+	defer c.Close()
+
+	if r.req.Method == http.MethodConnect {
+		if !r.replied {
+			if _, err := r.conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+				return
+			}
+		}
+	} else {
+		r.req.Header.Del("Proxy-Connection")
+		r.req.Header.Del("Proxy-Authorization")
+		// written in origin form with the original Host header
+		if err := r.req.Write(c); err != nil {
+			glog.Warningf("http %s -> %s (%s): %s\n", r.conn.RemoteAddr(), r.req.Host, addr, err)
+			return
+		}
+	}
+	relayConns(r.conn, c, bufs)
+}
+
+// connect `port` of `redirect`, or that of `host` if not redirected, through `chain`,
+// or by `dial` if it is not nil, e.g. racing all candidates of `host`, returns the dialed address for logging
+func dialRedirect(chain *gost.ProxyChain, redirect net.IP, dial func(port string) (net.Conn, error), host, port string) (string, net.Conn, error) {
+	if dial != nil {
+		c, err := dial(port)
+		return net.JoinHostPort(host, port), c, upstreamError(err)
+	}
+	if redirect != nil {
+		host = redirect.String()
+	}
+	addr := net.JoinHostPort(host, port)
+	c, err := chain.Dial(addr)
+	return addr, c, upstreamError(err)
+}
+
+// wrap `dial` to record how long connecting takes into s.latency under `key`,
+// `host` is dialed through `chain` from `bind` if `dial` is nil
+func (s *Server) timedDialer(key string, chain *gost.ProxyChain, bind *OutboundBind, host string, dial func(port string) (net.Conn, error)) func(port string) (net.Conn, error) {
+	if dial == nil {
+		dial = func(port string) (net.Conn, error) {
+			return bind.DialChain(chain, net.JoinHostPort(host, port))
+		}
+	}
+	return func(port string) (net.Conn, error) {
+		start := time.Now()
+		c, err := dial(port)
+		s.latency.observe(key, start, err)
+		return c, err
+	}
+}
+
+// copy data between `a` and `b` through buffers of `bufs` until either side is done, see relayCopy
+func relayConns(a, b net.Conn, bufs *RelayBuffers) {
+	done := make(chan struct{}, 2)
+	go func() {
+		relayCopy(a, b, bufs)
+		done <- struct{}{}
+	}()
+	go func() {
+		relayCopy(b, a, bufs)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// reply `reqer` that it is refused, by `httpStatus` for http and `socks5Rep` for socks5,
+// socks4 clients are told to be rejected and shadowsocks ones are told nothing
+func replyRefused(reqer requester, httpStatus int, socks5Rep uint8) {
+	switch r := reqer.(type) {
+	case *socks5Request:
+		gosocks5.NewReply(socks5Rep, nil).Write(r.conn)
+	case *socks4Request:
+		writeSocks4Reply(r.conn, _SOCKS4_REJECTED, nil)
+	case *httpRequest:
+		fmt.Fprintf(r.conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+			httpStatus, http.StatusText(httpStatus))
+	}
+}
+
+// value of the Host header in the raw http request head `b`, empty if there is none
+func rawHostHeader(b []byte) string {
+	lines := strings.Split(string(b), "\n")
+	// skip the request line
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			break
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 && strings.EqualFold(line[:i], "Host") {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
+
+// gosocks5.Selector keeping the conn negotiated by the wrapped one, e.g. wrapped in tls,
+// which carries the requests after the handshake
+type socks5ConnSelector struct {
+	gosocks5.Selector
+	conn net.Conn
+}
+
+// --- impl gosocks5.Selector for *socks5ConnSelector
+func (s *socks5ConnSelector) OnSelected(method uint8, conn net.Conn) (net.Conn, error) {
+	c, err := s.Selector.OnSelected(method, conn)
+	if err == nil {
+		s.conn = c
+	}
+	return c, err
+}
+
+// io.Writer keeping the first `max` bytes written
+type prefixRecorder struct {
+	b   []byte
+	max int
+}
+
+func (r *prefixRecorder) Write(p []byte) (int, error) {
+	if n := r.max - len(r.b); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		r.b = append(r.b, p[:n]...)
+	}
+	return len(p), nil
 }
 
 type connLeftAppendReader struct {
@@ -355,3 +944,14 @@ func (cc *connLeftAppendReader) SetReadDeadline(t time.Time) error {
 func (cc *connLeftAppendReader) SetWriteDeadline(t time.Time) error {
 	return cc.conn.SetWriteDeadline(t)
 }
+
+// --- impl relayWrapper for *connLeftAppendReader
+
+func (cc *connLeftAppendReader) relayInner(read bool) net.Conn {
+	if read && !cc.reof {
+		return nil
+	}
+	return cc.conn
+}
+
+func (cc *connLeftAppendReader) relayed(n int, read bool) {}
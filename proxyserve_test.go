@@ -0,0 +1,256 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ARwMq9b6/dnsproxy/dnsproxytest"
+	"github.com/ARwMq9b6/libgost"
+	"github.com/ginuerzh/gosocks5"
+)
+
+func TestRouteDestination(t *testing.T) {
+	local, abroad := dnsproxytest.NewExchanger(), dnsproxytest.NewExchanger()
+	local.AddRecords("www.cn.example. 60 IN A 10.0.0.1", "hosted.example. 60 IN A 10.0.0.3")
+	abroad.AddRecords("www.unknown.example. 60 IN A 9.9.9.9", "hosted.example. 60 IN A 10.0.0.3",
+		"slow.example. 60 IN A 10.0.0.4")
+	local.SetError("failed.example", errors.New("refused"))
+	abroad.SetError("failed.example", errors.New("refused"))
+	local.SetError("slow.example", errors.New("refused"))
+	s := newTestServer(local, abroad)
+	s.SetDNSQueryTimeout(50 * time.Millisecond)
+
+	tests := []struct {
+		addrType uint8
+		host     string
+		delay    time.Duration // of the abroad dns server
+		trans    Transport
+		redirect []string
+	}{
+		{AddrIPv4, "10.1.1.1", 0, TRANS_DIRECT, nil},
+		{AddrIPv4, "8.8.8.8", 0, TRANS_PROXY, nil},
+		{AddrDomain, "www.cn.example", 0, TRANS_DIRECT, []string{"10.0.0.1"}},
+		{AddrDomain, "www.blocked.example", 0, TRANS_PROXY, nil},
+		{AddrDomain, "www.unknown.example", 0, TRANS_PROXY, nil},
+		{AddrDomain, "hosted.example", 0, TRANS_DIRECT, []string{"10.0.0.3"}},
+		// domains whose dns servers all fail or time out are proxied
+		{AddrDomain, "failed.example", 0, TRANS_PROXY, nil},
+		{AddrDomain, "slow.example", time.Second, TRANS_PROXY, nil},
+	}
+	for _, tt := range tests {
+		abroad.SetDelay(tt.delay)
+		start := time.Now()
+		trans, _, redirect, err := s.routeDestination(net.IPv4(127, 0, 0, 1), tt.addrType, tt.host)
+		if err != nil {
+			t.Errorf("%s: %v", tt.host, err)
+			continue
+		}
+		if trans != tt.trans {
+			t.Errorf("%s: trans = %s, want %s", tt.host, trans, tt.trans)
+		}
+		var ips []string
+		for _, ip := range redirect {
+			ips = append(ips, ip.String())
+		}
+		if !equalStrings(ips, tt.redirect) {
+			t.Errorf("%s: redirect = %v, want %v", tt.host, ips, tt.redirect)
+		}
+		if took := time.Since(start); tt.delay > 0 && took >= tt.delay {
+			t.Errorf("%s: routed in %v, want the delay abandoned", tt.host, took)
+		}
+	}
+	if _, _, _, err := s.routeDestination(nil, AddrIPv4, "not an ip"); err == nil {
+		t.Errorf("invalid ip routed")
+	}
+}
+
+// tcp echo server on loopback
+func newTestEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// handle connections to the returned listener by s.handleProxyConn, proxied ones go through `proxy`
+func serveTestProxy(t *testing.T, s *Server, proxy *dnsproxytest.Socks5Server) net.Listener {
+	node, err := gost.ParseProxyNode("socks5://" + proxy.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := gost.NewProxyChain(node)
+	chain.Init()
+	pool := NewProxyPool([]*gost.ProxyChain{chain}, PROXY_POOL_FAILOVER)
+	serverDirect := gost.NewProxyServer(gost.ProxyNode{}, gost.NewProxyChain(), nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleProxyConn(conn, pool, serverDirect, serverDirect.Selector)
+		}
+	}()
+	return l
+}
+
+// socks5 CONNECT `host`:`port` through the proxy at `addr`, returns the relayed conn
+func testSocks5Connect(addr, host string, port uint16) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{gosocks5.Ver5, 1, gosocks5.MethodNoAuth}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req := gosocks5.NewRequest(gosocks5.CmdConnect, &gosocks5.Addr{Type: gosocks5.AddrDomain, Host: host, Port: port})
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := gosocks5.ReadReply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply.Rep != gosocks5.Succeeded {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 reply %d", reply.Rep)
+	}
+	return conn, nil
+}
+
+// http CONNECT `host`:`port` through the proxy at `addr`, returns the relayed conn
+func testHTTPConnect(addr, host string, port uint16) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http status %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("%d bytes after the CONNECT response", br.Buffered())
+	}
+	return conn, nil
+}
+
+func testEcho(conn net.Conn) error {
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if string(b) != "ping" {
+		return fmt.Errorf("echoed %q", b)
+	}
+	return nil
+}
+
+func TestHandleProxyConn(t *testing.T) {
+	echo := newTestEchoServer(t)
+	defer echo.Close()
+	echoPort := uint16(echo.Addr().(*net.TCPAddr).Port)
+
+	local, abroad := dnsproxytest.NewExchanger(), dnsproxytest.NewExchanger()
+	local.AddRecords("www.cn.example. 60 IN A 127.0.0.1")
+	abroad.AddRecords("www.blocked.example. 60 IN A 8.8.4.4")
+	s := newTestServer(local, abroad)
+
+	// proxied destinations are all served by the echo server
+	proxy, err := dnsproxytest.NewSocks5Server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	proxy.SetDial(func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	})
+	l := serveTestProxy(t, s, proxy)
+	defer l.Close()
+
+	tests := []struct {
+		connect func(addr, host string, port uint16) (net.Conn, error)
+		host    string
+		proxied bool
+	}{
+		{testSocks5Connect, "www.cn.example", false},
+		{testSocks5Connect, "www.blocked.example", true},
+		{testHTTPConnect, "www.cn.example", false},
+		{testHTTPConnect, "www.blocked.example", true},
+	}
+	for i, tt := range tests {
+		before := len(proxy.Targets())
+		conn, err := tt.connect(l.Addr().String(), tt.host, echoPort)
+		if err != nil {
+			t.Errorf("#%d %s: %v", i, tt.host, err)
+			continue
+		}
+		if err := testEcho(conn); err != nil {
+			t.Errorf("#%d %s: %v", i, tt.host, err)
+		}
+		conn.Close()
+		targets := proxy.Targets()[before:]
+		want := net.JoinHostPort(tt.host, strconv.Itoa(int(echoPort)))
+		if tt.proxied && (len(targets) != 1 || targets[0] != want) {
+			t.Errorf("#%d %s: proxied to %v, want %s", i, tt.host, targets, want)
+		}
+		if !tt.proxied && len(targets) != 0 {
+			t.Errorf("#%d %s: proxied to %v, want connected directly", i, tt.host, targets)
+		}
+	}
+
+	// unreachable proxies are replied failures
+	proxy.SetDial(func(addr string) (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	})
+	if conn, err := testSocks5Connect(l.Addr().String(), "www.blocked.example", echoPort); err == nil {
+		conn.Close()
+		t.Errorf("connected through an unreachable proxy")
+	}
+}
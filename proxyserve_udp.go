@@ -0,0 +1,329 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/ARwMq9b6/libgost"
+	"github.com/ginuerzh/gosocks5"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// socks5 server to relay proxied udp datagrams through
+type socks5UDPUpstream struct {
+	server string
+	auth   *proxy.Auth
+}
+
+// udp datagrams can be proxied only if `chain` is a single plain socks5 node, nil otherwise
+func udpUpstreamOf(chain *gost.ProxyChain) *socks5UDPUpstream {
+	nodes := chain.Nodes()
+	if len(nodes) != 1 {
+		return nil
+	}
+	node := nodes[0]
+	if (node.Protocol != "socks5" && node.Protocol != "socks") || node.Transport != "" {
+		return nil
+	}
+	u := &socks5UDPUpstream{server: node.Addr}
+	if len(node.Users) > 0 {
+		password, _ := node.Users[0].Password()
+		u.auth = &proxy.Auth{User: node.Users[0].Username(), Password: password}
+	}
+	return u
+}
+
+// serve a SOCKS5 UDP ASSOCIATE request read from `conn`,
+// every destination is routed like tcp connections with the same ipcache and domaincache,
+// the association ends when `conn` is closed, `touch` is called on every datagram as `conn` itself is idle
+func (s *Server) handleSocks5UDPAssociate(conn net.Conn, upstream *socks5UDPUpstream, touch func()) error {
+	client := addrIP(conn.RemoteAddr())
+	laddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	if laddr == nil {
+		laddr = &net.TCPAddr{}
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP})
+	if err != nil {
+		gosocks5.NewReply(gosocks5.Failure, nil).Write(conn)
+		return errors.WithStack(err)
+	}
+	direct, err := s.directBind.listenUDP()
+	if err != nil {
+		relay.Close()
+		gosocks5.NewReply(gosocks5.Failure, nil).Write(conn)
+		return errors.WithStack(err)
+	}
+
+	bindAddr := gost.ToSocksAddr(relay.LocalAddr())
+	bindAddr.Host = laddr.IP.String()
+	if err := gosocks5.NewReply(gosocks5.Succeeded, bindAddr).Write(conn); err != nil {
+		relay.Close()
+		direct.Close()
+		return errors.WithStack(err)
+	}
+
+	sess := &socks5UDPSession{
+		s:        s,
+		conn:     conn,
+		client:   client,
+		relay:    relay,
+		direct:   direct,
+		upstream: upstream,
+		touch:    touch,
+		routes:   make(map[string]*socks5UDPRoute),
+		assocs:   make(map[*socks5UDPUpstream]*socks5UDPAssoc),
+	}
+	go sess.relayClient()
+	go sess.relayDirect()
+
+	// the association is alive as long as the control connection is
+	io.Copy(ioutil.Discard, conn)
+	sess.close()
+	return nil
+}
+
+// how datagrams to a destination are sent
+type socks5UDPRoute struct {
+	trans    Transport
+	addr     *net.UDPAddr       // resolved destination of direct datagrams
+	upstream *socks5UDPUpstream // relay of proxied datagrams, nil if the chain can not relay udp
+}
+
+// max datagrams queued for an upstream association being dialed, later ones are dropped
+const _SOCKS5_UDP_MAX_PENDING = 16
+
+// association with an upstream socks5 server
+type socks5UDPAssoc struct {
+	ctrl    net.Conn     // control connection of the upstream association, nil while being dialed
+	proxied *net.UDPConn // connected to the relay of the upstream association, nil while being dialed
+	pending [][]byte     // datagrams to be sent once dialed
+}
+
+// a SOCKS5 UDP association of a client
+type socks5UDPSession struct {
+	s        *Server
+	conn     net.Conn // control connection of the client
+	client   net.IP
+	relay    *net.UDPConn       // talks to the client
+	direct   *net.UDPConn       // sends datagrams to direct destinations
+	upstream *socks5UDPUpstream // relay of the default proxy chain
+	touch    func()             // records traffic of the association
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr                           // where the client sends datagrams from
+	routes     map[string]*socks5UDPRoute             // destination -> route
+	assocs     map[*socks5UDPUpstream]*socks5UDPAssoc // upstream -> association, made on the first proxied datagram
+	closed     bool
+}
+
+// --- impl *socks5UDPSession
+
+// datagrams from the client -> destinations
+func (sess *socks5UDPSession) relayClient() {
+	b := make([]byte, 65535)
+	for {
+		n, from, err := sess.relay.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		// only accept datagrams from the host which requested the association
+		if sess.client != nil && !from.IP.Equal(sess.client) {
+			continue
+		}
+		sess.mu.Lock()
+		sess.clientAddr = from
+		sess.mu.Unlock()
+		sess.touch()
+
+		dgram, err := gosocks5.ReadUDPDatagram(bytes.NewReader(b[:n]))
+		if err != nil || dgram.Header.Frag != 0 { // fragmentation is not supported
+			continue
+		}
+		if err := sess.forward(dgram, b[:n]); err != nil {
+			glog.Warningf("socks5 udp %s -> %s: %s\n", from, dgram.Header.Addr, err)
+		}
+	}
+}
+
+// send `dgram` to its destination, `raw` is the encoded `dgram`
+func (sess *socks5UDPSession) forward(dgram *gosocks5.UDPDatagram, raw []byte) error {
+	route, err := sess.route(dgram.Header.Addr)
+	if err != nil {
+		return err
+	}
+	switch route.trans {
+	case TRANS_DIRECT:
+		_, err := sess.direct.WriteToUDP(dgram.Data, route.addr)
+		return errors.WithStack(err)
+	case TRANS_REJECT:
+		// dropped silently
+		return nil
+	}
+	// the header is for the upstream relay as well
+	return sess.sendProxied(route.upstream, raw)
+}
+
+// route of `dst`, decided once for each destination of the session,
+// proxied datagrams of named outbounds are relayed by their own socks5 servers
+func (sess *socks5UDPSession) route(dst *gosocks5.Addr) (*socks5UDPRoute, error) {
+	key := dst.String()
+	sess.mu.Lock()
+	route, ok := sess.routes[key]
+	sess.mu.Unlock()
+	if ok {
+		return route, nil
+	}
+
+	trans, outbound, redirect, err := sess.s.routeConnection(sess.client, dst.Type, dst.Host, dst.Port, "udp", "")
+	if err != nil {
+		return nil, err
+	}
+	route = &socks5UDPRoute{trans: trans, upstream: sess.upstream}
+	if pool, ok := sess.s.outbounds[outbound]; ok && trans == TRANS_PROXY {
+		route.upstream = pool.pick().udpUpstream
+	}
+	if trans == TRANS_DIRECT {
+		host := dst.Host
+		if len(redirect) > 0 {
+			host = redirect[0].String()
+		}
+		route.addr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(dst.Port))))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	sess.mu.Lock()
+	sess.routes[key] = route
+	sess.mu.Unlock()
+	return route, nil
+}
+
+// send `raw` to the relay of `upstream`, which is associated on the first proxied datagram:
+// the association is reserved under the lock and dialed without it, as the dial would hold up datagrams
+// of all destinations, and datagrams sent meanwhile are queued
+func (sess *socks5UDPSession) sendProxied(upstream *socks5UDPUpstream, raw []byte) error {
+	if upstream == nil {
+		return errors.New("udp can be proxied only through a socks5 proxy")
+	}
+	sess.mu.Lock()
+	if sess.closed {
+		sess.mu.Unlock()
+		return errors.New("socks5 udp association closed")
+	}
+	assoc, ok := sess.assocs[upstream]
+	if ok && assoc.proxied != nil {
+		proxied := assoc.proxied
+		sess.mu.Unlock()
+		_, err := proxied.Write(raw)
+		return errors.WithStack(err)
+	}
+	// `raw` is in the buffer of relayClient, which is reused
+	b := append([]byte(nil), raw...)
+	if ok {
+		if len(assoc.pending) < _SOCKS5_UDP_MAX_PENDING {
+			assoc.pending = append(assoc.pending, b)
+		}
+		sess.mu.Unlock()
+		return nil
+	}
+	sess.assocs[upstream] = &socks5UDPAssoc{pending: [][]byte{b}}
+	sess.mu.Unlock()
+	go sess.associate(upstream)
+	return nil
+}
+
+// dial the association with `upstream` reserved by sendProxied, and send the datagrams queued,
+// the reservation is dropped on failures, so that the next datagram dials again
+func (sess *socks5UDPSession) associate(upstream *socks5UDPUpstream) {
+	ctrl, proxied, err := dialSocks5Relay(upstream.server, upstream.auth, sess.s.proxyBind)
+
+	sess.mu.Lock()
+	if err != nil || sess.closed {
+		delete(sess.assocs, upstream)
+		sess.mu.Unlock()
+		if err != nil {
+			glog.Warningf("socks5 udp %s associate %s: %s\n", sess.client, upstream.server, err)
+		} else {
+			ctrl.Close()
+			proxied.Close()
+		}
+		return
+	}
+	assoc := sess.assocs[upstream]
+	assoc.ctrl, assoc.proxied = ctrl, proxied
+	pending := assoc.pending
+	assoc.pending = nil
+	sess.mu.Unlock()
+
+	go sess.relayProxied(proxied)
+	go func() {
+		// the session ends if any upstream association does
+		io.Copy(ioutil.Discard, ctrl)
+		sess.close()
+	}()
+	for _, b := range pending {
+		proxied.Write(b)
+	}
+}
+
+// replies from direct destinations -> the client
+func (sess *socks5UDPSession) relayDirect() {
+	b := make([]byte, 65535)
+	for {
+		n, from, err := sess.direct.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		// header and data must be sent in a single datagram
+		var buf bytes.Buffer
+		gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, gost.ToSocksAddr(from)), b[:n]).Write(&buf)
+		sess.reply(buf.Bytes())
+	}
+}
+
+// replies from the upstream relay -> the client, which are already socks5 datagrams
+func (sess *socks5UDPSession) relayProxied(proxied *net.UDPConn) {
+	b := make([]byte, 65535)
+	for {
+		n, err := proxied.Read(b)
+		if err != nil {
+			return
+		}
+		sess.reply(b[:n])
+	}
+}
+
+func (sess *socks5UDPSession) reply(b []byte) {
+	sess.touch()
+	sess.mu.Lock()
+	clientAddr := sess.clientAddr
+	sess.mu.Unlock()
+	if clientAddr != nil {
+		sess.relay.WriteToUDP(b, clientAddr)
+	}
+}
+
+func (sess *socks5UDPSession) close() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return
+	}
+	sess.closed = true
+	sess.conn.Close()
+	sess.relay.Close()
+	sess.direct.Close()
+	for _, assoc := range sess.assocs {
+		// those being dialed are closed by associate
+		if assoc.ctrl != nil {
+			assoc.ctrl.Close()
+			assoc.proxied.Close()
+		}
+	}
+}
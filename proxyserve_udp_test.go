@@ -0,0 +1,96 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+// session of a client at `clientAddr` whose datagrams are relayed by the returned listener
+func newTestSocks5UDPSession(t *testing.T, clientAddr *net.UDPAddr) *socks5UDPSession {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _ := net.Pipe()
+	return &socks5UDPSession{
+		s:          &Server{},
+		conn:       conn,
+		client:     clientAddr.IP,
+		relay:      relay,
+		direct:     direct,
+		touch:      func() {},
+		clientAddr: clientAddr,
+		routes:     make(map[string]*socks5UDPRoute),
+		assocs:     make(map[*socks5UDPUpstream]*socks5UDPAssoc),
+	}
+}
+
+func testSocks5Datagram(dst *gosocks5.Addr, data string) []byte {
+	var buf bytes.Buffer
+	gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, dst), []byte(data)).Write(&buf)
+	return buf.Bytes()
+}
+
+func TestSocks5UDPSessionSendProxied(t *testing.T) {
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess := newTestSocks5UDPSession(t, client.LocalAddr().(*net.UDPAddr))
+	defer sess.close()
+	dst := &gosocks5.Addr{Type: gosocks5.AddrIPv4, Host: "8.8.8.8", Port: 53}
+
+	// a blackholed upstream holds up neither the sender nor the session
+	blackhole, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+	start := time.Now()
+	if err := sess.sendProxied(&socks5UDPUpstream{server: blackhole.Addr().String()}, testSocks5Datagram(dst, "lost")); err != nil {
+		t.Fatal(err)
+	}
+	sess.mu.Lock()
+	sess.mu.Unlock()
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("sending held up for %v by the dial", took)
+	}
+
+	// datagrams sent while dialing are relayed once associated, and replies go back to the client
+	upstream := newTestSocks5UDPServer(t, func(dst *gosocks5.Addr, data []byte) []*gosocks5.UDPDatagram {
+		return []*gosocks5.UDPDatagram{gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, dst), data)}
+	})
+	defer upstream.Close()
+	u := &socks5UDPUpstream{server: upstream.l.Addr().String()}
+	for _, data := range []string{"first", "second"} {
+		if err := sess.sendProxied(u, testSocks5Datagram(dst, data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make(map[string]bool)
+	for len(got) < 2 {
+		b := make([]byte, 512)
+		n, err := client.Read(b)
+		if err != nil {
+			t.Fatalf("replies %v: %v", got, err)
+		}
+		dgram, err := gosocks5.ReadUDPDatagram(bytes.NewReader(b[:n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[string(dgram.Data)] = true
+	}
+	if !got["first"] || !got["second"] {
+		t.Errorf("replies %v, want first and second", got)
+	}
+}
@@ -0,0 +1,34 @@
+package dnsproxy
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ttl of the unspecified addresses answered for rejected domains
+const _REJECT_TTL = 300
+
+// --- impl *Server
+
+// answer A and AAAA queries of domains routed to TRANS_REJECT with 0.0.0.0 and :: instead of NXDOMAIN,
+// which some clients handle better, e.g. they do not retry with search domains, must be called before serving
+func (s *Server) SetRejectWithZeroIP(enable bool) {
+	s.rejectZeroIP = enable
+}
+
+// reply to `req` of a domain routed to TRANS_REJECT
+func (s *Server) rejectReply(req *dns.Msg) *dns.Msg {
+	if !s.rejectZeroIP || len(req.Question) == 0 {
+		return MsgNewNXDomainReply(req)
+	}
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: _REJECT_TTL}
+	switch q.Qtype {
+	case dns.TypeA:
+		return MsgNewReplyFromReq(req, &dns.A{Hdr: hdr, A: net.IPv4zero})
+	case dns.TypeAAAA:
+		return MsgNewReplyFromReq(req, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+	}
+	return MsgNewNXDomainReply(req)
+}
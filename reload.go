@@ -0,0 +1,57 @@
+package dnsproxy
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// DomainMatcher whose underlying matcher can be swapped at runtime, safe for concurrent use
+type SwappableDomainMatcher struct {
+	v atomic.Value // domainMatcherBox
+}
+
+// atomic.Value requires values of the same concrete type
+type domainMatcherBox struct {
+	DomainMatcher
+}
+
+// --- impl DomainMatcher for *SwappableDomainMatcher
+func NewSwappableDomainMatcher(dm DomainMatcher) *SwappableDomainMatcher {
+	m := new(SwappableDomainMatcher)
+	m.Swap(dm)
+	return m
+}
+
+// replace the underlying matcher, queries in flight may still use the old one
+func (m *SwappableDomainMatcher) Swap(dm DomainMatcher) {
+	m.v.Store(domainMatcherBox{dm})
+}
+
+func (m *SwappableDomainMatcher) MatchGFW(domain string) bool {
+	return m.v.Load().(domainMatcherBox).MatchGFW(domain)
+}
+
+func (m *SwappableDomainMatcher) MatchObedient(domain string) bool {
+	return m.v.Load().(domainMatcherBox).MatchObedient(domain)
+}
+
+// ip matcher whose underlying match function can be swapped at runtime, safe for concurrent use
+type SwappableIPMatcher struct {
+	v atomic.Value // func(net.IP) bool
+}
+
+// --- impl *SwappableIPMatcher
+func NewSwappableIPMatcher(match func(net.IP) bool) *SwappableIPMatcher {
+	m := new(SwappableIPMatcher)
+	m.Swap(match)
+	return m
+}
+
+// replace the underlying match function, queries in flight may still use the old one
+func (m *SwappableIPMatcher) Swap(match func(net.IP) bool) {
+	m.v.Store(match)
+}
+
+func (m *SwappableIPMatcher) Match(ip net.IP) bool {
+	return m.v.Load().(func(net.IP) bool)(ip)
+}
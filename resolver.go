@@ -0,0 +1,61 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+type clientContextKey struct{}
+
+// context of Resolve for queries of `client`, which decides client rules and the cache scope
+func ContextWithClient(ctx context.Context, client net.IP) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, client)
+}
+
+// client ip set by ContextWithClient, nil if unknown
+func ClientFromContext(ctx context.Context) net.IP {
+	client, _ := ctx.Value(clientContextKey{}).(net.IP)
+	return client
+}
+
+type listenerContextKey struct{}
+
+// context of Resolve for queries arriving on the dns listener tagged `listener`, which decides listener rules and the cache scope
+func ContextWithListener(ctx context.Context, listener string) context.Context {
+	return context.WithValue(ctx, listenerContextKey{}, listener)
+}
+
+// listener tag set by ContextWithListener, empty if untagged
+func ListenerFromContext(ctx context.Context) string {
+	listener, _ := ctx.Value(listenerContextKey{}).(string)
+	return listener
+}
+
+// --- impl *Server
+
+// answer `req` the same way as ServeDNS without any listener, for Go programs embedding the China/abroad split,
+// returns the routing verdict of the questioned domain as well, see resolve,
+// the client and the listener tag are taken from `ctx` by ClientFromContext and ListenerFromContext,
+// upstream queries are abandoned once `ctx` is done, and within the DNS query timeout if `ctx` has no deadline,
+// records of the response may be shared with the cache and must not be modified
+func (s *Server) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, Transport, error) {
+	if err := s.validate(); err != nil {
+		return nil, 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.queryTimeout())
+		defer cancel()
+	}
+	resp, trans, err := s.resolve(ctx, req, ClientFromContext(ctx))
+	if err != nil && ctx.Err() != nil {
+		return nil, 0, errors.WithStack(ctx.Err())
+	}
+	return resp, trans, err
+}
@@ -0,0 +1,97 @@
+package dnsproxy
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// named dns resolvers besides the obedient and the abroad dns servers, and domains assigned to them,
+// assigned domains and their subdomains are always resolved by their resolvers, see SetResolverRegistry
+//
+// not safe for concurrent Register and Assign, which are done before serving
+type ResolverRegistry struct {
+	resolvers map[string]DNSExchanger
+	domains   map[string]string // domain -> name of the resolver
+}
+
+// --- impl *ResolverRegistry
+func NewResolverRegistry() *ResolverRegistry {
+	return &ResolverRegistry{resolvers: make(map[string]DNSExchanger), domains: make(map[string]string)}
+}
+
+// add resolver `e` as `name`, which must be unique
+func (r *ResolverRegistry) Register(name string, e DNSExchanger) error {
+	if name == "" {
+		return errors.New("empty resolver name")
+	}
+	if _, ok := r.resolvers[name]; ok {
+		return errors.Errorf("duplicate resolver %q", name)
+	}
+	r.resolvers[name] = e
+	return nil
+}
+
+// resolver registered as `name`
+func (r *ResolverRegistry) Lookup(name string) (DNSExchanger, bool) {
+	e, ok := r.resolvers[name]
+	return e, ok
+}
+
+// sorted names of registered resolvers
+func (r *ResolverRegistry) Names() []string {
+	names := make([]string, 0, len(r.resolvers))
+	for name := range r.resolvers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolve `domain` and its subdomains by the resolver registered as `name`,
+// the longest assigned domain wins if a domain is assigned more than once
+func (r *ResolverRegistry) Assign(domain, name string) error {
+	if _, ok := r.resolvers[name]; !ok {
+		return errors.Errorf("unknown resolver %q", name)
+	}
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return errors.New("empty domain")
+	}
+	r.domains[domain] = name
+	return nil
+}
+
+func (r *ResolverRegistry) Len() int {
+	return len(r.domains)
+}
+
+// the resolver assigned to `domain` or its closest parent domain
+func (r *ResolverRegistry) Match(domain string) (name string, e DNSExchanger, ok bool) {
+	if len(r.domains) == 0 {
+		return "", nil, false
+	}
+	for domain = normalizeDomain(domain); domain != ""; domain = parentDomain(domain) {
+		if name, ok := r.domains[domain]; ok {
+			return name, r.resolvers[name], true
+		}
+	}
+	return "", nil, false
+}
+
+// --- impl *DefaultRoutingPolicy
+
+// resolve domains assigned by `r` with their resolvers instead of the obedient or the abroad dns server,
+// they are routed as usual but by the assigned resolver's answer, nil to disable, must be called before serving
+func (p *DefaultRoutingPolicy) SetResolverRegistry(r *ResolverRegistry) {
+	p.resolvers = r
+}
+
+// the resolver assigned to `domain`, nil if there is none
+func (p *DefaultRoutingPolicy) assignedResolver(domain string) DNSExchanger {
+	if p.resolvers == nil || domain == "" {
+		return nil
+	}
+	_, e, _ := p.resolvers.Match(domain)
+	return e
+}
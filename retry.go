@@ -0,0 +1,102 @@
+package dnsproxy
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// retries of queries of a dnsTransport, which replace the fixed 3 raced queries of STRATEGY_RACE,
+// e.g. behind a flaky proxy all simultaneous queries tend to fail together, while a later one may succeed
+//
+// an attempt queries nameservers once according to the upstream strategy,
+// a failed attempt is retried after Backoff, which is doubled for every following retry and randomized by Jitter,
+// and a slow attempt is hedged by starting the next one after Hedge without canceling it,
+// the first succeeded response of all attempts is returned
+type RetryPolicy struct {
+	Attempts int           // max number of attempts, 1 if not positive
+	Backoff  time.Duration // delay before the first retry
+	Jitter   float64       // every delay is randomized by ±Jitter of itself, in [0, 1]
+	Hedge    time.Duration // start the next attempt if the running one has not finished after this, 0 to disable
+}
+
+// --- impl *RetryPolicy
+
+// delay before the `n`th retry, n >= 1
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	d := p.Backoff << uint(n-1)
+	if d < p.Backoff { // overflowed
+		d = p.Backoff
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// run `attempt` until one succeeds, all attempts are made or `ctx` is done,
+// the running attempts are canceled on return
+func (p *RetryPolicy) do(ctx context.Context, attempt func(ctx context.Context) (*dns.Msg, error)) (*dns.Msg, error) {
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	// buffered, so that attempts never block after return
+	results := make(chan result, attempts)
+	var started, running int
+	var next <-chan time.Time // fires when the next attempt is due
+	start := func() {
+		started++
+		running++
+		go func() {
+			resp, err := attempt(ctx)
+			results <- result{resp, err}
+		}()
+		next = nil
+		if p.Hedge > 0 && started < attempts {
+			next = time.After(p.Hedge)
+		}
+	}
+
+	start()
+	var lastErr error
+	for {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				return r.resp, nil
+			}
+			lastErr = r.err
+			if started < attempts {
+				next = time.After(p.backoff(started))
+			} else if running == 0 {
+				return nil, lastErr
+			}
+		case <-next:
+			start()
+		case <-ctx.Done():
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, errors.WithStack(ctx.Err())
+		}
+	}
+}
+
+// --- impl *dnsTransport
+
+// retry failed queries according to `p`, nil to race 3 queries once as default
+func (dt *dnsTransport) SetRetryPolicy(p *RetryPolicy) {
+	dt.retry = p
+}
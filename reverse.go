@@ -0,0 +1,34 @@
+package dnsproxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// --- impl *Server
+
+// answer the PTR query `req` of clients in `scope` with the domain recently resolved to the ip,
+// addresses synthesized by DNS64 are looked up by their embedded ipv4 addresses,
+// false if `req` is not a PTR query or the ip is not in the domain cache
+func (s *Server) lookupReverse(req *dns.Msg, scope string) (*dns.Msg, bool) {
+	q := req.Question[0]
+	if q.Qtype != dns.TypePTR {
+		return nil, false
+	}
+	ip := ReverseNameToIP(q.Name)
+	if ip == nil {
+		return nil, false
+	}
+	domain, ttl, ok := s.domaincache.LookupIP(scope, ip)
+	if !ok && s.dns64 != nil {
+		if ip4 := s.dns64.Extract(ip); ip4 != nil {
+			domain, ttl, ok = s.domaincache.LookupIP(scope, ip4)
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	return MsgNewReplyFromReq(req, &dns.PTR{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+		Ptr: dns.Fqdn(domain),
+	}), true
+}
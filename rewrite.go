@@ -0,0 +1,123 @@
+package dnsproxy
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// addresses in answers rewritten after domains are resolved and routed, before they are cached,
+// returned to dns clients and connected by proxy requests, e.g. to remap a region-specific ip of a CDN
+// to a preferred one, or to point a domain at a reverse proxy in the home network
+type AnswerRewriter struct {
+	rules []rewriteRule
+}
+
+type rewriteRule struct {
+	from    *net.IPNet
+	to      net.IP
+	domains *DomainSet // nil for all domains
+	direct  bool       // rewritten answers are connected directly
+}
+
+// --- impl *AnswerRewriter
+func NewAnswerRewriter() *AnswerRewriter {
+	return new(AnswerRewriter)
+}
+
+// rewrite answered ips in `from` to `to` of the same family for `domains` and their subdomains, all domains if empty,
+// domains whose answers are rewritten are connected directly if `direct`, otherwise as they are routed,
+// the first added rule matching an ip applies
+func (w *AnswerRewriter) Add(from *net.IPNet, to net.IP, domains []string, direct bool) error {
+	if (from.IP.To4() != nil) != (to.To4() != nil) {
+		return errors.Errorf("rewrite %s to %s: different address families", from, to)
+	}
+	r := rewriteRule{from: from, to: to, direct: direct}
+	if to4 := to.To4(); to4 != nil {
+		r.to = to4
+	}
+	if len(domains) > 0 {
+		r.domains = NewDomainSet(domains...)
+	}
+	w.rules = append(w.rules, r)
+	return nil
+}
+
+func (w *AnswerRewriter) Len() int {
+	return len(w.rules)
+}
+
+// the rule rewriting `ip` answered for `domain`, nil if none matches
+func (w *AnswerRewriter) match(domain string, ip net.IP) *rewriteRule {
+	for i := range w.rules {
+		r := &w.rules[i]
+		if r.from.Contains(ip) && (r.domains == nil || r.domains.Match(domain)) {
+			return r
+		}
+	}
+	return nil
+}
+
+// copy of `d` whose answer of `domain` is rewritten, `d` itself if nothing is rewritten
+func (w *AnswerRewriter) Rewrite(domain string, d *RouteDecision) *RouteDecision {
+	if d == nil || d.Resp == nil || len(w.rules) == 0 {
+		return d
+	}
+	domain = normalizeDomain(domain)
+	var answer []dns.RR
+	var direct bool
+	for i, rr := range d.Resp.Answer {
+		var r *rewriteRule
+		switch v := rr.(type) {
+		case *dns.A:
+			if r = w.match(domain, v.A); r != nil {
+				rr = &dns.A{Hdr: v.Hdr, A: r.to}
+			}
+		case *dns.AAAA:
+			if r = w.match(domain, v.AAAA); r != nil {
+				rr = &dns.AAAA{Hdr: v.Hdr, AAAA: r.to}
+			}
+		}
+		if r == nil {
+			continue
+		}
+		// records are shared with the original response, copy the section on the first rewrite
+		if answer == nil {
+			answer = append([]dns.RR(nil), d.Resp.Answer...)
+		}
+		answer[i] = rr
+		direct = direct || r.direct
+	}
+	if answer == nil {
+		return d
+	}
+	_d := *d
+	_d.Resp = MsgShallowCopy(d.Resp)
+	_d.Resp.Answer = answer
+	if direct {
+		_d.Trans, _d.Outbound = TRANS_DIRECT, ""
+	}
+	return &_d
+}
+
+// --- impl *Server
+
+// rewrite answers of routed domains by `w`, nil to disable, must be called before serving
+func (s *Server) SetAnswerRewriter(w *AnswerRewriter) {
+	s.rewriter = w
+}
+
+// route the domain query `q` by the routing policy, with the answer rewritten if there is an AnswerRewriter
+func (s *Server) routeDomain(q *RouteQuery) (*RouteDecision, error) {
+	d, err := s.policy.Route(q)
+	if err != nil {
+		return nil, err
+	}
+	if s.rewriter != nil {
+		d = s.rewriter.Rewrite(q.Domain(), d)
+	}
+	s.events.publishRoute(q, d)
+	s.hooks.dnsDecided(q, d)
+	return d, nil
+}
@@ -0,0 +1,748 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// parse "direct", "proxy" or "reject"
+func ParseTransport(s string) (Transport, error) {
+	switch strings.ToLower(s) {
+	case "direct":
+		return TRANS_DIRECT, nil
+	case "proxy":
+		return TRANS_PROXY, nil
+	case "reject":
+		return TRANS_REJECT, nil
+	default:
+		return 0, errors.Errorf("unknown transport %q", s)
+	}
+}
+
+// "direct", "proxy" or "reject", the reverse of ParseTransport
+func (t Transport) String() string {
+	switch t {
+	case TRANS_DIRECT:
+		return "direct"
+	case TRANS_REJECT:
+		return "reject"
+	}
+	return "proxy"
+}
+
+func (t Transport) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *Transport) UnmarshalText(text []byte) (err error) {
+	*t, err = ParseTransport(string(text))
+	return
+}
+
+// what is to be routed, either a domain to resolve or an ip to connect
+type RouteQuery struct {
+	Req    *dns.Msg // dns query of the destination domain, nil if the destination is an ip
+	IP     net.IP   // destination ip, nil if the destination is a domain
+	Client net.IP   // client ip, nil if unknown
+
+	// tag of the dns listener the query arrived on, see SetListenerTags, empty if untagged or not a dns query
+	Listener string
+
+	// the answer of Req is wanted even if the destination is proxied,
+	// set by dns queries but not by proxy requests
+	NeedAnswer bool
+
+	// deadline and cancellation of resolving Req, see Context
+	Ctx context.Context
+
+	// the connection to the destination, set by proxy requests routed by RulePolicy.RouteConnection
+	Port     uint16
+	Network  string // "tcp" or "udp", empty if not a connection
+	Protocol string // sniffed application protocol such as "tls", see SNIFFED_PROTOCOLS, empty if unknown
+}
+
+// --- impl *RouteQuery
+
+// q.Ctx, or context.Background() if it is nil
+func (q *RouteQuery) Context() context.Context {
+	if q.Ctx == nil {
+		return context.Background()
+	}
+	return q.Ctx
+}
+
+// destination domain without the trailing dot, empty if the destination is an ip
+func (q *RouteQuery) Domain() string {
+	if q.Req == nil || len(q.Req.Question) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(q.Req.Question[0].Name, ".")
+}
+
+func (q *RouteQuery) Qtype() uint16 {
+	if q.Req == nil || len(q.Req.Question) == 0 {
+		return 0
+	}
+	return q.Req.Question[0].Qtype
+}
+
+// how a RouteQuery is routed
+type RouteDecision struct {
+	Trans     Transport
+	Outbound  string   // named proxy chain if Trans is TRANS_PROXY, empty for the default one
+	Resp      *dns.Msg // response to RouteQuery.Req, nil if not resolved, never resolved for TRANS_REJECT
+	Cacheable bool     // Trans and Resp may be cached as long as the answer's TTL
+}
+
+// decide whether a destination is connected directly or through the proxy,
+// and resolve it with the proper dns transport if needed
+type RoutingPolicy interface {
+	Route(q *RouteQuery) (*RouteDecision, error)
+}
+
+// RoutingPolicy which reports the health of its dns upstreams, keyed by their usage such as "abroad"
+type UpstreamHealthReporter interface {
+	UpstreamHealth() map[string][]UpstreamHealth
+}
+
+// RoutingPolicy whose decisions depend on clients,
+// clients in the same scope share cached decisions, "" is the scope of clients without special treatment
+type ClientScoper interface {
+	ClientScope(client net.IP) string
+}
+
+// RoutingPolicy whose decisions depend on the dns listeners queries arrive on, see RouteQuery.Listener,
+// queries of listeners in the same scope share cached decisions, "" is the scope of listeners without special treatment
+type ListenerScoper interface {
+	ListenerScope(listener string) string
+}
+
+// RoutingPolicy which is able to resolve a domain as if it was decided to `trans`
+type TransportResolver interface {
+	ResolveFor(ctx context.Context, trans Transport, req *dns.Msg) (*dns.Msg, error)
+}
+
+// RoutingPolicy which resolves queries of non-address types such as MX, TXT, SRV, NS, PTR and ANY,
+// whose answers have no ip to route, so neither routing decisions nor caching are involved
+type PassthroughResolver interface {
+	ResolvePassthrough(q *RouteQuery) (*dns.Msg, error)
+}
+
+// check if answers of `qtype` are ips to be routed, i.e. A and AAAA
+func IsAddressQtype(qtype uint16) bool {
+	return qtype == dns.TypeA || qtype == dns.TypeAAAA
+}
+
+// ####
+//  Default policy
+// ####
+
+// gfw list, obedient list and Chinese mainland ip list based policy
+type DefaultRoutingPolicy struct {
+	domainMatcher DomainMatcher
+	ipMatchCHN    func(net.IP) bool // check if an ip is Chinese mainland ip
+
+	subnetLocalIP net.IP // edns-client-subnet ip for querying as if in Chinese mainland
+	subnetProxyIP net.IP // edns-client-subnet ip for querying as if on the proxy server
+
+	dtObedient DNSExchanger // chinese dns server
+	dtAbroad   DNSExchanger // abroad dns server
+
+	learned map[string]Transport // domains routed by other instances, see SetLearnedDomains
+
+	resolvers *ResolverRegistry // resolvers assigned to domains, see SetResolverRegistry
+
+	fakeIPs  *IPNetMatcher   // forged answers of the chinese dns server, see SetFakeIPs
+	poisoned poisonedDomains // domains proxied since their forged answers were detected
+
+	userRules *DomainRules // domains forced by users, see DomainRules
+}
+
+// --- impl *DefaultRoutingPolicy
+func NewDefaultRoutingPolicy(dm DomainMatcher, ipMatchCHN func(net.IP) bool,
+	subnetLocalIP, subnetProxyIP net.IP,
+	dtObedient, dtAbroad DNSExchanger) *DefaultRoutingPolicy {
+	return &DefaultRoutingPolicy{
+		domainMatcher: dm,
+		ipMatchCHN:    ipMatchCHN,
+		subnetLocalIP: subnetLocalIP,
+		subnetProxyIP: subnetProxyIP,
+		dtObedient:    dtObedient,
+		dtAbroad:      dtAbroad,
+		userRules:     NewDomainRules(),
+	}
+}
+
+// check if all fields are initialized
+func (p *DefaultRoutingPolicy) validate() error {
+	if p.domainMatcher != nil &&
+		p.ipMatchCHN != nil &&
+		p.subnetLocalIP != nil &&
+		p.subnetProxyIP != nil &&
+		p.dtObedient != nil &&
+		p.dtAbroad != nil {
+		return nil
+	}
+	return errors.New("routing policy is not fully initialized")
+}
+
+// domains with assigned resolvers: query the assigned resolver, see SetResolverRegistry
+// direct: query chinese dns server
+// proxy: query abroad dns server with edns-client-subnet of the proxy server
+func (p *DefaultRoutingPolicy) ResolveFor(ctx context.Context, trans Transport, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) > 0 {
+		if e := p.assignedResolver(req.Question[0].Name); e != nil {
+			return e.Resolve(ctx, req)
+		}
+	}
+	if trans == TRANS_DIRECT {
+		return p.dtObedient.Resolve(ctx, req)
+	}
+	req = MsgShallowCopy(req)
+	MsgSetECSWithAddr(req, p.subnetProxyIP)
+	return p.dtAbroad.Resolve(ctx, req)
+}
+
+// route domains which are in neither list as they are learned by other instances instead of probing them,
+// as if proxied ones are in the gfw list and direct ones are in the obedient list, must be called before serving
+func (p *DefaultRoutingPolicy) SetLearnedDomains(learned map[string]Transport) {
+	p.learned = learned
+}
+
+// user defined domains taking precedence over the gfw list and the obedient list, rules can be added at runtime
+func (p *DefaultRoutingPolicy) DomainRules() *DomainRules {
+	return p.userRules
+}
+
+// as MatchDomainLists, but domains forced by user rules are matched as if proxied ones are in the gfw list
+// and direct ones are in the obedient list, and domains in neither list are matched by their learned transports,
+// or as if they are in the gfw list if they were detected to be poisoned
+func (p *DefaultRoutingPolicy) matchDomain(domain string) (gfw, obedient bool) {
+	if rule, ok := p.userRules.Match(domain); ok {
+		return rule.Trans == TRANS_PROXY, rule.Trans == TRANS_DIRECT
+	}
+	gfw, obedient = p.MatchDomainLists(domain)
+	if gfw || obedient {
+		return
+	}
+	if p.poisoned.has(domain) {
+		return true, false
+	}
+	if t, ok := p.learned[normalizeDomain(domain)]; ok {
+		return t == TRANS_PROXY, t == TRANS_DIRECT
+	}
+	return
+}
+
+// check if `domain` is forced to be rejected by user rules
+func (p *DefaultRoutingPolicy) rejected(domain string) bool {
+	rule, ok := p.userRules.Match(domain)
+	return ok && rule.Trans == TRANS_REJECT
+}
+
+// check if `domain` is in the gfw list and the obedient list
+func (p *DefaultRoutingPolicy) MatchDomainLists(domain string) (gfw, obedient bool) {
+	return p.domainMatcher.MatchGFW(domain), p.domainMatcher.MatchObedient(domain)
+}
+
+// check if `ip` is in the china ip list
+func (p *DefaultRoutingPolicy) MatchChinaIP(ip net.IP) bool {
+	return p.ipMatchCHN(ip)
+}
+
+// assigned resolvers are keyed as "resolver corp"
+func (p *DefaultRoutingPolicy) UpstreamHealth() map[string][]UpstreamHealth {
+	health := map[string][]UpstreamHealth{
+		"obedient": exchangerHealth(p.dtObedient),
+		"abroad":   exchangerHealth(p.dtAbroad),
+	}
+	if p.resolvers != nil {
+		for _, name := range p.resolvers.Names() {
+			e, _ := p.resolvers.Lookup(name)
+			health["resolver "+name] = exchangerHealth(e)
+		}
+	}
+	return health
+}
+
+func (p *DefaultRoutingPolicy) Route(q *RouteQuery) (*RouteDecision, error) {
+	// 按 decideRoute 的流程图决定，并按需查询 DNS 服务器
+	st := &routeState{domain: q.Req != nil, needAnswer: q.NeedAnswer}
+	if !st.domain {
+		st.ipChina = p.ipMatchCHN(q.IP)
+	} else if st.rejected = p.rejected(q.Domain()); !st.rejected {
+		st.gfw, st.obedient = p.matchDomain(q.Domain())
+		st.assigned = p.assignedResolver(q.Domain()) != nil
+	}
+
+	ctx, cancel := context.WithCancel(q.Context())
+	defer cancel() // resolutions started in advance are canceled if they turn out to be unneeded
+	var pending [_ROUTE_STEP_NUM]chan *routeResult
+	for {
+		d, next, err := decideRoute(st)
+		if len(next) == 0 {
+			if st.domain {
+				p.learnPoisoned(q.Domain(), st, d)
+			}
+			return d, err
+		}
+		for _, step := range next[1:] {
+			if pending[step] == nil && st.results[step] == nil {
+				pending[step] = make(chan *routeResult, 1)
+				go func(step routeStep, c chan<- *routeResult) {
+					c <- p.resolveStep(ctx, step, q.Req)
+				}(step, pending[step])
+			}
+		}
+		if c := pending[next[0]]; c != nil {
+			st.results[next[0]] = <-c
+		} else {
+			st.results[next[0]] = p.resolveStep(ctx, next[0], q.Req)
+		}
+	}
+}
+
+// resolve `req` as `step` says
+func (p *DefaultRoutingPolicy) resolveStep(ctx context.Context, step routeStep, req *dns.Msg) *routeResult {
+	var r routeResult
+	switch step {
+	case _ROUTE_STEP_PROXY:
+		r.resp, r.err = p.ResolveFor(ctx, TRANS_PROXY, req)
+	case _ROUTE_STEP_DIRECT:
+		r.resp, r.err = p.ResolveFor(ctx, TRANS_DIRECT, req)
+		r.poisoned = r.err == nil && p.forged(r.resp)
+	case _ROUTE_STEP_ABROAD_LOCAL:
+		req = MsgShallowCopy(req)
+		MsgSetECSWithAddr(req, p.subnetLocalIP)
+		r.resp, r.err = p.dtAbroad.Resolve(ctx, req)
+	case _ROUTE_STEP_ASSIGNED:
+		r.resp, r.err = p.assignedResolver(req.Question[0].Name).Resolve(ctx, req)
+	}
+	if ans, ip := MsgExtractAnswer(r.resp); ans != nil && r.err == nil && !r.poisoned {
+		r.chinaIP = p.ipMatchCHN(ip)
+	}
+	return &r
+}
+
+// domains with assigned resolvers, including reverse names: the assigned resolver
+// gfw list domains: abroad dns server with edns-client-subnet of the proxy server
+// obedient list domains and PTR of Chinese mainland ips: chinese dns server
+// PTR of other ips: abroad dns server, reverse names are not in the domain lists
+// others: abroad dns server with edns-client-subnet of local, then chinese dns server if it fails, SERVFAIL or REFUSED
+func (p *DefaultRoutingPolicy) ResolvePassthrough(q *RouteQuery) (*dns.Msg, error) {
+	domain := q.Domain()
+	if p.rejected(domain) {
+		return MsgNewNXDomainReply(q.Req), nil
+	}
+	if e := p.assignedResolver(domain); e != nil {
+		return e.Resolve(q.Context(), q.Req)
+	}
+	if q.Qtype() == dns.TypePTR {
+		if ip := ReverseNameToIP(domain); ip != nil {
+			if p.ipMatchCHN(ip) {
+				return p.ResolveFor(q.Context(), TRANS_DIRECT, q.Req)
+			}
+			return p.ResolveFor(q.Context(), TRANS_PROXY, q.Req)
+		}
+	}
+	gfw, obedient := p.matchDomain(domain)
+	switch {
+	case gfw:
+		return p.ResolveFor(q.Context(), TRANS_PROXY, q.Req)
+	case obedient:
+		return p.ResolveFor(q.Context(), TRANS_DIRECT, q.Req)
+	}
+	req := MsgShallowCopy(q.Req)
+	MsgSetECSWithAddr(req, p.subnetLocalIP)
+	if resp, err := p.dtAbroad.Resolve(q.Context(), req); err == nil && !MsgIsServerFailure(resp) {
+		return resp, nil
+	}
+	return p.dtObedient.Resolve(q.Context(), q.Req)
+}
+
+// ####
+//  Rule based policy
+// ####
+
+// route destinations matching any of the destination patterns to `Trans`,
+// only for clients matching any of the client patterns if there are,
+// all destinations of these clients if there is no destination pattern
+type RoutingRule struct {
+	domains  map[string]struct{} // "domain:example.com", exact domains
+	suffixes *DomainSet          // "domain:*.example.com", subdomains
+	ipNets   *IPNetMatcher       // "ip:10.0.0.0/8", destination ips of proxy requests
+	clients  *IPNetMatcher       // "client:192.168.1.0/28", client ips
+
+	listeners map[string]struct{} // "listener:vpn", tags of dns listeners, see RouteQuery.Listener
+
+	// connections only, see RouteQuery.Network
+	ports     [][2]uint16         // "port:22", "port:8000-8100", destination ports
+	networks  map[string]struct{} // "network:udp"
+	protocols map[string]struct{} // "protocol:ssh", see SNIFFED_PROTOCOLS
+
+	Trans    Transport
+	Outbound string       // named proxy chain of proxied destinations, empty for the default one
+	Resolver DNSExchanger // resolves matched domains, nil to resolve with the fallback policy
+}
+
+// --- impl *RoutingRule
+
+// patterns are "domain:example.com", "domain:*.example.com", "ip:10.0.0.0/8" or "client:192.168.1.0/28",
+// or "port:22", "port:8000-8100", "network:udp" and "protocol:ssh" which match connections of proxy requests only,
+// or "listener:vpn" which matches dns queries arriving on the listeners tagged "vpn" only,
+// a rule matches if each kind of its patterns is matched by any pattern of the kind,
+// where domains and ips are of the same kind
+func NewRoutingRule(patterns []string, trans Transport, resolver DNSExchanger) (*RoutingRule, error) {
+	r := &RoutingRule{
+		domains:   make(map[string]struct{}),
+		suffixes:  NewDomainSet(),
+		listeners: make(map[string]struct{}),
+		networks:  make(map[string]struct{}),
+		protocols: make(map[string]struct{}),
+		Trans:     trans,
+		Resolver:  resolver,
+	}
+	var ipnets, clientNets []*net.IPNet
+	for _, pattern := range patterns {
+		i := strings.IndexByte(pattern, ':')
+		if i < 0 {
+			return nil, errors.Errorf("invalid rule pattern %q", pattern)
+		}
+		kind, value := strings.TrimSpace(pattern[:i]), strings.TrimSpace(pattern[i+1:])
+		switch kind {
+		case "domain":
+			if strings.HasPrefix(value, "*.") {
+				r.suffixes.Add(value[2:])
+			} else {
+				r.domains[normalizeDomain(value)] = struct{}{}
+			}
+		case "ip", "client":
+			ipnet, err := ParseIPOrNet(value)
+			if err != nil {
+				return nil, errors.Errorf("invalid rule pattern %q", pattern)
+			}
+			if kind == "ip" {
+				ipnets = append(ipnets, ipnet)
+			} else {
+				clientNets = append(clientNets, ipnet)
+			}
+		case "listener":
+			if value == "" {
+				return nil, errors.Errorf("invalid rule pattern %q", pattern)
+			}
+			r.listeners[value] = struct{}{}
+		case "port":
+			ports, err := parsePortRange(value)
+			if err != nil {
+				return nil, errors.Errorf("invalid rule pattern %q", pattern)
+			}
+			r.ports = append(r.ports, ports)
+		case "network":
+			value = strings.ToLower(value)
+			if value != "tcp" && value != "udp" {
+				return nil, errors.Errorf("invalid rule pattern %q", pattern)
+			}
+			r.networks[value] = struct{}{}
+		case "protocol":
+			value = strings.ToLower(value)
+			if !isSniffedProtocol(value) {
+				return nil, errors.Errorf("invalid rule pattern %q: protocol should be one of %s",
+					pattern, strings.Join(SNIFFED_PROTOCOLS, ", "))
+			}
+			r.protocols[value] = struct{}{}
+		default:
+			return nil, errors.Errorf("invalid rule pattern %q", pattern)
+		}
+	}
+	r.ipNets = NewIPNetMatcher(ipnets)
+	r.clients = NewIPNetMatcher(clientNets)
+	return r, nil
+}
+
+// "10.0.0.0/8", or "10.0.0.1" as "10.0.0.1/32"
+func ParseIPOrNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, errors.WithStack(err)
+}
+
+// "22" or "8000-8100"
+func parsePortRange(s string) ([2]uint16, error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	from, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return [2]uint16{}, errors.WithStack(err)
+	}
+	to, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err != nil {
+		return [2]uint16{}, errors.WithStack(err)
+	}
+	if from == 0 || from > to {
+		return [2]uint16{}, errors.Errorf("invalid port range %q", s)
+	}
+	return [2]uint16{uint16(from), uint16(to)}, nil
+}
+
+// check if `client` is in the scope of the rule
+func (r *RoutingRule) matchClient(client net.IP) bool {
+	return r.clients.Len() == 0 || (client != nil && r.clients.Match(client))
+}
+
+// check if `listener` is in the scope of the rule, queries which are not tagged match only rules without listener patterns
+func (r *RoutingRule) matchListener(listener string) bool {
+	if len(r.listeners) == 0 {
+		return true
+	}
+	_, ok := r.listeners[listener]
+	return ok
+}
+
+// check if the rule has patterns of connections, whose decisions vary among connections to the same destination
+func (r *RoutingRule) connectionScoped() bool {
+	return len(r.ports) > 0 || len(r.networks) > 0 || len(r.protocols) > 0
+}
+
+// check if the connection of `q` matches the port, network and protocol patterns,
+// queries which are not of connections match only rules without such patterns
+func (r *RoutingRule) matchConnection(q *RouteQuery) bool {
+	if !r.connectionScoped() {
+		return true
+	}
+	if q.Network == "" {
+		return false
+	}
+	if len(r.networks) > 0 {
+		if _, ok := r.networks[q.Network]; !ok {
+			return false
+		}
+	}
+	if len(r.protocols) > 0 {
+		if _, ok := r.protocols[q.Protocol]; !ok {
+			return false
+		}
+	}
+	if len(r.ports) > 0 {
+		for _, ports := range r.ports {
+			if ports[0] <= q.Port && q.Port <= ports[1] {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (r *RoutingRule) match(q *RouteQuery) bool {
+	if !r.matchClient(q.Client) || !r.matchListener(q.Listener) || !r.matchConnection(q) {
+		return false
+	}
+	if len(r.domains) == 0 && r.suffixes.Len() == 0 && r.ipNets.Len() == 0 {
+		return true
+	}
+	if q.Req == nil {
+		return q.IP != nil && r.ipNets.Match(q.IP)
+	}
+	domain := normalizeDomain(q.Domain())
+	if _, ok := r.domains[domain]; ok {
+		return true
+	}
+	return r.suffixes.Match(parentDomain(domain))
+}
+
+// "example.com" for "www.example.com", empty for top level domains
+func parentDomain(domain string) string {
+	i := strings.IndexByte(domain, '.')
+	if i < 0 {
+		return ""
+	}
+	return domain[i+1:]
+}
+
+// RoutingPolicy which applies the first matched rule, or the fallback policy if none matches
+type RulePolicy struct {
+	rules    []*RoutingRule
+	fallback RoutingPolicy
+}
+
+// --- impl *RulePolicy
+func NewRulePolicy(rules []*RoutingRule, fallback RoutingPolicy) *RulePolicy {
+	return &RulePolicy{rules: rules, fallback: fallback}
+}
+
+func (p *RulePolicy) validate() error {
+	if v, ok := p.fallback.(interface{ validate() error }); ok {
+		return v.validate()
+	}
+	return nil
+}
+
+func (p *RulePolicy) Route(q *RouteQuery) (*RouteDecision, error) {
+	for _, r := range p.rules {
+		if r.match(q) {
+			return p.apply(r, q)
+		}
+	}
+	return p.fallback.Route(q)
+}
+
+// index of the first rule matching `q`, -1 if the fallback policy is applied
+func (p *RulePolicy) MatchRule(q *RouteQuery) int {
+	for i, r := range p.rules {
+		if r.match(q) {
+			return i
+		}
+	}
+	return -1
+}
+
+// route the connection of `q` by the first matched rule if it is connection scoped,
+// such decisions vary among connections to the same destination and are never cached,
+// false if the first matched rule is not connection scoped or no rule matches, then `q` is to be routed by Route
+func (p *RulePolicy) RouteConnection(q *RouteQuery) (*RouteDecision, bool, error) {
+	for _, r := range p.rules {
+		if !r.match(q) {
+			continue
+		}
+		if !r.connectionScoped() {
+			return nil, false, nil
+		}
+		d, err := p.apply(r, q)
+		return d, true, err
+	}
+	return nil, false, nil
+}
+
+// check if any rule is connection scoped, see RouteConnection
+func (p *RulePolicy) hasConnectionRules() bool {
+	for _, r := range p.rules {
+		if r.connectionScoped() {
+			return true
+		}
+	}
+	return false
+}
+
+// check if any rule matches sniffed protocols, which requires peeking at the first data of every connection
+func (p *RulePolicy) needsProtocol() bool {
+	for _, r := range p.rules {
+		if len(r.protocols) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// the policy applied if no rule matches
+func (p *RulePolicy) Fallback() RoutingPolicy {
+	return p.fallback
+}
+
+// health of the fallback policy's upstreams and resolvers of rules, which are keyed as "rule #1"
+func (p *RulePolicy) UpstreamHealth() map[string][]UpstreamHealth {
+	health := make(map[string][]UpstreamHealth)
+	if r, ok := p.fallback.(UpstreamHealthReporter); ok {
+		health = r.UpstreamHealth()
+	}
+	for i, r := range p.rules {
+		if r.Resolver != nil {
+			health["rule #"+strconv.Itoa(i+1)] = exchangerHealth(r.Resolver)
+		}
+	}
+	return health
+}
+
+// indexes of client scoped rules matching `client`, such as "0,2"
+func (p *RulePolicy) ClientScope(client net.IP) string {
+	var scope []string
+	for i, r := range p.rules {
+		if r.clients.Len() > 0 && r.matchClient(client) {
+			scope = append(scope, strconv.Itoa(i))
+		}
+	}
+	return strings.Join(scope, ",")
+}
+
+// indexes of listener scoped rules matching `listener`, such as "1"
+func (p *RulePolicy) ListenerScope(listener string) string {
+	var scope []string
+	for i, r := range p.rules {
+		if len(r.listeners) > 0 && r.matchListener(listener) {
+			scope = append(scope, strconv.Itoa(i))
+		}
+	}
+	return strings.Join(scope, ",")
+}
+
+func (p *RulePolicy) ResolveFor(ctx context.Context, trans Transport, req *dns.Msg) (*dns.Msg, error) {
+	if tr, ok := p.fallback.(TransportResolver); ok {
+		return tr.ResolveFor(ctx, trans, req)
+	}
+	return nil, errors.New("fallback routing policy is not able to resolve")
+}
+
+// resolve with the resolver or the transport of the first matched rule,
+// or with the fallback policy if none matches
+func (p *RulePolicy) ResolvePassthrough(q *RouteQuery) (*dns.Msg, error) {
+	for _, r := range p.rules {
+		if !r.match(q) {
+			continue
+		}
+		if r.Trans == TRANS_REJECT {
+			return MsgNewNXDomainReply(q.Req), nil
+		}
+		if r.Resolver != nil {
+			return r.Resolver.Resolve(q.Context(), q.Req)
+		}
+		return p.ResolveFor(q.Context(), r.Trans, q.Req)
+	}
+	if pr, ok := p.fallback.(PassthroughResolver); ok {
+		return pr.ResolvePassthrough(q)
+	}
+	d, err := p.fallback.Route(q)
+	if err != nil {
+		return nil, err
+	}
+	if d.Resp == nil {
+		return nil, errors.Errorf("routing policy did not resolve %s", q.Domain())
+	}
+	return d.Resp, nil
+}
+
+func (p *RulePolicy) apply(r *RoutingRule, q *RouteQuery) (*RouteDecision, error) {
+	// rejected domains are never resolved, nor cached
+	if r.Trans == TRANS_REJECT && q.Req != nil {
+		return &RouteDecision{Trans: TRANS_REJECT}, nil
+	}
+	// proxied domains are resolved by the proxy server, unless the answer is wanted
+	if q.Req == nil || (r.Trans == TRANS_PROXY && !q.NeedAnswer) {
+		return &RouteDecision{Trans: r.Trans, Outbound: r.Outbound, Cacheable: q.Req == nil}, nil
+	}
+	var resp *dns.Msg
+	var err error
+	if r.Resolver != nil {
+		resp, err = r.Resolver.Resolve(q.Context(), q.Req)
+	} else {
+		resp, err = p.ResolveFor(q.Context(), r.Trans, q.Req)
+	}
+	if err != nil {
+		if !q.NeedAnswer {
+			return &RouteDecision{Trans: r.Trans, Outbound: r.Outbound}, nil
+		}
+		return nil, err
+	}
+	return &RouteDecision{Trans: r.Trans, Outbound: r.Outbound, Resp: resp, Cacheable: true}, nil
+}
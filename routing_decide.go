@@ -0,0 +1,232 @@
+package dnsproxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// a resolution the default policy may need to decide a route, see decideRoute
+type routeStep int8
+
+const (
+	_ROUTE_STEP_PROXY        routeStep = iota // abroad dns server with edns-client-subnet of the proxy server
+	_ROUTE_STEP_DIRECT                        // chinese dns server
+	_ROUTE_STEP_ABROAD_LOCAL                  // abroad dns server with edns-client-subnet of local
+	_ROUTE_STEP_ASSIGNED                      // the resolver assigned to the domain, see SetResolverRegistry
+	_ROUTE_STEP_NUM
+)
+
+// result of a routeStep
+type routeResult struct {
+	resp     *dns.Msg
+	err      error
+	chinaIP  bool // the answered ip is Chinese mainland ip
+	poisoned bool // the answer of the chinese dns server is forged, see SetFakeIPs
+}
+
+// what the default policy knows about a RouteQuery, the input of decideRoute
+type routeState struct {
+	domain     bool // the destination is a domain, otherwise an ip
+	ipChina    bool // the destination ip is Chinese mainland ip
+	needAnswer bool // see RouteQuery.NeedAnswer
+
+	// the domain is forced to be rejected by user rules, or matched by (*DefaultRoutingPolicy).matchDomain
+	rejected, gfw, obedient bool
+	assigned                bool // the domain is resolved by its assigned resolver
+
+	results [_ROUTE_STEP_NUM]*routeResult // nil if not resolved yet
+}
+
+// --- impl *routeResult
+
+// check if the resolution succeeded with an answer which is not forged
+func (r *routeResult) answered() bool {
+	ans, _ := MsgExtractAnswer(r.resp)
+	return ans != nil && r.err == nil && !r.poisoned
+}
+
+// check if the resolution succeeded with an NXDOMAIN or NODATA response, see MsgIsNegative
+func (r *routeResult) negative() bool {
+	return r.err == nil && MsgIsNegative(r.resp)
+}
+
+// decide the route of `st` without any side effect, the decision may be cached if it is Cacheable,
+// or the resolutions needed to decide it if `next` is not empty:
+// next[0] is needed right now, and the others may be needed later so they could be resolved in advance
+func decideRoute(st *routeState) (d *RouteDecision, next []routeStep, err error) {
+	// 目标是 IP
+	//	-> 中国 IP 直连，外国 IP 代理
+	// 目标是域名
+	//	-> 判断域名是否被用户规则拒绝
+	//		-> 是 -> 拒绝
+	//	-> 判断域名是否指定了 DNS 服务器，见 SetResolverRegistry
+	//		-> 是 -> 若在 GFW list 中且不需要解析结果，代理
+	//			-> 否则使用指定的 DNS 服务器解析
+	//				-> 在 GFW list 中代理，在 obedient list 中直连，否则返回中国 IP 时直连，其余代理
+	//	-> 判断域名是否在 GFW list 中
+	//		-> 是 -> 代理 -> 若需要解析结果，使用 EDNS0 proxy + abroad dns server 查询
+	//		-> 否
+	//			-> 判断域名是否在 obedient list 中
+	//				-> 是 -> 直连 -> 使用 chinese dns server 解析
+	//					-> 域名不存在或无该类型记录（NXDOMAIN 或 NODATA） -> 直接返回
+	//					-> 失败（超时、SERVFAIL 或 REFUSED）或被污染 -> 若需要解析结果，使用 EDNS0 local + abroad dns server 重试（不缓存）
+	//				-> 否
+	//					-> 使用随便一个中国 IP + abroad dns server 解析
+	//						-> 域名不存在或无该类型记录 -> 代理 -> 直接返回，不再查询 chinese dns server
+	//						-> 成功
+	//							-> 判断是否返回中国 IP
+	//								-> 是 -> 使用 chinese dns server 再查一遍
+	//									-> 判断是否被污染（返回污染 IP，见 SetFakeIPs）
+	//										-> 否 -> 直连
+	//										-> 是 -> 代理，同下
+	//								-> 否 -> 代理 -> 若需要解析结果，使用 EDNS0 proxy + abroad dns server 的结果
+	//						-> 失败（超时、SERVFAIL 或 REFUSED） -> 使用 chinese dns server 解析
+	//							-> 判断是否被污染
+	//								-> 是 -> 代理 -> 若需要解析结果，使用 EDNS0 proxy + abroad dns server 查询
+	//								-> 否 -> 判断是否返回中国 IP
+	//									-> 是 -> 直连
+	//									-> 否 -> 代理
+	if !st.domain {
+		if st.ipChina {
+			return &RouteDecision{Trans: TRANS_DIRECT, Cacheable: true}, nil, nil
+		}
+		return &RouteDecision{Trans: TRANS_PROXY, Cacheable: true}, nil, nil
+	}
+	proxy, direct, abroadLocal := st.results[_ROUTE_STEP_PROXY], st.results[_ROUTE_STEP_DIRECT], st.results[_ROUTE_STEP_ABROAD_LOCAL]
+	switch {
+	case st.rejected:
+		return &RouteDecision{Trans: TRANS_REJECT}, nil, nil
+	case st.assigned:
+		return decideAssignedDomain(st)
+	case st.gfw: // domain is in gfw blacklist, forced or learned to be proxied
+		if !st.needAnswer {
+			return &RouteDecision{Trans: TRANS_PROXY}, nil, nil
+		}
+		if proxy == nil {
+			return nil, []routeStep{_ROUTE_STEP_PROXY}, nil
+		}
+		if proxy.err != nil {
+			return nil, nil, proxy.err
+		}
+		return &RouteDecision{Trans: TRANS_PROXY, Resp: proxy.resp, Cacheable: true}, nil, nil
+	case st.obedient: // domain is in gfw whitelist, forced or learned to be direct
+		if direct == nil {
+			return nil, []routeStep{_ROUTE_STEP_DIRECT}, nil
+		}
+		if direct.answered() || direct.negative() {
+			return &RouteDecision{Trans: TRANS_DIRECT, Resp: direct.resp, Cacheable: true}, nil, nil
+		}
+		if !st.needAnswer {
+			return &RouteDecision{Trans: TRANS_DIRECT}, nil, nil
+		}
+		// retry with abroad dns server, do not add to cache
+		if abroadLocal == nil {
+			return nil, []routeStep{_ROUTE_STEP_ABROAD_LOCAL}, nil
+		}
+		if abroadLocal.err != nil {
+			return nil, nil, abroadLocal.err
+		}
+		return &RouteDecision{Trans: TRANS_DIRECT, Resp: abroadLocal.resp}, nil, nil
+	default: // unknown domain
+		return decideUnknownDomain(st)
+	}
+}
+
+// see decideRoute
+func decideAssignedDomain(st *routeState) (*RouteDecision, []routeStep, error) {
+	if st.gfw && !st.needAnswer {
+		return &RouteDecision{Trans: TRANS_PROXY}, nil, nil
+	}
+	assigned := st.results[_ROUTE_STEP_ASSIGNED]
+	if assigned == nil {
+		return nil, []routeStep{_ROUTE_STEP_ASSIGNED}, nil
+	}
+	trans := TRANS_PROXY
+	if st.obedient || !st.gfw && assigned.answered() && assigned.chinaIP {
+		trans = TRANS_DIRECT
+	}
+	if assigned.err != nil {
+		if !st.needAnswer {
+			return &RouteDecision{Trans: trans}, nil, nil
+		}
+		return nil, nil, assigned.err
+	}
+	cacheable := assigned.answered() || assigned.negative()
+	return &RouteDecision{Trans: trans, Resp: assigned.resp, Cacheable: cacheable}, nil, nil
+}
+
+// see decideRoute
+func decideUnknownDomain(st *routeState) (*RouteDecision, []routeStep, error) {
+	proxy, direct, abroadLocal := st.results[_ROUTE_STEP_PROXY], st.results[_ROUTE_STEP_DIRECT], st.results[_ROUTE_STEP_ABROAD_LOCAL]
+
+	// abroad query with local ip, and abroad query with remote ip in advance,
+	// only if the answer for proxied domains is wanted
+	if abroadLocal == nil {
+		if st.needAnswer {
+			return nil, []routeStep{_ROUTE_STEP_ABROAD_LOCAL, _ROUTE_STEP_PROXY}, nil
+		}
+		return nil, []routeStep{_ROUTE_STEP_ABROAD_LOCAL}, nil
+	}
+	if abroadLocal.answered() && abroadLocal.resp.Rcode == dns.RcodeSuccess {
+		// succeeded to abroad query with local ip
+		resp := abroadLocal.resp
+		if abroadLocal.chinaIP {
+			// is Chinese mainland ip,
+			// try to query obedient dns server to improve `a` quality
+			if direct == nil {
+				return nil, []routeStep{_ROUTE_STEP_DIRECT}, nil
+			}
+			if !direct.poisoned {
+				if direct.answered() {
+					resp = direct.resp
+				}
+				return &RouteDecision{Trans: TRANS_DIRECT, Resp: resp, Cacheable: true}, nil, nil
+			}
+			// poisoned by the gfw, it is blocked though hosted in Chinese mainland
+		}
+		// abroad ip, try to improve resp with the result of abroad query with remote ip
+		if st.needAnswer {
+			if proxy == nil {
+				return nil, []routeStep{_ROUTE_STEP_PROXY}, nil
+			}
+			if ans, _ := MsgExtractAnswer(proxy.resp); ans != nil {
+				resp = proxy.resp
+			}
+		}
+		return &RouteDecision{Trans: TRANS_PROXY, Resp: resp, Cacheable: true}, nil, nil
+	}
+	if abroadLocal.negative() {
+		// nonexistent domain or type, which the obedient dns server can only confirm or forge
+		return &RouteDecision{Trans: TRANS_PROXY, Resp: abroadLocal.resp, Cacheable: true}, nil, nil
+	}
+
+	// failed to abroad query with local ip (timeout, SERVFAIL or REFUSED), try to query with obedient dns server
+	if direct == nil {
+		return nil, []routeStep{_ROUTE_STEP_DIRECT}, nil
+	}
+	if direct.err != nil { // all queries failed
+		if !st.needAnswer {
+			return &RouteDecision{Trans: TRANS_PROXY}, nil, nil
+		}
+		return nil, nil, direct.err
+	}
+	if direct.poisoned { // blocked, resolve it as gfw list domains
+		if !st.needAnswer {
+			return &RouteDecision{Trans: TRANS_PROXY}, nil, nil
+		}
+		if proxy == nil {
+			return nil, []routeStep{_ROUTE_STEP_PROXY}, nil
+		}
+		if proxy.err != nil {
+			return nil, nil, proxy.err
+		}
+		return &RouteDecision{Trans: TRANS_PROXY, Resp: proxy.resp, Cacheable: true}, nil, nil
+	}
+	if ans, _ := MsgExtractAnswer(direct.resp); ans != nil {
+		if direct.chinaIP {
+			return &RouteDecision{Trans: TRANS_DIRECT, Resp: direct.resp, Cacheable: true}, nil, nil
+		}
+		return &RouteDecision{Trans: TRANS_PROXY, Resp: direct.resp, Cacheable: true}, nil, nil
+	}
+	// negative answers are cached, but failures are not
+	return &RouteDecision{Trans: TRANS_PROXY, Resp: direct.resp, Cacheable: direct.negative()}, nil, nil
+}
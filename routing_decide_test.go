@@ -0,0 +1,224 @@
+package dnsproxy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// responses of routeResult for TestDecideRoute
+var (
+	decideChinaResp  = decideResp(dns.RcodeSuccess, "example.com. 60 IN A 114.114.114.114")
+	decideAbroadResp = decideResp(dns.RcodeSuccess, "example.com. 60 IN A 8.8.8.8")
+	decideProxyResp  = decideResp(dns.RcodeSuccess, "example.com. 60 IN A 8.8.4.4")
+	decideNXResp     = decideResp(dns.RcodeNameError)
+	decideNODATAResp = decideResp(dns.RcodeSuccess)
+	decideFailResp   = decideResp(dns.RcodeServerFailure)
+	decideErr        = errors.New("upstream timeout")
+)
+
+func decideResp(rcode int, rrs ...string) *dns.Msg {
+	m := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	m.Response, m.Rcode = true, rcode
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func decideResults(results map[routeStep]*routeResult) (r [_ROUTE_STEP_NUM]*routeResult) {
+	for step, result := range results {
+		r[step] = result
+	}
+	return
+}
+
+// one case per branch of the flowchart of decideRoute
+func TestDecideRoute(t *testing.T) {
+	china := &routeResult{resp: decideChinaResp, chinaIP: true}
+	abroad := &routeResult{resp: decideAbroadResp}
+	proxied := &routeResult{resp: decideProxyResp}
+	poisoned := &routeResult{resp: decideAbroadResp, poisoned: true}
+	nx := &routeResult{resp: decideNXResp}
+	nodata := &routeResult{resp: decideNODATAResp}
+	servfail := &routeResult{resp: decideFailResp}
+	failed := &routeResult{err: decideErr}
+
+	type R = map[routeStep]*routeResult
+	tests := []struct {
+		name    string
+		st      routeState
+		results R
+		want    *RouteDecision
+		next    []routeStep
+		err     error
+	}{
+		// ip destinations, such as those of the ip cache
+		{name: "ip china", st: routeState{ipChina: true},
+			want: &RouteDecision{Trans: TRANS_DIRECT, Cacheable: true}},
+		{name: "ip abroad", st: routeState{},
+			want: &RouteDecision{Trans: TRANS_PROXY, Cacheable: true}},
+
+		// blocked by user rules, even if listed
+		{name: "rejected", st: routeState{domain: true, rejected: true, gfw: true, needAnswer: true},
+			want: &RouteDecision{Trans: TRANS_REJECT}},
+
+		// assigned domains
+		{name: "assigned gfw without answer", st: routeState{domain: true, assigned: true, gfw: true},
+			want: &RouteDecision{Trans: TRANS_PROXY}},
+		{name: "assigned unresolved", st: routeState{domain: true, assigned: true, needAnswer: true},
+			next: []routeStep{_ROUTE_STEP_ASSIGNED}},
+		{name: "assigned china ip", st: routeState{domain: true, assigned: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ASSIGNED: china},
+			want:    &RouteDecision{Trans: TRANS_DIRECT, Resp: decideChinaResp, Cacheable: true}},
+		{name: "assigned abroad ip", st: routeState{domain: true, assigned: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ASSIGNED: abroad},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideAbroadResp, Cacheable: true}},
+		{name: "assigned gfw china ip", st: routeState{domain: true, assigned: true, gfw: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ASSIGNED: china},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideChinaResp, Cacheable: true}},
+		{name: "assigned obedient negative", st: routeState{domain: true, assigned: true, obedient: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ASSIGNED: nx},
+			want:    &RouteDecision{Trans: TRANS_DIRECT, Resp: decideNXResp, Cacheable: true}},
+		{name: "assigned servfail", st: routeState{domain: true, assigned: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ASSIGNED: servfail},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideFailResp}},
+		{name: "assigned failed", st: routeState{domain: true, assigned: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ASSIGNED: failed},
+			err:     decideErr},
+		{name: "assigned obedient failed without answer", st: routeState{domain: true, assigned: true, obedient: true},
+			results: R{_ROUTE_STEP_ASSIGNED: failed},
+			want:    &RouteDecision{Trans: TRANS_DIRECT}},
+
+		// gfw list
+		{name: "gfw without answer", st: routeState{domain: true, gfw: true},
+			want: &RouteDecision{Trans: TRANS_PROXY}},
+		{name: "gfw unresolved", st: routeState{domain: true, gfw: true, needAnswer: true},
+			next: []routeStep{_ROUTE_STEP_PROXY}},
+		{name: "gfw answered", st: routeState{domain: true, gfw: true, needAnswer: true},
+			results: R{_ROUTE_STEP_PROXY: proxied},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideProxyResp, Cacheable: true}},
+		{name: "gfw failed", st: routeState{domain: true, gfw: true, needAnswer: true},
+			results: R{_ROUTE_STEP_PROXY: failed},
+			err:     decideErr},
+
+		// obedient list
+		{name: "obedient unresolved", st: routeState{domain: true, obedient: true},
+			next: []routeStep{_ROUTE_STEP_DIRECT}},
+		{name: "obedient answered", st: routeState{domain: true, obedient: true, needAnswer: true},
+			results: R{_ROUTE_STEP_DIRECT: abroad},
+			want:    &RouteDecision{Trans: TRANS_DIRECT, Resp: decideAbroadResp, Cacheable: true}},
+		{name: "obedient nxdomain", st: routeState{domain: true, obedient: true, needAnswer: true},
+			results: R{_ROUTE_STEP_DIRECT: nx},
+			want:    &RouteDecision{Trans: TRANS_DIRECT, Resp: decideNXResp, Cacheable: true}},
+		{name: "obedient nodata", st: routeState{domain: true, obedient: true, needAnswer: true},
+			results: R{_ROUTE_STEP_DIRECT: nodata},
+			want:    &RouteDecision{Trans: TRANS_DIRECT, Resp: decideNODATAResp, Cacheable: true}},
+		{name: "obedient poisoned without answer", st: routeState{domain: true, obedient: true},
+			results: R{_ROUTE_STEP_DIRECT: poisoned},
+			want:    &RouteDecision{Trans: TRANS_DIRECT}},
+		{name: "obedient failed retried abroad", st: routeState{domain: true, obedient: true, needAnswer: true},
+			results: R{_ROUTE_STEP_DIRECT: servfail},
+			next:    []routeStep{_ROUTE_STEP_ABROAD_LOCAL}},
+		{name: "obedient failed answered abroad", st: routeState{domain: true, obedient: true, needAnswer: true},
+			results: R{_ROUTE_STEP_DIRECT: failed, _ROUTE_STEP_ABROAD_LOCAL: abroad},
+			want:    &RouteDecision{Trans: TRANS_DIRECT, Resp: decideAbroadResp}},
+		{name: "obedient failed twice", st: routeState{domain: true, obedient: true, needAnswer: true},
+			results: R{_ROUTE_STEP_DIRECT: poisoned, _ROUTE_STEP_ABROAD_LOCAL: failed},
+			err:     decideErr},
+
+		// unknown domains
+		{name: "unknown unresolved", st: routeState{domain: true, needAnswer: true},
+			next: []routeStep{_ROUTE_STEP_ABROAD_LOCAL, _ROUTE_STEP_PROXY}},
+		{name: "unknown unresolved without answer", st: routeState{domain: true},
+			next: []routeStep{_ROUTE_STEP_ABROAD_LOCAL}},
+		{name: "unknown china ip confirmed", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: china},
+			next:    []routeStep{_ROUTE_STEP_DIRECT}},
+		{name: "unknown china ip", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: china, _ROUTE_STEP_DIRECT: proxied},
+			want:    &RouteDecision{Trans: TRANS_DIRECT, Resp: decideProxyResp, Cacheable: true}},
+		{name: "unknown china ip unanswered directly", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: china, _ROUTE_STEP_DIRECT: servfail},
+			want:    &RouteDecision{Trans: TRANS_DIRECT, Resp: decideChinaResp, Cacheable: true}},
+		{name: "unknown china ip poisoned", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: china, _ROUTE_STEP_DIRECT: poisoned, _ROUTE_STEP_PROXY: proxied},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideProxyResp, Cacheable: true}},
+		{name: "unknown abroad ip without answer", st: routeState{domain: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: abroad},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideAbroadResp, Cacheable: true}},
+		{name: "unknown abroad ip unresolved by proxy", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: abroad},
+			next:    []routeStep{_ROUTE_STEP_PROXY}},
+		{name: "unknown abroad ip", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: abroad, _ROUTE_STEP_PROXY: proxied},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideProxyResp, Cacheable: true}},
+		{name: "unknown abroad ip failed by proxy", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: abroad, _ROUTE_STEP_PROXY: failed},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideAbroadResp, Cacheable: true}},
+		{name: "unknown nxdomain", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: nx},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideNXResp, Cacheable: true}},
+		{name: "unknown nodata", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: nodata},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideNODATAResp, Cacheable: true}},
+		{name: "unknown failed abroad", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: servfail},
+			next:    []routeStep{_ROUTE_STEP_DIRECT}},
+		{name: "unknown failed", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: failed, _ROUTE_STEP_DIRECT: failed},
+			err:     decideErr},
+		{name: "unknown failed without answer", st: routeState{domain: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: failed, _ROUTE_STEP_DIRECT: failed},
+			want:    &RouteDecision{Trans: TRANS_PROXY}},
+		{name: "unknown poisoned without answer", st: routeState{domain: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: failed, _ROUTE_STEP_DIRECT: poisoned},
+			want:    &RouteDecision{Trans: TRANS_PROXY}},
+		{name: "unknown poisoned unresolved by proxy", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: failed, _ROUTE_STEP_DIRECT: poisoned},
+			next:    []routeStep{_ROUTE_STEP_PROXY}},
+		{name: "unknown poisoned", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: failed, _ROUTE_STEP_DIRECT: poisoned, _ROUTE_STEP_PROXY: proxied},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideProxyResp, Cacheable: true}},
+		{name: "unknown poisoned failed by proxy", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: failed, _ROUTE_STEP_DIRECT: poisoned, _ROUTE_STEP_PROXY: failed},
+			err:     decideErr},
+		{name: "unknown direct china ip", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: failed, _ROUTE_STEP_DIRECT: china},
+			want:    &RouteDecision{Trans: TRANS_DIRECT, Resp: decideChinaResp, Cacheable: true}},
+		{name: "unknown direct abroad ip", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: failed, _ROUTE_STEP_DIRECT: abroad},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideAbroadResp, Cacheable: true}},
+		{name: "unknown direct nxdomain", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: failed, _ROUTE_STEP_DIRECT: nx},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideNXResp, Cacheable: true}},
+		{name: "unknown direct servfail", st: routeState{domain: true, needAnswer: true},
+			results: R{_ROUTE_STEP_ABROAD_LOCAL: failed, _ROUTE_STEP_DIRECT: servfail},
+			want:    &RouteDecision{Trans: TRANS_PROXY, Resp: decideFailResp}},
+	}
+	for _, tt := range tests {
+		st := tt.st
+		st.results = decideResults(tt.results)
+		d, next, err := decideRoute(&st)
+		if err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+		if !reflect.DeepEqual(next, tt.next) {
+			t.Errorf("%s: next = %v, want %v", tt.name, next, tt.next)
+		}
+		switch {
+		case d == nil && tt.want == nil:
+		case d == nil || tt.want == nil:
+			t.Errorf("%s: decision = %+v, want %+v", tt.name, d, tt.want)
+		case d.Trans != tt.want.Trans || d.Outbound != tt.want.Outbound || d.Resp != tt.want.Resp || d.Cacheable != tt.want.Cacheable:
+			t.Errorf("%s: decision = {%v %q %p %v}, want {%v %q %p %v}", tt.name,
+				d.Trans, d.Outbound, d.Resp, d.Cacheable, tt.want.Trans, tt.want.Outbound, tt.want.Resp, tt.want.Cacheable)
+		}
+	}
+}
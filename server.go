@@ -0,0 +1,311 @@
+package dnsproxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// DNS server and proxy server sharing the same caches and routing policy,
+// multiple independent Servers can run in the same process
+type Server struct {
+	ipcache     IPCache
+	domaincache DomainCache
+	negcache    negcache // NXDOMAIN and NODATA answers
+
+	policy RoutingPolicy // decides direct or proxy, see SetRoutingPolicy
+
+	override *OverrideZone   // optional static answers, see SetOverrideZone
+	leases   *DHCPLeases     // optional hostnames of LAN hosts, see SetDHCPLeases
+	rewriter *AnswerRewriter // optional rewriting of resolved answers, see SetAnswerRewriter
+
+	localZones []*LocalZone // authoritative zones, see AddLocalZone
+
+	dnsLimiter      *DNSLimiter       // optional abuse protection of ServeDNS, see SetDNSLimiter
+	dnstap          *DNSTap           // optional capture of queries of ServeDNS, see SetDNSTap
+	listenerTags    map[string]string // tags of listen addresses of ServeDNS, see SetListenerTags
+	dnsQueryTimeout time.Duration     // see SetDNSQueryTimeout
+	answerTTL       ttlBounds         // TTLs of answers of ServeDNS, see SetAnswerTTL
+	proxyACL        *ProxyACL         // optional access control of ServeProxy, see SetProxyACL
+	proxyLimiter    *ProxyLimiter     // optional overload protection of ServeProxy, see SetProxyLimiter
+	proxyTimeouts   *ProxyTimeouts    // optional reaping of dead connections of ServeProxy, see SetProxyTimeouts
+	relayBuffers    *RelayBuffers     // pooled buffers of ServeProxy, see SetRelayBuffers
+
+	preserveHost bool // see SetPreserveHostname
+	sniffSNI     bool // see SetSNISniffing
+
+	speculativeProxy bool // see SetSpeculativeProxy
+
+	proxyListeners int  // accept loops of ServeProxy sharing the address by SO_REUSEPORT, see SetProxyListenOptions
+	proxyFastOpen  bool // TCP Fast Open of ServeProxy, see SetProxyListenOptions
+
+	happyEyeballs *HappyEyeballs  // optional racing of direct connections, see SetHappyEyeballs
+	fallback      *DirectFallback // optional proxying of unreachable direct destinations, see SetDirectFallback
+
+	outbounds map[string]*ProxyPool // named proxy chains, see SetOutbound
+
+	directBind *OutboundBind // local address of direct connections, see SetOutboundBinds
+	proxyBind  *OutboundBind // local address of connections to proxy servers, see SetOutboundBinds
+
+	prefetch *prefetcher // access counters of dns queries, see EnablePrefetch
+
+	latency *LatencyStats // optional latencies of proxied connections, see SetLatencyStats
+
+	events *EventStream // optional live events for the dashboard, see SetEventStream
+	hooks  *Hooks       // optional callbacks of embedders, see SetHooks
+
+	dns64 *DNS64 // optional AAAA synthesis, see SetDNS64
+
+	rejectZeroIP bool // see SetRejectWithZeroIP
+
+	flights routeFlights // identical queries being routed, see routeCoalesced
+}
+
+// --- impl *Server
+func NewServer(ipc IPCache, domainc DomainCache,
+	dm DomainMatcher, ipMatchCHN func(net.IP) bool,
+	subnetLocalIP, subnetProxyIP net.IP,
+	dtObedient, dtAbroad DNSExchanger) *Server {
+	return &Server{
+		ipcache:     ipc,
+		domaincache: domainc,
+		negcache:    newNegcache(),
+		policy: NewDefaultRoutingPolicy(dm, ipMatchCHN,
+			subnetLocalIP, subnetProxyIP, dtObedient, dtAbroad),
+	}
+}
+
+// check if all fields are initialized
+func (s *Server) validate() error {
+	if s.ipcache.inner == nil ||
+		s.domaincache.inner == nil ||
+		s.policy == nil {
+		return errors.WithStack(ErrNotInitialized)
+	}
+	if v, ok := s.policy.(interface{ validate() error }); ok {
+		return v.validate()
+	}
+	return nil
+}
+
+// the policy routing destinations, a *DefaultRoutingPolicy unless replaced by SetRoutingPolicy
+func (s *Server) RoutingPolicy() RoutingPolicy {
+	return s.policy
+}
+
+// replace the routing policy, e.g. with a *RulePolicy falling back to the current one
+func (s *Server) SetRoutingPolicy(p RoutingPolicy) {
+	s.policy = p
+}
+
+// cache scope of `client`, see ClientScoper
+func (s *Server) clientScope(client net.IP) string {
+	if cs, ok := s.policy.(ClientScoper); ok {
+		return cs.ClientScope(client)
+	}
+	return ""
+}
+
+// cache scope of queries of `client` arriving on the dns listener tagged `listener`, see ClientScoper and ListenerScoper
+func (s *Server) queryScope(client net.IP, listener string) string {
+	scope := s.clientScope(client)
+	if ls, ok := s.policy.(ListenerScoper); ok {
+		if l := ls.ListenerScope(listener); l != "" {
+			scope += ";" + l
+		}
+	}
+	return scope
+}
+
+// cache the decision for clients in `scope` if it is cacheable and has an answer, or a negative one, see negcache
+func (s *Server) cacheDecision(scope, domain string, qtype uint16, d *RouteDecision) {
+	s.storeDecision(scope, domain, qtype, d, false)
+}
+
+// same as cacheDecision, cached items are replaced regardless of the cache policy if `replace`
+func (s *Server) storeDecision(scope, domain string, qtype uint16, d *RouteDecision, replace bool) {
+	if !d.Cacheable || d.Resp == nil {
+		return
+	}
+	if MsgIsNegative(d.Resp) {
+		s.negcache.Add(scope, domain, qtype, d.Resp, d.Trans)
+		return
+	}
+	if ans, ip := MsgExtractAnswer(d.Resp); ans != nil {
+		if replace {
+			s.domaincache.Set(scope, domain, qtype, d.Resp.Answer, d.Trans, d.Outbound)
+			s.ipcache.Set(scope, ip.String(), d.Trans, d.Outbound, RRsMinTTL(d.Resp.Answer))
+		} else {
+			s.domaincache.Add(scope, domain, qtype, d.Resp.Answer, d.Trans, d.Outbound)
+			s.ipcache.Add(scope, ip.String(), d.Trans, d.Outbound, RRsMinTTL(d.Resp.Answer))
+		}
+	}
+}
+
+// ip of `addr` if it is a *net.UDPAddr or *net.TCPAddr, otherwise nil
+func addrIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.UDPAddr:
+		return v.IP
+	case *net.TCPAddr:
+		return v.IP
+	}
+	return nil
+}
+
+// answer dns queries from `z` before looking up caches, nil to disable,
+// proxy requests to pinned domains are connected directly to the pinned ips, and those to blocked domains are refused
+func (s *Server) SetOverrideZone(z *OverrideZone) {
+	s.override = z
+}
+
+// rate limit and restrict clients of ServeDNS with `l`, nil to disable, must be called before serving
+func (s *Server) SetDNSLimiter(l *DNSLimiter) {
+	s.dnsLimiter = l
+}
+
+// capture queries of ServeDNS and ServeDoH and their responses into `t`, nil to disable,
+// queries to nameservers are captured by (*dnsTransport).SetDNSTap, must be called before serving
+func (s *Server) SetDNSTap(t *DNSTap) {
+	s.dnstap = t
+}
+
+// give up resolving a query of ServeDNS or ServeDoH, or the destination domain of a proxy request after `d`,
+// DNS_QUERY_TIMEOUT if not positive, must be called before serving
+func (s *Server) SetDNSQueryTimeout(d time.Duration) {
+	s.dnsQueryTimeout = d
+}
+
+// see SetDNSQueryTimeout
+func (s *Server) queryTimeout() time.Duration {
+	if s.dnsQueryTimeout <= 0 {
+		return DNS_QUERY_TIMEOUT
+	}
+	return s.dnsQueryTimeout
+}
+
+// restrict clients of ServeProxy and ServeProxyPool with `acl`, nil to allow everyone, must be called before serving
+func (s *Server) SetProxyACL(acl *ProxyACL) {
+	s.proxyACL = acl
+}
+
+// limit connections and bandwidth of ServeProxy and ServeShadowsocks with `l`, nil to disable, must be called before serving
+func (s *Server) SetProxyLimiter(l *ProxyLimiter) {
+	s.proxyLimiter = l
+}
+
+// close idle or long-lived connections of ServeProxy and ServeShadowsocks by `t`, nil to disable,
+// must be called before serving
+func (s *Server) SetProxyTimeouts(t *ProxyTimeouts) {
+	s.proxyTimeouts = t
+}
+
+// read requests and relay data of ServeProxy and ServeShadowsocks through buffers of `b`,
+// nil to allocate buffers for each connection, must be called before serving
+func (s *Server) SetRelayBuffers(b *RelayBuffers) {
+	s.relayBuffers = b
+}
+
+// run `listeners` accept loops of ServeProxy on sockets sharing the address by SO_REUSEPORT for multi-core machines,
+// and enable TCP Fast Open if `fastOpen`, both are only supported on linux, must be called before serving
+func (s *Server) SetProxyListenOptions(listeners int, fastOpen bool) {
+	s.proxyListeners = listeners
+	s.proxyFastOpen = fastOpen
+}
+
+// race all resolved ips of direct destinations of ServeProxy with `he`, nil to dial the first ip only,
+// must be called before serving
+func (s *Server) SetHappyEyeballs(he *HappyEyeballs) {
+	s.happyEyeballs = he
+}
+
+// connect destinations of ServeProxy through the proxy chains if they fail to be connected directly by `f`,
+// nil to disable, must be called before serving
+func (s *Server) SetDirectFallback(f *DirectFallback) {
+	s.fallback = f
+}
+
+// record how long connections of ServeProxy take to establish into `ls`, nil to disable,
+// dns queries are recorded by (*dnsTransport).SetLatencyStats, must be called before serving
+func (s *Server) SetLatencyStats(ls *LatencyStats) {
+	s.latency = ls
+}
+
+// answer queries of names in `z` authoritatively after looking up the override zone,
+// proxy requests to these names are connected directly, must be called before serving
+func (s *Server) AddLocalZone(z *LocalZone) {
+	s.localZones = append(s.localZones, z)
+}
+
+// answer from the most specific local zone of the questioned name
+func (s *Server) lookupLocalZones(req *dns.Msg) (*dns.Msg, bool) {
+	if len(s.localZones) == 0 || len(req.Question) == 0 {
+		return nil, false
+	}
+	var zone *LocalZone
+	longest := -1
+	for _, z := range s.localZones {
+		if n, ok := z.match(req.Question[0].Name, req.Question[0].Qtype); ok && n > longest {
+			zone, longest = z, n
+		}
+	}
+	if zone == nil {
+		return nil, false
+	}
+	return zone.Lookup(req)
+}
+
+// check if `name` is pinned to ips by the override zone
+func (s *Server) pinnedByOverride(name string) bool {
+	if s.override == nil {
+		return false
+	}
+	ips, _ := s.override.lookupHost(name)
+	return len(ips) > 0
+}
+
+// check if `name` is in any local zone
+func (s *Server) inLocalZones(name string) bool {
+	for _, z := range s.localZones {
+		if _, ok := z.match(name, dns.TypeA); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// when a direct socks5 CONNECT to a domain is redirected to its resolved ip,
+// dial the ip by ourselves and keep the requested host name instead of rewriting the request to the ip,
+// http proxy requests always keep their Host header
+func (s *Server) SetPreserveHostname(enable bool) {
+	s.preserveHost = enable
+}
+
+// proxy destinations whose RouteDecision.Outbound is `name` through `pool` instead of the default proxy chains,
+// destinations of unknown outbounds go through the default ones
+func (s *Server) SetOutbound(name string, pool *ProxyPool) {
+	if s.outbounds == nil {
+		s.outbounds = make(map[string]*ProxyPool)
+	}
+	s.outbounds[name] = pool
+}
+
+// drop all cached routing decisions, e.g. after domain lists or ip lists are reloaded
+func (s *Server) FlushCaches() {
+	s.ipcache.Flush()
+	s.domaincache.Flush()
+	s.negcache.Flush()
+}
+
+// routing decisions of ips cached by the server, shared with the one passed to NewServer
+func (s *Server) IPCache() IPCache {
+	return s.ipcache
+}
+
+// answers of domains cached by the server, shared with the one passed to NewServer,
+// negative answers are cached separately and are not in it
+func (s *Server) DomainCache() DomainCache {
+	return s.domaincache
+}
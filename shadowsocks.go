@@ -0,0 +1,406 @@
+package dnsproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ARwMq9b6/libgost"
+	ss "github.com/ARwMq9b6/libgost/vendors/github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// a shadowsocks client must send its destination in this long after connecting
+	_SHADOWSOCKS_HANDSHAKE_TIMEOUT = 30 * time.Second
+
+	// max payload size of an AEAD chunk, see https://shadowsocks.org/en/wiki/AEAD-Ciphers.html
+	_SHADOWSOCKS_MAX_PAYLOAD = 0x3FFF
+)
+
+// AEAD methods of shadowsocks, stream methods are provided by the shadowsocks package of libgost
+var shadowsocksAEADMethods = map[string]struct {
+	keyLen  int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}{
+	"aes-128-gcm":            {16, newAESGCM},
+	"aes-192-gcm":            {24, newAESGCM},
+	"aes-256-gcm":            {32, newAESGCM},
+	"chacha20-ietf-poly1305": {32, chacha20poly1305.New},
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// method and password shared by shadowsocks clients
+type ShadowsocksCipher struct {
+	// AEAD methods
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+
+	stream *ss.Cipher // stream methods, nil for AEAD ones
+}
+
+// `method` is an AEAD method such as "chacha20-ietf-poly1305" and "aes-256-gcm",
+// or a legacy stream method such as "aes-256-cfb", which is weak and only for old clients
+func NewShadowsocksCipher(method, password string) (*ShadowsocksCipher, error) {
+	if password == "" {
+		return nil, errors.New("empty shadowsocks password")
+	}
+	method = strings.ToLower(method)
+	if m, ok := shadowsocksAEADMethods[method]; ok {
+		return &ShadowsocksCipher{key: evpBytesToKey(password, m.keyLen), newAEAD: m.newAEAD}, nil
+	}
+	// one time auth of stream methods, i.e. "-auth" methods, is deprecated and not supported
+	if method == "" || ss.CheckCipherMethod(method) != nil {
+		methods := make([]string, 0, len(shadowsocksAEADMethods))
+		for m := range shadowsocksAEADMethods {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+		return nil, errors.Errorf("unsupported shadowsocks method %q, use one of %s or a stream method",
+			method, strings.Join(methods, ", "))
+	}
+	stream, err := ss.NewCipher(method, password)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &ShadowsocksCipher{stream: stream}, nil
+}
+
+// --- impl *ShadowsocksCipher
+
+// wrap the client connection `conn`, reads are decrypted and writes are encrypted
+func (c *ShadowsocksCipher) serverConn(conn net.Conn) net.Conn {
+	if c.stream != nil {
+		return &shadowsocksStreamConn{Conn: ss.NewConn(conn, c.stream.Copy())}
+	}
+	return &shadowsocksAEADConn{Conn: conn, key: c.key, newAEAD: c.newAEAD}
+}
+
+// master key derived from the password, the same as EVP_BytesToKey of OpenSSL with md5 and no salt
+func evpBytesToKey(password string, keyLen int) []byte {
+	var key, prev []byte
+	for len(key) < keyLen {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keyLen]
+}
+
+// writes of *ss.Conn count the iv in, which confuses io.Copy
+type shadowsocksStreamConn struct {
+	*ss.Conn
+}
+
+func (c *shadowsocksStreamConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// stream of AEAD chunks, each direction starts with a random salt from which its subkey is derived
+type shadowsocksAEADConn struct {
+	net.Conn
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+
+	r       cipher.AEAD // nil until the salt is read
+	rnonce  []byte
+	pending []byte // decrypted payload which is not read yet
+
+	w      cipher.AEAD // nil until the salt is written
+	wnonce []byte
+}
+
+// --- impl *shadowsocksAEADConn
+
+// AEAD of the subkey derived from `salt`
+func (c *shadowsocksAEADConn) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := c.newAEAD(subkey)
+	return aead, errors.WithStack(err)
+}
+
+func (c *shadowsocksAEADConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// read and decrypt the next chunk into c.pending
+func (c *shadowsocksAEADConn) readChunk() error {
+	if c.r == nil {
+		salt := make([]byte, len(c.key))
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+		aead, err := c.aead(salt)
+		if err != nil {
+			return err
+		}
+		c.r, c.rnonce = aead, make([]byte, aead.NonceSize())
+	}
+	overhead := c.r.Overhead()
+	buf := make([]byte, 2+overhead)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	size, err := c.r.Open(buf[:0], c.rnonce, buf, nil)
+	if err != nil {
+		return errors.Wrap(err, "shadowsocks decryption")
+	}
+	incrementNonce(c.rnonce)
+
+	buf = make([]byte, int(binary.BigEndian.Uint16(size)&_SHADOWSOCKS_MAX_PAYLOAD)+overhead)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	if c.pending, err = c.r.Open(buf[:0], c.rnonce, buf, nil); err != nil {
+		return errors.Wrap(err, "shadowsocks decryption")
+	}
+	incrementNonce(c.rnonce)
+	return nil
+}
+
+func (c *shadowsocksAEADConn) Write(b []byte) (int, error) {
+	var out []byte
+	if c.w == nil {
+		salt := make([]byte, len(c.key))
+		if _, err := rand.Read(salt); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		aead, err := c.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.w, c.wnonce = aead, make([]byte, aead.NonceSize())
+		// sent along with the first chunk
+		out = salt
+	}
+	for n := 0; n < len(b); {
+		payload := b[n:]
+		if len(payload) > _SHADOWSOCKS_MAX_PAYLOAD {
+			payload = payload[:_SHADOWSOCKS_MAX_PAYLOAD]
+		}
+		n += len(payload)
+
+		size := make([]byte, 2)
+		binary.BigEndian.PutUint16(size, uint16(len(payload)))
+		out = c.w.Seal(out, c.wnonce, size, nil)
+		incrementNonce(c.wnonce)
+		out = c.w.Seal(out, c.wnonce, payload, nil)
+		incrementNonce(c.wnonce)
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// increment the little-endian counter `nonce`
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// destination of a shadowsocks connection, which is always connected by ourselves
+type shadowsocksRequest struct {
+	host     string
+	addrType uint8
+	port     uint16
+
+	conn     net.Conn
+	proxy    *gost.ProxyServer
+	redirect net.IP                              // ip to dial instead of the requested domain, nil if not redirected
+	dial     func(port string) (net.Conn, error) // dials by ourselves instead of `redirect` if not nil
+}
+
+// read the destination address at the start of the decrypted stream `conn`, in the form of socks5 addresses
+func readShadowsocksRequest(conn net.Conn) (*shadowsocksRequest, error) {
+	b := make([]byte, 1+1+255+2) // ATYP, length of domain, domain, port
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	r := &shadowsocksRequest{addrType: b[0], conn: conn}
+	var addr []byte
+	switch b[0] {
+	case AddrIPv4, AddrIPv6:
+		addr = b[1 : 1+net.IPv4len]
+		if b[0] == AddrIPv6 {
+			addr = b[1 : 1+net.IPv6len]
+		}
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		r.host = net.IP(addr).String()
+	case AddrDomain:
+		if _, err := io.ReadFull(conn, b[1:2]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		addr = b[2 : 2+int(b[1])]
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if ip := net.ParseIP(string(addr)); ip != nil {
+			r.host, r.addrType = ip.String(), addrTypeOf(ip)
+		} else {
+			r.host = normalizeDomain(string(addr))
+		}
+	default:
+		return nil, errors.Errorf("unsupported shadowsocks address type %d", b[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	r.port = binary.BigEndian.Uint16(port)
+	return r, nil
+}
+
+// --- impl requester for *shadowsocksRequest
+
+func (r *shadowsocksRequest) setRedirect(ip net.IP) {
+	r.redirect = ip
+}
+
+func (r *shadowsocksRequest) setDialer(dial func(port string) (net.Conn, error)) {
+	r.dial = dial
+}
+
+func (r *shadowsocksRequest) getHostName() string {
+	return r.host
+}
+
+func (r *shadowsocksRequest) getAddrType() uint8 {
+	return r.addrType
+}
+
+func (r *shadowsocksRequest) getPort() string {
+	return strconv.Itoa(int(r.port))
+}
+
+func (r *shadowsocksRequest) setProxyServer(ps *gost.ProxyServer) {
+	r.proxy = ps
+}
+
+func (r *shadowsocksRequest) isConnect() bool {
+	return true
+}
+
+// shadowsocks has no reply
+func (r *shadowsocksRequest) replyEarly() (net.Conn, error) {
+	return r.conn, nil
+}
+
+func (r *shadowsocksRequest) setConn(conn net.Conn) {
+	r.conn = conn
+}
+
+func (r *shadowsocksRequest) setHostName(host string) {
+	r.host, r.addrType = host, AddrDomain
+}
+
+func (r *shadowsocksRequest) getHostHeaderDomain() string {
+	return ""
+}
+
+func (r *shadowsocksRequest) getProtocol() string {
+	return ""
+}
+
+func (r *shadowsocksRequest) exec(bufs *RelayBuffers) {
+	addr, c, err := dialRedirect(r.proxy.Chain, r.redirect, r.dial, r.host, r.getPort())
+	if err != nil {
+		glog.Warningf("shadowsocks %s -> %s (%s): %s\n", r.conn.RemoteAddr(), net.JoinHostPort(r.host, r.getPort()), addr, err)
+		return
+	}
+	defer c.Close()
+	relayConns(r.conn, c, bufs)
+}
+
+// --- impl *Server
+
+// serve shadowsocks at `laddr` for clients sharing `cipher`, destinations are routed
+// and connected as those of ServeProxyPool, through `direct` or chains of `pool` and outbounds,
+// only tcp is relayed, the allowed clients of SetProxyACL apply as well
+func (s *Server) ServeShadowsocks(laddr string, cipher *ShadowsocksCipher, pool *ProxyPool, direct *gost.ProxyChain) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if err := pool.validate(); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer l.Close()
+	serverDirect := gost.NewProxyServer(gost.ProxyNode{}, direct, nil)
+
+	return acceptConns(l, "shadowsocks", func(conn net.Conn) {
+		if err := s.handleShadowsocksConn(conn, cipher, pool, serverDirect); err != nil {
+			glog.V(1).Infof("shadowsocks %s: %s\n", conn.RemoteAddr(), err)
+		}
+	})
+}
+
+func (s *Server) handleShadowsocksConn(conn net.Conn, cipher *ShadowsocksCipher, pool *ProxyPool, serverDirect *gost.ProxyServer) error {
+	client := addrIP(conn.RemoteAddr())
+	if s.proxyACL != nil && !s.proxyACL.allowClient(client) {
+		conn.Close()
+		glog.Warningf("shadowsocks %s rejected: client is not allowed\n", conn.RemoteAddr())
+		return nil
+	}
+
+	conn, admitted := s.proxyLimiter.admit(conn)
+	if !admitted {
+		// nothing can be replied before the handshake
+		conn.Close()
+		glog.Warningf("shadowsocks %s rejected: too many connections\n", conn.RemoteAddr())
+		return nil
+	}
+	conn = cipher.serverConn(s.proxyTimeouts.watch(conn))
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(_SHADOWSOCKS_HANDSHAKE_TIMEOUT))
+	req, err := readShadowsocksRequest(conn)
+	if err != nil {
+		// e.g. a wrong password, or probing of the port
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return s.handleProxyRequest(client, req, pool, serverDirect)
+}
@@ -0,0 +1,137 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// conn of tests reading from `r` and writing to `w`
+type testBufConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *testBufConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *testBufConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func TestEvpBytesToKey(t *testing.T) {
+	// openssl enc -aes-256-cbc -md md5 -nosalt -pass pass:foobar -P
+	want := "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf"
+	for _, keyLen := range []int{16, 24, 32} {
+		if got := hex.EncodeToString(evpBytesToKey("foobar", keyLen)); got != want[:keyLen*2] {
+			t.Errorf("key of %d bytes %s, want %s", keyLen, got, want[:keyLen*2])
+		}
+	}
+}
+
+func TestIncrementNonce(t *testing.T) {
+	tests := []struct {
+		nonce, want []byte
+	}{
+		{[]byte{0, 0, 0}, []byte{1, 0, 0}},
+		{[]byte{0xFF, 0, 0}, []byte{0, 1, 0}},
+		{[]byte{0xFF, 0xFF, 7}, []byte{0, 0, 8}},
+		{[]byte{0xFF, 0xFF, 0xFF}, []byte{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		nonce := append([]byte(nil), tt.nonce...)
+		incrementNonce(nonce)
+		if !bytes.Equal(nonce, tt.want) {
+			t.Errorf("%x incremented to %x, want %x", tt.nonce, nonce, tt.want)
+		}
+	}
+}
+
+// chunks written by go-shadowsocks2, the reference implementation, with aes-256-gcm, password "foobar"
+// and the salt 00 01 ... 1f
+func TestShadowsocksAEADConnVector(t *testing.T) {
+	cipher, err := NewShadowsocksCipher("aes-256-gcm", "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := make([]byte, 32)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	large := make([]byte, _SHADOWSOCKS_MAX_PAYLOAD+1000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	tests := []struct {
+		payload []byte
+		size    int
+		want    string // hex of the chunks, or of their sha256 if they are large
+	}{
+		{[]byte("hello shadowsocks"), 2 + 16 + 17 + 16,
+			"26edee7684c5fe3cba1d9fb5a151ecabfde34f761ca44260da1655a88ec046f61a243b3af1ca3eff88715797c773e0a3060cd9"},
+		// split into chunks of 0x3FFF and 1000 bytes
+		{large, (2 + 16 + _SHADOWSOCKS_MAX_PAYLOAD + 16) + (2 + 16 + 1000 + 16),
+			"be42d6c8ca00c06084d8333151789d2e4ba46becda3f90a4c09928b85a2ca754"},
+	}
+	for _, tt := range tests {
+		conn := &testBufConn{}
+		c := cipher.serverConn(conn).(*shadowsocksAEADConn)
+		if c.w, err = c.aead(salt); err != nil {
+			t.Fatal(err)
+		}
+		c.wnonce = make([]byte, c.w.NonceSize())
+		if _, err := c.Write(tt.payload); err != nil {
+			t.Fatal(err)
+		}
+		out := conn.w.Bytes()
+		got := hex.EncodeToString(out)
+		if len(out) > 1024 {
+			sum := sha256.Sum256(out)
+			got = hex.EncodeToString(sum[:])
+		}
+		if len(out) != tt.size || got != tt.want {
+			t.Errorf("payload of %d bytes: wrote %d bytes %s, want %d bytes %s", len(tt.payload), len(out), got, tt.size, tt.want)
+		}
+
+		// and read back
+		read, err := ioutil.ReadAll(cipher.serverConn(&testBufConn{r: io.MultiReader(bytes.NewReader(salt), bytes.NewReader(out))}))
+		if err != nil || !bytes.Equal(read, tt.payload) {
+			t.Errorf("payload of %d bytes: read %d bytes, %v", len(tt.payload), len(read), err)
+		}
+	}
+}
+
+func TestShadowsocksAEADHandshake(t *testing.T) {
+	client, err := NewShadowsocksCipher("chacha20-ietf-poly1305", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := append([]byte{AddrDomain, byte(len("example.com"))}, "example.com"...)
+	request = append(request, 0x01, 0xBB)
+
+	for _, password := range []string{"password", "wrong password"} {
+		server, err := NewShadowsocksCipher("chacha20-ietf-poly1305", password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := &testBufConn{}
+		if _, err := client.serverConn(conn).Write(request); err != nil {
+			t.Fatal(err)
+		}
+		req, err := readShadowsocksRequest(server.serverConn(&testBufConn{r: bytes.NewReader(conn.w.Bytes())}))
+		if password != "password" {
+			if err == nil || !strings.Contains(err.Error(), "decryption") {
+				t.Errorf("%s: read %v, want a decryption error", password, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", password, err)
+		}
+		if req.getHostName() != "example.com" || req.getPort() != "443" {
+			t.Errorf("%s: read %s:%s, want example.com:443", password, req.getHostName(), req.getPort())
+		}
+	}
+}
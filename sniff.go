@@ -0,0 +1,189 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// how long to wait for the TLS ClientHello of a CONNECT to an ip,
+// clients of protocols where servers speak first are connected by the ip after that
+const SNI_SNIFF_TIMEOUT = 500 * time.Millisecond
+
+// max length of a TLS record, sniffed ClientHellos must fit in one record
+const _TLS_MAX_RECORD_LEN = 16384 + 2048
+
+// application protocols told by the first data from clients, for "protocol:" patterns of routing rules,
+// protocols where servers speak first, such as SMTP, are never sniffed
+var SNIFFED_PROTOCOLS = []string{"tls", "http", "ssh", "bittorrent"}
+
+// HTTP/1 methods and the HTTP/2 connection preface
+var _HTTP_REQUEST_PREFIXES = [...]string{
+	"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "CONNECT ", "OPTIONS ", "TRACE ", "PATCH ", "PRI * HTTP/2",
+}
+
+// --- impl *Server
+
+// when a client CONNECTs to an ip, reply success before connecting, and peek the TLS ClientHello
+// to route the connection by its server name (SNI) with domain rules instead of by the ip,
+// must be called before serving
+func (s *Server) SetSNISniffing(enable bool) {
+	s.sniffSNI = enable
+}
+
+// reply the CONNECT request of `reqer` early and replace the requested ip with the sniffed server name if any,
+// the peeked data is replayed to the destination, returns the protocol told by the peeked data
+func (s *Server) sniffServerName(reqer requester) (protocol string, err error) {
+	conn, err := reqer.replyEarly()
+	if err != nil {
+		return "", err
+	}
+	name, peeked := sniffTLSServerName(conn, SNI_SNIFF_TIMEOUT)
+	reqer.setConn(newConnLeftAppendReader(conn, bytes.NewReader(peeked)))
+	if name != "" {
+		glog.V(1).Infof("proxy %s %s sniffed server name %s\n", conn.RemoteAddr(), reqer.getHostName(), name)
+		reqer.setHostName(name)
+	}
+	return sniffProtocol(peeked), nil
+}
+
+// reply the CONNECT request of `reqer` early and wait for the first data from the client within SNI_SNIFF_TIMEOUT,
+// the peeked data is replayed to the destination, returns the protocol told by the peeked data
+func (s *Server) sniffConnProtocol(reqer requester) (protocol string, err error) {
+	conn, err := reqer.replyEarly()
+	if err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(SNI_SNIFF_TIMEOUT))
+	buf := make([]byte, 512)
+	n, _ := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	reqer.setConn(newConnLeftAppendReader(conn, bytes.NewReader(buf[:n])))
+	return sniffProtocol(buf[:n]), nil
+}
+
+// one of SNIFFED_PROTOCOLS told by the first data `b` from a client, empty if unknown
+func sniffProtocol(b []byte) string {
+	switch {
+	case len(b) >= 3 && b[0] == 0x16 && b[1] == 0x03: // handshake record
+		return "tls"
+	case bytes.HasPrefix(b, []byte("SSH-")):
+		return "ssh"
+	case bytes.HasPrefix(b, []byte("\x13BitTorrent protocol")):
+		return "bittorrent"
+	}
+	for _, prefix := range _HTTP_REQUEST_PREFIXES {
+		if bytes.HasPrefix(b, []byte(prefix)) {
+			return "http"
+		}
+	}
+	return ""
+}
+
+func isSniffedProtocol(protocol string) bool {
+	for _, p := range SNIFFED_PROTOCOLS {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// read the TLS ClientHello from `conn` within `timeout` and find the server name in it,
+// returns all read bytes, name is empty if the data is not a ClientHello with a domain as the server name
+func sniffTLSServerName(conn net.Conn, timeout time.Duration) (name string, peeked []byte) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 4096)
+	for len(peeked) < 5+_TLS_MAX_RECORD_LEN {
+		n, err := conn.Read(buf)
+		peeked = append(peeked, buf[:n]...)
+		// not a handshake record
+		if len(peeked) > 0 && peeked[0] != 0x16 {
+			return "", peeked
+		}
+		if len(peeked) >= 5 {
+			record, _, ok := readTLSVector(peeked[3:], 2)
+			if ok {
+				name = parseClientHelloServerName(record)
+				if net.ParseIP(name) != nil || !strings.Contains(name, ".") {
+					name = ""
+				}
+				return normalizeDomain(name), peeked
+			}
+		}
+		if err != nil {
+			return "", peeked
+		}
+	}
+	return "", peeked
+}
+
+// the host name of the server_name extension of a ClientHello handshake message, empty if there is none
+func parseClientHelloServerName(b []byte) string {
+	if len(b) < 4 || b[0] != 0x01 { // client_hello
+		return ""
+	}
+	b, _, ok := readTLSVector(b[1:], 3)
+	// client version and random
+	if !ok || len(b) < 34 {
+		return ""
+	}
+	b = b[34:]
+	// session id, cipher suites and compression methods
+	for _, lenBytes := range [...]int{1, 2, 1} {
+		if _, b, ok = readTLSVector(b, lenBytes); !ok {
+			return ""
+		}
+	}
+	exts, _, ok := readTLSVector(b, 2)
+	if !ok {
+		return ""
+	}
+	for len(exts) >= 4 {
+		typ := int(exts[0])<<8 | int(exts[1])
+		var data []byte
+		if data, exts, ok = readTLSVector(exts[2:], 2); !ok {
+			return ""
+		}
+		if typ != 0 { // server_name
+			continue
+		}
+		list, _, ok := readTLSVector(data, 2)
+		if !ok {
+			return ""
+		}
+		for len(list) >= 3 {
+			nameType := list[0]
+			var name []byte
+			if name, list, ok = readTLSVector(list[1:], 2); !ok {
+				return ""
+			}
+			if nameType == 0 { // host_name
+				return string(name)
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// the vector prefixed by its length of `lenBytes` bytes at the beginning of `b`, and the rest of `b`
+func readTLSVector(b []byte, lenBytes int) (vec, rest []byte, ok bool) {
+	if len(b) < lenBytes {
+		return nil, nil, false
+	}
+	n := 0
+	for _, c := range b[:lenBytes] {
+		n = n<<8 | int(c)
+	}
+	b = b[lenBytes:]
+	if len(b) < n {
+		return nil, nil, false
+	}
+	return b[:n], b[n:], true
+}
@@ -0,0 +1,178 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/ARwMq9b6/libgost"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	_SOCKS4_VERSION     = 4
+	_SOCKS4_CMD_CONNECT = 1
+	_SOCKS4_GRANTED     = 90
+	_SOCKS4_REJECTED    = 91
+
+	// max length of the user id and the domain of socks4a
+	_SOCKS4_MAX_FIELD = 255
+)
+
+// CONNECT request of socks4 or socks4a, which is always connected by ourselves as there is no socks4 server in gost
+type socks4Request struct {
+	cmd      byte
+	host     string // ip, or domain of socks4a
+	addrType uint8
+	port     uint16
+
+	conn     net.Conn
+	proxy    *gost.ProxyServer
+	redirect net.IP                              // ip to dial instead of the requested domain, nil if not redirected
+	dial     func(port string) (net.Conn, error) // dials by ourselves instead of `redirect` if not nil
+	replied  bool                                // success has been replied before connecting
+}
+
+// read a socks4 or socks4a request from `conn` whose first byte is _SOCKS4_VERSION
+func readSocks4Request(conn net.Conn) (*socks4Request, error) {
+	var head [8]byte // VN, CD, DSTPORT, DSTIP
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if head[0] != _SOCKS4_VERSION {
+		return nil, errors.Errorf("bad socks4 version %d", head[0])
+	}
+	r := &socks4Request{cmd: head[1], port: binary.BigEndian.Uint16(head[2:4]), conn: conn}
+	// the user id is ignored as it authenticates nothing
+	if _, err := readSocks4String(conn); err != nil {
+		return nil, err
+	}
+
+	ip := net.IPv4(head[4], head[5], head[6], head[7])
+	// socks4a: DSTIP is 0.0.0.x with x != 0 and the domain follows the user id
+	if head[4] == 0 && head[5] == 0 && head[6] == 0 && head[7] != 0 {
+		domain, err := readSocks4String(conn)
+		if err != nil {
+			return nil, err
+		}
+		if domain == "" {
+			return nil, errors.New("empty socks4a domain")
+		}
+		if ip := net.ParseIP(domain); ip != nil {
+			r.host, r.addrType = ip.String(), addrTypeOf(ip)
+		} else {
+			r.host, r.addrType = normalizeDomain(domain), AddrDomain
+		}
+		return r, nil
+	}
+	r.host, r.addrType = ip.String(), AddrIPv4
+	return r, nil
+}
+
+// read a null terminated string of at most _SOCKS4_MAX_FIELD bytes,
+// byte by byte as the rest of the connection belongs to the destination
+func readSocks4String(r io.Reader) (string, error) {
+	var buf []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", errors.WithStack(err)
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) == _SOCKS4_MAX_FIELD {
+			return "", errors.New("socks4 field is too long")
+		}
+		buf = append(buf, b[0])
+	}
+}
+
+// write a reply of `code` with the bound address `addr`, which may be nil
+func writeSocks4Reply(w io.Writer, code byte, addr net.Addr) error {
+	reply := make([]byte, 8)
+	reply[1] = code
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(reply[2:4], uint16(tcpAddr.Port))
+			copy(reply[4:], ip4)
+		}
+	}
+	_, err := w.Write(reply)
+	return errors.WithStack(err)
+}
+
+// --- impl requester for *socks4Request
+
+func (r *socks4Request) setRedirect(ip net.IP) {
+	r.redirect = ip
+}
+
+func (r *socks4Request) setDialer(dial func(port string) (net.Conn, error)) {
+	r.dial = dial
+}
+
+func (r *socks4Request) getHostName() string {
+	return r.host
+}
+
+func (r *socks4Request) getAddrType() uint8 {
+	return r.addrType
+}
+
+func (r *socks4Request) getPort() string {
+	return strconv.Itoa(int(r.port))
+}
+
+func (r *socks4Request) setProxyServer(ps *gost.ProxyServer) {
+	r.proxy = ps
+}
+
+func (r *socks4Request) isConnect() bool {
+	return r.cmd == _SOCKS4_CMD_CONNECT
+}
+
+func (r *socks4Request) replyEarly() (net.Conn, error) {
+	r.replied = true
+	if err := writeSocks4Reply(r.conn, _SOCKS4_GRANTED, nil); err != nil {
+		return nil, err
+	}
+	return r.conn, nil
+}
+
+func (r *socks4Request) setConn(conn net.Conn) {
+	r.conn = conn
+}
+
+func (r *socks4Request) setHostName(host string) {
+	r.host, r.addrType = host, AddrDomain
+}
+
+func (r *socks4Request) getHostHeaderDomain() string {
+	return ""
+}
+
+func (r *socks4Request) getProtocol() string {
+	return ""
+}
+
+func (r *socks4Request) exec(bufs *RelayBuffers) {
+	addr, c, err := dialRedirect(r.proxy.Chain, r.redirect, r.dial, r.host, r.getPort())
+	if err != nil {
+		glog.Warningf("socks4 %s -> %s (%s): %s\n", r.conn.RemoteAddr(), net.JoinHostPort(r.host, r.getPort()), addr, err)
+		if !r.replied {
+			writeSocks4Reply(r.conn, _SOCKS4_REJECTED, nil)
+		}
+		return
+	}
+	defer c.Close()
+
+	if !r.replied {
+		if err := writeSocks4Reply(r.conn, _SOCKS4_GRANTED, c.LocalAddr()); err != nil {
+			return
+		}
+	}
+	relayConns(r.conn, c, bufs)
+}
@@ -0,0 +1,452 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// proxy.Dialer dials "tcp" with SOCKS5 CONNECT and "udp" with SOCKS5 UDP ASSOCIATE
+//
+// One association is shared by all udp conns and re-established once it is broken,
+// replies are demultiplexed to udp conns by DNS message ID and the source address reported by the relay,
+// so udp conns are only for DNS queries of nameservers of ip addresses
+type Socks5Dialer struct {
+	server string
+	auth   *proxy.Auth
+	tcp    proxy.Dialer
+	bind   *OutboundBind // local address of connections to the server, see SetOutboundBind
+
+	mu    sync.Mutex
+	assoc *socks5Association
+}
+
+// --- impl *Socks5Dialer
+func NewSocks5Dialer(server string, auth *proxy.Auth) (*Socks5Dialer, error) {
+	tcp, err := proxy.SOCKS5("tcp", server, auth, proxy.Direct)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Socks5Dialer{server: server, auth: auth, tcp: tcp}, nil
+}
+
+// connect the socks5 server from the local address or network interface of `b`, nil to not bind,
+// must be called before dialing
+func (d *Socks5Dialer) SetOutboundBind(b *OutboundBind) error {
+	var forward proxy.Dialer = proxy.Direct
+	if b != nil {
+		forward = b
+	}
+	tcp, err := proxy.SOCKS5("tcp", d.server, d.auth, forward)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	d.tcp, d.bind = tcp, b
+	return nil
+}
+
+func (d *Socks5Dialer) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return d.tcp.Dial(network, addr)
+	}
+
+	dst, err := newSocks5Addr(addr)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	if d.assoc == nil || d.assoc.isClosed() {
+		assoc, err := dialSocks5Association(d.server, d.auth, d.bind)
+		if err != nil {
+			d.mu.Unlock()
+			return nil, err
+		}
+		d.assoc = assoc
+	}
+	assoc := d.assoc
+	d.mu.Unlock()
+	return assoc.newConn(dst), nil
+}
+
+// a SOCKS5 UDP association, which ends when the control connection is closed
+type socks5Association struct {
+	ctrl  net.Conn     // tcp control connection
+	relay *net.UDPConn // connected to the udp relay of the socks5 server
+
+	mu     sync.Mutex
+	conns  map[uint16][]*socks5UDPConn // dns message ID -> conns waiting for the reply
+	closed chan struct{}
+	err    error
+}
+
+// --- impl *socks5Association
+func dialSocks5Association(server string, auth *proxy.Auth, bind *OutboundBind) (*socks5Association, error) {
+	ctrl, relay, err := dialSocks5Relay(server, auth, bind)
+	if err != nil {
+		return nil, err
+	}
+	a := &socks5Association{
+		ctrl:   ctrl,
+		relay:  relay,
+		conns:  make(map[uint16][]*socks5UDPConn),
+		closed: make(chan struct{}),
+	}
+	go a.watchCtrl()
+	go a.readRelay()
+	return a, nil
+}
+
+// the association is alive as long as the control connection is
+func (a *socks5Association) watchCtrl() {
+	_, err := io.Copy(ioutil.Discard, a.ctrl)
+	if err == nil {
+		err = io.EOF
+	}
+	a.close(errors.Wrap(err, "socks5: udp association closed"))
+}
+
+// dispatch replies from the relay
+func (a *socks5Association) readRelay() {
+	b := make([]byte, 65535)
+	for {
+		n, err := a.relay.Read(b)
+		if err != nil {
+			a.close(errors.WithStack(err))
+			return
+		}
+		dgram, err := gosocks5.ReadUDPDatagram(bytes.NewReader(b[:n]))
+		if err != nil || dgram.Header.Frag != 0 || len(dgram.Data) < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(dgram.Data)
+
+		// queries of the same ID may be sent to several nameservers, e.g. raced ones of a dnsTransport
+		a.mu.Lock()
+		for _, c := range a.conns[id] {
+			if socks5AddrEqual(c.dst, dgram.Header.Addr) && c.deliver(dgram.Data) {
+				break
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *socks5Association) close(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-a.closed:
+		return
+	default:
+	}
+	a.err = err
+	close(a.closed)
+	a.ctrl.Close()
+	a.relay.Close()
+}
+
+func (a *socks5Association) isClosed() bool {
+	select {
+	case <-a.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *socks5Association) newConn(dst *gosocks5.Addr) *socks5UDPConn {
+	return &socks5UDPConn{
+		assoc: a,
+		dst:   dst,
+		recv:  make(chan []byte, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+func (a *socks5Association) register(id uint16, c *socks5UDPConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.conns[id] = append(a.conns[id], c)
+}
+
+func (a *socks5Association) unregister(id uint16, c *socks5UDPConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	conns := a.conns[id]
+	for i, _c := range conns {
+		if _c == c {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(a.conns, id)
+	} else {
+		a.conns[id] = conns
+	}
+}
+
+// net.Conn sends dns messages to `dst` through a socks5 udp association
+type socks5UDPConn struct {
+	assoc *socks5Association
+	dst   *gosocks5.Addr
+	recv  chan []byte
+
+	mu           sync.Mutex
+	ids          []uint16 // registered dns message IDs
+	readDeadline time.Time
+	done         chan struct{}
+}
+
+// --- impl *socks5UDPConn
+// false if `c` has got a reply which is not read yet
+func (c *socks5UDPConn) deliver(data []byte) bool {
+	select {
+	case c.recv <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// --- impl net.Conn for *socks5UDPConn
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case data := <-c.recv:
+		return copy(b, data), nil
+	case <-c.done:
+		return 0, errors.New("socks5: use of closed connection")
+	case <-c.assoc.closed:
+		return 0, c.assoc.err
+	case <-timeout:
+		return 0, socks5TimeoutError{}
+	}
+}
+
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, io.ErrShortBuffer
+	}
+	id := binary.BigEndian.Uint16(b)
+	c.mu.Lock()
+	registered := false
+	for _, _id := range c.ids {
+		registered = registered || _id == id
+	}
+	if !registered {
+		c.ids = append(c.ids, id)
+		c.assoc.register(id, c)
+	}
+	c.mu.Unlock()
+
+	// header and data must be sent in a single datagram
+	var buf bytes.Buffer
+	if err := gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, c.dst), b).Write(&buf); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if _, err := c.assoc.relay.Write(buf.Bytes()); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return len(b), nil
+}
+
+func (c *socks5UDPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	close(c.done)
+	for _, id := range c.ids {
+		c.assoc.unregister(id, c)
+	}
+	return nil
+}
+
+func (c *socks5UDPConn) LocalAddr() net.Addr {
+	return c.assoc.relay.LocalAddr()
+}
+
+func (c *socks5UDPConn) RemoteAddr() net.Addr {
+	return socks5UDPAddr(c.dst.String())
+}
+
+func (c *socks5UDPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *socks5UDPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// writes to the relay never block for long
+func (c *socks5UDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// udp address behind a socks5 server, which may be a domain name
+type socks5UDPAddr string
+
+// --- impl net.Addr for socks5UDPAddr
+func (addr socks5UDPAddr) Network() string { return "udp" }
+func (addr socks5UDPAddr) String() string  { return string(addr) }
+
+type socks5TimeoutError struct{}
+
+// --- impl net.Error for socks5TimeoutError
+func (socks5TimeoutError) Error() string   { return "socks5: i/o timeout" }
+func (socks5TimeoutError) Timeout() bool   { return true }
+func (socks5TimeoutError) Temporary() bool { return true }
+
+// request a udp association from the socks5 `server`, returns the control connection
+// and a udp conn connected to the relay, both from `bind`, the association ends when `ctrl` is closed
+func dialSocks5Relay(server string, auth *proxy.Auth, bind *OutboundBind) (ctrl net.Conn, relay *net.UDPConn, err error) {
+	const handshakeTimeout = 5 * time.Second
+
+	d := bind.dialer("tcp", 0)
+	d.Timeout = handshakeTimeout
+	ctrl, err = d.Dial("tcp", server)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if tcp, ok := ctrl.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(30 * time.Second)
+	}
+	ctrl.SetDeadline(time.Now().Add(handshakeTimeout))
+	relayAddr, err := socks5UDPAssociate(ctrl, auth)
+	if err != nil {
+		ctrl.Close()
+		return nil, nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// the relay may reply an unspecified address, which means the same host as the server,
+	// whose ip is the one connected, as resolving the host again may get another one or a poisoned one
+	if relayAddr.IP.IsUnspecified() {
+		tcpAddr, ok := ctrl.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			ctrl.Close()
+			return nil, nil, errors.Errorf("socks5: unknown address of %s", server)
+		}
+		relayAddr.IP = tcpAddr.IP
+	}
+	conn, err := bind.dialer("udp", 0).Dial("udp", relayAddr.String())
+	if err != nil {
+		ctrl.Close()
+		return nil, nil, errors.WithStack(err)
+	}
+	return ctrl, conn.(*net.UDPConn), nil
+}
+
+// negotiate with the socks5 server through `conn` and request a udp association,
+// returns the address of the udp relay
+func socks5UDPAssociate(conn net.Conn, auth *proxy.Auth) (*net.UDPAddr, error) {
+	methods := []byte{gosocks5.Ver5, 1, gosocks5.MethodNoAuth}
+	if auth != nil {
+		methods = []byte{gosocks5.Ver5, 2, gosocks5.MethodNoAuth, gosocks5.MethodUserPass}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if b[0] != gosocks5.Ver5 {
+		return nil, errors.WithStack(gosocks5.ErrBadVersion)
+	}
+	switch b[1] {
+	case gosocks5.MethodNoAuth:
+	case gosocks5.MethodUserPass:
+		if auth == nil {
+			return nil, errors.WithStack(gosocks5.ErrBadMethod)
+		}
+		req := gosocks5.NewUserPassRequest(gosocks5.UserPassVer, auth.User, auth.Password)
+		if err := req.Write(conn); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		resp, err := gosocks5.ReadUserPassResponse(conn)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if resp.Status != gosocks5.Succeeded {
+			return nil, errors.WithStack(gosocks5.ErrAuthFailure)
+		}
+	default:
+		return nil, errors.WithStack(gosocks5.ErrBadMethod)
+	}
+
+	req := gosocks5.NewRequest(gosocks5.CmdUdp, &gosocks5.Addr{Type: gosocks5.AddrIPv4, Host: "0.0.0.0"})
+	if err := req.Write(conn); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	reply, err := gosocks5.ReadReply(conn)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if reply.Rep != gosocks5.Succeeded {
+		return nil, errors.Errorf("socks5: udp associate failed with reply %d", reply.Rep)
+	}
+	addr, err := net.ResolveUDPAddr("udp", reply.Addr.String())
+	return addr, errors.WithStack(err)
+}
+
+// whether `a` and `b` are of the same host and port, ips are compared regardless of their forms,
+// e.g. IPv4-mapped IPv6 ones
+func socks5AddrEqual(a, b *gosocks5.Addr) bool {
+	if a == nil || b == nil || a.Port != b.Port {
+		return false
+	}
+	if ipa, ipb := net.ParseIP(a.Host), net.ParseIP(b.Host); ipa != nil && ipb != nil {
+		return ipa.Equal(ipb)
+	}
+	return strings.EqualFold(a.Host, b.Host)
+}
+
+func newSocks5Addr(addr string) (*gosocks5.Addr, error) {
+	host, _port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	port, err := strconv.ParseUint(_port, 10, 16)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	a := &gosocks5.Addr{Type: gosocks5.AddrDomain, Host: host, Port: uint16(port)}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			a.Type = gosocks5.AddrIPv4
+		} else {
+			a.Type = gosocks5.AddrIPv6
+		}
+	}
+	return a, nil
+}
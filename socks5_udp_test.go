@@ -0,0 +1,124 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+)
+
+// socks5 server on loopback supporting UDP ASSOCIATE only, datagrams to the relay are answered by `reply`
+// with datagrams whose headers report their sources, as relays do
+type testSocks5UDPServer struct {
+	l     net.Listener
+	relay *net.UDPConn
+	reply func(dst *gosocks5.Addr, data []byte) []*gosocks5.UDPDatagram
+}
+
+func newTestSocks5UDPServer(t *testing.T, reply func(dst *gosocks5.Addr, data []byte) []*gosocks5.UDPDatagram) *testSocks5UDPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	s := &testSocks5UDPServer{l: l, relay: relay, reply: reply}
+	go s.serveCtrl()
+	go s.serveRelay()
+	return s
+}
+
+func (s *testSocks5UDPServer) Close() {
+	s.l.Close()
+	s.relay.Close()
+}
+
+func (s *testSocks5UDPServer) serveCtrl() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			methods := make([]byte, 3)
+			if _, err := io.ReadFull(conn, methods); err != nil {
+				return
+			}
+			conn.Write([]byte{gosocks5.Ver5, gosocks5.MethodNoAuth})
+			if _, err := gosocks5.ReadRequest(conn); err != nil {
+				return
+			}
+			// the unspecified address, which means the same host as the server
+			port := uint16(s.relay.LocalAddr().(*net.UDPAddr).Port)
+			gosocks5.NewReply(gosocks5.Succeeded, &gosocks5.Addr{Type: gosocks5.AddrIPv4, Host: "0.0.0.0", Port: port}).Write(conn)
+			// the association lasts as long as the control connection
+			io.Copy(ioutil.Discard, conn)
+		}()
+	}
+}
+
+func (s *testSocks5UDPServer) serveRelay() {
+	b := make([]byte, 65535)
+	for {
+		n, client, err := s.relay.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		dgram, err := gosocks5.ReadUDPDatagram(bytes.NewReader(b[:n]))
+		if err != nil {
+			continue
+		}
+		for _, reply := range s.reply(dgram.Header.Addr, dgram.Data) {
+			var buf bytes.Buffer
+			reply.Write(&buf)
+			s.relay.WriteToUDP(buf.Bytes(), client)
+		}
+	}
+}
+
+// replies of the same DNS message ID from other sources are not delivered to conns of the query
+func TestSocks5UDPConnDemux(t *testing.T) {
+	other := &gosocks5.Addr{Type: gosocks5.AddrIPv4, Host: "127.0.0.2", Port: 53}
+	s := newTestSocks5UDPServer(t, func(dst *gosocks5.Addr, data []byte) []*gosocks5.UDPDatagram {
+		spoofed := append(append([]byte(nil), data[:2]...), "spoofed"...)
+		answer := append(append([]byte(nil), data[:2]...), "answer of "+dst.String()...)
+		return []*gosocks5.UDPDatagram{
+			gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, other), spoofed),
+			gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, dst), answer),
+		}
+	})
+	defer s.Close()
+
+	d, err := NewSocks5Dialer(s.l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ns := range []string{"127.0.0.1:53", "[::ffff:127.0.0.3]:5353"} {
+		conn, err := d.Dial("udp", ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte{0, 7, 'q'}); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 512)
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("%s: %v", ns, err)
+		}
+		if got := string(b[2:n]); !strings.HasPrefix(got, "answer of ") {
+			t.Errorf("%s: read %q, want the answer", ns, got)
+		}
+		conn.Close()
+	}
+}
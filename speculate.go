@@ -0,0 +1,88 @@
+package dnsproxy
+
+import (
+	"net"
+
+	"github.com/ARwMq9b6/libgost"
+	"github.com/miekg/dns"
+)
+
+// a connection dialed through a proxy chain while the destination is still being routed
+type speculativeDial struct {
+	server *gost.ProxyServer
+	bind   *OutboundBind // the chain of `server` is dialed from
+	host   string
+	port   string
+
+	done chan struct{} // closed when conn and err are set
+	conn net.Conn
+	err  error
+}
+
+// --- impl *speculativeDial
+
+// start dialing `port` of `host` through the chain of `server` from `bind`
+func startSpeculativeDial(server *gost.ProxyServer, bind *OutboundBind, host, port string) *speculativeDial {
+	sd := &speculativeDial{server: server, bind: bind, host: host, port: port, done: make(chan struct{})}
+	go func() {
+		sd.conn, sd.err = bind.DialChain(server.Chain, net.JoinHostPort(host, port))
+		close(sd.done)
+	}()
+	return sd
+}
+
+// the speculatively dialed connection of `port`, for requester.setDialer
+func (sd *speculativeDial) Dial(port string) (net.Conn, error) {
+	if port != sd.port {
+		sd.discard()
+		return sd.bind.DialChain(sd.server.Chain, net.JoinHostPort(sd.host, port))
+	}
+	<-sd.done
+	return sd.conn, sd.err
+}
+
+// close the connection once it is dialed, as the destination is not proxied through it
+func (sd *speculativeDial) discard() {
+	go func() {
+		<-sd.done
+		if sd.conn != nil {
+			sd.conn.Close()
+		}
+	}()
+}
+
+// --- impl *Server
+
+// when a client CONNECTs to a domain which is neither cached nor in any list, dial it through the default proxy chains
+// while it is being routed by dns queries, so that the tunnel is ready once the domain turns out to be proxied,
+// the speculative connection is closed if the domain is connected directly, must be called before serving
+func (s *Server) SetSpeculativeProxy(enable bool) {
+	s.speculativeProxy = enable
+}
+
+// check if routing `domain` for `client` waits for dns queries which a speculative dial can overlap,
+// i.e. the domain is routed by the default routing policy without being cached, learned or in any list
+func (s *Server) worthSpeculating(client net.IP, domain string) bool {
+	if s.inLocalZones(domain) || s.pinnedByOverride(domain) {
+		return false
+	}
+	// not counted as cache hits or misses
+	if _, ok := s.domaincache.inner.Get(scopedCacheKey(s.clientScope(client), domaincacheKey(domain, dns.TypeA))); ok {
+		return false
+	}
+	policy := s.policy
+	if rp, ok := policy.(*RulePolicy); ok {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+		if rp.MatchRule(&RouteQuery{Req: req, Client: client}) >= 0 {
+			return false
+		}
+		policy = rp.Fallback()
+	}
+	dp, ok := policy.(*DefaultRoutingPolicy)
+	if !ok {
+		return false
+	}
+	gfw, obedient := dp.matchDomain(domain)
+	return !gfw && !obedient && !dp.rejected(domain)
+}
@@ -0,0 +1,60 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+const (
+	// TTL of stale answers, as recommended by RFC 8767
+	_STALE_ANSWER_TTL = 30
+
+	// a stale answer is returned if the query is not resolved in this long, the client response timer of RFC 8767
+	_STALE_ANSWER_DELAY = 1800 * time.Millisecond
+)
+
+// --- impl *Server
+
+// resolve `req` for `client` whose answer `cell` has expired, the stale answer is returned with a short TTL
+// if the routing policy fails or takes longer than _STALE_ANSWER_DELAY, see DomainCache.SetServeStale,
+// resolving goes on in the background within the query timeout to refresh the cache even if the stale one is returned
+func (s *Server) resolveStale(ctx context.Context, req *dns.Msg, client net.IP, scope string, cell *DomainCacheCell) (*dns.Msg, Transport, error) {
+	q := req.Question[0]
+	domain := q.Name[:len(q.Name)-1]
+
+	done := make(chan *RouteDecision, 1)
+	go func() {
+		// not canceled along with the query
+		bctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout())
+		defer cancel()
+		d, err := s.routeDomain(&RouteQuery{Req: MsgShallowCopy(req), Client: client, Listener: ListenerFromContext(ctx), NeedAnswer: true, Ctx: bctx})
+		if err != nil || d.Resp == nil || d.Resp.Rcode == dns.RcodeServerFailure {
+			if err != nil {
+				glog.V(1).Infof("dns %s %s refresh: %s\n", client, q.Name, err)
+			}
+			done <- nil
+			return
+		}
+		// the stale cell is replaced regardless of the cache policy
+		s.storeDecision(scope, domain, q.Qtype, d, true)
+		done <- d
+	}()
+
+	timer := time.NewTimer(_STALE_ANSWER_DELAY)
+	defer timer.Stop()
+	select {
+	case d := <-done:
+		if d != nil {
+			glog.V(1).Infof("dns %s %s -> %s\n", client, q.Name, d.Trans)
+			return d.Resp, d.Trans, nil
+		}
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	glog.V(1).Infof("dns %s %s -> %s (stale)\n", client, q.Name, cell.trans)
+	return MsgNewReplyFromReq(req, cell.StaleAnswers()...), cell.trans, nil
+}
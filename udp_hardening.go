@@ -0,0 +1,100 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// times of binding another random port if the picked one is in use, before leaving it to the kernel
+const _UDP_RANDOM_PORT_ATTEMPTS = 8
+
+// --- impl *dnsTransport
+
+// harden plain udp queries against off-path spoofing if `enable`:
+// each query is sent with a random message ID from a random source port, and with random case of its name (0x20),
+// responses not echoing exactly the same ID and question are ignored instead of being accepted or failing the query,
+// nameservers which do not preserve the case of names are never answered then, must be called before serving
+func (dt *dnsTransport) SetUDPHardening(enable bool) {
+	dt.hardenUDP = enable
+}
+
+// copy of `req` to be sent on the wire by a hardened udp exchange, see SetUDPHardening
+func hardenUDPQuery(req *dns.Msg) *dns.Msg {
+	_req := MsgShallowCopy(req)
+	_req.Id = dns.Id()
+	for i := range _req.Question {
+		_req.Question[i].Name = randomizeCase(_req.Question[i].Name)
+	}
+	return _req
+}
+
+// check if `resp` echoes exactly the ID and the question of `sent`
+func hardenedUDPResponseMatches(sent, resp *dns.Msg) bool {
+	if resp.Id != sent.Id || len(resp.Question) != len(sent.Question) {
+		return false
+	}
+	for i, q := range resp.Question {
+		if q != sent.Question[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// restore the ID and names of `req` in `resp` to the hardened exchange of `sent`
+func restoreHardenedUDPResponse(req, sent, resp *dns.Msg) {
+	resp.Id = req.Id
+	resp.Question = append(resp.Question[:0], req.Question...)
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			// names in the case of the zone data rather than of the question are restored as well
+			for i, q := range sent.Question {
+				if strings.EqualFold(hdr.Name, q.Name) {
+					hdr.Name = req.Question[i].Name
+					break
+				}
+			}
+		}
+	}
+}
+
+// flip the case of each letter of `name` randomly, see https://tools.ietf.org/html/draft-vixie-dnsext-dns0x20-00
+func randomizeCase(name string) string {
+	bits := make([]byte, (len(name)+7)/8)
+	if _, err := rand.Read(bits); err != nil {
+		return name
+	}
+	b := []byte(strings.ToLower(name))
+	for i, c := range b {
+		if 'a' <= c && c <= 'z' && bits[i/8]&(1<<uint(i%8)) != 0 {
+			b[i] = c - 'a' + 'A'
+		}
+	}
+	return string(b)
+}
+
+// dial udp `addr` from a random local port of `bind`, which may be allocated in sequence by the kernel otherwise
+func dialUDPRandomPort(ctx context.Context, bind *OutboundBind, addr string) (net.Conn, error) {
+	var b [2]byte
+	for i := 0; i < _UDP_RANDOM_PORT_ATTEMPTS; i++ {
+		if _, err := rand.Read(b[:]); err != nil {
+			break
+		}
+		port := 1024 + int(binary.BigEndian.Uint16(b[:]))%(65536-1024)
+		conn, err := bind.dialer("udp", port).DialContext(ctx, "udp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return bind.DialContext(ctx, "udp", addr)
+}
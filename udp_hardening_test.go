@@ -0,0 +1,59 @@
+package dnsproxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHardenUDPQuery(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("www.Example.com.", dns.TypeA)
+	sent := hardenUDPQuery(req)
+	if req.Question[0].Name != "www.Example.com." {
+		t.Fatalf("query changed to %s", req.Question[0].Name)
+	}
+	if !strings.EqualFold(sent.Question[0].Name, req.Question[0].Name) {
+		t.Fatalf("sent %s for %s", sent.Question[0].Name, req.Question[0].Name)
+	}
+
+	// a zone in lower case, whose records are not compressed into the question
+	resp := new(dns.Msg).SetReply(sent)
+	resp.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: sent.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: "cdn.example.net."},
+		&dns.A{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}},
+		&dns.A{Hdr: dns.RR_Header{Name: "cdn.example.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}},
+	}
+	if !hardenedUDPResponseMatches(sent, resp) {
+		t.Fatal("response to the sent query does not match")
+	}
+	// of spoofers guessing the ID, or guessing the case of the name wrong
+	flipped := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return r
+	}, sent.Question[0].Name)
+	forged := []*dns.Msg{new(dns.Msg).SetReply(sent), new(dns.Msg).SetReply(sent)}
+	forged[0].Id++
+	forged[1].Question[0].Name = flipped
+	for _, f := range forged {
+		if hardenedUDPResponseMatches(sent, f) {
+			t.Errorf("response of ID %d and %s matches ID %d and %s", f.Id, f.Question[0].Name, sent.Id, sent.Question[0].Name)
+		}
+	}
+
+	restoreHardenedUDPResponse(req, sent, resp)
+	if resp.Id != req.Id || resp.Question[0] != req.Question[0] {
+		t.Errorf("restored ID %d and question %v, want %d and %v", resp.Id, resp.Question[0], req.Id, req.Question[0])
+	}
+	for i, want := range []string{"www.Example.com.", "www.Example.com.", "cdn.example.net."} {
+		if got := resp.Answer[i].Header().Name; got != want {
+			t.Errorf("answer %d restored to %s, want %s", i, got, want)
+		}
+	}
+}
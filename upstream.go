@@ -0,0 +1,367 @@
+package dnsproxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// how a dnsTransport chooses among its nameservers
+type UpstreamStrategy int8
+
+const (
+	STRATEGY_RACE         UpstreamStrategy = iota // query all nameservers concurrently, the first success wins
+	STRATEGY_WEIGHTED                             // query one nameserver chosen randomly by weight, fail over to the others
+	STRATEGY_SEQUENTIAL                           // query nameservers one by one in order until one succeeds
+	STRATEGY_FASTEST                              // query the nameserver with the lowest RTT, fail over to the slower ones
+	STRATEGY_ROUND_ROBIN                          // query nameservers in turn, fail over to the next ones
+	STRATEGY_LEAST_ERRORS                         // query the nameserver with the lowest error rate, fail over to the others
+)
+
+// parse "race", "weighted" (or "random"), "sequential", "fastest", "round_robin" or "least_errors",
+// STRATEGY_RACE if empty
+func ParseUpstreamStrategy(s string) (UpstreamStrategy, error) {
+	switch strings.ToLower(s) {
+	case "", "race":
+		return STRATEGY_RACE, nil
+	case "weighted", "random":
+		return STRATEGY_WEIGHTED, nil
+	case "sequential":
+		return STRATEGY_SEQUENTIAL, nil
+	case "fastest":
+		return STRATEGY_FASTEST, nil
+	case "round_robin":
+		return STRATEGY_ROUND_ROBIN, nil
+	case "least_errors":
+		return STRATEGY_LEAST_ERRORS, nil
+	default:
+		return 0, classified(ErrInvalidConfig, errors.Errorf("unknown upstream strategy %q", s))
+	}
+}
+
+// how long a nameserver is waited for a query by default, see Nameserver.Timeout
+const DNS_UPSTREAM_TIMEOUT = 2 * time.Second
+
+// dns server and its weight, used by STRATEGY_WEIGHTED
+type Nameserver struct {
+	Addr    string
+	Weight  int           // treated as 1 if not positive
+	Timeout time.Duration // max time of a query including dialing, DNS_UPSTREAM_TIMEOUT if not positive
+}
+
+const (
+	_UPSTREAM_MAX_FAILS     = 3                // an upstream is considered dead after this many consecutive failures
+	_UPSTREAM_DEAD_DURATION = 30 * time.Second // dead upstreams are skipped for this long
+	_UPSTREAM_SMOOTHING     = 0.3              // weight of the latest result in UpstreamStats.RTT and ErrorRate
+)
+
+// a nameserver of dnsTransport with its connections and health
+type upstream struct {
+	addr    string
+	weight  int
+	timeout time.Duration
+	tcpPool *dnsConnPool // pipelined tcp conns to `addr`
+
+	mu        sync.Mutex
+	fails     int
+	deadUntil time.Time
+	rtt       time.Duration // see UpstreamStats
+	errRate   float64
+}
+
+// health of a nameserver, see (*dnsTransport).Health
+type UpstreamHealth struct {
+	Addr      string    `json:"addr"`
+	Healthy   bool      `json:"healthy"`
+	Fails     int       `json:"fails"`      // consecutive failures
+	DeadUntil time.Time `json:"dead_until"` // skipped until then if not healthy
+	RTT       string    `json:"rtt"`        // such as "35ms", empty if never measured
+	ErrorRate float64   `json:"error_rate"` // smoothed ratio of failed queries
+	Secondary bool      `json:"secondary"`  // see (*dnsTransport).SetSecondaryNameservers
+}
+
+// --- impl *upstream
+func (u *upstream) healthy(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.deadUntil)
+}
+
+// record the result of a query which took `rtt`, failures count as the timeout in RTT
+func (u *upstream) report(err error, rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	failed := 0.0
+	if err != nil {
+		failed, rtt = 1, u.timeout
+	}
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt += time.Duration(_UPSTREAM_SMOOTHING * float64(rtt-u.rtt))
+	}
+	u.errRate += _UPSTREAM_SMOOTHING * (failed - u.errRate)
+
+	if err == nil {
+		// it answers again, e.g. a probe of a dead upstream
+		u.fails = 0
+		u.deadUntil = time.Time{}
+		return
+	}
+	u.fails++
+	if u.fails >= _UPSTREAM_MAX_FAILS {
+		u.fails = 0
+		u.deadUntil = time.Now().Add(_UPSTREAM_DEAD_DURATION)
+	}
+}
+
+// --- impl *dnsTransport
+
+// set how nameservers are chosen, STRATEGY_RACE as default
+func (dt *dnsTransport) SetStrategy(strategy UpstreamStrategy) {
+	dt.selector = NewUpstreamSelector(strategy)
+}
+
+// order nameservers by `selector` for each query and query them one by one, nil to race them,
+// overrides SetStrategy
+func (dt *dnsTransport) SetSelector(selector UpstreamSelector) {
+	dt.selector = selector
+}
+
+// fall back to `nameservers` for queries which all healthy nameservers fail, and for all queries once every
+// nameserver is dead, until any of them is healthy again, e.g. answers a probe, see Probe;
+// they are chosen among by the same strategy, ignored over DNS over HTTPS, must be called before querying
+func (dt *dnsTransport) SetSecondaryNameservers(nameservers []Nameserver) {
+	if dt.net == "https" {
+		return
+	}
+	dt.secondary = nil
+	for _, ns := range nameservers {
+		dt.secondary = append(dt.secondary, dt.newUpstream(ns))
+	}
+}
+
+// query every nameserver every `interval` to measure its RTT and bring it back once it answers again,
+// which keeps STRATEGY_FASTEST and STRATEGY_LEAST_ERRORS up to date without relying on queries of clients,
+// the secondary nameservers are probed as well, never returns
+func (dt *dnsTransport) Probe(interval time.Duration) {
+	req := new(dns.Msg).SetQuestion(".", dns.TypeNS)
+	for {
+		var wg sync.WaitGroup
+		for _, u := range dt.allUpstreams() {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				dt.exchangeUpstream(context.Background(), u, req)
+			}(u)
+		}
+		wg.Wait()
+		time.Sleep(interval)
+	}
+}
+
+// health of all nameservers in order, followed by the secondary ones
+func (dt *dnsTransport) Health() []UpstreamHealth {
+	now := time.Now()
+	health := make([]UpstreamHealth, 0, len(dt.upstreams)+len(dt.secondary))
+	for i, u := range dt.allUpstreams() {
+		u.mu.Lock()
+		h := UpstreamHealth{
+			Addr:      u.addr,
+			Healthy:   !now.Before(u.deadUntil),
+			Fails:     u.fails,
+			DeadUntil: u.deadUntil,
+			ErrorRate: u.errRate,
+			Secondary: i >= len(dt.upstreams),
+		}
+		if u.rtt > 0 {
+			h.RTT = u.rtt.String()
+		}
+		u.mu.Unlock()
+		health = append(health, h)
+	}
+	return health
+}
+
+// nameservers followed by the secondary ones
+func (dt *dnsTransport) allUpstreams() []*upstream {
+	if len(dt.secondary) == 0 {
+		return dt.upstreams
+	}
+	return append(dt.upstreams[:len(dt.upstreams):len(dt.upstreams)], dt.secondary...)
+}
+
+// healthy upstreams in order, the healthy secondary ones if none is healthy,
+// all upstreams and secondary ones if none of them is healthy either
+func (dt *dnsTransport) healthyUpstreams() []*upstream {
+	now := time.Now()
+	if ups := healthyUpstreams(dt.upstreams, now); len(ups) > 0 {
+		if len(dt.secondary) > 0 && atomic.CompareAndSwapInt32(&dt.onSecondary, 1, 0) {
+			glog.Infof("dns nameservers %s are healthy again, leaving secondary ones %s\n",
+				upstreamAddrs(ups), upstreamAddrs(dt.secondary))
+		}
+		return ups
+	}
+	if ups := healthyUpstreams(dt.secondary, now); len(ups) > 0 {
+		if atomic.CompareAndSwapInt32(&dt.onSecondary, 0, 1) {
+			glog.Warningf("dns nameservers %s are all dead, failing over to secondary ones %s\n",
+				upstreamAddrs(dt.upstreams), upstreamAddrs(ups))
+		}
+		return ups
+	}
+	return dt.allUpstreams()
+}
+
+// whether `u` is one of the secondary nameservers
+func (dt *dnsTransport) isSecondary(u *upstream) bool {
+	for _, s := range dt.secondary {
+		if s == u {
+			return true
+		}
+	}
+	return false
+}
+
+// healthy ones of `ups` at `now` in order
+func healthyUpstreams(ups []*upstream, now time.Time) []*upstream {
+	var healthy []*upstream
+	for _, u := range ups {
+		if u.healthy(now) {
+			healthy = append(healthy, u)
+		}
+	}
+	return healthy
+}
+
+// such as "119.29.29.29:53, 223.5.5.5:53"
+func upstreamAddrs(ups []*upstream) string {
+	addrs := make([]string, len(ups))
+	for i, u := range ups {
+		addrs[i] = u.addr
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// exchange `req` with nameservers according to dt.selector until `ctx` is done,
+// retried according to dt.retry if it is set
+func (dt *dnsTransport) spawnExchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if dt.retry == nil {
+		// at least 3 queries are raced to make up for packet loss
+		return dt.strategyExchange(ctx, req, 3)
+	}
+	return dt.retry.do(ctx, func(ctx context.Context) (*dns.Msg, error) {
+		return dt.strategyExchange(ctx, req, 1)
+	})
+}
+
+// a single attempt of spawnExchange, STRATEGY_RACE spawns at least `minSpawnNum` queries,
+// the secondary nameservers are queried if all healthy nameservers fail
+func (dt *dnsTransport) strategyExchange(ctx context.Context, req *dns.Msg, minSpawnNum int) (*dns.Msg, error) {
+	ups := dt.healthyUpstreams()
+	r, err := dt.exchangeAmong(ctx, req, ups, minSpawnNum)
+	// the secondary ones are last among `ups` if they are queried already
+	if err == nil || ctx.Err() != nil || len(dt.secondary) == 0 || dt.isSecondary(ups[len(ups)-1]) {
+		return r, err
+	}
+	// the nameservers fail before they are considered dead
+	secondary := healthyUpstreams(dt.secondary, time.Now())
+	if len(secondary) == 0 {
+		secondary = dt.secondary
+	}
+	glog.V(1).Infof("%s: %s, retrying secondary dns nameservers %s\n", req.Question[0].Name, err, upstreamAddrs(secondary))
+	return dt.exchangeAmong(ctx, req, secondary, minSpawnNum)
+}
+
+// query `ups` by the strategy, STRATEGY_RACE spawns at least `minSpawnNum` queries
+func (dt *dnsTransport) exchangeAmong(ctx context.Context, req *dns.Msg, ups []*upstream, minSpawnNum int) (*dns.Msg, error) {
+	if dt.selector == nil {
+		return dt.raceExchange(ctx, req, ups, minSpawnNum)
+	}
+	return dt.failoverExchange(ctx, req, dt.selectUpstreams(ups))
+}
+
+// `ups` in the order of dt.selector, invalid or duplicated indexes are ignored
+func (dt *dnsTransport) selectUpstreams(ups []*upstream) []*upstream {
+	if len(ups) == 1 {
+		return ups
+	}
+	stats := make([]UpstreamStats, len(ups))
+	for i, u := range ups {
+		u.mu.Lock()
+		stats[i] = UpstreamStats{Addr: u.addr, Weight: u.weight, RTT: u.rtt, ErrorRate: u.errRate}
+		u.mu.Unlock()
+	}
+	ordered := make([]*upstream, 0, len(ups))
+	picked := make([]bool, len(ups))
+	for _, i := range dt.selector.Select(stats) {
+		if i >= 0 && i < len(ups) && !picked[i] {
+			picked[i] = true
+			ordered = append(ordered, ups[i])
+		}
+	}
+	for i, u := range ups {
+		if !picked[i] {
+			ordered = append(ordered, u)
+		}
+	}
+	return ordered
+}
+
+// query all `ups` concurrently, at least `minSpawnNum` queries are spawned,
+// the first succeeded response is returned and the other queries are canceled
+func (dt *dnsTransport) raceExchange(ctx context.Context, req *dns.Msg, ups []*upstream, minSpawnNum int) (*dns.Msg, error) {
+	spawnNum := len(ups)
+	if spawnNum < minSpawnNum {
+		spawnNum = minSpawnNum
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// buffered, so that losers never block after the winner returns
+	resp := make(chan *dns.Msg, spawnNum)
+	errs := make(chan error, spawnNum)
+
+	for i := 0; i < spawnNum; i++ {
+		go func(u *upstream) {
+			if r, err := dt.exchangeUpstream(ctx, u, req); err == nil {
+				resp <- r
+			} else {
+				errs <- err
+			}
+		}(ups[i%len(ups)])
+	}
+
+	var lastErr error
+	for i := 0; i < spawnNum; i++ {
+		select {
+		case r := <-resp:
+			return r, nil
+		case lastErr = <-errs:
+		}
+	}
+	return nil, lastErr
+}
+
+// query `ups` one by one until one succeeds or `ctx` is done
+func (dt *dnsTransport) failoverExchange(ctx context.Context, req *dns.Msg, ups []*upstream) (*dns.Msg, error) {
+	var lastErr error
+	for _, u := range ups {
+		if err := ctx.Err(); err != nil {
+			if lastErr == nil {
+				lastErr = errors.WithStack(err)
+			}
+			break
+		}
+		r, err := dt.exchangeUpstream(ctx, u, req)
+		if err == nil {
+			return r, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,128 @@
+package dnsproxy
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// state of a nameserver seen by UpstreamSelector
+type UpstreamStats struct {
+	Addr      string
+	Weight    int           // at least 1
+	RTT       time.Duration // smoothed response time of queries and probes, failures count as the timeout, 0 if never measured
+	ErrorRate float64       // smoothed ratio of failed queries and probes, 0 ~ 1
+}
+
+// orders the healthy nameservers of a dnsTransport for each query,
+// which are then queried one by one until one succeeds, see (*dnsTransport).SetSelector
+//
+// implementations must be safe for concurrent use
+type UpstreamSelector interface {
+	// indexes of `stats` in the order to be queried,
+	// nameservers left out are queried after them in order
+	Select(stats []UpstreamStats) []int
+}
+
+// UpstreamSelector of `strategy`, nil for STRATEGY_RACE which races the nameservers instead of ordering them
+func NewUpstreamSelector(strategy UpstreamStrategy) UpstreamSelector {
+	switch strategy {
+	case STRATEGY_WEIGHTED:
+		return randomSelector{}
+	case STRATEGY_SEQUENTIAL:
+		return sequentialSelector{}
+	case STRATEGY_FASTEST:
+		return fastestSelector{}
+	case STRATEGY_ROUND_ROBIN:
+		return new(roundRobinSelector)
+	case STRATEGY_LEAST_ERRORS:
+		return leastErrorsSelector{}
+	default:
+		return nil
+	}
+}
+
+// nameservers in order
+type sequentialSelector struct{}
+
+// nameservers ordered randomly, those with higher weight are more likely to be in front
+type randomSelector struct{}
+
+// nameservers ordered by RTT, unmeasured ones first so that they get measured
+type fastestSelector struct{}
+
+// each query starts from the nameserver next to the previous one
+type roundRobinSelector struct {
+	next uint32
+}
+
+// nameservers ordered by error rate, then by RTT
+type leastErrorsSelector struct{}
+
+// --- impl UpstreamSelector for sequentialSelector
+func (sequentialSelector) Select(stats []UpstreamStats) []int {
+	return upstreamIndexes(len(stats))
+}
+
+// --- impl UpstreamSelector for randomSelector
+func (randomSelector) Select(stats []UpstreamStats) []int {
+	rest := upstreamIndexes(len(stats))
+	shuffled := make([]int, 0, len(stats))
+	for len(rest) > 0 {
+		total := 0
+		for _, i := range rest {
+			total += stats[i].Weight
+		}
+		n := rand.Intn(total)
+		for j, i := range rest {
+			if n -= stats[i].Weight; n < 0 {
+				shuffled = append(shuffled, i)
+				rest = append(rest[:j], rest[j+1:]...)
+				break
+			}
+		}
+	}
+	return shuffled
+}
+
+// --- impl UpstreamSelector for fastestSelector
+func (fastestSelector) Select(stats []UpstreamStats) []int {
+	order := upstreamIndexes(len(stats))
+	sort.SliceStable(order, func(a, b int) bool {
+		return stats[order[a]].RTT < stats[order[b]].RTT
+	})
+	return order
+}
+
+// --- impl UpstreamSelector for *roundRobinSelector
+func (s *roundRobinSelector) Select(stats []UpstreamStats) []int {
+	start := int(atomic.AddUint32(&s.next, 1) % uint32(len(stats)))
+	order := make([]int, 0, len(stats))
+	for i := range stats {
+		order = append(order, (start+i)%len(stats))
+	}
+	return order
+}
+
+// --- impl UpstreamSelector for leastErrorsSelector
+func (leastErrorsSelector) Select(stats []UpstreamStats) []int {
+	order := upstreamIndexes(len(stats))
+	sort.SliceStable(order, func(a, b int) bool {
+		sa, sb := stats[order[a]], stats[order[b]]
+		if sa.ErrorRate != sb.ErrorRate {
+			return sa.ErrorRate < sb.ErrorRate
+		}
+		return sa.RTT < sb.RTT
+	})
+	return order
+}
+
+// 0, 1, ..., n-1
+func upstreamIndexes(n int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}